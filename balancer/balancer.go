@@ -17,23 +17,34 @@
 //
 // Author: peterke@gmail.com (Peter Szilagyi)
 
-// Package balancer implements a capacity based load balancer where each entity
-// periodically reports its actual processing capacity and the balancer issues
-// requests based on those numbers.
+// Package balancer implements a load balancer where each entity periodically
+// reports its actual processing capacity, queue depth and latency, and the
+// balancer issues requests based on those numbers, using one of a few pluggable
+// strategies.
 package balancer
 
 import (
 	"fmt"
 	"math/big"
-	"math/rand"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Load report of a single entity (or an aggregated group of entities).
+type Load struct {
+	Cap     int           // Message capacity
+	Pend    int           // Number of messages queued for processing
+	Lat     time.Duration // Average message handling latency
+	Members int           // Number of application members behind the entity
+}
+
 // The load balancer for a single topic.
 type Balancer struct {
 	members  entitySlice  // Entries to which to balace to
 	capacity int          // Total message capacity of the topic
+	pickers  []picker     // Balancing strategy implementations
 	lock     sync.RWMutex // Mutex to allow reentrant balancing
 }
 
@@ -41,6 +52,7 @@ type Balancer struct {
 func New() *Balancer {
 	return &Balancer{
 		members: []*entity{},
+		pickers: newPickers(),
 	}
 }
 
@@ -76,67 +88,131 @@ func (b *Balancer) Unregister(id *big.Int) {
 	}
 }
 
-// Updates an entry's capacity to cap.
+// Updates an entry's capacity to cap, clearing any other load stats.
 func (b *Balancer) Update(id *big.Int, cap int) error {
+	return b.UpdateLoad(id, Load{Cap: cap})
+}
+
+// Updates an entry's load stats to the reported ones.
+func (b *Balancer) UpdateLoad(id *big.Int, load Load) error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
 	// Zero capacity is not allowed
-	if cap <= 0 {
-		cap = 1
+	if load.Cap <= 0 {
+		load.Cap = 1
 	}
 
 	idx := b.members.Search(id)
 	if idx < len(b.members) && b.members[idx].id.Cmp(id) == 0 {
 		// Update total system capacity
 		b.capacity -= b.members[idx].cap
-		b.capacity += cap
+		b.capacity += load.Cap
 
-		// Update local capacity
-		b.members[idx].cap = cap
+		// Update local stats and reset the outstanding counter
+		m := b.members[idx]
+		m.cap, m.pend, m.lat, m.members, m.sent = load.Cap, load.Pend, load.Lat, load.Members, 0
 	} else {
 		return fmt.Errorf("non-registered entity: %v", id)
 	}
 	return nil
 }
 
-// Returns an id to which to send the next message to. The optional ex (can be
-// nil) is used to exclude an entity from balancing to (if it's the only one
-// available then this guarantee will be forfeit).
+// Returns an id to which to send the next message to, picked by weighted random
+// selection on the reported capacities. The optional ex (can be nil) is used to
+// exclude an entity from balancing to (if it's the only one available then this
+// guarantee will be forfeit).
 func (b *Balancer) Balance(ex *big.Int) (*big.Int, error) {
+	return b.BalanceBy(Weighted, ex)
+}
+
+// Returns an id to which to send the next message to, picked by the requested
+// balancing strategy. The optional ex entities (can be nil) are excluded from
+// balancing to in order of priority (if none others remain, the guarantee will
+// be forfeit for the ones at the end of the list).
+func (b *Balancer) BalanceBy(strat Strategy, ex ...*big.Int) (*big.Int, error) {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 
-	// Make sure there is actually somebody to balance to
+	// Make sure the strategy exists and there is actually somebody to balance to
+	if int(strat) >= len(b.pickers) {
+		return nil, fmt.Errorf("unknown balancing strategy: %v", strat)
+	}
 	if b.capacity == 0 {
 		return nil, fmt.Errorf("no capacity to balance")
 	}
-	// Calculate the available capacity with ex excluded
+	// Calculate the available capacity with the ex entities excluded
 	available := b.capacity
-	exclude := -1
-	if ex != nil {
-		idx := b.members.Search(ex)
-		if idx < len(b.members) && b.members[idx].id.Cmp(ex) == 0 {
+	exclude := []int{}
+	for _, id := range ex {
+		if id == nil {
+			continue
+		}
+		idx := b.members.Search(id)
+		if idx < len(b.members) && b.members[idx].id.Cmp(id) == 0 && !excluded(idx, exclude) {
 			if available != b.members[idx].cap {
 				available -= b.members[idx].cap
-				exclude = idx
+				exclude = append(exclude, idx)
 			}
 		}
 	}
-	// Generate a uniform random capacity and send to the associated entity
-	cap := rand.Intn(available)
-	for i, m := range b.members {
-		// Skip the excluded source entity
-		if i == exclude {
+	sort.Ints(exclude)
+
+	// Pick the destination and account for the outstanding message
+	m := b.members[b.pickers[strat].pick(b.members, available, exclude)]
+	atomic.AddInt32(&m.sent, 1)
+	return m.id, nil
+}
+
+// Returns an id to which to send a message associated with key. The choice is
+// made by rendezvous hashing, so the same key is consistently mapped to the same
+// entity while the membership is stable, and only the keys of a joining or a
+// leaving entity get remapped. The optional ex (can be nil) is never chosen.
+func (b *Balancer) BalanceKey(key []byte, ex *big.Int) (*big.Int, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	// Pick the entity with the highest key score
+	var best *big.Int
+	var score uint64
+	for _, m := range b.members {
+		// Skip the excluded entity
+		if ex != nil && m.id.Cmp(ex) == 0 {
 			continue
 		}
-		cap -= m.cap
-		if cap < 0 {
-			return m.id, nil
+		if s := m.score(key); best == nil || s > score {
+			best, score = m.id, s
+		}
+	}
+	// Make sure there was actually somebody to balance to
+	if best == nil {
+		return nil, fmt.Errorf("no entity to balance to")
+	}
+	return best, nil
+}
+
+// Returns the aggregated load stats of all the entities, optionally with ex
+// excluded. Capacities, queues and members are summed, latencies averaged weighted
+// by the capacities.
+func (b *Balancer) Load(ex *big.Int) Load {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var load Load
+	var lats float64
+	for _, m := range b.members {
+		if ex != nil && m.id.Cmp(ex) == 0 {
+			continue
 		}
+		load.Cap += m.cap
+		load.Pend += m.depth()
+		load.Members += m.members
+		lats += float64(m.lat) * float64(m.cap)
+	}
+	if load.Cap > 0 {
+		load.Lat = time.Duration(lats / float64(load.Cap))
 	}
-	// Just in case to prevent bugs
-	panic("balanced out of bounds")
+	return load
 }
 
 // Returns the total capacity that the balancer can handle, optionally with ex
@@ -20,9 +20,11 @@
 package balancer
 
 import (
+	"fmt"
 	"math/big"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestBalancer(t *testing.T) {
@@ -103,3 +105,120 @@ func TestBalancer(t *testing.T) {
 		}
 	}
 }
+
+func TestBalancerKey(t *testing.T) {
+	entities := 10
+	keys := 10000
+
+	// Generate a handful of nodes and register them all
+	ids := make([]*big.Int, entities)
+	bal := New()
+	for i := 0; i < len(ids); i++ {
+		ids[i] = big.NewInt(rand.Int63())
+		bal.Register(ids[i])
+	}
+	// Map a lot of keys and check that they are consistently balanced
+	maps := make([]*big.Int, keys)
+	hist := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		id, err := bal.BalanceKey(key, nil)
+		if err != nil {
+			t.Fatalf("failed to balance key: %v.", err)
+		}
+		if again, _ := bal.BalanceKey(key, nil); again.Cmp(id) != 0 {
+			t.Fatalf("key %d: inconsistent balance: have %v, want %v.", i, again, id)
+		}
+		maps[i] = id
+		hist[id.String()]++
+	}
+	// Make sure keys are spread over all the entities
+	for _, id := range ids {
+		if n := hist[id.String()]; n < keys/entities/2 {
+			t.Fatalf("entity %v underloaded: have %v keys, want at least %v.", id, n, keys/entities/2)
+		}
+	}
+	// Check that exclusion never returns the excluded entity
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if id, _ := bal.BalanceKey(key, maps[i]); id.Cmp(maps[i]) == 0 {
+			t.Fatalf("key %d: balanced to excluded entity %v.", i, id)
+		}
+	}
+	// Remove an entity and ensure only its keys are remapped
+	bal.Unregister(ids[0])
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		id, _ := bal.BalanceKey(key, nil)
+		if maps[i].Cmp(ids[0]) == 0 {
+			if id.Cmp(ids[0]) == 0 {
+				t.Fatalf("key %d: balanced to removed entity %v.", i, id)
+			}
+		} else if id.Cmp(maps[i]) != 0 {
+			t.Fatalf("key %d: needlessly remapped: have %v, want %v.", i, id, maps[i])
+		}
+	}
+	// Add a new entity and ensure keys only move to it
+	bal.Register(ids[0])
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if id, _ := bal.BalanceKey(key, nil); id.Cmp(maps[i]) != 0 {
+			t.Fatalf("key %d: mapping not restored: have %v, want %v.", i, id, maps[i])
+		}
+	}
+}
+
+func TestBalancerStrategies(t *testing.T) {
+	// Register a few entities with increasing queue depths
+	ids := make([]*big.Int, 5)
+	bal := New()
+	for i := 0; i < len(ids); i++ {
+		ids[i] = big.NewInt(int64(i + 1))
+		bal.Register(ids[i])
+		bal.UpdateLoad(ids[i], Load{Cap: 10, Pend: 100 * i, Lat: time.Duration(i) * time.Millisecond})
+	}
+	// Round robin should cycle through all non-excluded members
+	hist := make(map[string]int)
+	for i := 0; i < 4*100; i++ {
+		id, err := bal.BalanceBy(RoundRobin, ids[0])
+		if err != nil {
+			t.Fatalf("failed to balance: %v.", err)
+		}
+		hist[id.String()]++
+	}
+	if n := hist[ids[0].String()]; n != 0 {
+		t.Fatalf("round robin balanced to excluded entity %d times.", n)
+	}
+	for _, id := range ids[1:] {
+		if n := hist[id.String()]; n != 100 {
+			t.Fatalf("round robin frequency mismatch for %v: have %v, want %v.", id, n, 100)
+		}
+	}
+	// Least outstanding should pick the shortest queue, accounting for sent ones
+	for i := 0; i < len(ids); i++ {
+		bal.UpdateLoad(ids[i], Load{Cap: 10, Pend: 100 * i, Lat: time.Duration(i) * time.Millisecond})
+	}
+	for i := 0; i <= 100; i++ {
+		if id, _ := bal.BalanceBy(LeastOutstanding, nil); id.Cmp(ids[0]) != 0 {
+			t.Fatalf("least outstanding picked %v, want %v.", id, ids[0])
+		}
+	}
+	if id, _ := bal.BalanceBy(LeastOutstanding, nil); id.Cmp(ids[1]) != 0 {
+		t.Fatalf("least outstanding picked %v after saturation, want %v.", id, ids[1])
+	}
+	// Power of two should never pick the longest queue (while it's the longest)
+	for i := 0; i < 50; i++ {
+		if id, _ := bal.BalanceBy(PowerOfTwo, nil); id.Cmp(ids[len(ids)-1]) == 0 {
+			t.Fatalf("power of two picked the most loaded entity.")
+		}
+	}
+	// Aggregated loads should sum the queues (with outstanding messages)
+	if load := bal.Load(ids[len(ids)-1]); load.Cap != 40 {
+		t.Fatalf("aggregated capacity mismatch: have %v, want %v.", load.Cap, 40)
+	}
+	// Reports should reset the outstanding counters
+	bal.UpdateLoad(ids[0], Load{Cap: 10})
+	if load := bal.Load(nil); load.Pend < 1000 {
+		t.Fatalf("aggregated queue too short: have %v, want at least %v.", load.Pend, 1000)
+	}
+}
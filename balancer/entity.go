@@ -23,14 +23,42 @@
 package balancer
 
 import (
+	"crypto/md5"
+	"encoding/binary"
 	"math/big"
 	"sort"
+	"sync/atomic"
+	"time"
 )
 
 // Entity and related information.
 type entity struct {
-	id  *big.Int // Unique identifier of the entity
-	cap int      // Message capacity as reported by entity
+	id   *big.Int      // Unique identifier of the entity
+	cap  int           // Message capacity as reported by entity
+	pend int           // Number of queued messages as reported by entity
+	lat  time.Duration // Average message handling latency as reported by entity
+	sent int32         // Messages balanced to the entity since its last report (atomic)
+
+	members int // Number of application members as reported by entity
+}
+
+// Estimates the number of outstanding messages at the entity.
+func (e *entity) depth() int {
+	return e.pend + int(atomic.LoadInt32(&e.sent))
+}
+
+// Calculates the rendezvous hashing score of the entity for a given key.
+func (e *entity) score(key []byte) uint64 {
+	return Score(key, e.id.Bytes())
+}
+
+// Calculates the rendezvous hashing score of a candidate id for a given key. The
+// candidate with the highest score should handle the key.
+func Score(key []byte, id []byte) uint64 {
+	hasher := md5.New()
+	hasher.Write(key)
+	hasher.Write(id)
+	return binary.BigEndian.Uint64(hasher.Sum(nil))
 }
 
 // Entity slice implementing sort.Interface.
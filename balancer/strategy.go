@@ -0,0 +1,156 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the pluggable balancing strategies. Each of them picks the
+// destination of the next message based on the last load reports of the members
+// and the number of messages balanced to them since.
+//
+// Strategies are chosen by the sender of each message, not by the members: two
+// callers may balance onto the same members with different strategies, and the
+// members have no say in (nor knowledge of) the strategy used.
+
+package balancer
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Balancing strategy identifier. It is picked per message by the sender and is
+// carried along with the balanced message so that every node of a topic tree
+// balances that message the same way.
+type Strategy uint8
+
+const (
+	Weighted         Strategy = iota // Random selection weighted by reported capacity
+	PowerOfTwo                       // Power of two random choices on reported queue depth
+	LeastOutstanding                 // Least queued and in-flight messages
+	RoundRobin                       // Cyclic selection between the members
+)
+
+// Balancing strategy implementation, picking the destination of the next message.
+type picker interface {
+	// Returns the index of the member to balance to. The available capacity and
+	// the sorted indices of the excluded members are precomputed by the caller
+	// and there's always at least one non-excluded member.
+	pick(members entitySlice, available int, exclude []int) int
+}
+
+// Creates the set of strategy implementations used by a single balancer.
+func newPickers() []picker {
+	return []picker{
+		Weighted:         new(weighted),
+		PowerOfTwo:       new(powerOfTwo),
+		LeastOutstanding: new(leastOutstanding),
+		RoundRobin:       new(roundRobin),
+	}
+}
+
+// Maps the k-th non-excluded member to its real index in the member list.
+func skip(k int, exclude []int) int {
+	for _, idx := range exclude {
+		if k >= idx {
+			k++
+		}
+	}
+	return k
+}
+
+// Checks whether a member index is within the exclusion list.
+func excluded(idx int, exclude []int) bool {
+	for _, ex := range exclude {
+		if ex == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// Capacity weighted random selection.
+type weighted struct{}
+
+func (s *weighted) pick(members entitySlice, available int, exclude []int) int {
+	// Generate a uniform random capacity and send to the associated entity
+	cap := rand.Intn(available)
+	for i, m := range members {
+		// Skip the excluded entities
+		if excluded(i, exclude) {
+			continue
+		}
+		cap -= m.cap
+		if cap < 0 {
+			return i
+		}
+	}
+	// Just in case to prevent bugs
+	panic("balanced out of bounds")
+}
+
+// Power of two random choices, picking the one with the shorter queue.
+type powerOfTwo struct{}
+
+func (s *powerOfTwo) pick(members entitySlice, available int, exclude []int) int {
+	// Calculate the number of candidates and short circuit a single one
+	n := len(members) - len(exclude)
+	if n == 1 {
+		return skip(0, exclude)
+	}
+	// Select two distinct members at random
+	a := rand.Intn(n)
+	b := rand.Intn(n - 1)
+	if b >= a {
+		b++
+	}
+	a, b = skip(a, exclude), skip(b, exclude)
+
+	// Pick the less loaded one, breaking ties by latency
+	da, db := members[a].depth(), members[b].depth()
+	if da < db || (da == db && members[a].lat <= members[b].lat) {
+		return a
+	}
+	return b
+}
+
+// Least outstanding messages, counting both the reported queue and the ones
+// balanced to a member since its last report.
+type leastOutstanding struct{}
+
+func (s *leastOutstanding) pick(members entitySlice, available int, exclude []int) int {
+	best := -1
+	for i, m := range members {
+		if excluded(i, exclude) {
+			continue
+		}
+		if best == -1 || m.depth() < members[best].depth() {
+			best = i
+		}
+	}
+	return best
+}
+
+// Cyclic selection, disregarding any load reports.
+type roundRobin struct {
+	next uint32 // Index of the next member to pick (atomic)
+}
+
+func (s *roundRobin) pick(members entitySlice, available int, exclude []int) int {
+	n := len(members) - len(exclude)
+	k := int((atomic.AddUint32(&s.next, 1) - 1) % uint32(n))
+	return skip(k, exclude)
+}
@@ -21,6 +21,7 @@
 package config
 
 import (
+	"compress/flate"
 	"crypto"
 	"crypto/aes"
 	"crypto/md5"
@@ -156,12 +157,30 @@ var SessionLinkTimeout = time.Second
 // Time allowance to gracefully terminate a session link.
 var SessionGraceTimeout = 3 * time.Second
 
+// Whether to negotiate compressed payloads with remote peers.
+var SessionCompress = true
+
+// Whether to negotiate periodic session link key renewals with remote peers.
+var SessionRekey = true
+
+// Outbound traffic after which the session link keys are renewed (0 = never).
+var SessionRekeyBytes uint64 = 1 << 30
+
+// Time after which the session link keys are renewed (0 = never).
+var SessionRekeyPeriod = time.Hour
+
 // Symmetric cipher for the temporary message encryption.
 var PacketCipher = aes.NewCipher
 
 // Key size for the temporary cipher (bits).
 var PacketCipherBits = 128
 
+// Payload size from which messages are compressed before encryption (0 = never).
+var PacketCompressThreshold = 1024
+
+// Compression level used for the message payloads.
+var PacketCompressLevel = flate.BestSpeed
+
 // Bootstrapping ports to use.
 var BootPorts = []int{14142, 27182, 31415, 45654, 22222, 33333}
 
@@ -231,6 +250,35 @@ var ScribeSpace = 32
 // Number of messages to buffer for application delivery before dropping.
 var ScribeAppBuffer = 128
 
+// Number of reliable events kept per topic for retransmission and repair.
+var ScribeReliableBuffer = 256
+
+// Time to wait for a reliable event acknowledgement before retransmitting.
+var ScribeRetransTimeout = 250 * time.Millisecond
+
+// Number of retransmissions after which a reliable event hop is deemed failed.
+var ScribeRetransLimit = 4
+
+// Time to wait for the delivery status of an acknowledged subtree.
+var ScribeStatusTimeout = 10 * time.Second
+
+// Maximum number of events a topic root retains, whatever the retention policy.
+var ScribeRetainLimit = 1024
+
+// Maximum number of unsettled jobs a work queue dispatches to a consumer node.
+var ScribeQueuePrefetch = 16
+
+// Time a consumer has to settle a job before it's redelivered (checked at each
+// heartbeat).
+var ScribeQueueVisibility = 30 * time.Second
+
+// Number of delivery attempts after which a job is moved to its dead-letter queue.
+var ScribeQueueAttempts = 5
+
+// Maximum number of distinct filters in a topic subtree summary before it is
+// collapsed into accepting all events.
+var ScribeFilterLimit = 32
+
 // Number of sub-clusters an app cluster or topic is split into.
 var IrisClusterSplits = 5
 
@@ -240,12 +288,60 @@ var IrisHandlerThreads = 16
 // Maximum time to queue an established tunnel stream before dropping it.
 var IrisTunnelAcceptTimeout = time.Second
 
+// Time to wait for the retained events of a topic to arrive after subscribing.
+var IrisReplayTimeout = 5 * time.Second
+
+// Maximum total payload size buffered by a detached durable subscription.
+var IrisDurableBuffer = 4 * 1024 * 1024
+
+// Maximum time an event is buffered by a detached durable subscription.
+var IrisDurableAge = 10 * time.Minute
+
 // Maximum time to wait for a client init packet.
 var IrisTunnelInitTimeout = time.Second
 
 // Send and receive window for tunnel ordering and throttling.
 var IrisTunnelBuffer = 256
 
+// Maximum payload size of the messages written by tunnel stream adapters.
+var IrisTunnelFrame = 32 * 1024
+
+// Period at which blocked tunnel stream reads check for deadline changes.
+var IrisTunnelPoll = 100 * time.Millisecond
+
+// Time allowed for the remote endpoint to acknowledge a tunnel close.
+var IrisTunnelCloseTimeout = 3 * time.Second
+
+// Period after which unacknowledged relayed tunnel frames are retransmitted.
+var IrisTunnelRelayResend = time.Second
+
+// Time without acknowledgement progress after which a relayed tunnel is dropped.
+var IrisTunnelRelayTimeout = 10 * time.Second
+
+// Number of recent reply latencies to track per cluster for request hedging.
+var IrisLatencyWindow = 128
+
+// Minimum number of tracked reply latencies before hedging is enabled.
+var IrisLatencyWarmup = 16
+
+// Payload size above which requests, replies, broadcasts and publishes are split
+// into chunks of this size, reassembled at the destination.
+var IrisChunkSize = 256 * 1024
+
+// Time allowed for all the chunks of a message to arrive before dropping it.
+var IrisChunkTimeout = 10 * time.Second
+
+// Maximum payload size of a single message, rejected if exceeded.
+var IrisMessageLimit = 64 * 1024 * 1024
+
+// Period at which the wildcard anchors with local subscribers are re-announced.
+// Changes are announced immediately, the refresh only repairs announcements lost
+// while the overlay is churning.
+var IrisAnchorBeat = time.Minute
+
+// Time after which a wildcard anchor not re-announced is considered abandoned.
+var IrisAnchorTimeout = 3 * time.Minute
+
 // Use in case of federated applications.
 var AppParentId = []byte(nil)
 
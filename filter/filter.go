@@ -0,0 +1,284 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Package filter implements the content based event filters: boolean expressions
+// over the key/value headers of published messages, and the summaries used to
+// aggregate the filters of whole topic subtrees.
+//
+// The expression syntax is a small subset of the usual C-like conditionals:
+//
+//	expr  := or
+//	or    := and { "||" and }
+//	and   := unary { "&&" unary }
+//	unary := "!" unary | "(" expr ")" | ident op literal
+//	op    := "==" | "!=" | "<" | "<=" | ">" | ">="
+//
+// where literals are either double quoted strings or numbers. Numeric literals
+// are compared numerically against the header value, string ones lexically. A
+// comparison against a missing (or non-numeric when needed) header is false.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Filter specific errors
+var ErrEmpty = errors.New("empty filter expression")
+
+// A parsed content filter.
+type Filter struct {
+	expr string // Original textual representation
+	root node   // Root of the parsed expression tree
+}
+
+// Parses a filter expression.
+func Parse(expr string) (*Filter, error) {
+	p := &parser{lex: &lexer{input: expr}}
+	p.next()
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected token at %d: %v", p.tok.pos, p.tok.text)
+	}
+	return &Filter{
+		expr: expr,
+		root: root,
+	}, nil
+}
+
+// Returns the textual representation of the filter.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Evaluates the filter against the headers of a message.
+func (f *Filter) Match(headers map[string]string) bool {
+	return f.root.eval(headers)
+}
+
+// Implements gob.GobEncoder, sending only the textual expression.
+func (f *Filter) GobEncode() ([]byte, error) {
+	return []byte(f.expr), nil
+}
+
+// Implements gob.GobDecoder, reparsing the textual expression.
+func (f *Filter) GobDecode(data []byte) error {
+	parsed, err := Parse(string(data))
+	if err != nil {
+		return err
+	}
+	*f = *parsed
+	return nil
+}
+
+// Node of the parsed expression tree.
+type node interface {
+	eval(headers map[string]string) bool
+}
+
+// Logical disjunction of two sub-expressions.
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) eval(headers map[string]string) bool {
+	return n.left.eval(headers) || n.right.eval(headers)
+}
+
+// Logical conjunction of two sub-expressions.
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) eval(headers map[string]string) bool {
+	return n.left.eval(headers) && n.right.eval(headers)
+}
+
+// Logical negation of a sub-expression.
+type notNode struct {
+	expr node
+}
+
+func (n *notNode) eval(headers map[string]string) bool {
+	return !n.expr.eval(headers)
+}
+
+// Comparison of a header against a literal value.
+type cmpNode struct {
+	key     string  // Header to compare
+	op      string  // Comparison operator
+	text    string  // Literal value (string form)
+	number  float64 // Literal value (numeric form)
+	numeric bool    // Whether to compare numerically
+}
+
+func (n *cmpNode) eval(headers map[string]string) bool {
+	value, ok := headers[n.key]
+	if !ok {
+		return false
+	}
+	// Calculate the ordering between the header and the literal
+	order := 0
+	if n.numeric {
+		num, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		switch {
+		case num < n.number:
+			order = -1
+		case num > n.number:
+			order = 1
+		}
+	} else {
+		switch {
+		case value < n.text:
+			order = -1
+		case value > n.text:
+			order = 1
+		}
+	}
+	// Evaluate the operator on the ordering
+	switch n.op {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	}
+	panic(fmt.Sprintf("unknown comparison operator: %v", n.op))
+}
+
+// Recursive descent parser of filter expressions.
+type parser struct {
+	lex *lexer // Token source
+	tok token  // Current lookahead token
+	err error  // First lexing error encountered
+}
+
+// Advances the lookahead token.
+func (p *parser) next() {
+	tok, err := p.lex.next()
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	p.tok = tok
+}
+
+// Parses a sequence of disjunctions.
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+// Parses a sequence of conjunctions.
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+// Parses a negation, a parenthesized expression or a single comparison.
+func (p *parser) parseUnary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	switch p.tok.kind {
+	case tokNot:
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{expr}, nil
+
+	case tokLParen:
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, fmt.Errorf("missing closing parenthesis at %d", p.tok.pos)
+		}
+		p.next()
+		return expr, nil
+
+	case tokIdent:
+		cmp := &cmpNode{key: p.tok.text}
+		p.next()
+		if p.tok.kind != tokOp {
+			return nil, fmt.Errorf("expected comparison operator at %d", p.tok.pos)
+		}
+		cmp.op = p.tok.text
+		p.next()
+
+		switch p.tok.kind {
+		case tokString:
+			cmp.text = p.tok.text
+		case tokNumber:
+			num, err := strconv.ParseFloat(p.tok.text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d: %v", p.tok.pos, p.tok.text)
+			}
+			cmp.text, cmp.number, cmp.numeric = p.tok.text, num, true
+		default:
+			return nil, fmt.Errorf("expected literal at %d", p.tok.pos)
+		}
+		p.next()
+		return cmp, p.err
+
+	case tokEOF:
+		return nil, ErrEmpty
+	}
+	return nil, fmt.Errorf("unexpected token at %d: %v", p.tok.pos, p.tok.text)
+}
@@ -0,0 +1,122 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package filter
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	headers := map[string]string{
+		"region":   "eu",
+		"priority": "5",
+		"customer": "acme",
+	}
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{`region == "eu"`, true},
+		{`region != "eu"`, false},
+		{`priority > 3`, true},
+		{`priority >= 5.5`, false},
+		{`region == "eu" && priority > 3`, true},
+		{`region == "us" && priority > 3`, false},
+		{`region == "us" || priority > 3`, true},
+		{`!(region == "us")`, true},
+		{`missing == "x" || customer < "b"`, true},
+		{`(region == "us" || region == "eu") && !(priority < 5)`, true},
+		{`customer > 3`, false},
+	}
+	for i, tt := range tests {
+		f, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("test %d: failed to parse %v: %v.", i, tt.expr, err)
+		}
+		if match := f.Match(headers); match != tt.match {
+			t.Errorf("test %d: match mismatch for %v: have %v, want %v.", i, tt.expr, match, tt.match)
+		}
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	tests := []string{
+		``,
+		`region`,
+		`region ==`,
+		`region == eu`,
+		`region == "eu`,
+		`(region == "eu"`,
+		`region == "eu" &&`,
+		`region == "eu" region == "us"`,
+		`region = "eu"`,
+	}
+	for i, expr := range tests {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("test %d: invalid expression accepted: %v.", i, expr)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	eu, _ := Parse(`region == "eu"`)
+	us, _ := Parse(`region == "us"`)
+
+	// Merge two filtered summaries and check the union
+	sum := Summary{Filters: []*Filter{eu}}.Merge(Summary{Filters: []*Filter{us, eu}}, 10)
+	if sum.All || len(sum.Filters) != 2 {
+		t.Fatalf("merged summary mismatch: have %v/%d, want %v/%d.", sum.All, len(sum.Filters), false, 2)
+	}
+	for _, region := range []string{"eu", "us"} {
+		if !sum.Match(map[string]string{"region": region}) {
+			t.Errorf("summary rejected region %v.", region)
+		}
+	}
+	if sum.Match(map[string]string{"region": "asia"}) {
+		t.Errorf("summary accepted non matching region.")
+	}
+	// Check collapsing into accepting all
+	if !sum.Merge(All(), 10).All {
+		t.Errorf("merge with accept-all didn't collapse.")
+	}
+	if !sum.Merge(Summary{}, 1).All {
+		t.Errorf("merge exceeding limit didn't collapse.")
+	}
+	if (Summary{}).Match(nil) {
+		t.Errorf("empty summary accepted event.")
+	}
+	// Make sure summaries survive the wire encoding
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(sum); err != nil {
+		t.Fatalf("failed to encode summary: %v.", err)
+	}
+	dec := Summary{}
+	if err := gob.NewDecoder(buf).Decode(&dec); err != nil {
+		t.Fatalf("failed to decode summary: %v.", err)
+	}
+	if len(dec.Filters) != 2 || dec.Filters[0].String() != sum.Filters[0].String() {
+		t.Fatalf("decoded summary mismatch: have %v, want %v.", dec, sum)
+	}
+	if !dec.Match(map[string]string{"region": "us"}) {
+		t.Errorf("decoded summary rejected matching event.")
+	}
+}
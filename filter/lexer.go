@@ -0,0 +1,151 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the tokenizer of the filter expressions.
+
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Type of a lexical token.
+type tokenKind uint8
+
+const (
+	tokEOF    tokenKind = iota // End of the expression
+	tokIdent                   // Header name
+	tokString                  // Quoted string literal
+	tokNumber                  // Numeric literal
+	tokOp                      // Comparison operator
+	tokAnd                     // Logical conjunction
+	tokOr                      // Logical disjunction
+	tokNot                     // Logical negation
+	tokLParen                  // Opening parenthesis
+	tokRParen                  // Closing parenthesis
+)
+
+// A single lexical token.
+type token struct {
+	kind tokenKind // Type of the token
+	text string    // Textual value (unquoted for strings)
+	pos  int       // Byte offset of the token in the input
+}
+
+// Tokenizer splitting a filter expression into lexical tokens.
+type lexer struct {
+	input string // Expression being tokenized
+	pos   int    // Current byte offset in the input
+}
+
+// Returns the next token from the input, or an error if an invalid character
+// sequence was found. At the end of the input an EOF token is returned.
+func (l *lexer) next() (token, error) {
+	// Skip any leading whitespace
+	for l.pos < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += size
+	}
+	start := l.pos
+	if start == len(l.input) {
+		return token{tokEOF, "", start}, nil
+	}
+	// Operators and punctuation
+	rest := l.input[start:]
+	for _, op := range []string{"==", "!=", "<=", ">=", "&&", "||"} {
+		if len(rest) >= 2 && rest[:2] == op {
+			l.pos += 2
+			switch op {
+			case "&&":
+				return token{tokAnd, op, start}, nil
+			case "||":
+				return token{tokOr, op, start}, nil
+			default:
+				return token{tokOp, op, start}, nil
+			}
+		}
+	}
+	switch rest[0] {
+	case '<', '>':
+		l.pos++
+		return token{tokOp, rest[:1], start}, nil
+	case '!':
+		l.pos++
+		return token{tokNot, "!", start}, nil
+	case '(':
+		l.pos++
+		return token{tokLParen, "(", start}, nil
+	case ')':
+		l.pos++
+		return token{tokRParen, ")", start}, nil
+	case '"':
+		return l.lexString()
+	}
+	// Identifiers and numbers
+	r, _ := utf8.DecodeRuneInString(rest)
+	switch {
+	case r == '-' || r == '.' || unicode.IsDigit(r):
+		return l.lexWord(tokNumber, func(r rune) bool {
+			return unicode.IsDigit(r) || r == '.' || r == '-' || r == '+' || r == 'e' || r == 'E'
+		})
+	case r == '_' || unicode.IsLetter(r):
+		return l.lexWord(tokIdent, func(r rune) bool {
+			return r == '_' || r == '.' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)
+		})
+	}
+	return token{}, fmt.Errorf("invalid character at %d: %q", start, r)
+}
+
+// Consumes a sequence of runes accepted by valid, returning them as a token.
+func (l *lexer) lexWord(kind tokenKind, valid func(rune) bool) (token, error) {
+	start := l.pos
+	for l.pos < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+		if !valid(r) {
+			break
+		}
+		l.pos += size
+	}
+	return token{kind, l.input[start:l.pos], start}, nil
+}
+
+// Consumes a double quoted string literal, resolving the escape sequences.
+func (l *lexer) lexString() (token, error) {
+	start := l.pos
+	for end := start + 1; end < len(l.input); end++ {
+		switch l.input[end] {
+		case '\\':
+			end++
+		case '"':
+			text, err := strconv.Unquote(l.input[start : end+1])
+			if err != nil {
+				return token{}, fmt.Errorf("invalid string literal at %d: %v", start, err)
+			}
+			l.pos = end + 1
+			return token{tokString, text, start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unterminated string literal at %d", start)
+}
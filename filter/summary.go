@@ -0,0 +1,73 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the filter summaries, aggregating the interests of all subscribers
+// within a topic subtree.
+
+package filter
+
+// Summary of the filters of a group of subscribers. An event matches the summary
+// if it matches any of the contained filters, or if any subscriber of the group
+// accepts all events. The zero value matches nothing.
+type Summary struct {
+	All     bool      // Whether some subscriber accepts all events
+	Filters []*Filter // Distinct filters of the remaining subscribers
+}
+
+// Creates a summary accepting all events.
+func All() Summary {
+	return Summary{All: true}
+}
+
+// Checks whether an event with the given headers matches the summary.
+func (s Summary) Match(headers map[string]string) bool {
+	if s.All {
+		return true
+	}
+	for _, f := range s.Filters {
+		if f.Match(headers) {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges another summary into the current one, returning the union. If the
+// number of distinct filters would exceed limit, the result collapses into
+// accepting all events.
+func (s Summary) Merge(other Summary, limit int) Summary {
+	if s.All || other.All {
+		return All()
+	}
+	// Collect the distinct filters of both summaries
+	seen := make(map[string]struct{})
+	filters := make([]*Filter, 0, len(s.Filters)+len(other.Filters))
+	for _, set := range [][]*Filter{s.Filters, other.Filters} {
+		for _, f := range set {
+			if _, ok := seen[f.expr]; !ok {
+				seen[f.expr] = struct{}{}
+				filters = append(filters, f)
+			}
+		}
+	}
+	if len(filters) > limit {
+		return All()
+	}
+	return Summary{Filters: filters}
+}
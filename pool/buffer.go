@@ -0,0 +1,78 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains a size classed byte buffer pool, recycling the message
+// payloads on the network paths to reduce the garbage collector overhead.
+
+package pool
+
+import (
+	"sync"
+)
+
+// Smallest and largest pooled buffer capacities (as powers of two). Buffers of
+// other sizes are allocated and collected normally.
+const (
+	minBufferBits = 6
+	maxBufferBits = 20
+)
+
+// Buffer pools of the individual size classes.
+var buffers [maxBufferBits - minBufferBits + 1]sync.Pool
+
+// Byte buffer retrieved from the pool. After releasing it, neither the buffer
+// nor its data slice may be used any more.
+type Buffer struct {
+	Data []byte // Data slice of the requested length
+
+	class int // Size class of the buffer (-1 if not pooled)
+}
+
+// Retrieves a buffer with a data slice of the given length, allocating a new
+// one if none is available. The contents of the slice are undefined.
+func NewBuffer(size int) *Buffer {
+	class := sizeClass(size)
+	if class < 0 {
+		return &Buffer{Data: make([]byte, size), class: -1}
+	}
+	if buf, ok := buffers[class].Get().(*Buffer); ok {
+		buf.Data = buf.Data[:size]
+		return buf
+	}
+	return &Buffer{Data: make([]byte, size, 1<<uint(class+minBufferBits)), class: class}
+}
+
+// Returns the buffer into the pool for later reuse.
+func (b *Buffer) Release() {
+	if b.class >= 0 {
+		buffers[b.class].Put(b)
+	}
+}
+
+// Calculates the size class of a buffer length, or -1 if not pooled.
+func sizeClass(size int) int {
+	if size > 1<<maxBufferBits {
+		return -1
+	}
+	class := 0
+	for size > 1<<uint(class+minBufferBits) {
+		class++
+	}
+	return class
+}
@@ -0,0 +1,64 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package pool
+
+import (
+	"testing"
+)
+
+// Tests that buffers are sized correctly and recycled within their size class.
+func TestBuffer(t *testing.T) {
+	for _, size := range []int{0, 1, 63, 64, 65, 1000, 1 << 20, 1<<20 + 1} {
+		buf := NewBuffer(size)
+		if len(buf.Data) != size {
+			t.Fatalf("size %d: buffer length mismatch: have %v, want %v.", size, len(buf.Data), size)
+		}
+		if class := sizeClass(size); class >= 0 && cap(buf.Data) != 1<<uint(class+minBufferBits) {
+			t.Fatalf("size %d: buffer capacity mismatch: have %v, want %v.", size, cap(buf.Data), 1<<uint(class+minBufferBits))
+		}
+		if size > 1<<minBufferBits && size <= cap(buf.Data)/2 {
+			t.Fatalf("size %d: buffer capacity too large: %v.", size, cap(buf.Data))
+		}
+		buf.Release()
+	}
+	// Make sure an oversized buffer is not pooled
+	if class := sizeClass(1<<maxBufferBits + 1); class != -1 {
+		t.Fatalf("oversized buffer pooled: class %v.", class)
+	}
+}
+
+// Sink to prevent the compiler from optimizing away the benchmarked allocations.
+var sink []byte
+
+func BenchmarkBufferAlloc(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = make([]byte, 4096)
+	}
+}
+
+func BenchmarkBufferPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := NewBuffer(4096)
+		sink = buf.Data
+		buf.Release()
+	}
+}
@@ -26,6 +26,7 @@ package pool
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/karalabe/iris/container/queue"
 )
@@ -46,6 +47,8 @@ type ThreadPool struct {
 	start bool // Whether the pool was already started
 	quit  bool // Whether the pool was already terminated
 
+	latency time.Duration // Moving average of the task execution times
+
 	mutex sync.Mutex
 	done  *sync.Cond
 }
@@ -110,6 +113,15 @@ func (t *ThreadPool) Schedule(task Task) error {
 	return nil
 }
 
+// Returns the number of tasks either queued or under execution, and the moving
+// average of the task execution latencies.
+func (t *ThreadPool) Stats() (int, time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.tasks.Size() + t.total - t.idle, t.latency
+}
+
 // Dumps the waiting tasks from the pool.
 func (t *ThreadPool) Clear() {
 	t.mutex.Lock()
@@ -135,17 +147,26 @@ func (t *ThreadPool) runner(task Task) {
 		t.mutex.Unlock()
 		t.done.Broadcast()
 	}()
-	// Execute all tasks that are available
-	for ; task != nil; task = t.next() {
+	// Execute all tasks that are available, measuring their latencies
+	for task != nil {
+		start := time.Now()
 		task()
+		task = t.next(time.Since(start))
 	}
 }
 
-// Fetches the next task from the queue.
-func (t *ThreadPool) next() Task {
+// Accounts for the latency of the last executed task and fetches the next one
+// from the queue.
+func (t *ThreadPool) next(latency time.Duration) Task {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
+	if t.latency == 0 {
+		t.latency = latency
+	} else {
+		t.latency += (latency - t.latency) / 8
+	}
+
 	if t.tasks.Empty() { // Note, tasks is reset on termination
 		return nil
 	}
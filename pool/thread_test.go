@@ -242,3 +242,33 @@ func TestTerminate(t *testing.T) {
 		}
 	}
 }
+
+func TestThreadPoolStats(t *testing.T) {
+	t.Parallel()
+
+	// Create a pool and schedule some sleeper tasks
+	pool := NewThreadPool(2)
+	for i := 0; i < 6; i++ {
+		if err := pool.Schedule(func() { time.Sleep(50 * time.Millisecond) }); err != nil {
+			t.Fatalf("failed to schedule task: %v.", err)
+		}
+	}
+	if pend, lat := pool.Stats(); pend != 6 || lat != 0 {
+		t.Fatalf("stats mismatch: have %v/%v pending/latency, want %v/%v.", pend, lat, 6, 0)
+	}
+	// Start the pool and check the queue draining
+	pool.Start()
+	time.Sleep(75 * time.Millisecond)
+	if pend, _ := pool.Stats(); pend != 4 {
+		t.Fatalf("pending task mismatch: have %v, want %v.", pend, 4)
+	}
+	time.Sleep(100 * time.Millisecond)
+	pend, lat := pool.Stats()
+	if pend != 0 {
+		t.Fatalf("pending task mismatch: have %v, want %v.", pend, 0)
+	}
+	if lat < 50*time.Millisecond || lat > 75*time.Millisecond {
+		t.Fatalf("latency mismatch: have %v, want ~%v.", lat, 50*time.Millisecond)
+	}
+	pool.Terminate(true)
+}
@@ -37,7 +37,7 @@ import (
 	"time"
 
 	"github.com/karalabe/iris/config"
-	"github.com/karalabe/iris/gobber"
+	"github.com/karalabe/iris/proto/wire"
 )
 
 // Constants for the protocol UDP layer
@@ -59,6 +59,36 @@ type Message struct {
 	Request bool
 }
 
+// Implements wire.Codec, appending the non-zero message fields to the encoder.
+func (m *Message) EncodeWire(enc *wire.Encoder) {
+	enc.Text(1, m.Version)
+	enc.Bytes(2, m.Magic)
+	enc.Big(3, m.NodeId)
+	enc.Int(4, int64(m.Overlay))
+	enc.Bool(5, m.Request)
+}
+
+// Implements wire.Codec, restoring the message fields from the decoder.
+func (m *Message) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			m.Version = dec.Text()
+		case 2:
+			m.Magic = dec.Bytes()
+		case 3:
+			m.NodeId = dec.Big()
+		case 4:
+			m.Overlay = int(dec.Int())
+		case 5:
+			m.Request = dec.Bool()
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
 // Bootstrapper state for a single network interface.
 type Bootstrapper struct {
 	addr *net.UDPAddr
@@ -69,8 +99,6 @@ type Bootstrapper struct {
 	request  []byte // Pre-generated request packet
 	response []byte // Pre-generated response packet
 
-	gob *gobber.Gobber // Datagram gobber to decode the network messages
-
 	beats chan *Event     // Channel on which to report bootstrap events
 	quit  chan chan error // Quit channel to synchronize bootstrapper termination
 
@@ -108,30 +136,19 @@ func New(ipnet *net.IPNet, magic []byte, node *big.Int, overlay int) (*Bootstrap
 	}
 	// Generate the local heartbeat messages (request and response)
 	bs.magic = magic
-	bs.gob = gobber.New()
-	bs.gob.Init(new(Message))
 
-	msg := Message{
+	msg := &Message{
 		Version: config.ProtocolVersion,
 		Magic:   magic,
 		NodeId:  node,
 		Overlay: overlay,
 		Request: true,
 	}
-	if buf, err := bs.gob.Encode(msg); err != nil {
-		return nil, nil, fmt.Errorf("request encode failed: %v.", err)
-	} else {
-		bs.request = make([]byte, len(buf))
-		copy(bs.request, buf)
-	}
+	bs.request = wire.Marshal(msg)
 
 	msg.Request = false
-	if buf, err := bs.gob.Encode(msg); err != nil {
-		return nil, nil, fmt.Errorf("response encode failed: %v.", err)
-	} else {
-		bs.response = make([]byte, len(buf))
-		copy(bs.response, buf)
-	}
+	bs.response = wire.Marshal(msg)
+
 	// Return the ready-to-boot bootstrapper
 	return bs, bs.beats, nil
 }
@@ -199,7 +216,7 @@ func (bs *Bootstrapper) accept() {
 			bs.sock.SetReadDeadline(time.Now().Add(acceptTimeout))
 			if size, from, err := bs.sock.ReadFromUDP(buf); err == nil {
 				msg := new(Message)
-				if err := bs.gob.Decode(buf[:size], msg); err == nil {
+				if err := wire.Unmarshal(buf[:size], msg); err == nil {
 					if config.ProtocolVersion == msg.Version && msg.Magic != nil && bytes.Compare(bs.magic, msg.Magic) == 0 {
 						// If it's a beat request, respond to it
 						if msg.Request {
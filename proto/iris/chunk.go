@@ -0,0 +1,217 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the fragmentation of large messages into chunks and their reassembly
+// at the destination, keeping the individual overlay messages small enough not
+// to stall the data links (and the heartbeats going through them).
+
+package iris
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Error returned when a message exceeds the size limit of its destination.
+var ErrTooLarge = errors.New("message too large")
+
+// Chunked message being reassembled.
+type partial struct {
+	parts [][]byte    // Payload chunks, nil until arrived
+	have  int         // Number of chunks arrived
+	size  int         // Total payload size of the message
+	timer *time.Timer // Timer dropping the message if not completed in time
+}
+
+// Sets the maximum payload size of the requests and broadcasts sent from the
+// current connection to cluster. Larger messages are rejected with ErrTooLarge
+// before being sent. The global config.IrisMessageLimit applies regardless.
+func (c *Connection) SetMessageLimit(cluster string, limit int) {
+	c.limLock.Lock()
+	defer c.limLock.Unlock()
+
+	c.limits[cluster] = limit
+}
+
+// Checks whether a payload fits into the global and the cluster's size limits.
+// Topic events are only checked against the global limit (empty cluster).
+func (c *Connection) checkSize(cluster string, size int) error {
+	if size > config.IrisMessageLimit {
+		return ErrTooLarge
+	}
+	if cluster != "" {
+		c.limLock.RLock()
+		limit, ok := c.limits[cluster]
+		c.limLock.RUnlock()
+
+		if ok && size > limit {
+			return ErrTooLarge
+		}
+	}
+	return nil
+}
+
+// Splits an assembled message into chunks if its payload exceeds the chunking
+// threshold. Every chunk carries a copy of the original header extended with the
+// chunking infos, so any of them can start the reassembly.
+func (c *Connection) chunk(msg *proto.Message) []*proto.Message {
+	size := len(msg.Data)
+	if size <= config.IrisChunkSize {
+		return []*proto.Message{msg}
+	}
+	head := msg.Head.Meta.(*header)
+	id := atomic.AddUint64(&c.chunkIdx, 1)
+	num := (size + config.IrisChunkSize - 1) / config.IrisChunkSize
+
+	parts := make([]*proto.Message, num)
+	for i := 0; i < num; i++ {
+		end := (i + 1) * config.IrisChunkSize
+		if end > size {
+			end = size
+		}
+		part := *head
+		part.ChunkId, part.ChunkIdx, part.ChunkNum, part.ChunkSize = id, i, num, size
+		parts[i] = &proto.Message{
+			Head: proto.Header{
+				Meta: &part,
+			},
+			Data: msg.Data[i*config.IrisChunkSize : end],
+		}
+	}
+	return parts
+}
+
+// Sends an assembled message chunk by chunk (or whole if small enough).
+func (c *Connection) sendChunked(msg *proto.Message, send func(*proto.Message) error) error {
+	for _, part := range c.chunk(msg) {
+		if err := send(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Balances the first chunk of a message, keeping the rest until pulled by the
+// member accepting it (or the timeout passes), as the member is not known yet.
+func (c *Connection) balanceChunked(msg *proto.Message, timeout time.Duration, balance func(*proto.Message) error) error {
+	parts := c.chunk(msg)
+	if len(parts) > 1 {
+		id := parts[0].Head.Meta.(*header).ChunkId
+
+		c.pullLock.Lock()
+		c.pullPend[id] = parts[1:]
+		c.pullLock.Unlock()
+
+		time.AfterFunc(timeout, func() {
+			c.pullLock.Lock()
+			delete(c.pullPend, id)
+			c.pullLock.Unlock()
+		})
+	}
+	return balance(parts[0])
+}
+
+// Sends the remaining chunks of a balanced message directly to the member which
+// accepted the first one.
+func (c *Connection) handlePull(node *big.Int, conn uint64, id uint64) {
+	c.pullLock.Lock()
+	parts, ok := c.pullPend[id]
+	delete(c.pullPend, id)
+	c.pullLock.Unlock()
+
+	if !ok {
+		log.Printf("iris: pull for unknown chunked message %v.", id)
+		return
+	}
+	for _, part := range parts {
+		part.Head.Meta.(*header).Dest = conn
+		c.iris.scribe.Direct(node, part)
+	}
+}
+
+// Collects a chunk of a fragmented message, returning the reassembled payload
+// once all the chunks arrived. Malformed chunks and messages exceeding the size
+// limit are dropped, as are messages not completed within the chunk timeout.
+func (o *Overlay) reassemble(src *big.Int, head *header, data []byte) ([]byte, bool) {
+	if head.ChunkSize <= 0 || head.ChunkSize > config.IrisMessageLimit || head.ChunkIdx < 0 || head.ChunkIdx >= head.ChunkNum ||
+		head.ChunkNum != (head.ChunkSize+config.IrisChunkSize-1)/config.IrisChunkSize {
+		log.Printf("iris: invalid or oversized chunk %v/%v of %v bytes, dropping.", head.ChunkIdx, head.ChunkNum, head.ChunkSize)
+		return nil, false
+	}
+	// Make sure the chunk is exactly as long as the splitting would produce
+	size := config.IrisChunkSize
+	if head.ChunkIdx == head.ChunkNum-1 {
+		size = head.ChunkSize - (head.ChunkNum-1)*config.IrisChunkSize
+	}
+	if len(data) != size {
+		log.Printf("iris: chunk %v/%v size mismatch: have %v, want %v, dropping.", head.ChunkIdx, head.ChunkNum, len(data), size)
+		return nil, false
+	}
+	id := fmt.Sprintf("%v/%v/%v", src, head.Src, head.ChunkId)
+
+	o.chunkLock.Lock()
+	defer o.chunkLock.Unlock()
+
+	// Fetch the partial message or start a new one
+	part, ok := o.chunks[id]
+	if !ok {
+		part = &partial{
+			parts: make([][]byte, head.ChunkNum),
+			size:  head.ChunkSize,
+		}
+		part.timer = time.AfterFunc(config.IrisChunkTimeout, func() {
+			o.chunkLock.Lock()
+			defer o.chunkLock.Unlock()
+
+			if o.chunks[id] == part {
+				log.Printf("iris: chunked message %v timed out, dropping.", id)
+				delete(o.chunks, id)
+			}
+		})
+		o.chunks[id] = part
+	}
+	// Store the chunk, dropping duplicates and mismatches
+	if len(part.parts) != head.ChunkNum || part.size != head.ChunkSize || part.parts[head.ChunkIdx] != nil {
+		return nil, false
+	}
+	part.parts[head.ChunkIdx] = data
+	if part.have++; part.have < len(part.parts) {
+		return nil, false
+	}
+	// All chunks arrived, reassemble the message
+	delete(o.chunks, id)
+	part.timer.Stop()
+
+	msg := make([]byte, 0, part.size)
+	for _, chunk := range part.parts {
+		msg = append(msg, chunk...)
+	}
+	if len(msg) != part.size {
+		log.Printf("iris: chunked message %v size mismatch: have %v, want %v.", id, len(msg), part.size)
+		return nil, false
+	}
+	return msg, true
+}
@@ -0,0 +1,231 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Connection handler for the chunking tests, echoing requests and collecting
+// broadcasts.
+type chunker struct {
+	msgs chan []byte
+}
+
+func (c *chunker) HandleBroadcast(msg []byte) {
+	c.msgs <- msg
+}
+
+func (c *chunker) HandleRequest(req []byte, timeout time.Duration) []byte {
+	return req
+}
+
+func (c *chunker) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on chunking handler")
+}
+
+func (c *chunker) HandleDrop(reason error) {
+	panic("Connection dropped on chunking handler")
+}
+
+func TestChunking(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	size := config.IrisChunkSize
+	config.IrisChunkSize = 1024
+	defer func() { config.IrisChunkSize = size }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "chunk-test"
+	cluster := "chunk-test"
+	topic := "chunk-test-topic"
+
+	// Boot the iris overlays and connect a member to each
+	conns := make([]*Connection, 2)
+	hands := make([]*chunker, 2)
+	subs := make([]*subscriber, 2)
+	for i := 0; i < 2; i++ {
+		node := New(overlay, key)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(node)
+
+		hands[i] = &chunker{make(chan []byte, 16)}
+		conn, err := node.Connect(cluster, hands[i])
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer func(conn *Connection) {
+			if err := conn.Close(); err != nil {
+				t.Fatalf("failed to close iris connection: %v.", err)
+			}
+		}(conn)
+		conns[i] = conn
+
+		subs[i] = &subscriber{make(chan []byte, 16)}
+		if err := conn.Subscribe(topic, subs[i]); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(3 * time.Second)
+
+	// Send large requests and verify the (also large) replies
+	for i := 0; i < 10; i++ {
+		req := make([]byte, 16*1024+i)
+		io.ReadFull(rand.Reader, req)
+		orig := make([]byte, len(req))
+		copy(orig, req)
+
+		if rep, err := conns[0].Request(cluster, req, 3*time.Second); err != nil {
+			t.Fatalf("request %d failed: %v.", i, err)
+		} else if !bytes.Equal(rep, orig) {
+			t.Fatalf("request %d: reply mismatch.", i)
+		}
+	}
+	// Send a large broadcast and a large publish, verify arrival at both members
+	msg := make([]byte, 16*1024)
+	io.ReadFull(rand.Reader, msg)
+	orig := make([]byte, len(msg))
+	copy(orig, msg)
+
+	if err := conns[0].Broadcast(cluster, msg); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	}
+	for i, hand := range hands {
+		select {
+		case msg := <-hand.msgs:
+			if !bytes.Equal(msg, orig) {
+				t.Fatalf("member %d: broadcast mismatch.", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("member %d: broadcast not received.", i)
+		}
+	}
+	copy(msg, orig)
+	if err := conns[1].Publish(topic, msg); err != nil {
+		t.Fatalf("failed to publish: %v.", err)
+	}
+	for i, sub := range subs {
+		select {
+		case msg := <-sub.msgs:
+			if !bytes.Equal(msg, orig) {
+				t.Fatalf("subscriber %d: event mismatch.", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %d: event not received.", i)
+		}
+	}
+	// Schedule a large publish and verify arrival at both subscribers
+	copy(msg, orig)
+	if err := conns[1].PublishAt(topic, msg, time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatalf("failed to schedule publish: %v.", err)
+	}
+	for i, sub := range subs {
+		select {
+		case msg := <-sub.msgs:
+			if !bytes.Equal(msg, orig) {
+				t.Fatalf("subscriber %d: scheduled event mismatch.", i)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("subscriber %d: scheduled event not received.", i)
+		}
+	}
+	// Verify that size limits reject oversized messages early
+	conns[0].SetMessageLimit(cluster, 8*1024)
+	if _, err := conns[0].Request(cluster, orig, time.Second); err != ErrTooLarge {
+		t.Fatalf("oversized request error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+	if err := conns[0].Broadcast(cluster, orig); err != ErrTooLarge {
+		t.Fatalf("oversized broadcast error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+	limit := config.IrisMessageLimit
+	config.IrisMessageLimit = 8 * 1024
+	defer func() { config.IrisMessageLimit = limit }()
+
+	if err := conns[0].Publish(topic, orig); err != ErrTooLarge {
+		t.Fatalf("oversized publish error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+	if err := conns[0].PublishAt(topic, orig, time.Now()); err != ErrTooLarge {
+		t.Fatalf("oversized scheduled publish error mismatch: have %v, want %v.", err, ErrTooLarge)
+	}
+}
+
+// Tests that chunks inconsistent with the splitting of their message are dropped.
+func TestChunkValidation(t *testing.T) {
+	size := config.IrisChunkSize
+	config.IrisChunkSize = 1024
+	defer func() { config.IrisChunkSize = size }()
+
+	o := &Overlay{chunks: make(map[string]*partial)}
+	src := big.NewInt(1)
+
+	tests := []struct {
+		num, idx, size, data int
+	}{
+		{num: 1, idx: 0, size: 2048, data: 1024},          // too few chunks
+		{num: 3, idx: 0, size: 2048, data: 1024},          // too many chunks
+		{num: 2, idx: 0, size: 2048, data: 512},           // short inner chunk
+		{num: 2, idx: 1, size: 1500, data: 1024},          // long last chunk
+		{num: 2, idx: 2, size: 2048, data: 1024},          // index out of bounds
+		{num: 0, idx: 0, size: 0, data: 0},                // empty message
+		{num: 1 << 20, idx: 0, size: 1 << 30, data: 1024}, // oversized message
+	}
+	for i, tt := range tests {
+		head := &header{ChunkId: uint64(i), ChunkIdx: tt.idx, ChunkNum: tt.num, ChunkSize: tt.size}
+		if _, done := o.reassemble(src, head, make([]byte, tt.data)); done {
+			t.Errorf("test %d: malformed chunk accepted.", i)
+		}
+		if len(o.chunks) != 0 {
+			t.Fatalf("test %d: malformed chunk stored.", i)
+		}
+	}
+	// Sanity check that well formed chunks reassemble
+	for i := 0; i < 2; i++ {
+		head := &header{ChunkId: 100, ChunkIdx: i, ChunkNum: 2, ChunkSize: 1500}
+		data, done := o.reassemble(src, head, make([]byte, 1024-i*(2048-1500)))
+		if done != (i == 1) {
+			t.Fatalf("chunk %d: completion mismatch: have %v, want %v.", i, done, i == 1)
+		}
+		if done && len(data) != 1500 {
+			t.Fatalf("reassembled size mismatch: have %v, want %v.", len(data), 1500)
+		}
+	}
+}
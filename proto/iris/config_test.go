@@ -78,10 +78,12 @@ var bootTimeout = 500 * time.Millisecond
 var convTimeout = 250 * time.Millisecond
 var pastryLeaves = 4
 var scribeBeat = 250 * time.Millisecond
+var anchorBeat = 500 * time.Millisecond
 
 func swapConfigs() {
 	config.PastryBootTimeout, bootTimeout = bootTimeout, config.PastryBootTimeout
 	config.PastryConvTimeout, convTimeout = convTimeout, config.PastryConvTimeout
 	config.PastryLeaves, pastryLeaves = pastryLeaves, config.PastryLeaves
 	config.ScribeBeatPeriod, scribeBeat = scribeBeat, config.ScribeBeatPeriod
+	config.IrisAnchorBeat, anchorBeat = anchorBeat, config.IrisAnchorBeat
 }
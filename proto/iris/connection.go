@@ -20,14 +20,20 @@
 package iris
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/karalabe/iris/balancer"
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/filter"
 	"github.com/karalabe/iris/pool"
+	"github.com/karalabe/iris/proto"
 )
 
 // Iris specific errors
@@ -39,16 +45,26 @@ var ErrNotSubscribed = errors.New("not subscribed")
 // Prefixes for multi-clustering.
 var clusterPrefixes []string
 var topicPrefixes []string
+var wildcardPrefixes []string
+
+// Tags identifying cluster, topic and wildcard topic prefixes.
+const clusterPrefixTag = "c#"
+const topicPrefixTag = "t#"
+const wildcardPrefixTag = "w#"
 
 // Creates the cluster split prefix tags.
 func init() {
 	clusterPrefixes = make([]string, config.IrisClusterSplits)
 	for i := 0; i < len(clusterPrefixes); i++ {
-		clusterPrefixes[i] = fmt.Sprintf("c#%d-", i)
+		clusterPrefixes[i] = fmt.Sprintf("%s%d-", clusterPrefixTag, i)
 	}
 	topicPrefixes = make([]string, config.IrisClusterSplits)
 	for i := 0; i < len(topicPrefixes); i++ {
-		topicPrefixes[i] = fmt.Sprintf("t#%d-", i)
+		topicPrefixes[i] = fmt.Sprintf("%s%d-", topicPrefixTag, i)
+	}
+	wildcardPrefixes = make([]string, config.IrisClusterSplits)
+	for i := 0; i < len(wildcardPrefixes); i++ {
+		wildcardPrefixes[i] = fmt.Sprintf("%s%d-", wildcardPrefixTag, i)
 	}
 }
 
@@ -67,6 +83,17 @@ type ConnectionHandler interface {
 	HandleTunnel(tun *Tunnel)
 }
 
+// Optional extension of the connection handler, receiving along with requests
+// their idempotency tokens. Requests sent under a retry or hedging policy may be
+// delivered multiple times (to different members), all copies sharing the same
+// token, allowing handlers to deduplicate them.
+type TokenHandler interface {
+	// Handles a request carrying an idempotency token, returning the reply that
+	// should be forwarded back to the caller. Requests issued without a policy
+	// have no token and are passed to HandleRequest.
+	HandleTokenRequest(token []byte, req []byte, timeout time.Duration) []byte
+}
+
 // Subscription handler receiving events from a single subscribed topic.
 type SubscriptionHandler interface {
 	// Handles an event published to the subscribed topic.
@@ -81,12 +108,39 @@ type Connection struct {
 	handler ConnectionHandler // Handler for connection events
 	iris    *Overlay          // Interface into the distributed carrier
 
+	deadLive bool // Whether the handler accepts dead letters
+
 	reqIdx  uint64                 // Index to assign the next request
 	reqPend map[uint64]chan []byte // Active requests waiting for a reply
-	reqLock sync.RWMutex           // Mutex to protect the request map
-
-	subLive map[string]SubscriptionHandler // Active subscriptions
-	subLock sync.RWMutex                   // Mutex to protect the subscription map
+	reqAccs map[uint64][]*acceptor // Known acceptors of policy driven requests
+	reqLats map[string]*latencies  // Recent reply latencies of remote clusters
+	reqLock sync.RWMutex           // Mutex to protect the request maps
+
+	subLive  map[string]SubscriptionHandler            // Active subscriptions
+	subFilt  map[string]*filter.Filter                 // Content filters of the active subscriptions
+	wildLive map[string]map[string]SubscriptionHandler // Active wildcard subscriptions, grouped by anchor
+	wildFilt map[string]*filter.Filter                 // Content filters of the wildcard subscriptions
+	presLive map[string]PresenceHandler                // Active presence subscriptions
+	durLive  map[string]*durable                       // Attached durable subscriptions
+	queLive  map[string]JobHandler                     // Consumed work queues
+	eleLive  map[string]*Leadership                    // Running leader election campaigns
+	lockLive map[string]*lease                         // Held (or acquiring) lock leases
+	subLock  sync.RWMutex                              // Mutex to protect the subscription maps
+
+	balStrat map[string]balancer.Strategy // Balancing strategies used by this caller, per cluster
+	balLock  sync.RWMutex                 // Mutex to protect the strategy map
+
+	limits  map[string]int // Message size limits of remote clusters
+	limLock sync.RWMutex   // Mutex to protect the size limits
+
+	chunkIdx uint64                      // Id to assign to the next chunked message
+	pullPend map[uint64][]*proto.Message // Chunks of balanced messages waiting to be pulled
+	pullLock sync.Mutex                  // Mutex to protect the pending chunks
+
+	ordSeqs  map[string]uint64  // Last sequence number of the ordered streams per topic
+	ordLock  sync.Mutex         // Mutex to serialize ordered publishing
+	ordExec  map[string]*serial // Serial executors of the inbound ordered streams
+	execLock sync.Mutex         // Mutex to protect the serial executors
 
 	tunIdx  uint64             // Index to assign the next tunnel
 	tunLive map[uint64]*Tunnel // Tunnels either live, or being established
@@ -109,9 +163,24 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 		handler: handler,
 		iris:    o,
 
-		reqPend: make(map[uint64]chan []byte),
-		subLive: make(map[string]SubscriptionHandler),
-		tunLive: make(map[uint64]*Tunnel),
+		reqPend:  make(map[uint64]chan []byte),
+		reqAccs:  make(map[uint64][]*acceptor),
+		reqLats:  make(map[string]*latencies),
+		subLive:  make(map[string]SubscriptionHandler),
+		subFilt:  make(map[string]*filter.Filter),
+		wildLive: make(map[string]map[string]SubscriptionHandler),
+		wildFilt: make(map[string]*filter.Filter),
+		presLive: make(map[string]PresenceHandler),
+		durLive:  make(map[string]*durable),
+		queLive:  make(map[string]JobHandler),
+		eleLive:  make(map[string]*Leadership),
+		lockLive: make(map[string]*lease),
+		balStrat: make(map[string]balancer.Strategy),
+		limits:   make(map[string]int),
+		pullPend: make(map[uint64][]*proto.Message),
+		ordSeqs:  make(map[string]uint64),
+		ordExec:  make(map[string]*serial),
+		tunLive:  make(map[uint64]*Tunnel),
 
 		// Quality of service
 		workers: pool.NewThreadPool(config.IrisHandlerThreads),
@@ -120,18 +189,21 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 		quit: make(chan chan error),
 		term: make(chan struct{}),
 	}
+	_, c.deadLive = handler.(DeadLetterHandler)
+
 	// Assign a connection id and track it
 	o.lock.Lock()
 	c.id, o.autoid = o.autoid, o.autoid+1
 	o.conns[c.id] = c
 	o.lock.Unlock()
 
-	// Subscribe to the multi-group
+	// Subscribe to the multi-group and announce the new member
 	for _, prefix := range clusterPrefixes {
 		if err := c.iris.subscribe(c.id, prefix+cluster); err != nil {
 			return nil, err
 		}
 	}
+	o.publishPresence(cluster, true, o.scribe.Self(), c.id)
 	c.workers.Start()
 
 	return c, nil
@@ -140,13 +212,43 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 // Broadcasts asynchronously a message to all members of an iris cluster. No
 // guarantees are made that all nodes receive the message (best effort).
 func (c *Connection) Broadcast(cluster string, msg []byte) error {
+	if err := c.checkSize(cluster, len(msg)); err != nil {
+		return err
+	}
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg))
+	return c.sendChunked(c.assembleBroadcast(msg), func(part *proto.Message) error {
+		return c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, part)
+	})
 }
 
 // Executes a synchronous request to cluster (load balanced between all active),
 // and returns the received reply, or an error if a timeout is reached.
 func (c *Connection) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.request(cluster, nil, req, timeout, nil)
+}
+
+// Executes a synchronous request to cluster, routing all requests with the same
+// key consistently to the same member while the cluster membership is stable.
+// Returns the received reply, or an error if a timeout is reached.
+func (c *Connection) RequestByKey(cluster string, key []byte, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.request(cluster, key, req, timeout, nil)
+}
+
+// Executes a synchronous request to cluster, either load balanced or routed by
+// the affinity key if one was specified. If a delivery policy is given, the
+// request is retried or hedged accordingly.
+func (c *Connection) request(cluster string, key []byte, req []byte, timeout time.Duration, policy *Policy) ([]byte, error) {
+	if err := c.checkSize(cluster, len(req)); err != nil {
+		return nil, err
+	}
+	// Generate the idempotency token for policy driven requests
+	var token []byte
+	if policy != nil {
+		token = make([]byte, tokenBytes)
+		if _, err := io.ReadFull(rand.Reader, token); err != nil {
+			return nil, err
+		}
+	}
 	// Create a reply channel for the results
 	c.reqLock.Lock()
 	reqCh := make(chan []byte, 1)
@@ -161,26 +263,93 @@ func (c *Connection) Request(cluster string, req []byte, timeout time.Duration)
 		defer c.reqLock.Unlock()
 
 		delete(c.reqPend, reqId)
+		delete(c.reqAccs, reqId)
 		close(reqCh)
 	}()
-	// Send the request
-	prefixIdx := int(reqId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout))
-
+	// Send the request, keyed ones always into the same sub-cluster
+	start := time.Now()
+	switch {
+	case policy != nil:
+		c.sendPolicyRequest(cluster, reqId, token, req, timeout)
+	case key == nil:
+		prefixIdx := int(reqId) % config.IrisClusterSplits
+		c.balanceChunked(c.assembleRequest(reqId, nil, req, timeout), timeout, func(part *proto.Message) error {
+			return c.iris.scribe.BalanceBy(clusterPrefixes[prefixIdx]+cluster, c.strategy(cluster), nil, part)
+		})
+	default:
+		hasher := fnv.New32a()
+		hasher.Write(key)
+		prefixIdx := int(hasher.Sum32() % uint32(config.IrisClusterSplits))
+		c.balanceChunked(c.assembleRequest(reqId, key, req, timeout), timeout, func(part *proto.Message) error {
+			return c.iris.scribe.BalanceKey(clusterPrefixes[prefixIdx]+cluster, key, part)
+		})
+	}
+	// Set up the retry and hedging timers if requested
+	var retry, hedge <-chan time.Time
+	retries := 0
+	if policy != nil {
+		retries = policy.Retries
+		retry = policy.retryTimer(retries, timeout)
+		hedge = policy.hedgeTimer(c.latencies(cluster), timeout)
+	}
 	// Retrieve the results, time out or fail if terminating
-	select {
-	case <-c.term:
-		return nil, ErrTerminating
-	case <-time.After(timeout):
-		return nil, ErrTimeout
-	case rep := <-reqCh:
-		return rep, nil
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-c.term:
+			return nil, ErrTerminating
+		case <-deadline:
+			return nil, ErrTimeout
+		case <-retry:
+			c.sendPolicyRequest(cluster, reqId, token, req, timeout-time.Since(start))
+			retries--
+			retry = policy.retryTimer(retries, timeout)
+		case <-hedge:
+			c.sendPolicyRequest(cluster, reqId, token, req, timeout-time.Since(start))
+			hedge = nil
+		case rep := <-reqCh:
+			c.latencies(cluster).add(time.Since(start))
+			return rep, nil
+		}
 	}
 }
 
-// Subscribes to topic, using handler as the callback for arriving events. An
-// error is returned if subscription fails.
+// Sets the load balancing strategy to use for requests and tunnels sent from the
+// current connection to cluster. Keyed requests are not affected.
+//
+// The strategy is a caller side setting: it applies only to the messages sent
+// through this connection, other connections (local or remote) keep balancing
+// onto the same cluster with their own strategies, and the cluster members can
+// neither set nor observe it.
+func (c *Connection) SetStrategy(cluster string, strat balancer.Strategy) {
+	c.balLock.Lock()
+	defer c.balLock.Unlock()
+
+	c.balStrat[cluster] = strat
+}
+
+// Retrieves the load balancing strategy assigned to cluster (weighted default).
+func (c *Connection) strategy(cluster string) balancer.Strategy {
+	c.balLock.RLock()
+	defer c.balLock.RUnlock()
+
+	return c.balStrat[cluster]
+}
+
+// Subscribes to topic, using handler as the callback for arriving events. The
+// topic may be a wildcard pattern, in which case events published to any of the
+// matching topics are delivered. Remote publishers pick up a new pattern once its
+// anchor announcement spreads (during overlay churn at the latest a few anchor
+// beats later). An error is returned if subscription fails.
 func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error {
+	return c.subscribe(topic, nil, handler)
+}
+
+// Subscribes to topic (or wildcard pattern) with an optional content filter.
+func (c *Connection) subscribe(topic string, flt *filter.Filter, handler SubscriptionHandler) error {
+	if isPattern(topic) {
+		return c.subscribeWildcard(topic, flt, handler)
+	}
 	// Make sure there are no double subscriptions and not closing
 	c.subLock.Lock()
 	select {
@@ -194,6 +363,9 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 		}
 		for _, prefix := range topicPrefixes {
 			c.subLive[prefix+topic] = handler
+			if flt != nil {
+				c.subFilt[prefix+topic] = flt
+			}
 		}
 	}
 	c.subLock.Unlock()
@@ -204,18 +376,24 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 			return err
 		}
 	}
+	// Replay the retained events of the topic, if any
+	go c.replay(topic)
 	return nil
 }
 
-// Publishes an event asynchronously to topic. No guarantees are made that all
-// subscribers receive the message.
+// Publishes an event asynchronously to topic, reaching both the subscribers of
+// the exact topic and those of all matching wildcard patterns. No guarantees are
+// made that all subscribers receive the message.
 func (c *Connection) Publish(topic string, msg []byte) error {
-	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, c.assemblePublish(msg))
+	return c.PublishHeaders(topic, nil, msg)
 }
 
-// Unsubscribes from topic, receiving no more event notifications for it.
+// Unsubscribes from topic (or wildcard pattern), receiving no more event
+// notifications for it.
 func (c *Connection) Unsubscribe(topic string) error {
+	if isPattern(topic) {
+		return c.unsubscribeWildcard(topic)
+	}
 	// Remove subscription if present
 	c.subLock.Lock()
 	select {
@@ -230,6 +408,7 @@ func (c *Connection) Unsubscribe(topic string) error {
 	}
 	for _, prefix := range topicPrefixes {
 		delete(c.subLive, prefix+topic)
+		delete(c.subFilt, prefix+topic)
 	}
 	c.subLock.Unlock()
 
@@ -257,26 +436,81 @@ func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*Tunnel, err
 	}
 }
 
-// Gracefully terminates the connection, all subscriptions and all tunnels.
+// Gracefully terminates the connection, all subscriptions, campaigns, locks and
+// tunnels.
+// Durable subscriptions are only detached, buffering events until reattached.
 func (c *Connection) Close() error {
 	// Signal the connection as terminating
 	close(c.term)
 
-	// Close all open tunnels
-	/*c.tunLock.Lock()
+	// Close all established tunnels and wait for the tear-downs to finish
+	c.tunLock.RLock()
+	tuns := make([]*Tunnel, 0, len(c.tunLive))
 	for _, tun := range c.tunLive {
-		go tun.Close()
+		if tun.conn != nil {
+			tuns = append(tuns, tun)
+		}
+	}
+	c.tunLock.RUnlock()
+
+	pend := new(sync.WaitGroup)
+	for _, tun := range tuns {
+		pend.Add(1)
+		go func(tun *Tunnel) {
+			defer pend.Done()
+			tun.Close()
+		}(tun)
 	}
-	c.tunLock.Unlock()*/
+	pend.Wait()
 
-	// Remove all topic subscriptions
+	// Remove all topic and presence subscriptions
 	c.subLock.Lock()
 	for topic, _ := range c.subLive {
 		c.iris.unsubscribe(c.id, topic)
 	}
+	for anchor, _ := range c.wildLive {
+		for _, prefix := range wildcardPrefixes {
+			c.iris.unsubscribe(c.id, prefix+anchor)
+		}
+	}
+	for topic, _ := range c.presLive {
+		c.iris.unsubscribe(c.id, topic)
+	}
+	// Detach durable subscriptions, leaving them buffering
+	for _, dur := range c.durLive {
+		dur.detach(c)
+	}
+	// Stop consuming work queues, unsettled jobs will be redelivered
+	for queue := range c.queLive {
+		c.iris.unconsume(c.id, queuePrefix+queue)
+	}
+	// End all leader election campaigns, handing over the leaderships
+	elections := make([]string, 0, len(c.eleLive))
+	for election, lead := range c.eleLive {
+		elections = append(elections, election)
+		close(lead.lost)
+	}
+	c.eleLive = make(map[string]*Leadership)
+
+	// Release all held lock leases
+	leases := make(map[string]*lease)
+	for name, l := range c.lockLive {
+		if l.token != 0 {
+			leases[name] = l
+		}
+	}
+	c.lockLive = make(map[string]*lease)
 	c.subLock.Unlock()
 
-	// Leave the cluster and close the carrier connection
+	for _, election := range elections {
+		c.iris.scribe.Resign(election, c.id)
+	}
+	for name, l := range leases {
+		c.iris.scribe.Unlock(lockPrefix+name, c.id, l.token)
+	}
+
+	// Announce the departure, leave the cluster and close the carrier connection
+	c.iris.publishPresence(c.cluster, false, c.iris.scribe.Self(), c.id)
 	for _, prefix := range clusterPrefixes {
 		c.iris.unsubscribe(c.id, prefix+c.cluster)
 	}
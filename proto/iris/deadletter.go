@@ -0,0 +1,131 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the dead-letter reporting: messages sent by a connection which the
+// overlay had to discard are returned to it (only if its handler accepts them)
+// and reported along with the reason of the failed delivery.
+
+package iris
+
+import (
+	"math/big"
+
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/scribe"
+)
+
+// Reasons for which the overlay may discard a message.
+type DeadReason int
+
+const (
+	NoSubscribers DeadReason = iota // The topic or cluster had no members
+	NoCapacity                      // The cluster had members, but none could be balanced to
+	NoRecipient                     // The connection a reply was addressed to is gone
+)
+
+// Returns the textual representation of the dead-letter reason.
+func (r DeadReason) String() string {
+	switch r {
+	case NoSubscribers:
+		return "no subscribers"
+	case NoCapacity:
+		return "no capacity"
+	case NoRecipient:
+		return "no recipient"
+	default:
+		return "unknown"
+	}
+}
+
+// Kinds of the messages that may be reported as dead letters.
+type LetterKind int
+
+const (
+	DeadBroadcast LetterKind = iota // Cluster broadcast
+	DeadEvent                       // Topic event
+	DeadRequest                     // Cluster request
+	DeadReply                       // Reply to a remote request
+)
+
+// Message discarded by the overlay, returned to the connection that sent it.
+type DeadLetter struct {
+	Kind   LetterKind // Kind of the discarded message
+	Reason DeadReason // Reason why the message was discarded
+	Topic  string     // Topic of a discarded event (empty otherwise)
+	Msg    []byte     // Payload of the discarded message
+}
+
+// Optional extension of the connection handler, receiving the locally sent
+// messages which the overlay could not deliver. Connections without it have their
+// undeliverable messages dropped silently.
+type DeadLetterHandler interface {
+	// Handles a message returned by the overlay as undeliverable.
+	HandleDeadLetter(letter *DeadLetter)
+}
+
+// Implements proto.scribe.Callback.HandleBounce. Converts the scribe failure into
+// a dead letter and passes it to the connection that sent the message.
+func (o *Overlay) HandleBounce(reason error, msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+
+	dead := NoSubscribers
+	if reason == scribe.ErrNoCapacity {
+		dead = NoCapacity
+	}
+	// Fetch the sender, dropping the letter if closed meanwhile
+	o.lock.RLock()
+	conn, ok := o.conns[head.Src]
+	o.lock.RUnlock()
+	if ok {
+		conn.workers.Schedule(func() { conn.handleDeadLetter(head.Op, dead, head.PubTopic, msg.Data) })
+	}
+}
+
+// Returns a message discarded by the iris layer to the connection that sent it,
+// if the message requested so.
+func (o *Overlay) bounceMessage(src *big.Int, head *header, reason DeadReason, msg []byte) {
+	if head.Return {
+		o.scribe.Direct(src, o.assembleDeadLetter(head, reason, msg))
+	}
+}
+
+// Reports a returned message to the dead-letter handler. Events are returned by
+// the exact topic tree alone, and only if no live wildcard anchor was published
+// into, as the delivery to wildcard subscribers is not tracked. Returned internal
+// messages (acks, membership queries, tunnel requests) are not reported at all.
+func (c *Connection) handleDeadLetter(op opcode, reason DeadReason, topic string, msg []byte) {
+	handler, ok := c.handler.(DeadLetterHandler)
+	if !ok {
+		return
+	}
+	letter := &DeadLetter{Reason: reason, Msg: msg}
+	switch op {
+	case opBcast:
+		letter.Kind = DeadBroadcast
+	case opPub:
+		letter.Kind, letter.Topic = DeadEvent, topic
+	case opReq:
+		letter.Kind = DeadRequest
+	case opRep:
+		letter.Kind = DeadReply
+	default:
+		return
+	}
+	handler.HandleDeadLetter(letter)
+}
@@ -0,0 +1,169 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Connection handler collecting the returned dead letters.
+type undeliverable struct {
+	letters chan *DeadLetter
+}
+
+func (u *undeliverable) HandleBroadcast(msg []byte) {
+}
+
+func (u *undeliverable) HandleRequest(req []byte, timeout time.Duration) []byte {
+	return req
+}
+
+func (u *undeliverable) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on dead-letter handler")
+}
+
+func (u *undeliverable) HandleDeadLetter(letter *DeadLetter) {
+	select {
+	case u.letters <- letter:
+		// Ok
+	default:
+		panic("dead-letter queue full")
+	}
+}
+
+// Individual dead-letter tests.
+func TestDeadLetterSingleNode(t *testing.T) {
+	testDeadLetter(t, 1)
+}
+
+func TestDeadLetterMultiNode(t *testing.T) {
+	testDeadLetter(t, 5)
+}
+
+// Tests that undeliverable broadcasts, events and requests are reported, but
+// delivered ones are not.
+func testDeadLetter(t *testing.T, nodes int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "dead-letter-test"
+	cluster := fmt.Sprintf("dead-letter-test-%d", nodes)
+	missing := fmt.Sprintf("dead-letter-missing-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect the sender to the first node and a subscriber to the last one
+	handler := &undeliverable{make(chan *DeadLetter, 16)}
+	sender, err := liveNodes[0].Connect(cluster, handler)
+	if err != nil {
+		t.Fatalf("failed to connect sender: %v.", err)
+	}
+	defer sender.Close()
+
+	receiver, err := liveNodes[nodes-1].Connect(cluster, &undeliverable{make(chan *DeadLetter, 16)})
+	if err != nil {
+		t.Fatalf("failed to connect receiver: %v.", err)
+	}
+	defer receiver.Close()
+
+	sub := &subscriber{make(chan []byte, 16)}
+	if err := receiver.Subscribe("dead.exact", sub); err != nil {
+		t.Fatalf("failed to subscribe to exact topic: %v.", err)
+	}
+	if err := receiver.Subscribe("dead.wild.*", sub); err != nil {
+		t.Fatalf("failed to subscribe to wildcard topic: %v.", err)
+	}
+	// Make sure there is a little time to propagate state and reports
+	if nodes > 1 {
+		time.Sleep(3 * time.Second)
+	}
+	// Send a message of each kind into the void, and a few deliverable ones
+	if err := sender.Broadcast(missing, []byte{0x01}); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	}
+	if err := sender.Publish("dead.missing", []byte{0x02}); err != nil {
+		t.Fatalf("failed to publish: %v.", err)
+	}
+	if _, err := sender.Request(missing, []byte{0x03}, 250*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("request error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if err := sender.Broadcast(cluster, []byte{0x04}); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	}
+	if err := sender.Publish("dead.exact", []byte{0x05}); err != nil {
+		t.Fatalf("failed to publish: %v.", err)
+	}
+	if err := sender.Publish("dead.wild.card", []byte{0x06}); err != nil {
+		t.Fatalf("failed to publish: %v.", err)
+	}
+	if rep, err := sender.Request(cluster, []byte{0x07}, time.Second); err != nil || rep[0] != 0x07 {
+		t.Fatalf("request failed: %v %v.", rep, err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	// Verify the reported dead letters
+	want := map[byte]*DeadLetter{
+		0x01: &DeadLetter{Kind: DeadBroadcast, Reason: NoSubscribers},
+		0x02: &DeadLetter{Kind: DeadEvent, Reason: NoSubscribers, Topic: "dead.missing"},
+		0x03: &DeadLetter{Kind: DeadRequest, Reason: NoSubscribers},
+	}
+	if n := len(handler.letters); n != len(want) {
+		t.Fatalf("dead-letter count mismatch: have %v, want %v.", n, len(want))
+	}
+	for i := 0; i < len(want); i++ {
+		letter := <-handler.letters
+		if len(letter.Msg) != 1 {
+			t.Fatalf("dead-letter payload mismatch: have %v, want 1 byte.", letter.Msg)
+		}
+		exp, ok := want[letter.Msg[0]]
+		if !ok {
+			t.Fatalf("unexpected dead letter: %+v.", letter)
+		}
+		if letter.Kind != exp.Kind || letter.Reason != exp.Reason || letter.Topic != exp.Topic {
+			t.Fatalf("dead letter mismatch: have %+v, want %+v.", letter, exp)
+		}
+	}
+	if n := len(sub.msgs); n != 2 {
+		t.Fatalf("delivered event count mismatch: have %v, want 2.", n)
+	}
+}
@@ -0,0 +1,264 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the durable subscriptions. A durable subscription is owned by the
+// local overlay node instead of a client connection: it is a carrier member of
+// the topic on its own, so events keep arriving while no client is attached.
+// These are buffered (bounded by size and age) and delivered to the next client
+// attaching with the same subscription name.
+
+package iris
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Durable subscription specific errors
+var ErrDurableMismatch = errors.New("durable subscription bound to another topic")
+
+// Overflow policy of a durable subscription, applied when the buffer of detached
+// events is full.
+type Overflow int
+
+const (
+	DropOldest Overflow = iota // Evict the oldest buffered events to make room
+	DropNewest                 // Discard arriving events until there is room
+)
+
+// Event buffered by a durable subscription.
+type buffered struct {
+	origin Member    // Publisher of the event
+	seq    uint64    // Position in the publisher's ordered stream (0 if unordered)
+	msg    []byte    // Payload of the event
+	stamp  time.Time // Arrival time of the event
+}
+
+// Durable subscription of a single topic.
+type durable struct {
+	id       uint64   // Carrier member id of the subscription
+	name     string   // Name clients attach by
+	topic    string   // Subscribed topic
+	overflow Overflow // Overflow policy of the buffer
+
+	conn     *Connection         // Attached client connection (nil if detached)
+	handler  SubscriptionHandler // Event handler of the attached client
+	backlog  []*buffered         // Events waiting for delivery
+	size     int                 // Total payload size of the backlog
+	flushing bool                // Whether the backlog is being delivered
+
+	lock sync.Mutex
+}
+
+// Subscribes to topic under a durable name. If a durable subscription with the
+// same name already exists on the local node, the connection is attached to it,
+// receiving the events buffered since the last client detached, followed by the
+// live ones. Closing the connection only detaches the subscription, which keeps
+// buffering events (within config.IrisDurableBuffer bytes and config.IrisDurableAge
+// time), handling overflows according to the given policy.
+func (c *Connection) SubscribeDurable(name string, topic string, overflow Overflow, handler SubscriptionHandler) error {
+	if isPattern(topic) {
+		return ErrInvalidTopic
+	}
+	select {
+	case <-c.term:
+		return ErrTerminating
+	default:
+	}
+	// Fetch the durable subscription or create a new one
+	c.iris.lock.Lock()
+	dur, ok := c.iris.durLive[name]
+	if !ok {
+		dur = &durable{
+			id:    c.iris.autoid,
+			name:  name,
+			topic: topic,
+		}
+		c.iris.autoid++
+		c.iris.durLive[name] = dur
+		c.iris.durIds[dur.id] = dur
+	}
+	c.iris.lock.Unlock()
+
+	if dur.topic != topic {
+		return ErrDurableMismatch
+	}
+	// Subscribe through the carrier if the subscription is new
+	if !ok {
+		for _, prefix := range topicPrefixes {
+			if err := c.iris.subscribe(dur.id, prefix+topic); err != nil {
+				return err
+			}
+		}
+	}
+	// Attach the connection to the subscription, if not closing
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.durLive[name]; ok {
+			c.subLock.Unlock()
+			return ErrSubscribed
+		}
+		if err := dur.attach(c, overflow, handler); err != nil {
+			c.subLock.Unlock()
+			return err
+		}
+		c.durLive[name] = dur
+	}
+	c.subLock.Unlock()
+
+	return nil
+}
+
+// Cancels an attached durable subscription, dropping all buffered events and
+// removing it from the local node.
+func (c *Connection) UnsubscribeDurable(name string) error {
+	// Detach the subscription if present
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+	}
+	dur, ok := c.durLive[name]
+	if !ok {
+		c.subLock.Unlock()
+		return ErrNotSubscribed
+	}
+	delete(c.durLive, name)
+	dur.detach(c)
+	c.subLock.Unlock()
+
+	// Remove the subscription from the node and the carrier
+	c.iris.lock.Lock()
+	delete(c.iris.durLive, name)
+	delete(c.iris.durIds, dur.id)
+	c.iris.lock.Unlock()
+
+	for _, prefix := range topicPrefixes {
+		if err := c.iris.unsubscribe(dur.id, prefix+dur.topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attaches a client connection to the subscription and starts delivering the
+// backlog, if any.
+func (d *durable) attach(conn *Connection, overflow Overflow, handler SubscriptionHandler) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.conn != nil {
+		return ErrSubscribed
+	}
+	d.conn, d.handler, d.overflow = conn, handler, overflow
+
+	d.expire()
+	if len(d.backlog) > 0 && !d.flushing {
+		d.flushing = true
+		go d.flush()
+	}
+	return nil
+}
+
+// Detaches a client connection from the subscription, if still attached.
+func (d *durable) detach(conn *Connection) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.conn == conn {
+		d.conn, d.handler = nil, nil
+	}
+}
+
+// Delivers the backlog one by one to the attached client, until either it is
+// emptied or the client detaches.
+func (d *durable) flush() {
+	for {
+		d.lock.Lock()
+		if d.conn == nil || len(d.backlog) == 0 {
+			d.flushing = false
+			d.lock.Unlock()
+			return
+		}
+		event, handler := d.backlog[0], d.handler
+		d.backlog = d.backlog[1:]
+		d.size -= len(event.msg)
+		d.lock.Unlock()
+
+		deliverEvent(handler, event.origin, event.seq, event.msg)
+	}
+}
+
+// Delivers an arriving event to the attached client, or buffers it if detached
+// (or still flushing the backlog, to retain ordering).
+func (d *durable) handlePublish(origin Member, seq uint64, msg []byte) {
+	d.lock.Lock()
+	if d.conn == nil || d.flushing {
+		d.buffer(&buffered{origin: origin, seq: seq, msg: msg, stamp: time.Now()})
+		d.lock.Unlock()
+		return
+	}
+	conn, handler := d.conn, d.handler
+	d.lock.Unlock()
+
+	task := func() { deliverEvent(handler, origin, seq, msg) }
+	if seq != 0 {
+		conn.scheduleOrdered(d.name, origin, task)
+	} else {
+		conn.workers.Schedule(task)
+	}
+}
+
+// Appends an event to the backlog, enforcing the size limit according to the
+// overflow policy. The lock is assumed held.
+func (d *durable) buffer(event *buffered) {
+	d.expire()
+
+	if len(event.msg) > config.IrisDurableBuffer {
+		return
+	}
+	for d.size+len(event.msg) > config.IrisDurableBuffer {
+		if d.overflow == DropNewest {
+			return
+		}
+		d.size -= len(d.backlog[0].msg)
+		d.backlog = d.backlog[1:]
+	}
+	d.backlog = append(d.backlog, event)
+	d.size += len(event.msg)
+}
+
+// Drops the events from the backlog older than the age limit. The lock is assumed
+// held.
+func (d *durable) expire() {
+	limit := time.Now().Add(-config.IrisDurableAge)
+	for len(d.backlog) > 0 && d.backlog[0].stamp.Before(limit) {
+		d.size -= len(d.backlog[0].msg)
+		d.backlog = d.backlog[1:]
+	}
+}
@@ -0,0 +1,155 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Individual durable subscription tests.
+func TestDurableSingleNode(t *testing.T) {
+	testDurable(t, 1)
+}
+
+func TestDurableMultiNode(t *testing.T) {
+	testDurable(t, 5)
+}
+
+// Tests that durable subscriptions buffer events while detached and deliver the
+// backlog on reattach, honoring the overflow policies.
+func testDurable(t *testing.T, nodes int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	oldBuffer := config.IrisDurableBuffer
+	config.IrisDurableBuffer = 3
+	defer func() { config.IrisDurableBuffer = oldBuffer }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "durable-test"
+	cluster := fmt.Sprintf("durable-test-%d", nodes)
+	topic := fmt.Sprintf("durable-test-topic-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Set up a publisher and two durable subscriptions on the last node
+	pub, err := liveNodes[0].Connect(cluster, nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer pub.Close()
+
+	node := liveNodes[nodes-1]
+	policies := []Overflow{DropOldest, DropNewest}
+	for i, policy := range policies {
+		conn, err := node.Connect(cluster, nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		hand := &subscriber{make(chan []byte, 10)}
+		if err := conn.SubscribeDurable(fmt.Sprintf("durable-%d", i), topic, policy, hand); err != nil {
+			t.Fatalf("policy %d: failed to subscribe durably: %v.", i, err)
+		}
+		if err := conn.SubscribeDurable(fmt.Sprintf("durable-%d", i), topic, policy, hand); err != ErrSubscribed {
+			t.Fatalf("policy %d: double subscription error mismatch: have %v, want %v.", i, err, ErrSubscribed)
+		}
+		if err := conn.SubscribeDurable(fmt.Sprintf("durable-%d", i), topic+"-other", policy, hand); err != ErrDurableMismatch {
+			t.Fatalf("policy %d: topic mismatch error mismatch: have %v, want %v.", i, err, ErrDurableMismatch)
+		}
+		conn.Close()
+	}
+	// Make sure there is a little time to propagate state and reports
+	if nodes > 1 {
+		time.Sleep(3 * time.Second)
+	} else {
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Publish more events than the detached buffers can hold
+	for i := 0; i < 5; i++ {
+		if err := pub.Publish(topic, []byte{byte(i)}); err != nil {
+			t.Fatalf("event %d: failed to publish: %v.", i, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Reattach to the subscriptions and verify the backlogs, then the live events
+	backlogs := [][]byte{{2, 3, 4}, {0, 1, 2}}
+	hands := make([]*subscriber, len(policies))
+	for i, policy := range policies {
+		conn, err := node.Connect(cluster, nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+
+		hands[i] = &subscriber{make(chan []byte, 10)}
+		if err := conn.SubscribeDurable(fmt.Sprintf("durable-%d", i), topic, policy, hands[i]); err != nil {
+			t.Fatalf("policy %d: failed to reattach: %v.", i, err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		if err := pub.Publish(topic, []byte{byte(5 + i)}); err != nil {
+			t.Fatalf("event %d: failed to publish: %v.", 5+i, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, hand := range hands {
+		want := append(backlogs[i], 5, 6, 7, 8, 9)
+		have := []byte{}
+		for j := 0; j < len(want); j++ {
+			select {
+			case msg := <-hand.msgs:
+				have = append(have, msg...)
+			case <-time.After(time.Second):
+				t.Fatalf("policy %d: event %d timed out.", i, j)
+			}
+		}
+		// The backlog must arrive first, in order, live events may be reordered
+		if !bytes.Equal(have[:len(backlogs[i])], backlogs[i]) {
+			t.Fatalf("policy %d: backlog mismatch: have %v, want %v.", i, have, want)
+		}
+	}
+}
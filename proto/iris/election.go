@@ -0,0 +1,150 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the leader elections within application clusters, delegating to the
+// elections of the scribe layer: the node owning the election id keeps the
+// candidates in campaign order and confirms the first one as the leader. Leaders
+// that die (or stop refreshing their campaigns) are replaced by the next in line.
+
+package iris
+
+import (
+	"errors"
+)
+
+// Prefix of the scribe elections backing the cluster leader elections.
+const electionPrefix = "e#-"
+
+// Leader election specific errors
+var ErrCampaigning = errors.New("already campaigning")
+
+// Leadership won by a connection in a cluster election.
+type Leadership struct {
+	Lost <-chan struct{} // Closed when the leadership is lost or resigned
+
+	election string        // Scribe election the leadership was won in
+	term     uint64        // Term of the leadership (increases with each leader change)
+	won      bool          // Whether the campaign was already won
+	elected  chan struct{} // Closed when the campaign is won
+	lost     chan struct{} // Closed when the campaign ends
+	conn     *Connection   // Connection holding the leadership
+}
+
+// Campaigns for the leadership of the named election within cluster, blocking
+// until elected or the connection is closed. At most one of the campaigning
+// connections is the leader at any time, as long as the overlay is not split.
+// Once lost, the leadership is not regained automatically: a new campaign has to
+// be started.
+func (c *Connection) Campaign(cluster string, name string) (*Leadership, error) {
+	election := electionPrefix + cluster + "/" + name
+
+	// Make sure there are no double campaigns and not closing
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return nil, ErrTerminating
+	default:
+		if _, ok := c.eleLive[election]; ok {
+			c.subLock.Unlock()
+			return nil, ErrCampaigning
+		}
+	}
+	lead := &Leadership{
+		election: election,
+		elected:  make(chan struct{}),
+		lost:     make(chan struct{}),
+		conn:     c,
+	}
+	lead.Lost = lead.lost
+	c.eleLive[election] = lead
+	c.subLock.Unlock()
+
+	// Enter the election and wait for the outcome
+	c.iris.scribe.Campaign(election, c.id)
+	select {
+	case <-lead.elected:
+		return lead, nil
+	case <-lead.lost:
+		return nil, ErrTerminating
+	case <-c.term:
+		lead.Resign()
+		return nil, ErrTerminating
+	}
+}
+
+// Returns the term of the leadership, strictly increasing with each new leader of
+// the election (while the election owner survives).
+func (l *Leadership) Term() uint64 {
+	return l.term
+}
+
+// Gives up the leadership, allowing the next candidate to be elected. Resigning
+// an already lost leadership is a no-op.
+func (l *Leadership) Resign() {
+	c := l.conn
+
+	c.subLock.Lock()
+	if c.eleLive[l.election] != l {
+		c.subLock.Unlock()
+		return
+	}
+	delete(c.eleLive, l.election)
+	close(l.lost)
+	c.subLock.Unlock()
+
+	c.iris.scribe.Resign(l.election, c.id)
+}
+
+// Implements proto.scribe.Callback.HandleLeadership. Passes the leadership change
+// to the campaigning connection.
+func (o *Overlay) HandleLeadership(election string, member uint64, leader bool, term uint64) {
+	o.lock.RLock()
+	conn, ok := o.conns[member]
+	o.lock.RUnlock()
+
+	if ok {
+		conn.handleLeadership(election, leader, term)
+	}
+}
+
+// Signals a campaign of winning the election, or a leader of losing it, in which
+// case the campaign is ended.
+func (c *Connection) handleLeadership(election string, leader bool, term uint64) {
+	c.subLock.Lock()
+	lead, ok := c.eleLive[election]
+	if !ok {
+		c.subLock.Unlock()
+		return
+	}
+	switch {
+	case leader && !lead.won:
+		lead.won, lead.term = true, term
+		close(lead.elected)
+		c.subLock.Unlock()
+	case !leader && lead.won:
+		delete(c.eleLive, election)
+		close(lead.lost)
+		c.subLock.Unlock()
+
+		c.iris.scribe.Resign(election, c.id)
+	default:
+		c.subLock.Unlock()
+	}
+}
@@ -0,0 +1,126 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Result of a leader election campaign.
+type outcome struct {
+	idx  int
+	lead *Leadership
+	err  error
+}
+
+// Tests that exactly one campaigning connection leads at any time, and that the
+// leadership passes on when the leader resigns or its node dies.
+func TestElection(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "election-test"
+	cluster := "election-test"
+
+	// Boot the iris overlays and connect to each
+	liveNodes := make([]*Overlay, nodes)
+	liveConns := make([]*Connection, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		conn, err := liveNodes[i].Connect(cluster, &broadcaster{make(chan []byte, 16)})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		liveConns[i] = conn
+	}
+	// Make sure there is a little time to propagate state and reports
+	time.Sleep(3 * time.Second)
+
+	// Campaign from every connection concurrently
+	outcomes := make(chan *outcome, nodes)
+	for i, conn := range liveConns {
+		go func(idx int, conn *Connection) {
+			lead, err := conn.Campaign(cluster, "master")
+			outcomes <- &outcome{idx, lead, err}
+		}(i, conn)
+	}
+	// Elect a leader, make it resign, and kill the node of the next one
+	var dead int
+	var term uint64
+	for round := 0; round < 3; round++ {
+		var won *outcome
+		select {
+		case won = <-outcomes:
+			if won.err != nil {
+				t.Fatalf("round %d: campaign failed: %v.", round, won.err)
+			}
+			if won.lead.Term() <= term {
+				t.Fatalf("round %d: term not increasing: have %v, want > %v.", round, won.lead.Term(), term)
+			}
+			term = won.lead.Term()
+		case <-time.After(3 * time.Second):
+			t.Fatalf("round %d: no leader elected.", round)
+		}
+		// Make sure nobody else is leading
+		select {
+		case other := <-outcomes:
+			t.Fatalf("round %d: multiple leaders: %v and %v.", round, won.idx, other.idx)
+		case <-time.After(500 * time.Millisecond):
+		}
+		switch round {
+		case 0:
+			won.lead.Resign()
+			select {
+			case <-won.lead.Lost:
+			default:
+				t.Fatalf("resigned leadership not marked lost.")
+			}
+		case 1:
+			dead = won.idx
+			if err := liveNodes[dead].Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}
+	}
+	// Tear down the remaining nodes, cancelling the pending campaigns
+	for i := 0; i < nodes; i++ {
+		if i != dead {
+			liveConns[i].Close()
+			if err := liveNodes[i].Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}
+	}
+}
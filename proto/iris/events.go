@@ -22,11 +22,15 @@
 package iris
 
 import (
+	"encoding/binary"
 	"log"
 	"math/big"
 	"math/rand"
+	"strings"
 	"time"
 
+	"github.com/karalabe/iris/balancer"
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
 )
 
@@ -35,6 +39,14 @@ import (
 func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
 
+	// Wildcard anchor announcements are handled by the overlay itself
+	if topic == anchorTopic {
+		if head.Op == opAnch {
+			o.handleAnchors(src, head.AnchList, head.AnchGone, head.AnchQuery)
+		}
+		return
+	}
+
 	// Fetch the message recipients
 	o.lock.RLock()
 	subs, ok := o.subLive[topic]
@@ -43,12 +55,34 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 		log.Printf("iris: non-existent topic: %v.", topic)
 		return
 	}
-	conns := make([]*Connection, len(subs))
-	for i, id := range subs {
-		conns[i] = o.conns[id]
+	conns := make([]*Connection, 0, len(subs))
+	durs := []*durable{}
+	for _, id := range subs {
+		if conn, ok := o.conns[id]; ok {
+			conns = append(conns, conn)
+		} else if dur, ok := o.durIds[id]; ok {
+			durs = append(durs, dur)
+		}
 	}
 	o.lock.RUnlock()
 
+	// Reassemble chunked events, passing them on only when complete
+	if head.ChunkNum > 0 {
+		data, done := o.reassemble(src, head, msg.Data)
+		if !done {
+			return
+		}
+		msg.Data = data
+	}
+
+	// Pass events to the durable subscriptions, buffering if detached
+	if head.Op == opPub {
+		origin := Member{Node: src, Conn: head.Src}
+		for _, dur := range durs {
+			dur.handlePublish(origin, head.PubSeq, msg.Data)
+		}
+	}
+
 	// Publish to every live subscription
 	for i := 0; i < len(conns); i++ {
 		conn := conns[i] // Closure
@@ -56,7 +90,15 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 		case opBcast:
 			conn.workers.Schedule(func() { conn.handleBroadcast(msg.Data) })
 		case opPub:
-			conn.workers.Schedule(func() { conn.handlePublish(topic, msg.Data) })
+			origin := Member{Node: src, Conn: head.Src}
+			task := func() { conn.handlePublish(topic, head.PubTopic, head.PubHeaders, origin, head.PubSeq, msg.Data) }
+			if head.PubSeq != 0 {
+				conn.scheduleOrdered(topic, origin, task)
+			} else {
+				conn.workers.Schedule(task)
+			}
+		case opPres:
+			conn.workers.Schedule(func() { conn.handlePresence(topic, head.PresJoin, head.PresNode, head.PresConn) })
 		default:
 			log.Printf("iris: invalid publish opcode: %v.", head.Op)
 		}
@@ -68,23 +110,45 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
 
-	// Fetch the possible message recipients and pick one at random
+	// Fetch the possible message recipients and pick one (keyed or at random)
 	o.lock.RLock()
 	subs, ok := o.subLive[topic]
 	if !ok {
 		o.lock.RUnlock()
 		log.Printf("iris: non-existent topic: %v.", topic)
+		o.bounceMessage(src, head, NoSubscribers, msg.Data)
 		return
 	}
-	conn := o.conns[subs[rand.Intn(len(subs))]]
+	var conn *Connection
+	switch {
+	case head.ReqKey != nil:
+		conn = o.conns[pickByKey(head.ReqKey, subs)]
+	case len(head.ReqAvoid) > 0 && len(subs) > 1:
+		conn = o.conns[pickAvoiding(head.ReqAvoid, subs)]
+	default:
+		conn = o.conns[subs[rand.Intn(len(subs))]]
+	}
 	o.lock.RUnlock()
 
 	// Balance to the chose one
 	switch head.Op {
 	case opReq:
-		conn.workers.Schedule(func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime) })
+		if head.ReqAck {
+			conn.iris.scribe.Direct(src, conn.assembleAck(head.Src, head.ReqId))
+		}
+		// First chunk of a large request, pull the rest directly to the chosen member
+		if head.ChunkNum > 0 {
+			o.reassemble(src, head, msg.Data)
+			conn.iris.scribe.Direct(src, conn.assemblePull(head.Src, head.ChunkId))
+			return
+		}
+		conn.workers.Schedule(func() { conn.handleRequest(src, head.Src, head.ReqId, head.ReqToken, msg.Data, head.ReqTime) })
+	case opMemb:
+		conn.workers.Schedule(func() { conn.handleMembersQuery(src, head.Src, head.ReqId, topic) })
 	case opTun:
-		conn.workers.Schedule(func() { conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime) })
+		conn.workers.Schedule(func() {
+			conn.handleTunnelRequest(src, head.Src, head.TunClust, head.TunId, head.TunKey, head.TunAddrs, head.TunTime)
+		})
 	default:
 		log.Printf("iris: invalid balance opcode: %v.", head.Op)
 	}
@@ -95,67 +159,209 @@ func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message)
 func (o *Overlay) HandleDirect(src *big.Int, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
 
+	// Payloads are handed to the application, recycle only pure control messages
+	switch head.Op {
+	case opAck, opRelay, opRAck, opPull:
+		defer msg.Release()
+	default:
+		msg.Detach()
+	}
+
+	// Reassemble chunked messages, passing them on only when complete
+	if head.ChunkNum > 0 {
+		data, done := o.reassemble(src, head, msg.Data)
+		if !done {
+			return
+		}
+		msg.Data = data
+	}
+
 	// Fetch the intended recipient
 	o.lock.RLock()
 	conn, ok := o.conns[head.Dest]
 	o.lock.RUnlock()
 	if !ok {
 		log.Printf("iris: non-existent direct recipient: %v", head.Dest)
+		if head.Op == opRep {
+			o.bounceMessage(src, head, NoRecipient, msg.Data)
+		}
 		return
 	}
 	// Pass the message to the connection to handle
 	switch head.Op {
+	case opReq:
+		// Only large requests are completed directly, after pulling their chunks
+		conn.workers.Schedule(func() { conn.handleRequest(src, head.Src, head.ReqId, head.ReqToken, msg.Data, head.ReqTime) })
 	case opRep:
 		conn.workers.Schedule(func() { conn.handleReply(head.ReqId, msg.Data) })
+	case opAck:
+		conn.workers.Schedule(func() { conn.handleAck(src, head.Src, head.ReqId) })
+	case opDead:
+		conn.workers.Schedule(func() { conn.handleDeadLetter(head.DeadOp, head.DeadReason, head.PubTopic, msg.Data) })
+	case opRelay:
+		conn.workers.Schedule(func() { conn.handleRelaySetup(src, head.Src, head.TunId, head.TunPeer) })
+	case opFrame:
+		// Relayed frames are reordered by the relay, no need to schedule
+		conn.handleRelayData(head.TunId, head.TunSeq, head.TunCtrl, head.TunKey, head.TunIv, head.TunSize, msg.Data)
+	case opRAck:
+		conn.handleRelayAck(head.TunId, head.TunSeq)
+	case opPull:
+		conn.workers.Schedule(func() { conn.handlePull(src, head.Src, head.ChunkId) })
 	default:
 		log.Printf("iris: invalid direct opcode: %v.", head.Op)
 	}
 }
 
+// Implements proto.scribe.Callback.Load. Aggregates the handler queue depths and
+// latencies of the local connections subscribed to an application group. Plain
+// topics are not balanced, so no load is reported for them.
+func (o *Overlay) Load(topic string) *balancer.Load {
+	if !strings.HasPrefix(topic, clusterPrefixTag) {
+		return nil
+	}
+	// Fetch the local members of the application group
+	o.lock.RLock()
+	subs, ok := o.subLive[topic]
+	if !ok {
+		o.lock.RUnlock()
+		return nil
+	}
+	conns := make([]*Connection, 0, len(subs))
+	for _, id := range subs {
+		if conn, ok := o.conns[id]; ok {
+			conns = append(conns, conn)
+		}
+	}
+	o.lock.RUnlock()
+
+	// Sum up the capacities and queues, average the latencies
+	load := new(balancer.Load)
+	for _, conn := range conns {
+		pend, lat := conn.workers.Stats()
+
+		// Capacity is the number of tasks processable in a beat minus the backlog
+		if lat < time.Millisecond {
+			lat = time.Millisecond
+		}
+		cap := int(int64(config.IrisHandlerThreads)*int64(config.ScribeBeatPeriod)/int64(lat)) - pend
+		if cap < 1 {
+			cap = 1
+		}
+		load.Cap += cap
+		load.Pend += pend
+		load.Lat += lat
+	}
+	load.Members = len(conns)
+	if len(conns) > 0 {
+		load.Lat /= time.Duration(len(conns))
+	}
+	return load
+}
+
+// Selects the connection id which should handle a keyed request, consistently
+// hashing the key onto the live subscriptions (rendezvous hashing).
+func pickByKey(key []byte, subs []uint64) uint64 {
+	var best, score uint64
+	buf := make([]byte, 8)
+	for i, id := range subs {
+		binary.BigEndian.PutUint64(buf, id)
+		if s := balancer.Score(key, buf); i == 0 || s > score {
+			best, score = id, s
+		}
+	}
+	return best
+}
+
+// Selects a connection id at random from the live subscriptions, other than the
+// ones to be avoided. If all of them are to be avoided, any one is picked.
+func pickAvoiding(avoid []uint64, subs []uint64) uint64 {
+	allowed := make([]uint64, 0, len(subs))
+	for _, sub := range subs {
+		skip := false
+		for _, id := range avoid {
+			if sub == id {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			allowed = append(allowed, sub)
+		}
+	}
+	if len(allowed) == 0 {
+		allowed = subs
+	}
+	return allowed[rand.Intn(len(allowed))]
+}
+
 // Passes the broadcast message up to the application handler.
 func (c *Connection) handleBroadcast(msg []byte) {
 	c.handler.HandleBroadcast(msg)
 }
 
 // Passes the request up to the application handler, also specifying the timeout
-// under which the reply must be sent back. Only a non-nil reply is forwarded to
-// the requester.
-func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, msg []byte, timeout time.Duration) {
-	if rep := c.handler.HandleRequest(msg, timeout); rep != nil {
-		c.iris.scribe.Direct(srcNode, c.assembleReply(srcConn, reqId, rep))
+// under which the reply must be sent back. Requests carrying an idempotency token
+// are passed to token aware handlers if available. Only a non-nil reply is
+// forwarded to the requester.
+func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, token []byte, msg []byte, timeout time.Duration) {
+	var rep []byte
+	if handler, ok := c.handler.(TokenHandler); ok && token != nil {
+		rep = handler.HandleTokenRequest(token, msg, timeout)
+	} else {
+		rep = c.handler.HandleRequest(msg, timeout)
+	}
+	if rep != nil {
+		if err := c.checkSize("", len(rep)); err != nil {
+			log.Printf("iris: failed to send reply: %v.", err)
+			return
+		}
+		c.sendChunked(c.assembleReply(srcConn, reqId, rep), func(part *proto.Message) error {
+			return c.iris.scribe.Direct(srcNode, part)
+		})
 	}
 }
 
 // Looks up the result channel for the pending request and inserts the reply. If
-// the channel doesn't exist any more the reply is silently dropped.
+// the channel doesn't exist any more, or a reply was already inserted (retried
+// or hedged requests), the reply is silently dropped.
 func (c *Connection) handleReply(reqId uint64, rep []byte) {
 	c.reqLock.RLock()
 	defer c.reqLock.RUnlock()
 
 	// Make sure the request is still alive and don't block if dying
 	if ch, ok := c.reqPend[reqId]; ok {
-		ch <- rep
+		select {
+		case ch <- rep:
+		default:
+		}
 	}
 }
 
 // Delivers a topic event to a subscribed handler. If the subscription does not
-// exist the message is silently dropped.
-func (c *Connection) handlePublish(topic string, msg []byte) {
-	// Fetch the handler
+// exist or its content filter rejects the headers, the message is silently
+// dropped.
+func (c *Connection) handlePublish(topic string, event string, headers map[string]string, origin Member, seq uint64, msg []byte) {
+	// Wildcard events are matched against the patterns of the anchor
+	if strings.HasPrefix(topic, wildcardPrefixTag) {
+		c.handleWildcard(topic[strings.Index(topic, "-")+1:], event, headers, origin, seq, msg)
+		return
+	}
+	// Fetch the handler and filter
 	c.subLock.RLock()
 	handler, ok := c.subLive[topic]
+	flt, filtered := c.subFilt[topic]
 	c.subLock.RUnlock()
 
 	// Deliver the event
-	if ok {
-		handler.HandleEvent(msg)
+	if ok && (!filtered || flt.Match(headers)) {
+		deliverEvent(handler, origin, seq, msg)
 	}
 }
 
 // Accepts the inbound tunnel, notifies the remote endpoint of the success and
 // starts the local handler.
-func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, addrs []string, timeout time.Duration) {
-	if tun, err := c.buildTunnel(conn, id, key, addrs, timeout); err != nil {
+func (c *Connection) handleTunnelRequest(node *big.Int, conn uint64, cluster string, id uint64, key []byte, addrs []string, timeout time.Duration) {
+	if tun, err := c.buildTunnel(node, conn, cluster, id, key, addrs, timeout); err != nil {
 		log.Printf("iris: failed to accept tunnel: %v.", err)
 	} else {
 		c.handler.HandleTunnel(tun)
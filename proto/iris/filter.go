@@ -0,0 +1,136 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the content based subscriptions: events published with key/value
+// headers and subscriptions filtering them. The filters of the local subscribers
+// are summarized to scribe, which propagates them up the topic trees so that
+// events are only forwarded into subtrees with potentially matching subscribers.
+
+package iris
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/filter"
+	"github.com/karalabe/iris/proto"
+)
+
+// Subscribes to topic (or wildcard pattern), delivering to handler only the
+// events whose headers match the filter expression. An error is returned if the
+// expression is invalid or if subscription fails.
+func (c *Connection) SubscribeFilter(topic string, expr string, handler SubscriptionHandler) error {
+	flt, err := filter.Parse(expr)
+	if err != nil {
+		return err
+	}
+	return c.subscribe(topic, flt, handler)
+}
+
+// Publishes an event asynchronously to topic, attaching the given headers for
+// the subscription filters to evaluate. No guarantees are made that all matching
+// subscribers receive the message.
+func (c *Connection) PublishHeaders(topic string, headers map[string]string, msg []byte) error {
+	if isPattern(topic) {
+		return ErrInvalidTopic
+	}
+	if err := c.checkSize("", len(msg)); err != nil {
+		return err
+	}
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	anchors := c.iris.liveAnchors(topic)
+	publish := func(topic string, part *proto.Message) error {
+		return c.iris.scribe.PublishHeaders(topic, headers, part)
+	}
+	if err := c.publishWildcard(prefixIdx, anchors, topic, headers, 0, msg, publish); err != nil {
+		return err
+	}
+	return c.sendChunked(c.assemblePublish(topic, headers, 0, len(anchors) == 0, msg), func(part *proto.Message) error {
+		return publish(topicPrefixes[prefixIdx]+topic, part)
+	})
+}
+
+// Implements proto.scribe.Callback.Filter. Merges the content filters of the
+// local connections subscribed to a topic. Application groups and presence
+// topics are never filtered.
+func (o *Overlay) Filter(topic string) filter.Summary {
+	topics := strings.HasPrefix(topic, topicPrefixTag)
+	wilds := strings.HasPrefix(topic, wildcardPrefixTag)
+	if !topics && !wilds {
+		return filter.All()
+	}
+	// Fetch the local subscribers of the topic
+	o.lock.RLock()
+	subs, ok := o.subLive[topic]
+	if !ok {
+		o.lock.RUnlock()
+		return filter.All()
+	}
+	conns := make([]*Connection, 0, len(subs))
+	for _, id := range subs {
+		if conn, ok := o.conns[id]; ok {
+			conns = append(conns, conn)
+		} else if _, ok := o.durIds[id]; ok {
+			// Durable subscriptions are unfiltered
+			o.lock.RUnlock()
+			return filter.All()
+		}
+	}
+	o.lock.RUnlock()
+
+	// Merge the filters of all the subscriptions
+	sum := filter.Summary{}
+	for _, conn := range conns {
+		var flts []*filter.Filter
+		if topics {
+			flts = conn.topicFilters(topic)
+		} else {
+			flts = conn.wildcardFilters(topic[strings.Index(topic, "-")+1:])
+		}
+		for _, flt := range flts {
+			if flt == nil {
+				return filter.All()
+			}
+			sum = sum.Merge(filter.Summary{Filters: []*filter.Filter{flt}}, config.ScribeFilterLimit)
+		}
+	}
+	return sum
+}
+
+// Returns the content filter of a topic subscription (nil if unfiltered).
+func (c *Connection) topicFilters(topic string) []*filter.Filter {
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+
+	return []*filter.Filter{c.subFilt[topic]}
+}
+
+// Returns the content filters of all the wildcard subscriptions within an anchor
+// (nil entries for unfiltered ones).
+func (c *Connection) wildcardFilters(anchor string) []*filter.Filter {
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+
+	flts := make([]*filter.Filter, 0, len(c.wildLive[anchor]))
+	for pattern, _ := range c.wildLive[anchor] {
+		flts = append(flts, c.wildFilt[pattern])
+	}
+	return flts
+}
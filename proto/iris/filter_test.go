@@ -0,0 +1,124 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Individual filtered pubsub tests.
+func TestFilterSingleNode(t *testing.T) {
+	testFilter(t, 1)
+}
+
+func TestFilterMultiNode(t *testing.T) {
+	testFilter(t, 5)
+}
+
+// Tests that filtered subscriptions receive only the matching events.
+func testFilter(t *testing.T, nodes int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "filter-test"
+	cluster := fmt.Sprintf("filter-test-%d", nodes)
+	topic := fmt.Sprintf("filter-test-topic-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Subscribe with a few filters on each node
+	filters := []string{`region == "eu"`, `region == "eu" && priority > 3`, `priority <= 3`}
+	expects := []int{2, 1, 2}
+
+	liveHands := make([][]*subscriber, nodes)
+	for i, node := range liveNodes {
+		liveHands[i] = make([]*subscriber, len(filters))
+		for j, expr := range filters {
+			conn, err := node.Connect(cluster, nil)
+			if err != nil {
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			defer conn.Close()
+
+			liveHands[i][j] = &subscriber{make(chan []byte, 16)}
+			if err := conn.SubscribeFilter(topic, expr, liveHands[i][j]); err != nil {
+				t.Fatalf("failed to subscribe with filter %v: %v.", expr, err)
+			}
+		}
+	}
+	// Make sure there is a little time to propagate the filter summaries
+	time.Sleep(3 * time.Second)
+
+	// Publish a few events with various headers from the first node
+	conn, err := liveNodes[0].Connect(cluster, nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SubscribeFilter(topic, `region ==`, &subscriber{}); err == nil {
+		t.Fatalf("invalid filter accepted.")
+	}
+	events := []map[string]string{
+		{"region": "eu", "priority": "5"},
+		{"region": "eu", "priority": "1"},
+		{"region": "us", "priority": "2"},
+		{"region": "us", "priority": "9"},
+		nil,
+	}
+	for i, headers := range events {
+		if err := conn.PublishHeaders(topic, headers, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish event %d: %v.", i, err)
+		}
+	}
+	// Verify the number of events received by each subscription
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < nodes; i++ {
+		for j, expr := range filters {
+			if n := len(liveHands[i][j].msgs); n != expects[j] {
+				t.Fatalf("node %d, %v: event count mismatch: have %v, want %v.", i, expr, n, expects[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the distributed locks, delegating to the leased locks of the scribe
+// layer: the node owning the lock id hands out the leases along with strictly
+// increasing fencing tokens, and mirrors the lock to its closest leaf. Leases are
+// released when unlocked, when their time-to-live passes, or when the holding
+// connection closes or its node dies.
+
+package iris
+
+import (
+	"errors"
+	"time"
+
+	"github.com/karalabe/iris/proto/scribe"
+)
+
+// Prefix of the scribe locks backing the distributed locks.
+const lockPrefix = "l#-"
+
+// Distributed lock specific errors
+var ErrLocked = errors.New("already locked")
+var ErrNotLocked = errors.New("not locked")
+
+// Lease held by a connection on a distributed lock.
+type lease struct {
+	token uint64    // Fencing token of the lease (0 while acquiring)
+	until time.Time // Expiry of the lease (lower estimate)
+}
+
+// Acquires a lease on the named lock, blocking until granted or the timeout
+// expires. The lease lasts until unlocked, until ttl passes, or until the
+// connection or its node dies. The returned fencing token is larger than any
+// handed out for the lock before, allowing protected resources to reject stale
+// holders.
+func (c *Connection) Lock(name string, ttl time.Duration, timeout time.Duration) (uint64, error) {
+	// Make sure the lock is not held already and not closing
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return 0, ErrTerminating
+	default:
+		if l, ok := c.lockLive[name]; ok && (l.token == 0 || time.Now().Before(l.until)) {
+			c.subLock.Unlock()
+			return 0, ErrLocked
+		}
+	}
+	l := &lease{until: time.Now().Add(ttl)}
+	c.lockLive[name] = l
+	c.subLock.Unlock()
+
+	// Acquire the lease through the carrier
+	token, err := c.iris.scribe.Lock(lockPrefix+name, c.id, ttl, timeout)
+
+	c.subLock.Lock()
+	if err != nil {
+		delete(c.lockLive, name)
+		c.subLock.Unlock()
+		if err == scribe.ErrLockTimeout {
+			return 0, ErrTimeout
+		}
+		return 0, err
+	}
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		c.iris.scribe.Unlock(lockPrefix+name, c.id, token)
+		return 0, ErrTerminating
+	default:
+		l.token = token
+		c.subLock.Unlock()
+	}
+	return token, nil
+}
+
+// Releases the lease held on the named lock. Leases which already expired are
+// released silently.
+func (c *Connection) Unlock(name string) error {
+	c.subLock.Lock()
+	l, ok := c.lockLive[name]
+	if !ok || l.token == 0 {
+		c.subLock.Unlock()
+		return ErrNotLocked
+	}
+	delete(c.lockLive, name)
+	c.subLock.Unlock()
+
+	c.iris.scribe.Unlock(lockPrefix+name, c.id, l.token)
+	return nil
+}
@@ -0,0 +1,142 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package iris
+
+import (
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Tests that locks are mutually exclusive with increasing fencing tokens, and
+// that leases end on unlock, expiry, connection close and node death.
+func TestLock(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes, rounds := 5, 10
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "lock-test"
+	cluster := "lock-test"
+
+	// Boot the iris overlays and connect to each
+	liveNodes := make([]*Overlay, nodes)
+	liveConns := make([]*Connection, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		conn, err := liveNodes[i].Connect(cluster, &broadcaster{make(chan []byte, 16)})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		liveConns[i] = conn
+	}
+	// Make sure there is a little time to propagate state and reports
+	time.Sleep(3 * time.Second)
+
+	// Contend for a lock from every connection, verifying exclusion and tokens
+	var lock sync.Mutex
+	var holders int
+	var last uint64
+
+	var pend sync.WaitGroup
+	errc := make(chan error, nodes*rounds)
+	for _, conn := range liveConns {
+		pend.Add(1)
+		go func(conn *Connection) {
+			defer pend.Done()
+			for i := 0; i < rounds; i++ {
+				token, err := conn.Lock("mutex", time.Minute, 10*time.Second)
+				if err != nil {
+					errc <- err
+					return
+				}
+				lock.Lock()
+				holders++
+				if holders != 1 || token <= last {
+					errc <- ErrLocked
+				}
+				last = token
+				lock.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				lock.Lock()
+				holders--
+				lock.Unlock()
+
+				if err := conn.Unlock("mutex"); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(conn)
+	}
+	pend.Wait()
+	if len(errc) > 0 {
+		t.Fatalf("contended locking failed: %v.", <-errc)
+	}
+	// Verify that leases expire, and get released on close and node death
+	if _, err := liveConns[0].Lock("expire", 500*time.Millisecond, time.Second); err != nil {
+		t.Fatalf("failed to lock expiring lease: %v.", err)
+	}
+	if _, err := liveConns[1].Lock("expire", time.Minute, 250*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("double locking error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if _, err := liveConns[1].Lock("expire", time.Minute, 3*time.Second); err != nil {
+		t.Fatalf("failed to lock expired lease: %v.", err)
+	}
+	if _, err := liveConns[2].Lock("close", time.Minute, time.Second); err != nil {
+		t.Fatalf("failed to lock before close: %v.", err)
+	}
+	liveConns[2].Close()
+	if _, err := liveConns[3].Lock("close", time.Minute, time.Second); err != nil {
+		t.Fatalf("failed to lock closed lease: %v.", err)
+	}
+	if _, err := liveConns[4].Lock("death", time.Minute, time.Second); err != nil {
+		t.Fatalf("failed to lock before death: %v.", err)
+	}
+	if err := liveNodes[4].Shutdown(); err != nil {
+		t.Fatalf("failed to terminate iris node: %v.", err)
+	}
+	if _, err := liveConns[0].Lock("death", time.Minute, 3*time.Second); err != nil {
+		t.Fatalf("failed to lock dead lease: %v.", err)
+	}
+	// Tear down the remaining nodes
+	for i := 0; i < nodes-1; i++ {
+		if i != 2 {
+			liveConns[i].Close()
+		}
+		if err := liveNodes[i].Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}
+}
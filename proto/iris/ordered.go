@@ -0,0 +1,132 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the ordered publish mode. Ordered streams are pinned to a single split
+// of the topic (instead of rotating between them) and carry per connection and
+// topic sequence numbers. Subscribers execute the events of each stream through
+// a serial executor on top of the worker pool, preserving the publishing order.
+
+package iris
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Optional extension of the subscription handler, receiving along with ordered
+// events the identity of their publisher and their sequence number within the
+// publisher's stream, allowing the detection of gaps. Unordered events are still
+// passed to HandleEvent.
+type SequencedHandler interface {
+	// Handles an ordered event published to the subscribed topic.
+	HandleSequencedEvent(publisher Member, seq uint64, msg []byte)
+}
+
+// Serial executor of a single inbound ordered stream.
+type serial struct {
+	tasks []func() // Tasks waiting for execution
+	busy  bool     // Whether the stream is being drained
+}
+
+// Publishes an event to topic as part of the connection's ordered stream: all
+// subscribers will receive the events published this way in the same order, each
+// tagged with its sequence number. No guarantees are made that all subscribers
+// receive the message.
+func (c *Connection) PublishOrdered(topic string, msg []byte) error {
+	if isPattern(topic) {
+		return ErrInvalidTopic
+	}
+	if err := c.checkSize("", len(msg)); err != nil {
+		return err
+	}
+	// Pin the stream to a topic split, consistently hashing the publisher
+	hash := fnv.New32a()
+	hash.Write([]byte(topic))
+	binary.Write(hash, binary.BigEndian, c.id)
+	prefixIdx := int(hash.Sum32() % uint32(config.IrisClusterSplits))
+
+	// Assign the sequence number and send while holding the stream lock
+	c.ordLock.Lock()
+	defer c.ordLock.Unlock()
+
+	seq := c.ordSeqs[topic] + 1
+	c.ordSeqs[topic] = seq
+
+	anchors := c.iris.liveAnchors(topic)
+	if err := c.publishWildcard(prefixIdx, anchors, topic, nil, seq, msg, c.iris.scribe.Publish); err != nil {
+		return err
+	}
+	return c.sendChunked(c.assemblePublish(topic, nil, seq, len(anchors) == 0, msg), func(part *proto.Message) error {
+		return c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, part)
+	})
+}
+
+// Schedules a task of an inbound ordered stream for execution, after all the
+// previously scheduled ones of the same stream finished.
+func (c *Connection) scheduleOrdered(topic string, origin Member, task func()) {
+	stream := fmt.Sprintf("%s/%v/%d", topic, origin.Node, origin.Conn)
+
+	c.execLock.Lock()
+	defer c.execLock.Unlock()
+
+	exec, ok := c.ordExec[stream]
+	if !ok {
+		exec = new(serial)
+		c.ordExec[stream] = exec
+	}
+	exec.tasks = append(exec.tasks, task)
+	if !exec.busy {
+		exec.busy = true
+		c.workers.Schedule(func() { c.drainOrdered(stream, exec) })
+	}
+}
+
+// Executes the tasks of an ordered stream one after the other, dropping the
+// executor when no more are left.
+func (c *Connection) drainOrdered(stream string, exec *serial) {
+	for {
+		c.execLock.Lock()
+		if len(exec.tasks) == 0 {
+			delete(c.ordExec, stream)
+			c.execLock.Unlock()
+			return
+		}
+		task := exec.tasks[0]
+		exec.tasks = exec.tasks[1:]
+		c.execLock.Unlock()
+
+		task()
+	}
+}
+
+// Delivers an event to a subscription handler, passing the stream position too
+// if the event was ordered and the handler is interested.
+func deliverEvent(handler SubscriptionHandler, origin Member, seq uint64, msg []byte) {
+	if seq != 0 {
+		if seqer, ok := handler.(SequencedHandler); ok {
+			seqer.HandleSequencedEvent(origin, seq, msg)
+			return
+		}
+	}
+	handler.HandleEvent(msg)
+}
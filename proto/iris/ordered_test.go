@@ -0,0 +1,145 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Subscription handler verifying the ordering of the sequenced events.
+type sequencer struct {
+	last  map[string]uint64 // Last sequence number seen from each publisher
+	count int               // Number of events received in total
+	fails []string          // Ordering violations detected
+	lock  sync.Mutex
+}
+
+func (s *sequencer) HandleEvent(msg []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.fails = append(s.fails, "unsequenced event")
+}
+
+func (s *sequencer) HandleSequencedEvent(publisher Member, seq uint64, msg []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := fmt.Sprintf("%v/%d", publisher.Node, publisher.Conn)
+	if last := s.last[id]; seq != last+1 {
+		s.fails = append(s.fails, fmt.Sprintf("%v: have %d, want %d", id, seq, last+1))
+	}
+	s.last[id] = seq
+	s.count++
+}
+
+// Individual ordered pubsub tests.
+func TestOrderedSingleNode(t *testing.T) {
+	testOrdered(t, 1, 500)
+}
+
+func TestOrderedMultiNode(t *testing.T) {
+	testOrdered(t, 5, 50)
+}
+
+// Tests that ordered events of each publisher arrive in sequence.
+func testOrdered(t *testing.T, nodes, msgs int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "ordered-test"
+	cluster := fmt.Sprintf("ordered-test-%d", nodes)
+	topic := fmt.Sprintf("ordered-test-topic-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Subscribe to the topic on every node
+	liveConns := make([]*Connection, nodes)
+	liveHands := make([]*sequencer, nodes)
+	for i, node := range liveNodes {
+		conn, err := node.Connect(cluster, nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+
+		liveConns[i] = conn
+		liveHands[i] = &sequencer{last: make(map[string]uint64)}
+		if err := conn.Subscribe(topic, liveHands[i]); err != nil {
+			t.Fatalf("failed to subscribe to the topic: %v.", err)
+		}
+	}
+	if nodes > 1 {
+		time.Sleep(time.Second)
+	}
+	// Publish ordered streams from every node concurrently
+	pend := new(sync.WaitGroup)
+	for i, conn := range liveConns {
+		pend.Add(1)
+		go func(i int, conn *Connection) {
+			defer pend.Done()
+			for j := 0; j < msgs; j++ {
+				if err := conn.PublishOrdered(topic, []byte{byte(i), byte(j)}); err != nil {
+					t.Errorf("node %d: failed to publish event %d: %v.", i, j, err)
+					return
+				}
+			}
+		}(i, conn)
+	}
+	pend.Wait()
+
+	// Verify that every subscriber received every stream in order
+	time.Sleep(500 * time.Millisecond)
+	for i, hand := range liveHands {
+		hand.lock.Lock()
+		if len(hand.fails) > 0 {
+			t.Errorf("node %d: ordering violations: %v.", i, hand.fails)
+		}
+		if hand.count != nodes*msgs {
+			t.Errorf("node %d: event count mismatch: have %v, want %v.", i, hand.count, nodes*msgs)
+		}
+		hand.lock.Unlock()
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/karalabe/iris/proto/scribe"
 )
@@ -41,9 +42,20 @@ type Overlay struct {
 	subLive map[string][]uint64     // Live members of each subscribed topic
 	subLock map[string]sync.RWMutex // Locks protecting the individual topics
 
+	durLive map[string]*durable // Durable subscriptions, by name
+	durIds  map[uint64]*durable // Durable subscriptions, by carrier member id
+	queLive map[string][]uint64 // Local consumers of each work queue
+
 	tunAddrs []string          // Listener addresses for the tunnel endpoints
 	tunQuits []chan chan error // Quit channels for the tunnel acceptors
 
+	chunks    map[string]*partial // Chunked messages being reassembled
+	chunkLock sync.Mutex          // Protects the reassembly state
+
+	anchors  map[string]map[string]time.Time // Wildcard anchors with live subscribers, expiry per announcer
+	anchLock sync.RWMutex                    // Protects the anchor registry
+	anchQuit chan struct{}                   // Quit channel for the anchor announcer
+
 	lock sync.RWMutex // Protects the overlay state
 }
 
@@ -55,6 +67,13 @@ func New(overId string, key *rsa.PrivateKey) *Overlay {
 		conns:   make(map[uint64]*Connection),
 		subLive: make(map[string][]uint64),
 		subLock: make(map[string]sync.RWMutex),
+		durLive: make(map[string]*durable),
+		durIds:  make(map[uint64]*durable),
+		queLive: make(map[string][]uint64),
+		chunks:  make(map[string]*partial),
+		anchors: make(map[string]map[string]time.Time),
+
+		anchQuit: make(chan struct{}),
 	}
 	o.scribe = scribe.New(overId, key, o)
 	return o
@@ -67,6 +86,12 @@ func (o *Overlay) Boot() (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	// Join the wildcard anchor registry and fetch the live anchors
+	if err := o.scribe.Subscribe(anchorTopic); err != nil {
+		return 0, err
+	}
+	go o.announceAnchors(nil, nil, true)
+	go o.anchorBeater()
 	// Start a tunnel acceptor on each network interface
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -94,6 +119,16 @@ func (o *Overlay) Shutdown() error {
 	errs := []error{}
 	errc := make(chan error)
 
+	// Stop announcing the local wildcard anchors, withdraw any left-over ones and
+	// leave the anchor registry
+	close(o.anchQuit)
+	if anchors := o.localAnchors(); len(anchors) > 0 {
+		o.announceAnchors(nil, anchors, false)
+	}
+	if err := o.scribe.Unsubscribe(anchorTopic); err != nil {
+		errs = append(errs, err)
+	}
+
 	// Close the tunnel listeners to prevent new connections
 	for _, quit := range o.tunQuits {
 		quit <- errc
@@ -137,9 +172,14 @@ func (o *Overlay) subscribe(id uint64, topic string) error {
 	}
 	o.lock.Unlock()
 
-	// If a new subscription was requested, do it
+	// If a new subscription was requested, do it (announcing new wildcard anchors)
 	if cascade {
-		return o.scribe.Subscribe(topic)
+		if err := o.scribe.Subscribe(topic); err != nil {
+			return err
+		}
+		if anchor, ok := topicAnchor(topic); ok {
+			o.announceAnchors([]string{anchor}, nil, false)
+		}
 	}
 	return nil
 }
@@ -182,9 +222,14 @@ func (o *Overlay) unsubscribe(id uint64, topic string) error {
 			cascade = true
 		}
 	}
-	// Dump the topic if all subscriptions are gone
+	// Dump the topic if all subscriptions are gone (withdrawing wildcard anchors)
 	if cascade {
-		return o.scribe.Unsubscribe(topic)
+		if err := o.scribe.Unsubscribe(topic); err != nil {
+			return err
+		}
+		if anchor, ok := topicAnchor(topic); ok {
+			o.announceAnchors(nil, []string{anchor}, false)
+		}
 	}
 	return nil
 }
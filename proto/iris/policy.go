@@ -0,0 +1,194 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the request delivery policies: retries on different members after a
+// fraction of the timeout elapses, and hedged copies sent after a percentile of
+// the recent reply latencies.
+
+package iris
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Length of the idempotency tokens attached to policy driven requests.
+const tokenBytes = 16
+
+// Delivery policy of a request, trading extra messages for resilience against
+// dying or slow cluster members. Each repeated copy of a request is sent to a
+// different member than all the ones known to have accepted a previous copy (if
+// possible), and all copies share the same idempotency token.
+type Policy struct {
+	Retries    int     // Number of times to resend an unanswered request
+	RetryAfter float64 // Fraction of the timeout to wait before each retry
+	Hedge      float64 // Reply latency percentile after which to send a hedged copy (0 = disabled)
+}
+
+// Member of a remote cluster which accepted a request.
+type acceptor struct {
+	node *big.Int // Overlay node of the member
+	conn uint64   // Connection id of the member
+}
+
+// Executes a synchronous request to cluster, retrying or hedging it according
+// to policy. Returns the first received reply, or an error if a timeout is
+// reached.
+func (c *Connection) RequestWithPolicy(cluster string, req []byte, timeout time.Duration, policy *Policy) ([]byte, error) {
+	return c.request(cluster, nil, req, timeout, policy)
+}
+
+// Sends out a copy of a policy driven request, avoiding all the members known to
+// have accepted a previous copy.
+func (c *Connection) sendPolicyRequest(cluster string, reqId uint64, token []byte, req []byte, timeout time.Duration) {
+	// Fetch the members to avoid, if any
+	c.reqLock.RLock()
+	accs := c.reqAccs[reqId]
+	nodes := make([]*big.Int, len(accs))
+	conns := make([]uint64, len(accs))
+	for i, acc := range accs {
+		nodes[i], conns[i] = acc.node, acc.conn
+	}
+	c.reqLock.RUnlock()
+	// Send the request copy into the cluster (encryption is done in place)
+	data := make([]byte, len(req))
+	copy(data, req)
+
+	prefixIdx := int(reqId) % config.IrisClusterSplits
+	msg := c.assemblePolicyRequest(reqId, token, conns, data, timeout)
+	c.balanceChunked(msg, timeout, func(part *proto.Message) error {
+		return c.iris.scribe.BalanceBy(clusterPrefixes[prefixIdx]+cluster, c.strategy(cluster), nodes, part)
+	})
+}
+
+// Creates the timer firing when the next retry is due, or nil if none are left.
+func (p *Policy) retryTimer(retries int, timeout time.Duration) <-chan time.Time {
+	if retries <= 0 || p.RetryAfter <= 0 {
+		return nil
+	}
+	return time.After(time.Duration(float64(timeout) * p.RetryAfter))
+}
+
+// Creates the timer firing when a hedged copy is due, or nil if hedging is not
+// requested or not enough latency samples were gathered yet.
+func (p *Policy) hedgeTimer(lats *latencies, timeout time.Duration) <-chan time.Time {
+	if p.Hedge <= 0 {
+		return nil
+	}
+	if after, ok := lats.percentile(p.Hedge); ok && after < timeout {
+		return time.After(after)
+	}
+	return nil
+}
+
+// Records a member which accepted a copy of a policy driven request.
+func (c *Connection) handleAck(node *big.Int, conn uint64, reqId uint64) {
+	c.reqLock.Lock()
+	defer c.reqLock.Unlock()
+
+	// Only track the acceptor if the request is still alive
+	if _, ok := c.reqPend[reqId]; !ok {
+		return
+	}
+	// Skip members already known (e.g. duplicate acks)
+	for _, acc := range c.reqAccs[reqId] {
+		if acc.node.Cmp(node) == 0 && acc.conn == conn {
+			return
+		}
+	}
+	c.reqAccs[reqId] = append(c.reqAccs[reqId], &acceptor{node: node, conn: conn})
+}
+
+// Retrieves the latency tracker of a remote cluster, creating it if needed.
+func (c *Connection) latencies(cluster string) *latencies {
+	c.reqLock.Lock()
+	defer c.reqLock.Unlock()
+
+	lats, ok := c.reqLats[cluster]
+	if !ok {
+		lats = &latencies{samples: make([]time.Duration, 0, config.IrisLatencyWindow)}
+		c.reqLats[cluster] = lats
+	}
+	return lats
+}
+
+// Sliding window of recent reply latencies to estimate percentiles from.
+type latencies struct {
+	samples []time.Duration // Recorded latencies (ring buffer once full)
+	next    int             // Index of the next sample to overwrite
+	lock    sync.Mutex      // Mutex to protect the sample window
+}
+
+// Records a new latency sample, overwriting the oldest if the window is full.
+func (l *latencies) add(lat time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.samples) < cap(l.samples) {
+		l.samples = append(l.samples, lat)
+		return
+	}
+	l.samples[l.next] = lat
+	l.next = (l.next + 1) % len(l.samples)
+}
+
+// Estimates the p-th percentile (0 < p <= 1) of the recorded latencies. False is
+// returned if not enough samples were recorded yet.
+func (l *latencies) percentile(p float64) (time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.samples) == 0 || len(l.samples) < config.IrisLatencyWarmup {
+		return 0, false
+	}
+	sorted := make([]time.Duration, len(l.samples))
+	copy(sorted, l.samples)
+	sort.Sort(durations(sorted))
+
+	idx := int(p*float64(len(sorted))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	} else if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx], true
+}
+
+// Duration slice implementing sort.Interface.
+type durations []time.Duration
+
+// Required for sort.Sort.
+func (d durations) Len() int {
+	return len(d)
+}
+
+// Required for sort.Sort.
+func (d durations) Less(i, j int) bool {
+	return d[i] < d[j]
+}
+
+// Required for sort.Sort.
+func (d durations) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
@@ -0,0 +1,188 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Connection handler for the policy tests, optionally playing dead and tracking
+// the idempotency tokens seen.
+type policyRequester struct {
+	dead   bool                // Whether to drop all requests
+	tokens map[string]struct{} // Idempotency tokens seen
+	lock   sync.Mutex
+}
+
+func (r *policyRequester) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to request handler")
+}
+
+func (r *policyRequester) HandleRequest(req []byte, timeout time.Duration) []byte {
+	panic("Tokenless request passed to policy handler")
+}
+
+func (r *policyRequester) HandleTokenRequest(token []byte, req []byte, timeout time.Duration) []byte {
+	r.lock.Lock()
+	r.tokens[string(token)] = struct{}{}
+	r.lock.Unlock()
+
+	if r.dead {
+		return nil
+	}
+	return req
+}
+
+func (r *policyRequester) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on request handler")
+}
+
+// Individual policy tests.
+func TestPolicyRetrySingleNode(t *testing.T) {
+	testPolicyRetry(t, 1, 2, 1, 3, 100)
+}
+
+func TestPolicyRetryMultiNode(t *testing.T) {
+	testPolicyRetry(t, 3, 1, 1, 3, 100)
+}
+
+func TestPolicyRetryManyDeadSingleNode(t *testing.T) {
+	testPolicyRetry(t, 1, 3, 2, 2, 50)
+}
+
+func TestPolicyRetryManyDeadMultiNode(t *testing.T) {
+	testPolicyRetry(t, 3, 1, 2, 2, 50)
+}
+
+// Tests that retried requests reach live members if some members play dead (ack
+// the requests but never reply). With only as many retries as dead members, all
+// previous acceptors must be avoided for the last copy to reach a live one.
+func testPolicyRetry(t *testing.T, nodes, conns, dead, retries, reqs int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "policy-test"
+	cluster := fmt.Sprintf("policy-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect to all nodes, the very first members playing dead
+	liveHands := []*policyRequester{}
+	liveConns := []*Connection{}
+	for _, node := range liveNodes {
+		for j := 0; j < conns; j++ {
+			hand := &policyRequester{dead: len(liveHands) < dead, tokens: make(map[string]struct{})}
+			conn, err := node.Connect(cluster, hand)
+			if err != nil {
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			liveHands = append(liveHands, hand)
+			liveConns = append(liveConns, conn)
+
+			defer func(conn *Connection) {
+				if err := conn.Close(); err != nil {
+					t.Fatalf("failed to close iris connection: %v.", err)
+				}
+			}(conn)
+		}
+	}
+	// Make sure there is a little time to propagate state and reports
+	if nodes > 1 {
+		time.Sleep(3 * time.Second)
+	}
+	// Issue the requests from a live member and make sure all are answered
+	policy := &Policy{Retries: retries, RetryAfter: 0.2}
+	for i := 0; i < reqs; i++ {
+		orig := []byte{byte(i)}
+		rep, err := liveConns[len(liveConns)-1].RequestWithPolicy(cluster, orig, 2*time.Second, policy)
+		if err != nil {
+			t.Fatalf("request %d: failed to execute: %v.", i, err)
+		} else if !bytes.Equal(orig, rep) {
+			t.Fatalf("request %d: reply mismatch: have %v, want %v.", i, rep, orig)
+		}
+	}
+	// Make sure the dead members were actually tried, and the tokens were retained
+	for _, hand := range liveHands {
+		hand.lock.Lock()
+		defer hand.lock.Unlock()
+	}
+	for i := 0; i < dead; i++ {
+		if len(liveHands[i].tokens) == 0 {
+			t.Fatalf("dead member %d never received any requests.", i)
+		}
+		for token := range liveHands[i].tokens {
+			retried := false
+			for _, hand := range liveHands[dead:] {
+				if _, ok := hand.tokens[token]; ok {
+					retried = true
+				}
+			}
+			if !retried {
+				t.Fatalf("request dropped by dead member %d was not retried with the same token.", i)
+			}
+		}
+	}
+}
+
+// Tests the latency percentile estimation used for hedging.
+func TestPolicyLatencies(t *testing.T) {
+	lats := &latencies{samples: make([]time.Duration, 0, 100)}
+	if _, ok := lats.percentile(0.5); ok {
+		t.Fatalf("percentile reported without samples.")
+	}
+	for i := 1; i <= 200; i++ {
+		lats.add(time.Duration(i) * time.Millisecond)
+	}
+	// The window should only contain the last 100 samples
+	for _, test := range []struct {
+		p   float64
+		lat time.Duration
+	}{{0.01, 101 * time.Millisecond}, {0.5, 150 * time.Millisecond}, {0.95, 195 * time.Millisecond}, {1, 200 * time.Millisecond}} {
+		if lat, ok := lats.percentile(test.p); !ok || lat != test.lat {
+			t.Fatalf("percentile %v mismatch: have %v/%v, want %v.", test.p, lat, ok, test.lat)
+		}
+	}
+}
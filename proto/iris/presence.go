@@ -0,0 +1,184 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the cluster membership queries and the presence events, notifying
+// subscribers of members joining and leaving a cluster.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Prefix of the topics on which cluster presence events are published.
+const presencePrefix = "p#-"
+
+// Identifier of a cluster member.
+type Member struct {
+	Node *big.Int // Overlay node hosting the member
+	Conn uint64   // Connection id of the member (0 if all members of the node)
+}
+
+// Handler receiving the membership changes of a cluster. If a whole node dies,
+// a single leave event is delivered, with a zero connection id.
+type PresenceHandler interface {
+	// Handles a new member joining the cluster.
+	HandleJoin(member Member)
+
+	// Handles a member leaving the cluster.
+	HandleLeave(member Member)
+}
+
+// Retrieves the approximate number of members in cluster. Only a count is
+// returned, not the membership itself: it is gathered from the load reports of
+// the cluster's first split topic tree, so changes are reflected with a delay
+// of a few heartbeats. Use SubscribePresence to track the individual members.
+func (c *Connection) Members(cluster string, timeout time.Duration) (int, error) {
+	// Create a reply channel for the results
+	c.reqLock.Lock()
+	reqCh := make(chan []byte, 1)
+	reqId := c.reqIdx
+	c.reqIdx++
+	c.reqPend[reqId] = reqCh
+	c.reqLock.Unlock()
+
+	// Make sure reply channel is cleaned up
+	defer func() {
+		c.reqLock.Lock()
+		defer c.reqLock.Unlock()
+
+		delete(c.reqPend, reqId)
+		close(reqCh)
+	}()
+	// Send the query to any member of the cluster
+	c.iris.scribe.Balance(clusterPrefixes[0]+cluster, c.assembleMembersQuery(reqId))
+
+	// Retrieve the results, time out or fail if terminating
+	select {
+	case <-c.term:
+		return 0, ErrTerminating
+	case <-time.After(timeout):
+		return 0, ErrTimeout
+	case rep := <-reqCh:
+		if len(rep) != 8 {
+			return 0, errors.New("invalid membership reply")
+		}
+		return int(binary.BigEndian.Uint64(rep)), nil
+	}
+}
+
+// Subscribes to the presence events of cluster, using handler as the callback
+// for members joining and leaving.
+func (c *Connection) SubscribePresence(cluster string, handler PresenceHandler) error {
+	topic := presencePrefix + cluster
+
+	// Make sure there are no double subscriptions and not closing
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.presLive[topic]; ok {
+			c.subLock.Unlock()
+			return ErrSubscribed
+		}
+		c.presLive[topic] = handler
+	}
+	c.subLock.Unlock()
+
+	// Subscribe through the carrier
+	return c.iris.subscribe(c.id, topic)
+}
+
+// Unsubscribes from the presence events of cluster.
+func (c *Connection) UnsubscribePresence(cluster string) error {
+	topic := presencePrefix + cluster
+
+	// Remove subscription if present
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.presLive[topic]; !ok {
+			c.subLock.Unlock()
+			return ErrNotSubscribed
+		}
+	}
+	delete(c.presLive, topic)
+	c.subLock.Unlock()
+
+	// Notify the carrier of the removal
+	return c.iris.unsubscribe(c.id, topic)
+}
+
+// Publishes a presence event of a cluster member.
+func (o *Overlay) publishPresence(cluster string, join bool, node *big.Int, conn uint64) {
+	if err := o.scribe.Publish(presencePrefix+cluster, o.assemblePresence(join, node, conn)); err != nil {
+		log.Printf("iris: failed to publish presence event: %v.", err)
+	}
+}
+
+// Implements proto.scribe.Callback.HandleDeath. Publishes a leave event for all
+// members of a dead node. Scribe reports the death only from the former parent
+// of a node that hosted members, and only the first split of the cluster is
+// considered, so each dead node is announced once.
+func (o *Overlay) HandleDeath(topic string, node *big.Int) {
+	if strings.HasPrefix(topic, clusterPrefixes[0]) {
+		go o.publishPresence(strings.TrimPrefix(topic, clusterPrefixes[0]), false, node, 0)
+	}
+}
+
+// Responds to a membership query with the number of members in the cluster as
+// seen from the local node.
+func (c *Connection) handleMembersQuery(srcNode *big.Int, srcConn uint64, reqId uint64, topic string) {
+	load, err := c.iris.scribe.Load(topic)
+	if err != nil {
+		log.Printf("iris: failed to count cluster members: %v.", err)
+		return
+	}
+	rep := make([]byte, 8)
+	binary.BigEndian.PutUint64(rep, uint64(load.Members))
+	c.iris.scribe.Direct(srcNode, c.assembleReply(srcConn, reqId, rep))
+}
+
+// Delivers a presence event to a subscribed handler. If the subscription does
+// not exist the event is silently dropped.
+func (c *Connection) handlePresence(topic string, join bool, node *big.Int, conn uint64) {
+	// Fetch the handler
+	c.subLock.RLock()
+	handler, ok := c.presLive[topic]
+	c.subLock.RUnlock()
+
+	// Deliver the event
+	if ok {
+		if join {
+			handler.HandleJoin(Member{Node: node, Conn: conn})
+		} else {
+			handler.HandleLeave(Member{Node: node, Conn: conn})
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Presence handler collecting the join and leave events.
+type presenceCollector struct {
+	joins  chan Member
+	leaves chan Member
+}
+
+func (p *presenceCollector) HandleJoin(member Member) {
+	p.joins <- member
+}
+
+func (p *presenceCollector) HandleLeave(member Member) {
+	p.leaves <- member
+}
+
+// Individual presence tests.
+func TestPresenceSingleNode(t *testing.T) {
+	testPresence(t, 1, 5)
+}
+
+func TestPresenceMultiNode(t *testing.T) {
+	testPresence(t, 5, 2)
+}
+
+// Tests the membership counts and the presence events of a cluster.
+func testPresence(t *testing.T, nodes, conns int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "presence-test"
+	cluster := fmt.Sprintf("presence-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Create a watcher outside of the cluster and subscribe to presence events
+	watcher, err := liveNodes[0].Connect(cluster+"-watcher", &requester{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer watcher.Close()
+
+	events := &presenceCollector{
+		joins:  make(chan Member, nodes*conns),
+		leaves: make(chan Member, nodes*conns),
+	}
+	if err := watcher.SubscribePresence(cluster, events); err != nil {
+		t.Fatalf("failed to subscribe to presence events: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	// Connect a few members into the cluster and wait for the join events
+	members := []*Connection{}
+	for _, node := range liveNodes {
+		for j := 0; j < conns; j++ {
+			conn, err := node.Connect(cluster, &requester{})
+			if err != nil {
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			members = append(members, conn)
+		}
+	}
+	for i := 0; i < len(members); i++ {
+		select {
+		case <-events.joins:
+		case <-time.After(time.Second):
+			t.Fatalf("join event %d timed out.", i)
+		}
+	}
+	// Wait for the load reports to propagate and check the member count
+	time.Sleep(2 * time.Second)
+	if n, err := watcher.Members(cluster, time.Second); err != nil {
+		t.Fatalf("failed to count cluster members: %v.", err)
+	} else if n != len(members) {
+		t.Fatalf("member count mismatch: have %v, want %v.", n, len(members))
+	}
+	// Disconnect the members and wait for the leave events
+	for i, conn := range members {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+		select {
+		case member := <-events.leaves:
+			if member.Conn != conn.id {
+				t.Fatalf("leave event %d: connection mismatch: have %v, want %v.", i, member.Conn, conn.id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("leave event %d timed out.", i)
+		}
+	}
+}
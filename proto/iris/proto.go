@@ -23,9 +23,11 @@ package iris
 
 import (
 	"encoding/gob"
+	"math/big"
 	"time"
 
 	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/wire"
 )
 
 // Iris operation code.
@@ -37,32 +39,215 @@ const (
 	opRep                 // Cluster reply
 	opPub                 // Topic publish
 	opTun                 // Tunneling request
+	opAck                 // Request acceptance notification
+	opMemb                // Cluster membership query
+	opPres                // Cluster presence event
+	opJob                 // Work queue job
+	opDead                // Undeliverable message returned to its sender
+	opRelay               // Relayed tunnel offer (acceptor) or confirmation (initiator)
+	opFrame               // Relayed tunnel frame
+	opRAck                // Relayed tunnel cumulative acknowledgement
+	opPull                // Request for the remaining chunks of a balanced message
+	opAnch                // Wildcard anchor announcement (or query)
 )
 
 // Extra headers for the Iris layer.
 type header struct {
 	Op   opcode // Operation code of the message
-	Src  uint64 // Connection id of the sender (requests, tunnel)
+	Src  uint64 // Connection id of the sender (requests, acks, tunnel)
 	Dest uint64 // Connection id of the recipient (direct messages)
 
+	// Optional fields for dead-letter reporting
+	Return     bool       // Whether the message should be returned if undeliverable
+	DeadOp     opcode     // Operation code of the returned message
+	DeadReason DeadReason // Reason why the returned message was discarded
+
+	// Optional fields for chunked messages
+	ChunkId   uint64 // Id of the chunked message, unique per sender connection
+	ChunkIdx  int    // Index of the chunk within the message
+	ChunkNum  int    // Total number of chunks (0 if the message is not chunked)
+	ChunkSize int    // Total payload size of the chunked message
+
 	// Optional fields for requests and replies
-	ReqId   uint64        // Request/response identifier
-	ReqTime time.Duration // Maximum amount of time spendable on the request
+	ReqId    uint64        // Request/response identifier
+	ReqTime  time.Duration // Maximum amount of time spendable on the request
+	ReqKey   []byte        // Affinity key for sticky request balancing
+	ReqToken []byte        // Idempotency token shared by all copies of a request
+	ReqAck   bool          // Whether the accepting member should notify the requester
+	ReqAvoid []uint64      // Connection ids to avoid if possible (retried requests)
+
+	// Optional fields for topic events
+	PubTopic   string            // Concrete topic the event was published to
+	PubHeaders map[string]string // Content headers to evaluate filters against
+	PubSeq     uint64            // Sequence number within the publisher's ordered stream (0 if unordered)
+
+	// Optional fields for presence events
+	PresJoin bool     // Whether the member joined (left otherwise)
+	PresNode *big.Int // Overlay node hosting the member
+	PresConn uint64   // Connection id of the member (0 if all members of the node)
 
 	// Optional fields for tunnels
 	TunId    uint64        // Id of the tunnel being requested
 	TunKey   []byte        // Secret symmetric key of the tunnel
 	TunAddrs []string      // Tunnel listener endpoints
 	TunTime  time.Duration // Maximum time to establish tunnel
+	TunClust string        // Cluster of the tunnel initiator
+	TunPeer  uint64        // Id of the sender's tunnel endpoint (relay setup)
+	TunSeq   uint64        // Sequence number of a relayed frame (next expected if ack)
+	TunCtrl  relayCtrl     // Control code of a relayed frame
+	TunIv    []byte        // Counter mode nonce of a relayed frame (key in TunKey)
+	TunSize  int           // Uncompressed payload size of a relayed frame (0 if plain)
+
+	// Optional fields for wildcard anchor announcements
+	AnchList  []string // Wildcard anchors with live subscribers at the sender
+	AnchGone  []string // Wildcard anchors the sender has no more subscribers for
+	AnchQuery bool     // Whether all nodes should re-announce their anchors
+}
+
+// Implements proto.scribe.Bouncer, requesting undeliverable messages to be
+// returned if the sender connection handles dead letters. Of chunked messages
+// only the first chunk is returned.
+func (h *header) Bounce() bool {
+	return h.Return && h.ChunkIdx == 0
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with gob and the wire codecs.
 func init() {
 	gob.Register(&header{})
+	wire.Register(wire.IrisHeader, func() wire.Codec { return new(header) })
 }
 
-// Envelopes an Iris header and payload into the generic packet container.
+// Implements wire.Codec, appending the non-zero header fields to the encoder.
+func (h *header) EncodeWire(enc *wire.Encoder) {
+	enc.Uint(1, uint64(h.Op))
+	enc.Uint(2, h.Src)
+	enc.Uint(3, h.Dest)
+
+	enc.Bool(4, h.Return)
+	enc.Uint(5, uint64(h.DeadOp))
+	enc.Int(6, int64(h.DeadReason))
+
+	enc.Uint(7, h.ChunkId)
+	enc.Int(8, int64(h.ChunkIdx))
+	enc.Int(9, int64(h.ChunkNum))
+	enc.Int(10, int64(h.ChunkSize))
+
+	enc.Uint(11, h.ReqId)
+	enc.Duration(12, h.ReqTime)
+	enc.Bytes(13, h.ReqKey)
+	enc.Bytes(14, h.ReqToken)
+	enc.Bool(15, h.ReqAck)
+	enc.Uints(16, h.ReqAvoid)
+
+	enc.Text(17, h.PubTopic)
+	enc.StringMap(18, h.PubHeaders)
+	enc.Uint(19, h.PubSeq)
+
+	enc.Bool(21, h.PresJoin)
+	enc.Big(22, h.PresNode)
+	enc.Uint(23, h.PresConn)
+
+	enc.Uint(24, h.TunId)
+	enc.Bytes(25, h.TunKey)
+	enc.Strings(26, h.TunAddrs)
+	enc.Duration(27, h.TunTime)
+	enc.Text(28, h.TunClust)
+	enc.Uint(29, h.TunPeer)
+	enc.Uint(30, h.TunSeq)
+	enc.Uint(31, uint64(h.TunCtrl))
+	enc.Bytes(32, h.TunIv)
+	enc.Int(33, int64(h.TunSize))
+
+	enc.Strings(34, h.AnchList)
+	enc.Bool(35, h.AnchQuery)
+	enc.Strings(36, h.AnchGone)
+}
+
+// Implements wire.Codec, restoring the header fields from the decoder.
+func (h *header) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			h.Op = opcode(dec.Uint())
+		case 2:
+			h.Src = dec.Uint()
+		case 3:
+			h.Dest = dec.Uint()
+		case 4:
+			h.Return = dec.Bool()
+		case 5:
+			h.DeadOp = opcode(dec.Uint())
+		case 6:
+			h.DeadReason = DeadReason(dec.Int())
+		case 7:
+			h.ChunkId = dec.Uint()
+		case 8:
+			h.ChunkIdx = int(dec.Int())
+		case 9:
+			h.ChunkNum = int(dec.Int())
+		case 10:
+			h.ChunkSize = int(dec.Int())
+		case 11:
+			h.ReqId = dec.Uint()
+		case 12:
+			h.ReqTime = dec.Duration()
+		case 13:
+			h.ReqKey = dec.Bytes()
+		case 14:
+			h.ReqToken = dec.Bytes()
+		case 15:
+			h.ReqAck = dec.Bool()
+		case 16:
+			h.ReqAvoid = dec.Uints()
+		case 17:
+			h.PubTopic = dec.Text()
+		case 18:
+			h.PubHeaders = dec.StringMap()
+		case 19:
+			h.PubSeq = dec.Uint()
+		case 21:
+			h.PresJoin = dec.Bool()
+		case 22:
+			h.PresNode = dec.Big()
+		case 23:
+			h.PresConn = dec.Uint()
+		case 24:
+			h.TunId = dec.Uint()
+		case 25:
+			h.TunKey = dec.Bytes()
+		case 26:
+			h.TunAddrs = dec.Strings()
+		case 27:
+			h.TunTime = dec.Duration()
+		case 28:
+			h.TunClust = dec.Text()
+		case 29:
+			h.TunPeer = dec.Uint()
+		case 30:
+			h.TunSeq = dec.Uint()
+		case 31:
+			h.TunCtrl = relayCtrl(dec.Uint())
+		case 32:
+			h.TunIv = dec.Bytes()
+		case 33:
+			h.TunSize = int(dec.Int())
+		case 34:
+			h.AnchList = dec.Strings()
+		case 35:
+			h.AnchQuery = dec.Bool()
+		case 36:
+			h.AnchGone = dec.Strings()
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+// Envelopes an Iris header and payload into the generic packet container. The
+// message is marked for return if the connection handles dead letters.
 func (c *Connection) assemblePacket(head *header, data []byte) *proto.Message {
+	head.Return = c.deadLive
 	return &proto.Message{
 		Head: proto.Header{
 			Meta: head,
@@ -71,33 +256,123 @@ func (c *Connection) assemblePacket(head *header, data []byte) *proto.Message {
 	}
 }
 
-// Assembles an application broadcast message. It consists of the bcast opcode
-// and the payload.
+// Assembles an application broadcast message. It consists of the bcast opcode,
+// the broadcasting connection and the payload.
 func (c *Connection) assembleBroadcast(msg []byte) *proto.Message {
-	return c.assemblePacket(&header{Op: opBcast}, msg)
+	return c.assemblePacket(&header{Op: opBcast, Src: c.id}, msg)
 }
 
 // Assembles an application request message. It consists of the request opcode,
-// the locally unique request id and the payload.
-func (c *Connection) assembleRequest(reqId uint64, req []byte, timeout time.Duration) *proto.Message {
-	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout}, req)
+// the locally unique request id, the optional affinity key and the payload.
+func (c *Connection) assembleRequest(reqId uint64, key []byte, req []byte, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout, ReqKey: key}, req)
+}
+
+// Assembles a request message delivered under a retry or hedging policy. Apart
+// from the plain request fields, it contains the idempotency token, the accept
+// notification request and the connections to avoid (already tried).
+func (c *Connection) assemblePolicyRequest(reqId uint64, token []byte, avoid []uint64, req []byte, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout, ReqToken: token, ReqAck: true, ReqAvoid: avoid}, req)
+}
+
+// Assembles the acceptance notification of a request. It consists of the ack
+// opcode, the requester and the accepting connection ids and the request id.
+func (c *Connection) assembleAck(dest uint64, reqId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opAck, Src: c.id, Dest: dest, ReqId: reqId}, nil)
 }
 
 // Assembles the reply message to an application request. It consists of the
-// reply opcode, the original request's id and the payload itself.
+// reply opcode, the replying connection, the original request's id and the
+// payload itself.
 func (c *Connection) assembleReply(dest uint64, reqId uint64, rep []byte) *proto.Message {
-	return c.assemblePacket(&header{Op: opRep, Dest: dest, ReqId: reqId}, rep)
+	return c.assemblePacket(&header{Op: opRep, Src: c.id, Dest: dest, ReqId: reqId}, rep)
 }
 
 // Assembles an event message to be published in a topic. It consists of the
-// publish opcode and the payload.
-func (c *Connection) assemblePublish(msg []byte) *proto.Message {
-	return c.assemblePacket(&header{Op: opPub}, msg)
+// publish opcode, the publishing connection and its stream sequence number (if
+// ordered), the concrete topic (needed for wildcard matching), the content headers
+// and the payload. The event is marked for return only if ret is set too.
+func (c *Connection) assemblePublish(topic string, headers map[string]string, seq uint64, ret bool, msg []byte) *proto.Message {
+	head := &header{Op: opPub, Src: c.id, PubSeq: seq, PubTopic: topic, PubHeaders: headers}
+	pkt := c.assemblePacket(head, msg)
+	head.Return = head.Return && ret
+	return pkt
+}
+
+// Assembles a work queue job, consisting of the job opcode, the enqueuing
+// connection and the payload.
+func (c *Connection) assembleJob(msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opJob, Src: c.id}, msg)
+}
+
+// Assembles a membership query, consisting of the membership opcode and the id
+// of the query (reusing the request/reply mechanism).
+func (c *Connection) assembleMembersQuery(reqId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opMemb, Src: c.id, ReqId: reqId}, nil)
+}
+
+// Assembles a presence event of a cluster member, consisting of the presence
+// opcode, the join/leave flag and the member identifiers.
+func (o *Overlay) assemblePresence(join bool, node *big.Int, conn uint64) *proto.Message {
+	return &proto.Message{
+		Head: proto.Header{
+			Meta: &header{Op: opPres, PresJoin: join, PresNode: node, PresConn: conn},
+		},
+	}
+}
+
+// Assembles a wildcard anchor announcement, consisting of the anchor opcode, the
+// anchors with local subscribers, the withdrawn anchors and the flag requesting
+// remote announcements.
+func (o *Overlay) assembleAnchors(anchors []string, gone []string, query bool) *proto.Message {
+	return &proto.Message{
+		Head: proto.Header{
+			Meta: &header{Op: opAnch, AnchList: anchors, AnchGone: gone, AnchQuery: query},
+		},
+	}
+}
+
+// Assembles a dead letter returning an undeliverable message to the connection
+// that sent it, consisting of the dead opcode, the original operation, the reason
+// of the failed delivery, the fields identifying the message and the payload.
+func (o *Overlay) assembleDeadLetter(head *header, reason DeadReason, msg []byte) *proto.Message {
+	return &proto.Message{
+		Head: proto.Header{
+			Meta: &header{Op: opDead, Dest: head.Src, DeadOp: head.Op, DeadReason: reason, PubTopic: head.PubTopic},
+		},
+		Data: msg,
+	}
 }
 
 // Assembles a tunneling request message, consisting of the tunneling opcode,
-// local tunnel id, assigned secret key and reachability infos for the reverse
-// stream connection.
+// local tunnel id, assigned secret key, reachability infos for the reverse
+// stream connection and the cluster of the initiator.
 func (c *Connection) assembleTunnelRequest(tunId uint64, key []byte, addrs []string, timeout time.Duration) *proto.Message {
-	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunAddrs: addrs, TunTime: timeout}, nil)
+	return c.assemblePacket(&header{Op: opTun, Src: c.id, TunId: tunId, TunKey: key, TunAddrs: addrs, TunTime: timeout, TunClust: c.cluster}, nil)
+}
+
+// Assembles a chunk pull message, consisting of the pull opcode, the connection
+// which accepted the first chunk, the original sender and the chunked message id.
+func (c *Connection) assemblePull(dest uint64, chunkId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opPull, Src: c.id, Dest: dest, ChunkId: chunkId}, nil)
+}
+
+// Assembles a relay setup message, consisting of the relay opcode, the remote
+// connection and tunnel ids and the local tunnel id to relay the frames to.
+func (c *Connection) assembleRelaySetup(dest uint64, tunId uint64, peerId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opRelay, Src: c.id, Dest: dest, TunId: tunId, TunPeer: peerId}, nil)
+}
+
+// Assembles a relayed tunnel frame, consisting of the frame opcode, the remote
+// connection and tunnel ids, the sequence number and control code of the frame,
+// the crypto nonces and original size of the tunnel message and its (encrypted)
+// payload.
+func (c *Connection) assembleRelayData(dest uint64, tunId uint64, seq uint64, ctrl relayCtrl, key []byte, iv []byte, size int, data []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opFrame, Src: c.id, Dest: dest, TunId: tunId, TunSeq: seq, TunCtrl: ctrl, TunKey: key, TunIv: iv, TunSize: size}, data)
+}
+
+// Assembles a relayed tunnel acknowledgement, consisting of the ack opcode, the
+// remote connection and tunnel ids and the next expected sequence number.
+func (c *Connection) assembleRelayAck(dest uint64, tunId uint64, seq uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opRAck, Src: c.id, Dest: dest, TunId: tunId, TunSeq: seq}, nil)
 }
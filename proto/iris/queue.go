@@ -0,0 +1,203 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the competing-consumer work queues, delegating to the replicated
+// queues of the scribe layer. Each job is delivered to a single consumer, which
+// must explicitly ack or nack it. Unsettled jobs are redelivered after a timeout
+// and moved to the dead-letter queue after too many failed attempts.
+
+package iris
+
+import (
+	"log"
+	"math/rand"
+	"strings"
+
+	"github.com/karalabe/iris/proto"
+)
+
+// Prefix of the scribe queues backing the work queues.
+const queuePrefix = "q#-"
+
+// Suffix of the dead-letter queue names.
+const deadLetterSuffix = ".dead"
+
+// Handler for the jobs of a consumed work queue.
+type JobHandler interface {
+	// Handles a job of the consumed queue. The job must be acked or nacked, else
+	// it is redelivered after the visibility timeout.
+	HandleJob(job *Job)
+}
+
+// Job of a work queue, delivered to a consumer.
+type Job struct {
+	Id      uint64 // Id of the job within the queue
+	Attempt int    // Delivery attempt of the job (starting at 1)
+	Msg     []byte // Payload of the job
+
+	queue string      // Work queue the job belongs to
+	conn  *Connection // Connection consuming the job
+}
+
+// Returns the name of the dead-letter queue of a work queue, into which jobs are
+// moved after exhausting their delivery attempts. Dead-letter queues can be
+// consumed like any other, but have no dead-letter queues of their own.
+func DeadLetterQueue(queue string) string {
+	return queue + deadLetterSuffix
+}
+
+// Enqueues a job into a work queue, to be delivered to exactly one of its
+// consumers (possibly multiple times, if not acked in time).
+func (c *Connection) Enqueue(queue string, msg []byte) error {
+	select {
+	case <-c.term:
+		return ErrTerminating
+	default:
+	}
+	dead := ""
+	if !strings.HasSuffix(queue, deadLetterSuffix) {
+		dead = queuePrefix + DeadLetterQueue(queue)
+	}
+	return c.iris.scribe.Enqueue(queuePrefix+queue, dead, c.assembleJob(msg))
+}
+
+// Starts consuming the jobs of a work queue, competing with all other consumers
+// of the same queue. An error is returned if already consuming.
+func (c *Connection) Consume(queue string, handler JobHandler) error {
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.queLive[queue]; ok {
+			c.subLock.Unlock()
+			return ErrSubscribed
+		}
+		c.queLive[queue] = handler
+	}
+	c.subLock.Unlock()
+
+	c.iris.consume(c.id, queuePrefix+queue)
+	return nil
+}
+
+// Stops consuming the jobs of a work queue. Jobs delivered but not yet settled
+// are redelivered after their visibility timeout.
+func (c *Connection) Unconsume(queue string) error {
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.queLive[queue]; !ok {
+			c.subLock.Unlock()
+			return ErrNotSubscribed
+		}
+		delete(c.queLive, queue)
+	}
+	c.subLock.Unlock()
+
+	c.iris.unconsume(c.id, queuePrefix+queue)
+	return nil
+}
+
+// Acknowledges the successful processing of the job, removing it from the queue.
+func (j *Job) Ack() {
+	j.conn.iris.scribe.Ack(queuePrefix+j.queue, j.Id)
+}
+
+// Reports the failed processing of the job, making it available for redelivery
+// (or moving it to the dead-letter queue if out of attempts).
+func (j *Job) Nack() {
+	j.conn.iris.scribe.Nack(queuePrefix+j.queue, j.Id)
+}
+
+// Registers a local connection as a consumer of a queue, starting consumption
+// through the carrier if the first.
+func (o *Overlay) consume(id uint64, queue string) {
+	o.lock.Lock()
+	o.queLive[queue] = append(o.queLive[queue], id)
+	first := len(o.queLive[queue]) == 1
+	o.lock.Unlock()
+
+	if first {
+		o.scribe.Consume(queue)
+	}
+}
+
+// Removes a local connection from the consumers of a queue, stopping consumption
+// through the carrier if the last.
+func (o *Overlay) unconsume(id uint64, queue string) {
+	o.lock.Lock()
+	subs := o.queLive[queue]
+	for i, sub := range subs {
+		if sub == id {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	last := len(subs) == 0
+	if last {
+		delete(o.queLive, queue)
+	} else {
+		o.queLive[queue] = subs
+	}
+	o.lock.Unlock()
+
+	if last {
+		o.scribe.Unconsume(queue)
+	}
+}
+
+// Implements proto.scribe.Callback.HandleJob. Passes the job to a random local
+// consumer of the queue, or nacks it if there are none.
+func (o *Overlay) HandleJob(queue string, id uint64, attempt int, msg *proto.Message) {
+	if head := msg.Head.Meta.(*header); head.Op != opJob {
+		log.Printf("iris: invalid job opcode: %v.", head.Op)
+		return
+	}
+	o.lock.RLock()
+	var conn *Connection
+	if subs := o.queLive[queue]; len(subs) > 0 {
+		conn = o.conns[subs[rand.Intn(len(subs))]]
+	}
+	o.lock.RUnlock()
+
+	if conn == nil {
+		o.scribe.Nack(queue, id)
+		return
+	}
+	conn.workers.Schedule(func() { conn.handleJob(queue[len(queuePrefix):], id, attempt, msg.Data) })
+}
+
+// Delivers a job to the local queue handler, nacking it if consumption stopped
+// in the meanwhile.
+func (c *Connection) handleJob(queue string, id uint64, attempt int, msg []byte) {
+	c.subLock.RLock()
+	handler, ok := c.queLive[queue]
+	c.subLock.RUnlock()
+
+	if !ok {
+		c.iris.scribe.Nack(queuePrefix+queue, id)
+		return
+	}
+	handler.HandleJob(&Job{Id: id, Attempt: attempt, Msg: msg, queue: queue, conn: c})
+}
@@ -0,0 +1,146 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Work queue consumer for the queue tests, nacking the first attempt of every
+// job and all attempts of the poisoned ones (unless consuming dead-letters).
+type consumer struct {
+	dead  bool
+	acked map[string]int
+	lock  sync.Mutex
+}
+
+func (c *consumer) HandleJob(job *Job) {
+	if !c.dead && (job.Attempt == 1 || string(job.Msg) == "poison") {
+		job.Nack()
+		return
+	}
+	c.lock.Lock()
+	c.acked[string(job.Msg)]++
+	c.lock.Unlock()
+
+	job.Ack()
+}
+
+// Individual work queue tests.
+func TestQueueSingleNode(t *testing.T) {
+	testQueue(t, 1, 50)
+}
+
+func TestQueueMultiNode(t *testing.T) {
+	testQueue(t, 5, 20)
+}
+
+// Tests that jobs are delivered to the competing consumers, redelivered on nacks
+// and dead-lettered after too many attempts.
+func testQueue(t *testing.T, nodes, jobs int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "queue-test"
+	cluster := fmt.Sprintf("queue-test-%d", nodes)
+	queue := fmt.Sprintf("queue-test-queue-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Consume the queue on every node, and the dead-letter queue on the first
+	liveConns := make([]*Connection, nodes)
+	liveHands := make([]*consumer, nodes)
+	for i, node := range liveNodes {
+		conn, err := node.Connect(cluster, nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+
+		liveConns[i] = conn
+		liveHands[i] = &consumer{acked: make(map[string]int)}
+		if err := conn.Consume(queue, liveHands[i]); err != nil {
+			t.Fatalf("failed to consume the queue: %v.", err)
+		}
+		if err := conn.Consume(queue, liveHands[i]); err != ErrSubscribed {
+			t.Fatalf("double consume error mismatch: have %v, want %v.", err, ErrSubscribed)
+		}
+	}
+	dead := &consumer{dead: true, acked: make(map[string]int)}
+	if err := liveConns[0].Consume(DeadLetterQueue(queue), dead); err != nil {
+		t.Fatalf("failed to consume the dead-letter queue: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Enqueue the jobs from every node and a poisoned one
+	for i := 0; i < jobs; i++ {
+		if err := liveConns[i%nodes].Enqueue(queue, []byte(fmt.Sprintf("job-%d", i))); err != nil {
+			t.Fatalf("job %d: failed to enqueue: %v.", i, err)
+		}
+	}
+	if err := liveConns[0].Enqueue(queue, []byte("poison")); err != nil {
+		t.Fatalf("failed to enqueue poisoned job: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	// Verify that every job was acked exactly once, and the poison dead-lettered
+	acked := make(map[string]int)
+	for _, hand := range liveHands {
+		hand.lock.Lock()
+		for job, count := range hand.acked {
+			acked[job] += count
+		}
+		hand.lock.Unlock()
+	}
+	for i := 0; i < jobs; i++ {
+		if count := acked[fmt.Sprintf("job-%d", i)]; count != 1 {
+			t.Fatalf("job %d: ack count mismatch: have %v, want %v.", i, count, 1)
+		}
+	}
+	dead.lock.Lock()
+	defer dead.lock.Unlock()
+	if len(dead.acked) != 1 || dead.acked["poison"] != 1 {
+		t.Fatalf("dead-letter mismatch: have %v, want %v.", dead.acked, map[string]int{"poison": 1})
+	}
+}
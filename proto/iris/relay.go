@@ -0,0 +1,400 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the overlay relayed tunnel transport, used as a fallback when the
+// tunnel endpoints cannot establish a direct stream link. Frames are sent as
+// direct overlay messages, sequenced, windowed and retransmitted by the sender,
+// reordered and acknowledged by the receiver.
+
+package iris
+
+import (
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Control code of a relayed tunnel frame.
+type relayCtrl uint8
+
+const (
+	relayData  relayCtrl = iota // Encrypted tunnel data message
+	relayFin                    // Tunnel write side termination
+	relayAck                    // Tunnel close acknowledgement
+	relayClose                  // Relay tear-down, no more frames follow
+)
+
+// Outbound frame waiting for acknowledgement.
+type relayFrame struct {
+	ctrl relayCtrl      // Control code of the frame
+	msg  *proto.Message // Tunnel message carried (nil for relay tear-down)
+}
+
+// Wraps an outbound tunnel message into a frame, mapping the tear-down packets
+// to control codes.
+func newRelayFrame(msg *proto.Message) *relayFrame {
+	switch msg.Head.Meta.(type) {
+	case *finPacket:
+		return &relayFrame{ctrl: relayFin, msg: msg}
+	case *ackPacket:
+		return &relayFrame{ctrl: relayAck, msg: msg}
+	default:
+		return &relayFrame{ctrl: relayData, msg: msg}
+	}
+}
+
+// Carrier of a tunnel relayed through the overlay network.
+type relayLink struct {
+	owner *Connection // Local connection owning the tunnel
+	node  *big.Int    // Overlay node of the remote endpoint
+	conn  uint64      // Connection id of the remote endpoint
+	tunId uint64      // Tunnel id of the remote endpoint
+
+	send chan *proto.Message // Outbound tunnel messages, drained by the sender
+	recv chan *proto.Message // Inbound tunnel messages, in sequence order
+
+	frames map[uint64]*relayFrame // Inbound frames waiting for their predecessors
+	next   uint64                 // Sequence number of the next inbound frame to pass upstream
+	acked  uint64                 // Highest cumulative acknowledgement of the remote
+	lock   sync.Mutex             // Protects the inbound frames and acknowledgement
+
+	ready chan struct{}   // Notification of newly arrived inbound frames
+	ack   chan struct{}   // Notification of acknowledgement progress
+	quit  chan chan error // Quit channel to synchronize sender termination
+	term  chan struct{}   // Channel closed when the relay is torn down
+	once  sync.Once       // Guard to tear down the relay only once
+}
+
+// Creates a new relay towards a remote tunnel endpoint. The transfers are only
+// started when the tunnel is established.
+func newRelayLink(owner *Connection, node *big.Int, conn uint64, tunId uint64) *relayLink {
+	return &relayLink{
+		owner: owner,
+		node:  node,
+		conn:  conn,
+		tunId: tunId,
+
+		send:   make(chan *proto.Message, config.IrisTunnelBuffer),
+		recv:   make(chan *proto.Message),
+		frames: make(map[uint64]*relayFrame),
+
+		ready: make(chan struct{}, 1),
+		ack:   make(chan struct{}, 1),
+		quit:  make(chan chan error),
+		term:  make(chan struct{}),
+	}
+}
+
+func (r *relayLink) outbox() chan<- *proto.Message { return r.send }
+func (r *relayLink) inbox() <-chan *proto.Message  { return r.recv }
+
+// Starts the transfer processes.
+func (r *relayLink) start() {
+	go r.sender()
+	go r.receiver()
+}
+
+// Flushes the queued messages, waits for their acknowledgement (at most for the
+// session grace period) and tears down the relay.
+func (r *relayLink) Close() error {
+	errc := make(chan error)
+	r.quit <- errc
+	err := <-errc
+
+	r.terminate()
+	return err
+}
+
+// Marks the relay torn down, ending both transfer processes.
+func (r *relayLink) terminate() {
+	r.once.Do(func() { close(r.term) })
+}
+
+// Sends a single frame through the overlay. The payload is copied, as it gets
+// encrypted in place while the frame is still needed for retransmissions.
+func (r *relayLink) transmit(seq uint64, frame *relayFrame) {
+	var key, iv, data []byte
+	var size int
+	if frame.msg != nil {
+		key, iv, size = frame.msg.Head.Key, frame.msg.Head.Iv, frame.msg.Head.Size
+		data = make([]byte, len(frame.msg.Data))
+		copy(data, frame.msg.Data)
+	}
+	r.owner.iris.scribe.Direct(r.node, r.owner.assembleRelayData(r.conn, r.tunId, seq, frame.ctrl, key, iv, size, data))
+}
+
+// Sequences the outbound messages into frames and sends them, keeping at most a
+// tunnel buffer worth unacknowledged. Unacknowledged frames are retransmitted
+// periodically until the relay timeout passes without progress.
+func (r *relayLink) sender() {
+	var errc chan error
+	var grace <-chan time.Time
+
+	base, seq := uint64(0), uint64(0)
+	pending := make(map[uint64]*relayFrame)
+	progress := time.Now()
+
+	resend := time.NewTicker(config.IrisTunnelRelayResend)
+	defer resend.Stop()
+
+	for {
+		// Flush completed, report termination
+		if errc != nil && base == seq {
+			errc <- nil
+			return
+		}
+		// Accept new messages only while the window has room and not closing
+		send := r.send
+		if errc != nil || seq-base >= uint64(config.IrisTunnelBuffer) {
+			send = nil
+		}
+		select {
+		case msg := <-send:
+			if base == seq {
+				progress = time.Now()
+			}
+			pending[seq] = newRelayFrame(msg)
+			r.transmit(seq, pending[seq])
+			seq++
+
+		case <-r.ack:
+			r.lock.Lock()
+			acked := r.acked
+			r.lock.Unlock()
+
+			for ; base < acked && base < seq; base++ {
+				delete(pending, base)
+				progress = time.Now()
+			}
+
+		case <-resend.C:
+			if base == seq || time.Since(progress) < config.IrisTunnelRelayResend {
+				continue
+			}
+			if time.Since(progress) > config.IrisTunnelRelayTimeout {
+				log.Printf("iris: relayed tunnel timed out, dropping.")
+				r.terminate()
+				continue
+			}
+			for i := base; i < seq; i++ {
+				r.transmit(i, pending[i])
+			}
+
+		case errc = <-r.quit:
+			// Flush all queued messages and the tear-down frame (window ignored)
+			for done := false; !done; {
+				select {
+				case msg := <-r.send:
+					pending[seq] = newRelayFrame(msg)
+					r.transmit(seq, pending[seq])
+					seq++
+				default:
+					done = true
+				}
+			}
+			if base == seq {
+				progress = time.Now()
+			}
+			pending[seq] = &relayFrame{ctrl: relayClose}
+			r.transmit(seq, pending[seq])
+			seq++
+
+			grace = time.After(config.SessionGraceTimeout)
+
+		case <-grace:
+			errc <- ErrTimeout
+			return
+
+		case <-r.term:
+			// Relay torn down (remotely or failed), nothing more to deliver
+			if errc == nil {
+				errc = <-r.quit
+			}
+			errc <- nil
+			return
+		}
+	}
+}
+
+// Passes the inbound frames upstream in sequence order, acknowledging them as
+// they are consumed, until the remote tears down the relay or it fails.
+func (r *relayLink) receiver() {
+	defer close(r.recv)
+
+	for {
+		select {
+		case <-r.term:
+			return
+		case <-r.ready:
+		}
+		// Pass upstream all the frames available in order
+		for {
+			r.lock.Lock()
+			frame, ok := r.frames[r.next]
+			r.lock.Unlock()
+			if !ok {
+				break
+			}
+			if frame.ctrl == relayClose {
+				r.acknowledge(r.next + 1)
+				r.terminate()
+				return
+			}
+			select {
+			case r.recv <- frame.msg:
+			case <-r.term:
+				return
+			}
+			r.lock.Lock()
+			delete(r.frames, r.next)
+			r.next++
+			r.lock.Unlock()
+		}
+		r.lock.Lock()
+		next := r.next
+		r.lock.Unlock()
+
+		r.acknowledge(next)
+	}
+}
+
+// Notifies the remote endpoint of the next expected frame.
+func (r *relayLink) acknowledge(next uint64) {
+	r.owner.iris.scribe.Direct(r.node, r.owner.assembleRelayAck(r.conn, r.tunId, next))
+}
+
+// Inserts an inbound frame into the reordering buffer. Duplicates are dropped,
+// but acknowledged to stop the remote retransmissions.
+func (r *relayLink) deliver(seq uint64, frame *relayFrame) {
+	r.lock.Lock()
+	if seq < r.next {
+		next := r.next
+		r.lock.Unlock()
+
+		r.acknowledge(next)
+		return
+	}
+	// Accept at most a window and a flushed queue ahead (plus tear-down)
+	if seq-r.next <= 2*uint64(config.IrisTunnelBuffer) {
+		r.frames[seq] = frame
+	}
+	r.lock.Unlock()
+
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Records an acknowledgement of the remote endpoint.
+func (r *relayLink) acknowledged(next uint64) {
+	r.lock.Lock()
+	if next > r.acked {
+		r.acked = next
+	}
+	r.lock.Unlock()
+
+	select {
+	case r.ack <- struct{}{}:
+	default:
+	}
+}
+
+// Falls back to relaying an inbound tunnel through the overlay: offers a relay
+// to the initiating endpoint and waits for its confirmation.
+func (c *Connection) acceptRelay(tun *Tunnel, node *big.Int, conn uint64, tunId uint64, deadline time.Time) (carrier, error) {
+	c.tunLock.RLock()
+	pend := tun.init
+	c.tunLock.RUnlock()
+
+	c.iris.scribe.Direct(node, c.assembleRelaySetup(conn, tunId, tun.id))
+	select {
+	case relay := <-pend:
+		return relay, nil
+	case <-time.After(deadline.Sub(time.Now())):
+		return nil, ErrTimeout
+	case <-c.term:
+		return nil, ErrTerminating
+	}
+}
+
+// Handles a relay offer or confirmation, passing a new relay to the pending tunnel
+// if still waiting for its carrier.
+func (c *Connection) handleRelaySetup(node *big.Int, conn uint64, tunId uint64, peerId uint64) {
+	c.tunLock.RLock()
+	tun, ok := c.tunLive[tunId]
+	var pend chan carrier
+	if ok {
+		pend = tun.init
+	}
+	c.tunLock.RUnlock()
+
+	if pend == nil {
+		log.Printf("iris: relay setup for non-pending tunnel %v.", tunId)
+		return
+	}
+	select {
+	case pend <- newRelayLink(c, node, conn, peerId):
+	default:
+		log.Printf("iris: tunnel %v already set up, dropping relay.", tunId)
+	}
+}
+
+// Looks up the relay of a local tunnel endpoint.
+func (c *Connection) relayOf(tunId uint64) *relayLink {
+	c.tunLock.RLock()
+	defer c.tunLock.RUnlock()
+
+	if tun, ok := c.tunLive[tunId]; ok {
+		if relay, ok := tun.conn.(*relayLink); ok {
+			return relay
+		}
+	}
+	return nil
+}
+
+// Inserts a relayed frame into the tunnel's relay. Frames of unknown (or not yet
+// established) tunnels are dropped, being retransmitted if needed.
+func (c *Connection) handleRelayData(tunId uint64, seq uint64, ctrl relayCtrl, key []byte, iv []byte, size int, data []byte) {
+	relay := c.relayOf(tunId)
+	if relay == nil {
+		return
+	}
+	frame := &relayFrame{ctrl: ctrl}
+	switch ctrl {
+	case relayData:
+		frame.msg = &proto.Message{Head: proto.Header{Key: key, Iv: iv, Size: size}, Data: data}
+	case relayFin:
+		frame.msg = &proto.Message{Head: proto.Header{Meta: &finPacket{}}}
+	case relayAck:
+		frame.msg = &proto.Message{Head: proto.Header{Meta: &ackPacket{}}}
+	}
+	relay.deliver(seq, frame)
+}
+
+// Passes a relay acknowledgement to the tunnel's relay.
+func (c *Connection) handleRelayAck(tunId uint64, next uint64) {
+	if relay := c.relayOf(tunId); relay != nil {
+		relay.acknowledged(next)
+	}
+}
@@ -0,0 +1,84 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the reliable publish mode, delegating to the acknowledged, repairable
+// event delivery of the scribe topic trees.
+
+package iris
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Delivery status of a reliably published event.
+type DeliveryStatus struct {
+	Delivered int // Number of subscribed carrier nodes (per topic tree) the event was delivered to
+	Failed    int // Number of topic tree links which failed to acknowledge it
+}
+
+// Publishes an event to topic (and all matching wildcard patterns) reliably,
+// with acknowledged, retransmitted hops along the topic trees. The method blocks
+// until the trees report back the delivery status, or the timeout expires. An
+// event reaching no subscriber is reported by the status, not as a dead letter.
+func (c *Connection) PublishReliable(topic string, headers map[string]string, msg []byte, timeout time.Duration) (*DeliveryStatus, error) {
+	if isPattern(topic) {
+		return nil, ErrInvalidTopic
+	}
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+
+	// Publish into the exact and wildcard topic trees concurrently
+	targets := []string{topicPrefixes[prefixIdx] + topic}
+	for _, anchor := range c.iris.liveAnchors(topic) {
+		targets = append(targets, wildcardPrefixes[prefixIdx]+anchor)
+	}
+	errc := make(chan error, len(targets))
+	stats := make(chan *DeliveryStatus, len(targets))
+	for _, target := range targets {
+		// Each publish encrypts in place, so needs its own payload
+		cpy := make([]byte, len(msg))
+		copy(cpy, msg)
+
+		go func(target string, data []byte) {
+			status, err := c.iris.scribe.PublishReliable(target, headers, c.assemblePublish(topic, headers, 0, false, data), timeout)
+			if err != nil {
+				errc <- err
+				return
+			}
+			stats <- &DeliveryStatus{Delivered: status.Delivered, Failed: status.Failed}
+		}(target, cpy)
+	}
+	// Aggregate the statuses, failing if any tree did not report
+	total := new(DeliveryStatus)
+	var err error
+	for i := 0; i < len(targets); i++ {
+		select {
+		case status := <-stats:
+			total.Delivered += status.Delivered
+			total.Failed += status.Failed
+		case err = <-errc:
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return total, nil
+}
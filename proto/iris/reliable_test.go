@@ -0,0 +1,136 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Maximum number of probe rounds to wait for the topic trees to assemble.
+const reliableProbes = 100
+
+// Individual reliable pubsub tests.
+func TestReliableSingleNode(t *testing.T) {
+	testReliable(t, 1, 50)
+}
+
+func TestReliableMultiNode(t *testing.T) {
+	testReliable(t, 5, 10)
+}
+
+// Tests that reliable publishes reach every subscriber and report it back.
+func testReliable(t *testing.T, nodes, msgs int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "reliable-test"
+	cluster := fmt.Sprintf("reliable-test-%d", nodes)
+	topic := fmt.Sprintf("reliable-test-topic-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Subscribe to the topic on every node
+	liveConns := make([]*Connection, nodes)
+	liveHands := make([]*subscriber, nodes)
+	for i, node := range liveNodes {
+		conn, err := node.Connect(cluster, nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+
+		liveConns[i] = conn
+		liveHands[i] = &subscriber{make(chan []byte, nodes*(msgs+reliableProbes*config.IrisClusterSplits))}
+		if err := conn.Subscribe(topic, liveHands[i]); err != nil {
+			t.Fatalf("failed to subscribe to the topic: %v.", err)
+		}
+	}
+	// Wait until the topic trees are assembled: a full round of reliable probes
+	// from every node (rotating through all the cluster splits) must reach all the
+	// subscribers
+	if nodes > 1 {
+		for round := 0; ; round++ {
+			if round == reliableProbes {
+				t.Fatalf("topic trees not assembled after %d probe rounds.", round)
+			}
+			settled := true
+			for i := 0; i < len(liveConns)*config.IrisClusterSplits && settled; i++ {
+				status, err := liveConns[i%len(liveConns)].PublishReliable(topic, nil, nil, time.Second)
+				if err != nil || status.Delivered != nodes || status.Failed != 0 {
+					settled = false
+				}
+			}
+			if settled {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	// Publish reliably from every node and verify the reported statuses
+	for i, conn := range liveConns {
+		for j := 0; j < msgs; j++ {
+			status, err := conn.PublishReliable(topic, nil, []byte{byte(i), byte(j)}, 5*time.Second)
+			if err != nil {
+				t.Fatalf("node %d, event %d: failed to publish: %v.", i, j, err)
+			}
+			if status.Delivered != nodes || status.Failed != 0 {
+				t.Fatalf("node %d, event %d: status mismatch: have %+v, want %+v.", i, j, *status, DeliveryStatus{Delivered: nodes})
+			}
+		}
+	}
+	// Verify that all the events arrived (ignoring the empty probes)
+	for i, hand := range liveHands {
+		timeout := time.After(5 * time.Second)
+		for n := 0; n < nodes*msgs; {
+			select {
+			case msg := <-hand.msgs:
+				if len(msg) > 0 {
+					n++
+				}
+			case <-timeout:
+				t.Fatalf("node %d: event count mismatch: have %v, want %v.", i, n, nodes*msgs)
+			}
+		}
+	}
+}
@@ -161,3 +161,98 @@ func testReqRep(t *testing.T, nodes, conns, reqs int) {
 		}
 	}
 }
+
+// Connection handler for the keyed req/rep tests, replying with its own id.
+type keyedRequester struct {
+	id byte // Unique identifier of the handler
+}
+
+func (r *keyedRequester) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to request handler")
+}
+
+func (r *keyedRequester) HandleRequest(req []byte, timeout time.Duration) []byte {
+	return []byte{r.id}
+}
+
+func (r *keyedRequester) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on request handler")
+}
+
+// Keyed reqrep tests.
+func TestReqRepByKeySingleNodeMultiConn(t *testing.T) {
+	testReqRepByKey(t, 1, 10, 100)
+}
+
+func TestReqRepByKeyMultiNodeMultiConn(t *testing.T) {
+	testReqRepByKey(t, 5, 5, 100)
+}
+
+// Tests that keyed requests are consistently routed to the same handler.
+func testReqRepByKey(t *testing.T, nodes, conns, keys int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "reqrep-key-test"
+	cluster := fmt.Sprintf("reqrep-key-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect to all nodes with a few clients each
+	liveConns := []*Connection{}
+	for i, node := range liveNodes {
+		for j := 0; j < conns; j++ {
+			conn, err := node.Connect(cluster, &keyedRequester{byte(i*conns + j)})
+			if err != nil {
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			liveConns = append(liveConns, conn)
+
+			defer func(conn *Connection) {
+				if err := conn.Close(); err != nil {
+					t.Fatalf("failed to close iris connection: %v.", err)
+				}
+			}(conn)
+		}
+	}
+	// Make sure there is a little time to propagate state and reports
+	if nodes > 1 {
+		time.Sleep(3 * time.Second)
+	}
+	// Issue each keyed request from every connection and verify the handler
+	for k := 0; k < keys; k++ {
+		reqKey := []byte(fmt.Sprintf("key-%d", k))
+
+		var owner []byte
+		for i, conn := range liveConns {
+			rep, err := conn.RequestByKey(cluster, reqKey, []byte{byte(k)}, 5*time.Second)
+			if err != nil {
+				t.Fatalf("conn %d, key %d: failed to send request: %v.", i, k, err)
+			}
+			if owner == nil {
+				owner = rep
+			} else if !bytes.Equal(owner, rep) {
+				t.Fatalf("conn %d, key %d: handler mismatch: have %v, want %v.", i, k, rep, owner)
+			}
+		}
+	}
+}
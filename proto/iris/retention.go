@@ -0,0 +1,121 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the topic retention mode, delegating to the retaining topic roots of
+// the scribe layer. Since a topic is split into multiple trees, each root retains
+// its own share of the events, which are merged on replay.
+
+package iris
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto/scribe"
+)
+
+// Retention policy of a topic: new subscribers receive the retained events right
+// after subscribing. The replay runs concurrently with the live delivery, so live
+// events may arrive before, between or even duplicated by the retained ones. A
+// zero policy disables retention.
+type Retention struct {
+	Events int    // Number of most recent events to keep (0 if unbounded by count)
+	Key    string // Event header to keep only the latest event of per value ("" if none)
+}
+
+// Sets the retention policy of topic, after which the topic roots start keeping
+// the published events (either the last few, or the latest per key) and replay
+// them to new subscribers.
+func (c *Connection) Retain(topic string, policy Retention) error {
+	if isPattern(topic) {
+		return ErrInvalidTopic
+	}
+	select {
+	case <-c.term:
+		return ErrTerminating
+	default:
+	}
+	for _, prefix := range topicPrefixes {
+		c.iris.scribe.Retain(prefix+topic, scribe.Retention{Events: policy.Events, Key: policy.Key})
+	}
+	return nil
+}
+
+// Fetches the retained events of all the topic splits, merges them according to
+// the retention policy and delivers them to the subscription. Replayed events may
+// overlap with live ones arriving concurrently.
+func (c *Connection) replay(topic string) {
+	// Recall the retained events of all splits concurrently
+	var policy *scribe.Retention
+	var events []*scribe.RetainedEvent
+	var lock sync.Mutex
+
+	var pend sync.WaitGroup
+	for _, prefix := range topicPrefixes {
+		pend.Add(1)
+		go func(split string) {
+			defer pend.Done()
+
+			pol, evs, err := c.iris.scribe.Recall(split, config.IrisReplayTimeout)
+			if err != nil || pol == nil {
+				return
+			}
+			lock.Lock()
+			policy = pol
+			events = append(events, evs...)
+			lock.Unlock()
+		}(prefix + topic)
+	}
+	pend.Wait()
+	if policy == nil {
+		return
+	}
+	// Merge the splits in arrival order, enforcing the policy on the whole topic
+	sort.Sort(byStamp(events))
+	if policy.Key != "" {
+		latest := make(map[string]int)
+		for i, event := range events {
+			latest[event.Msg.Head.Meta.(*header).PubHeaders[policy.Key]] = i
+		}
+		merged := events[:0]
+		for i, event := range events {
+			if latest[event.Msg.Head.Meta.(*header).PubHeaders[policy.Key]] == i {
+				merged = append(merged, event)
+			}
+		}
+		events = merged
+	}
+	if policy.Events > 0 && len(events) > policy.Events {
+		events = events[len(events)-policy.Events:]
+	}
+	// Deliver the events in order, through the usual subscription checks
+	for _, event := range events {
+		head := event.Msg.Head.Meta.(*header)
+		origin := Member{Node: event.Origin, Conn: head.Src}
+		c.handlePublish(topicPrefixes[0]+topic, head.PubTopic, head.PubHeaders, origin, head.PubSeq, event.Msg.Data)
+	}
+}
+
+// Retained events sortable by their arrival time at the topic roots.
+type byStamp []*scribe.RetainedEvent
+
+func (s byStamp) Len() int           { return len(s) }
+func (s byStamp) Less(i, j int) bool { return s[i].Stamp.Before(s[j].Stamp) }
+func (s byStamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
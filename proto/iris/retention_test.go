@@ -0,0 +1,122 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Individual retention tests.
+func TestRetentionSingleNode(t *testing.T) {
+	testRetention(t, 1)
+}
+
+func TestRetentionMultiNode(t *testing.T) {
+	testRetention(t, 5)
+}
+
+// Tests that late subscribers receive the retained events of a topic.
+func testRetention(t *testing.T, nodes int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "retention-test"
+	cluster := fmt.Sprintf("retention-test-%d", nodes)
+	topic := fmt.Sprintf("retention-test-topic-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect to every node
+	liveConns := make([]*Connection, nodes)
+	for i, node := range liveNodes {
+		conn, err := node.Connect(cluster, nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+		liveConns[i] = conn
+	}
+	// Retain the last few events and publish more than that before subscribing
+	if err := liveConns[0].Retain(topic, Retention{Events: 5}); err != nil {
+		t.Fatalf("failed to set retention policy: %v.", err)
+	}
+	if err := liveConns[0].Retain(topic+".*", Retention{Events: 5}); err != ErrInvalidTopic {
+		t.Fatalf("pattern retention error mismatch: have %v, want %v.", err, ErrInvalidTopic)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		if err := liveConns[i%nodes].Publish(topic, []byte{byte(i)}); err != nil {
+			t.Fatalf("event %d: failed to publish: %v.", i, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Subscribe on every node and verify the replayed events
+	liveHands := make([]*subscriber, nodes)
+	for i, conn := range liveConns {
+		liveHands[i] = &subscriber{make(chan []byte, 10)}
+		if err := conn.Subscribe(topic, liveHands[i]); err != nil {
+			t.Fatalf("failed to subscribe to the topic: %v.", err)
+		}
+	}
+	for i, hand := range liveHands {
+		for j := 0; j < 5; j++ {
+			select {
+			case msg := <-hand.msgs:
+				if want := []byte{byte(5 + j)}; !bytes.Equal(msg, want) {
+					t.Fatalf("node %d, event %d: replay mismatch: have %v, want %v.", i, j, msg, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("node %d, event %d: replay timed out.", i, j)
+			}
+		}
+		select {
+		case msg := <-hand.msgs:
+			t.Fatalf("node %d: extra event replayed: %v.", i, msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
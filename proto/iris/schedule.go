@@ -0,0 +1,70 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the scheduled delivery mode, delegating to the delayed publishing of
+// the scribe layer: events and broadcasts are held by the overlay until due, so
+// the sender may leave in the meanwhile.
+
+package iris
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Publishes an event to topic (and all matching wildcard patterns) at a future
+// time. The event is held by the overlay until due and delivered like a normal
+// publish then. No guarantees are made that all subscribers receive the message.
+func (c *Connection) PublishAt(topic string, msg []byte, due time.Time) error {
+	if isPattern(topic) {
+		return ErrInvalidTopic
+	}
+	if err := c.checkSize("", len(msg)); err != nil {
+		return err
+	}
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	anchors := c.iris.liveAnchors(topic)
+
+	// Schedule into the wildcard and exact trees, chunk by chunk
+	publish := func(topic string, part *proto.Message) error {
+		return c.iris.scribe.PublishAt(topic, nil, part, due)
+	}
+	if err := c.publishWildcard(prefixIdx, anchors, topic, nil, 0, msg, publish); err != nil {
+		return err
+	}
+	return c.sendChunked(c.assemblePublish(topic, nil, 0, len(anchors) == 0, msg), func(part *proto.Message) error {
+		return publish(topicPrefixes[prefixIdx]+topic, part)
+	})
+}
+
+// Broadcasts a message to all members of an iris cluster at a future time. The
+// message is held by the overlay until due. No guarantees are made that all
+// nodes receive the message (best effort).
+func (c *Connection) BroadcastAt(cluster string, msg []byte, due time.Time) error {
+	if err := c.checkSize(cluster, len(msg)); err != nil {
+		return err
+	}
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	return c.sendChunked(c.assembleBroadcast(msg), func(part *proto.Message) error {
+		return c.iris.scribe.PublishAt(clusterPrefixes[prefixIdx]+cluster, nil, part, due)
+	})
+}
@@ -0,0 +1,120 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Individual scheduled delivery tests.
+func TestScheduleSingleNode(t *testing.T) {
+	testSchedule(t, 1)
+}
+
+func TestScheduleMultiNode(t *testing.T) {
+	testSchedule(t, 5)
+}
+
+// Tests that scheduled events and broadcasts arrive when due, and not before.
+func testSchedule(t *testing.T, nodes int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "schedule-test"
+	cluster := fmt.Sprintf("schedule-test-%d", nodes)
+	topic := fmt.Sprintf("schedule-test-topic-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect to every node and subscribe to the topic
+	liveConns := make([]*Connection, nodes)
+	liveBcasts := make([]*broadcaster, nodes)
+	liveSubs := make([]*subscriber, nodes)
+	for i, node := range liveNodes {
+		liveBcasts[i] = &broadcaster{make(chan []byte, nodes)}
+		conn, err := node.Connect(cluster, liveBcasts[i])
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+
+		liveConns[i] = conn
+		liveSubs[i] = &subscriber{make(chan []byte, nodes)}
+		if err := conn.Subscribe(topic, liveSubs[i]); err != nil {
+			t.Fatalf("failed to subscribe to the topic: %v.", err)
+		}
+	}
+	// Make sure there is a little time to propagate state and reports
+	if nodes > 1 {
+		time.Sleep(3 * time.Second)
+	}
+	// Schedule an event and a broadcast from every node
+	due := time.Now().Add(time.Second)
+	for i, conn := range liveConns {
+		if err := conn.PublishAt(topic, []byte{byte(i)}, due); err != nil {
+			t.Fatalf("node %d: failed to schedule event: %v.", i, err)
+		}
+		if err := conn.BroadcastAt(cluster, []byte{byte(i)}, due); err != nil {
+			t.Fatalf("node %d: failed to schedule broadcast: %v.", i, err)
+		}
+	}
+	// Verify that nothing arrives before due, and everything after
+	time.Sleep(due.Sub(time.Now()) - 250*time.Millisecond)
+	for i := 0; i < nodes; i++ {
+		if n := len(liveSubs[i].msgs); n != 0 {
+			t.Fatalf("node %d: events arrived before due: %v.", i, n)
+		}
+		if n := len(liveBcasts[i].msgs); n != 0 {
+			t.Fatalf("node %d: broadcasts arrived before due: %v.", i, n)
+		}
+	}
+	time.Sleep(time.Second)
+	for i := 0; i < nodes; i++ {
+		if n := len(liveSubs[i].msgs); n != nodes {
+			t.Fatalf("node %d: event count mismatch: have %v, want %v.", i, n, nodes)
+		}
+		if n := len(liveBcasts[i].msgs); n != nodes {
+			t.Fatalf("node %d: broadcast count mismatch: have %v, want %v.", i, n, nodes)
+		}
+	}
+}
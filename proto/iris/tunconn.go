@@ -0,0 +1,241 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Network name reported by the addresses of tunnel stream adapters.
+const tunnelNetwork = "iris"
+
+// Address of a tunnel endpoint, identified by the cluster of its connection.
+type TunnelAddr string
+
+// Implements net.Addr, returning the network name of iris tunnels.
+func (a TunnelAddr) Network() string {
+	return tunnelNetwork
+}
+
+// Implements net.Addr, returning the cluster name of the endpoint.
+func (a TunnelAddr) String() string {
+	return string(a)
+}
+
+// Timeout error reported by the stream adapter when an I/O deadline fires.
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// Byte stream adapter over a message tunnel, implementing net.Conn. Writes are
+// split into messages of at most config.IrisTunnelFrame bytes, whereas reads
+// reassemble the stream, ignoring the original message boundaries.
+type TunnelConn struct {
+	tun *Tunnel // Message tunnel carrying the stream
+
+	rlock sync.Mutex // Serializes readers (and guards the leftover data)
+	wlock sync.Mutex // Serializes writers to keep the stream ordered
+	left  []byte     // Remainder of a partially read message
+	eof   bool       // Flag whether the remote side closed the tunnel
+
+	dlock  sync.Mutex // Protects the deadlines and the close flag
+	rdead  time.Time  // Deadline of pending and future reads
+	wdead  time.Time  // Deadline of pending and future writes
+	closed bool       // Flag whether the adapter was closed locally
+}
+
+// Wraps an established tunnel into a byte stream connection. The tunnel should
+// not be used directly afterwards.
+func NewTunnelConn(tun *Tunnel) *TunnelConn {
+	return &TunnelConn{tun: tun}
+}
+
+// Reads data from the tunnel into b, blocking until at least one byte arrives,
+// the read deadline passes or the tunnel is closed (io.EOF).
+func (c *TunnelConn) Read(b []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	for len(c.left) == 0 {
+		if c.isClosed() {
+			return 0, ErrClosed
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		// Wait for the next message, but at most a polling period to notice deadline changes
+		wait := config.IrisTunnelPoll
+		if deadline := c.readDeadline(); !deadline.IsZero() {
+			left := deadline.Sub(time.Now())
+			if left <= 0 {
+				return 0, &timeoutError{}
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+		msg, err := c.tun.Recv(wait)
+		switch err {
+		case nil:
+			c.left = msg
+		case ErrTimeout:
+			continue
+		case ErrTerminating:
+			c.eof = true
+		default:
+			return 0, err
+		}
+	}
+	n := copy(b, c.left)
+	c.left = c.left[n:]
+	return n, nil
+}
+
+// Writes b into the tunnel, splitting it into frames. The data is copied, so the
+// caller may reuse the buffer after return.
+func (c *TunnelConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.isClosed() {
+		return 0, ErrClosed
+	}
+	// Set up the write deadline for the whole operation
+	var deadline <-chan time.Time
+	if dead := c.writeDeadline(); !dead.IsZero() {
+		left := dead.Sub(time.Now())
+		if left <= 0 {
+			return 0, &timeoutError{}
+		}
+		timer := time.NewTimer(left)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	// Frame the data and send each chunk (copied, as encryption works in place)
+	n := 0
+	for n < len(b) {
+		size := len(b) - n
+		if size > config.IrisTunnelFrame {
+			size = config.IrisTunnelFrame
+		}
+		frame := make([]byte, size)
+		copy(frame, b[n:n+size])
+
+		if err := c.tun.send(frame, deadline); err != nil {
+			if err == ErrTimeout {
+				return n, &timeoutError{}
+			}
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// Closes the underlying tunnel. Blocked reads return once the tunnel link is
+// torn down.
+func (c *TunnelConn) Close() error {
+	c.dlock.Lock()
+	if c.closed {
+		c.dlock.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.dlock.Unlock()
+
+	return c.tun.Close()
+}
+
+// Closes the write side of the underlying tunnel. The remote reads io.EOF after
+// consuming the pending data, but may still keep writing.
+func (c *TunnelConn) CloseWrite() error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	return c.tun.CloseWrite()
+}
+
+// Returns the cluster of the local tunnel endpoint.
+func (c *TunnelConn) LocalAddr() net.Addr {
+	return TunnelAddr(c.tun.owner.cluster)
+}
+
+// Returns the cluster of the remote tunnel endpoint.
+func (c *TunnelConn) RemoteAddr() net.Addr {
+	return TunnelAddr(c.tun.remote)
+}
+
+// Sets both the read and write deadlines. A zero value disables them.
+func (c *TunnelConn) SetDeadline(t time.Time) error {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+
+	c.rdead, c.wdead = t, t
+	return nil
+}
+
+// Sets the deadline of pending and future reads. A zero value disables it.
+func (c *TunnelConn) SetReadDeadline(t time.Time) error {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+
+	c.rdead = t
+	return nil
+}
+
+// Sets the deadline of future writes. A zero value disables it.
+func (c *TunnelConn) SetWriteDeadline(t time.Time) error {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+
+	c.wdead = t
+	return nil
+}
+
+// Retrieves the current read deadline.
+func (c *TunnelConn) readDeadline() time.Time {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+
+	return c.rdead
+}
+
+// Retrieves the current write deadline.
+func (c *TunnelConn) writeDeadline() time.Time {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+
+	return c.wdead
+}
+
+// Checks whether the adapter was closed locally.
+func (c *TunnelConn) isClosed() bool {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+
+	return c.closed
+}
@@ -0,0 +1,208 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connection handler for the tunnel stream tests, echoing back all data.
+type streamer struct{}
+
+func (s *streamer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to stream handler")
+}
+
+func (s *streamer) HandleRequest(req []byte, timeout time.Duration) []byte {
+	panic("Request passed to stream handler")
+}
+
+func (s *streamer) HandleTunnel(tun *Tunnel) {
+	conn := NewTunnelConn(tun)
+	io.Copy(conn, conn)
+	conn.Close()
+}
+
+func (s *streamer) HandleDrop(reason error) {
+	panic("Connection dropped on stream handler")
+}
+
+func TestTunnelConn(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "tunconn-test"
+	cluster := "tunconn-test"
+
+	// Boot the iris overlay
+	node := New(overlay, key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect(cluster, new(streamer))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Establish a tunnel and wrap it into a stream
+	tun, err := conn.Tunnel(cluster, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	strm := NewTunnelConn(tun)
+	defer strm.Close()
+
+	if addr := strm.RemoteAddr(); addr.Network() != "iris" || addr.String() != cluster {
+		t.Fatalf("remote address mismatch: have %v/%v, want %v/%v.", addr.Network(), addr, "iris", cluster)
+	}
+	if addr := strm.LocalAddr(); addr.String() != cluster {
+		t.Fatalf("local address mismatch: have %v, want %v.", addr, cluster)
+	}
+	// Stream a large blob through the echo handler and verify the result
+	data := make([]byte, 1024*1024)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatalf("failed to generate random data: %v.", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := strm.Write(data)
+		errc <- err
+	}()
+	echo := make([]byte, len(data))
+	strm.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(strm, echo); err != nil {
+		t.Fatalf("failed to read echoed data: %v.", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to write data: %v.", err)
+	}
+	if !bytes.Equal(data, echo) {
+		t.Fatalf("echoed data mismatch.")
+	}
+	// Verify that read deadlines are reported as net timeouts
+	strm.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+	if _, err := strm.Read(echo); err == nil {
+		t.Fatalf("read succeeded without data.")
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("read error mismatch: have %v, want timeout.", err)
+	}
+}
+
+func TestTunnelRelay(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "tunnel-relay-test"
+	cluster := "tunnel-relay-test"
+
+	// Boot the iris overlay
+	node := New(overlay, key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect(cluster, new(streamer))
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Make sure reachable endpoints get a direct tunnel
+	tun, err := conn.Tunnel(cluster, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	if mode := tun.Mode(); mode != DirectTunnel {
+		t.Fatalf("tunnel mode mismatch: have %v, want %v.", mode, DirectTunnel)
+	}
+	if err := tun.Close(); err != nil {
+		t.Fatalf("failed to tear down tunnel: %v.", err)
+	}
+	// Advertise an unreachable listener and check the relayed fallback
+	node.lock.Lock()
+	addrs := node.tunAddrs
+	node.tunAddrs = []string{"127.0.0.1:1"}
+	node.lock.Unlock()
+	defer func() {
+		node.lock.Lock()
+		node.tunAddrs = addrs
+		node.lock.Unlock()
+	}()
+
+	tun, err = conn.Tunnel(cluster, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish relayed tunnel: %v.", err)
+	}
+	if mode := tun.Mode(); mode != RelayedTunnel {
+		t.Fatalf("tunnel mode mismatch: have %v, want %v.", mode, RelayedTunnel)
+	}
+	strm := NewTunnelConn(tun)
+
+	// Stream a blob larger than the window through the echo handler
+	data := make([]byte, 256*1024)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatalf("failed to generate random data: %v.", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := strm.Write(data)
+		errc <- err
+	}()
+	echo := make([]byte, len(data))
+	strm.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(strm, echo); err != nil {
+		t.Fatalf("failed to read echoed data: %v.", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to write data: %v.", err)
+	}
+	if !bytes.Equal(data, echo) {
+		t.Fatalf("echoed data mismatch.")
+	}
+	if err := strm.Close(); err != nil {
+		t.Fatalf("failed to tear down relayed tunnel: %v.", err)
+	}
+}
@@ -27,8 +27,10 @@ import (
 	"hash"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"sort"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
@@ -44,17 +46,68 @@ type initPacket struct {
 	TunId  uint64 // Id of the tunnel being built
 }
 
-// Authorization packet to send over the established encrypted tunnels.
+// Authorization packet to send over the established encrypted tunnels, also
+// advertising whether compressed payloads are accepted.
 type authPacket struct {
-	Id uint64
+	Id       uint64
+	Compress bool
 }
 
-// Make sure the handshake packets are registered with gob.
+// Write side termination packet, queued after all pending data messages.
+type finPacket struct {
+}
+
+// Acknowledgement of a remote write side termination, sent after all preceding
+// data messages were received.
+type ackPacket struct {
+}
+
+// Make sure the handshake and tear-down packets are registered with gob.
 func init() {
 	gob.Register(&initPacket{})
 	gob.Register(&authPacket{})
+	gob.Register(&finPacket{})
+	gob.Register(&ackPacket{})
 }
 
+// Error returned when sending through a tunnel after its write side was closed.
+var ErrClosed = errors.New("tunnel closed")
+
+// Transport mode of an established tunnel.
+type TunnelMode uint8
+
+const (
+	DirectTunnel  TunnelMode = iota // Dedicated encrypted stream between the endpoints
+	RelayedTunnel                   // Messages relayed through the overlay network
+)
+
+// Implements fmt.Stringer, returning the name of the tunnel mode.
+func (m TunnelMode) String() string {
+	switch m {
+	case DirectTunnel:
+		return "direct"
+	case RelayedTunnel:
+		return "relayed"
+	default:
+		return fmt.Sprintf("unknown mode %d", m)
+	}
+}
+
+// Ordered message transport carrying the data of an established tunnel.
+type carrier interface {
+	outbox() chan<- *proto.Message // Queue of messages to send to the remote endpoint
+	inbox() <-chan *proto.Message  // Queue of messages arrived from the remote, closed on tear-down
+	Close() error                  // Flushes the outbound queue and tears down the transport
+}
+
+// Carrier of a tunnel connected directly via an encrypted stream link.
+type directLink struct {
+	*link.Link
+}
+
+func (d *directLink) outbox() chan<- *proto.Message { return d.Send }
+func (d *directLink) inbox() <-chan *proto.Message  { return d.Recv }
+
 func (o *Overlay) tunneler(ipnet *net.IPNet, live chan struct{}, quit chan chan error) {
 	// Listen for incoming streams on the given interface and random port.
 	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), "0"))
@@ -109,14 +162,23 @@ func (o *Overlay) tunneler(ipnet *net.IPNet, live chan struct{}, quit chan chan
 // Communication stream between the local app and a remote endpoint. Ordered
 // message delivery is guaranteed.
 type Tunnel struct {
-	id    uint64      // Auto-incremented tunnel identifier
-	owner *Connection // Iris connection through which to communicate
+	id     uint64      // Auto-incremented tunnel identifier
+	owner  *Connection // Iris connection through which to communicate
+	remote string      // Cluster of the remote endpoint
+
+	conn   carrier // Transport carrying the tunnel data
+	secret []byte  // Master key from which to derive the link keys
 
-	conn   *link.Link // Encrypted data link of the tunnel
-	secret []byte     // Master key from which to derive the link keys
+	recv  chan *proto.Message // Data messages demultiplexed from the link
+	acked chan struct{}       // Channel closed when the remote acknowledged the write close
+	drop  chan struct{}       // Channel closed on local close to discard inbound data
 
-	init chan *link.Link // Channel to receive the reverse tunnel link
-	term chan struct{}   // Channel to signal termination to blocked go-routines
+	lock   sync.RWMutex // Serializes the write side close with in-flight sends
+	fin    bool         // Flag whether the write side was already closed
+	closed bool         // Flag whether the tunnel was already torn down
+
+	init chan carrier  // Channel to receive the reverse tunnel link or relay
+	term chan struct{} // Channel to signal termination to blocked go-routines
 }
 
 // Initiates an outgoing tunnel to a remote cluster, by configuring a local
@@ -126,12 +188,14 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 	c.tunLock.Lock()
 	tunId := c.tunIdx
 	tun := &Tunnel{
-		id:    tunId,
-		owner: c,
+		id:     tunId,
+		owner:  c,
+		remote: cluster,
 
-		init: make(chan *link.Link, 1),
+		init: make(chan carrier, 1),
 		term: make(chan struct{}),
 	}
+	tun.setup()
 	c.tunIdx++
 	c.tunLive[tunId] = tun
 	c.tunLock.Unlock()
@@ -143,7 +207,7 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 	}
 	// Send the tunneling request
 	prefixIdx := int(tunId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleTunnelRequest(tunId, tun.secret, c.iris.tunAddrs, timeout))
+	c.iris.scribe.BalanceBy(clusterPrefixes[prefixIdx]+cluster, c.strategy(cluster), nil, c.assembleTunnelRequest(tunId, tun.secret, c.iris.tunAddrs, timeout))
 
 	// Retrieve the results, time out or terminate
 	var err error
@@ -152,10 +216,14 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 		err = ErrTerminating
 	case <-time.After(timeout):
 		err = ErrTimeout
-	case tun.conn = <-tun.init:
-		// Clean up init fields
-		tun.secret, tun.init = nil, nil
-		return tun, nil
+	case conn := <-tun.init:
+		// Confirm relay offers to the accepting endpoint and start the tunnel
+		if relay, ok := conn.(*relayLink); ok {
+			c.iris.scribe.Direct(relay.node, c.assembleRelaySetup(relay.conn, relay.tunId, tunId))
+		}
+		if err = c.establishTunnel(tun, conn); err == nil {
+			return tun, nil
+		}
 	}
 	// Tunneling failed, clean up and report error
 	c.tunLock.Lock()
@@ -166,40 +234,57 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 }
 
 // Accepts an incoming tunneling request from a remote, initializes and stores
-// the new tunnel into the connection state.
-func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
+// the new tunnel into the connection state. If the initiator cannot be reached
+// directly within half of the allowed time, the tunnel is relayed through the
+// overlay instead.
+func (c *Connection) buildTunnel(node *big.Int, remote uint64, cluster string, id uint64, key []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
 	deadline := time.Now().Add(timeout)
+	direct := time.Now().Add(timeout / 2)
 
 	// Create the local tunnel endpoint
 	c.tunLock.Lock()
 	tunId := c.tunIdx
 	tun := &Tunnel{
-		id:    tunId,
-		owner: c,
-		term:  make(chan struct{}),
+		id:     tunId,
+		owner:  c,
+		remote: cluster,
+		init:   make(chan carrier, 1),
+		term:   make(chan struct{}),
 	}
+	tun.setup()
 	c.tunIdx++
 	c.tunLive[tunId] = tun
 	c.tunLock.Unlock()
 
 	// Dial the remote tunnel listener
-	var err error
+	err := errors.New("no tunnel listener")
 	var strm *stream.Stream
 	for _, addr := range addrs {
-		strm, err = stream.Dial(addr, timeout)
+		strm, err = stream.Dial(addr, direct.Sub(time.Now()))
 		if err == nil {
 			break
 		}
 	}
 	// If no error occurred, initialize the client endpoint
+	var conn carrier
 	if err == nil {
-		tun.conn, err = c.initClientTunnel(strm, remote, id, key, deadline)
-		if err != nil {
+		var link *link.Link
+		if link, err = c.initClientTunnel(strm, remote, id, key, direct); err != nil {
 			if err := strm.Close(); err != nil {
 				log.Printf("iris: failed to close uninitialized client tunnel stream: %v.", err)
 			}
+		} else {
+			conn = &directLink{link}
 		}
 	}
+	// If the direct link failed, fall back to relaying through the overlay
+	if err != nil {
+		log.Printf("iris: failed to build direct tunnel, relaying: %v.", err)
+		conn, err = c.acceptRelay(tun, node, remote, id, deadline)
+	}
+	if err == nil {
+		err = c.establishTunnel(tun, conn)
+	}
 	// Tunneling failed, clean up and report error
 	if err != nil {
 		c.tunLock.Lock()
@@ -229,6 +314,10 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	}
 	c.tunLock.RLock()
 	tun, ok := c.tunLive[init.TunId]
+	var pend chan carrier
+	if ok {
+		pend = tun.init
+	}
 	c.tunLock.RUnlock()
 	if !ok {
 		return errors.New("tunnel not found")
@@ -241,7 +330,7 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: &authPacket{Id: tun.id},
+			Meta: &authPacket{Id: tun.id, Compress: config.SessionCompress},
 		},
 	}
 	if err := conn.SendDirect(auth); err != nil {
@@ -251,12 +340,19 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 		return err
 	} else if auth, ok := msg.Head.Meta.(*authPacket); !ok || auth.Id != tun.id {
 		return errors.New("protocol violation")
+	} else {
+		conn.SetCompression(config.SessionCompress && auth.Compress)
 	}
 	conn.Start(config.IrisTunnelBuffer)
 
-	// Send back the initialized link to the pending tunnel
-	tun.init <- conn
-	return nil
+	// Send back the initialized link to the pending tunnel, unless already set up
+	select {
+	case pend <- &directLink{conn}:
+		return nil
+	default:
+		conn.Close()
+		return errors.New("tunnel already established")
+	}
 }
 
 // Initializes a stream into an encrypted tunnel link.
@@ -278,7 +374,7 @@ func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uin
 	// Send and retrieve an authorization to verify both directions
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: &authPacket{Id: id},
+			Meta: &authPacket{Id: id, Compress: config.SessionCompress},
 		},
 	}
 	if err := conn.SendDirect(auth); err != nil {
@@ -288,6 +384,8 @@ func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uin
 		return nil, err
 	} else if auth, ok := msg.Head.Meta.(*authPacket); !ok || auth.Id != id {
 		return nil, errors.New("protocol violation")
+	} else {
+		conn.SetCompression(config.SessionCompress && auth.Compress)
 	}
 	conn.Start(config.IrisTunnelBuffer)
 
@@ -295,14 +393,161 @@ func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uin
 	return conn, nil
 }
 
-// Closes the tunnel connection.
+// Creates the channels of a tunnel endpoint needed before the link is up.
+func (t *Tunnel) setup() {
+	t.recv = make(chan *proto.Message, config.IrisTunnelBuffer)
+	t.acked = make(chan struct{})
+	t.drop = make(chan struct{})
+}
+
+// Attaches an initialized carrier to a pending tunnel and starts processing the
+// inbound messages. If the connection is terminating meanwhile, the tunnel is
+// torn down instead.
+func (c *Connection) establishTunnel(tun *Tunnel, conn carrier) error {
+	c.tunLock.Lock()
+	tun.conn, tun.secret, tun.init = conn, nil, nil
+	if relay, ok := conn.(*relayLink); ok {
+		relay.start()
+	}
+	go tun.pump()
+	c.tunLock.Unlock()
+
+	select {
+	case <-c.term:
+		tun.Close()
+		return ErrTerminating
+	default:
+		return nil
+	}
+}
+
+// Demultiplexes the inbound link messages, passing data upstream and handling
+// the tear-down handshake packets, until the link is closed.
+func (t *Tunnel) pump() {
+	defer close(t.term)
+
+	eof, acked := false, false
+	for msg := range t.conn.inbox() {
+		switch msg.Head.Meta.(type) {
+		case *finPacket:
+			// Remote write side closed, all data arrived: mark the end and acknowledge
+			msg.Release()
+			if !eof {
+				eof = true
+				close(t.recv)
+			}
+			select {
+			case t.conn.outbox() <- &proto.Message{Head: proto.Header{Meta: &ackPacket{}}}:
+			case <-time.After(config.IrisTunnelCloseTimeout):
+				log.Printf("iris: failed to acknowledge tunnel close: timeout.")
+			}
+		case *ackPacket:
+			// Remote acknowledged the local write close
+			msg.Release()
+			if acked {
+				log.Printf("iris: duplicate tunnel close acknowledgement, dropping.")
+				continue
+			}
+			acked = true
+			close(t.acked)
+		default:
+			// Data message, pass upstream unless the read side is gone
+			if eof {
+				log.Printf("iris: data received after tunnel close, dropping.")
+				msg.Release()
+				continue
+			}
+			msg.Detach()
+			select {
+			case t.recv <- msg:
+			case <-t.drop:
+			}
+		}
+	}
+	// Link torn down, signal end of data if not yet done
+	if !eof {
+		close(t.recv)
+	}
+}
+
+// Returns the transport mode of the tunnel.
+func (t *Tunnel) Mode() TunnelMode {
+	if _, ok := t.conn.(*relayLink); ok {
+		return RelayedTunnel
+	}
+	return DirectTunnel
+}
+
+// Closes the write side of the tunnel, signalling the remote endpoint that no
+// more data will follow. Messages already queued are still delivered, and the
+// remote may continue sending until it closes its own side.
+func (t *Tunnel) CloseWrite() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.fin {
+		return ErrClosed
+	}
+	t.fin = true
+
+	select {
+	case t.conn.outbox() <- &proto.Message{Head: proto.Header{Meta: &finPacket{}}}:
+		return nil
+	case <-t.term:
+		return ErrTerminating
+	}
+}
+
+// Gracefully closes the tunnel connection: closes the write side, waits until
+// the remote acknowledges receiving all queued messages (or the close timeout
+// passes) and tears down the link. Inbound data not yet read is discarded.
 func (t *Tunnel) Close() error {
-	// Terminate the encrypted link
-	return t.conn.Close()
+	// Make sure the tunnel is closed only once
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return ErrClosed
+	}
+	t.closed = true
+	t.lock.Unlock()
+
+	// Stop delivering inbound data and flush the write side
+	close(t.drop)
+	t.CloseWrite()
+
+	// Wait for the remote acknowledgement or link termination
+	var res error
+	select {
+	case <-t.acked:
+	case <-t.term:
+	case <-time.After(config.IrisTunnelCloseTimeout):
+		res = ErrTimeout
+	}
+	// Terminate the encrypted link and drop the tunnel
+	if err := t.conn.Close(); res == nil {
+		res = err
+	}
+	t.owner.tunLock.Lock()
+	delete(t.owner.tunLive, t.id)
+	t.owner.tunLock.Unlock()
+
+	return res
 }
 
 // Sends an asynchronous message to the remote pair. Not reentrant (order).
 func (t *Tunnel) Send(msg []byte) error {
+	return t.send(msg, nil)
+}
+
+// Sends an asynchronous message to the remote pair, failing with a timeout if it
+// cannot be queued before the deadline fires (nil never fires).
+func (t *Tunnel) send(msg []byte, deadline <-chan time.Time) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.fin {
+		return ErrClosed
+	}
 	// Create and encrypt the message
 	packet := &proto.Message{Data: msg}
 	if err := packet.Encrypt(); err != nil {
@@ -310,22 +555,24 @@ func (t *Tunnel) Send(msg []byte) error {
 	}
 	// Queue the message for sending
 	select {
-	case t.conn.Send <- packet:
+	case t.conn.outbox() <- packet:
 		return nil
 	case <-t.term:
-		return errors.New("closed")
+		return ErrTerminating
+	case <-deadline:
+		return ErrTimeout
 	}
 }
 
 // Retrieves a message waiting in the local queue. If none is available, the
-// call blocks until either one arrives or a timeout is reached.
+// call blocks until either one arrives or a timeout is reached. After the remote
+// side closed its write side (or the link was torn down) and all pending data
+// was consumed, ErrTerminating is returned.
 func (t *Tunnel) Recv(timeout time.Duration) ([]byte, error) {
-	// Retrieve an encrypted packet from the tunnel link
+	// Retrieve an encrypted packet from the tunnel
 	select {
-	case packet, ok := <-t.conn.Recv:
-		// Terminate the tunnel if closed remotely
+	case packet, ok := <-t.recv:
 		if !ok {
-			close(t.term)
 			return nil, ErrTerminating
 		}
 		// Decrypt and pass upstream
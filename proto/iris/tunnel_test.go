@@ -29,6 +29,7 @@ import (
 	"time"
 
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
 )
 
 // Connection handler for the tunnel tests.
@@ -187,3 +188,169 @@ func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
 		}
 	}
 }
+
+// Connection handler for the tunnel close tests, collecting all inbound data
+// until the remote closes its write side and replying with the message count.
+type halfCloser struct {
+	counts chan int // Number of messages received per tunnel
+}
+
+func (h *halfCloser) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to half-close handler")
+}
+
+func (h *halfCloser) HandleRequest(req []byte, timeout time.Duration) []byte {
+	panic("Request passed to half-close handler")
+}
+
+func (h *halfCloser) HandleTunnel(tun *Tunnel) {
+	defer tun.Close()
+
+	count := 0
+	for {
+		if _, err := tun.Recv(3 * time.Second); err == ErrTerminating {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+		count++
+	}
+	h.counts <- count
+
+	// Remote write side is closed, reply on the still open reverse direction
+	tun.Send([]byte{byte(count)})
+}
+
+func (h *halfCloser) HandleDrop(reason error) {
+	panic("Connection dropped on half-close handler")
+}
+
+func TestTunnelClose(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "tunnel-close-test"
+	cluster := "tunnel-close-test"
+	msgs := 100
+
+	// Boot the iris overlay
+	node := New(overlay, key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	handler := &halfCloser{make(chan int, 2)}
+	server, err := node.Connect(cluster, handler)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := server.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	client, err := node.Connect("tunnel-close-client", handler)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	// Half close a tunnel and check that the reverse direction remains open
+	tun, err := client.Tunnel(cluster, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	for i := 0; i < msgs; i++ {
+		if err := tun.Send([]byte{byte(i)}); err != nil {
+			t.Fatalf("failed to send message: %v.", err)
+		}
+	}
+	if err := tun.CloseWrite(); err != nil {
+		t.Fatalf("failed to close tunnel write side: %v.", err)
+	}
+	if err := tun.Send([]byte{0x00}); err != ErrClosed {
+		t.Fatalf("send after write close error mismatch: have %v, want %v.", err, ErrClosed)
+	}
+	if msg, err := tun.Recv(3 * time.Second); err != nil {
+		t.Fatalf("failed to receive reply: %v.", err)
+	} else if int(msg[0]) != msgs {
+		t.Fatalf("reply mismatch: have %v, want %v.", msg[0], msgs)
+	}
+	if _, err := tun.Recv(3 * time.Second); err != ErrTerminating {
+		t.Fatalf("receive after remote close error mismatch: have %v, want %v.", err, ErrTerminating)
+	}
+	if err := tun.Close(); err != nil {
+		t.Fatalf("failed to tear down tunnel: %v.", err)
+	}
+	if count := <-handler.counts; count != msgs {
+		t.Fatalf("delivered message count mismatch: have %v, want %v.", count, msgs)
+	}
+	// Leave a tunnel open with queued messages and close the whole connection
+	tun, err = client.Tunnel(cluster, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	for i := 0; i < msgs; i++ {
+		if err := tun.Send([]byte{byte(i)}); err != nil {
+			t.Fatalf("failed to send message: %v.", err)
+		}
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("failed to close iris connection: %v.", err)
+	}
+	select {
+	case count := <-handler.counts:
+		if count != msgs {
+			t.Fatalf("delivered message count mismatch: have %v, want %v.", count, msgs)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("tunnel not closed by connection close.")
+	}
+	if err := tun.Send([]byte{0x00}); err != ErrClosed {
+		t.Fatalf("send after connection close error mismatch: have %v, want %v.", err, ErrClosed)
+	}
+}
+
+// Carrier stub feeding a tunnel with hand crafted inbound packets.
+type stubCarrier struct {
+	in  chan *proto.Message
+	out chan *proto.Message
+}
+
+func (s *stubCarrier) outbox() chan<- *proto.Message { return s.out }
+func (s *stubCarrier) inbox() <-chan *proto.Message  { return s.in }
+func (s *stubCarrier) Close() error                  { return nil }
+
+func TestTunnelDuplicateAck(t *testing.T) {
+	conn := &stubCarrier{
+		in:  make(chan *proto.Message, 2),
+		out: make(chan *proto.Message, 1),
+	}
+	tun := &Tunnel{
+		conn: conn,
+		term: make(chan struct{}),
+	}
+	tun.setup()
+	go tun.pump()
+
+	// Acknowledge the write close twice and make sure the tunnel survives
+	for i := 0; i < 2; i++ {
+		conn.in <- &proto.Message{Head: proto.Header{Meta: &ackPacket{}}}
+	}
+	close(conn.in)
+
+	select {
+	case <-tun.term:
+	case <-time.After(time.Second):
+		t.Fatalf("tunnel pump not terminated.")
+	}
+	select {
+	case <-tun.acked:
+	default:
+		t.Fatalf("write close acknowledgement not signalled.")
+	}
+}
@@ -0,0 +1,375 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the wildcard topic subscriptions. Topics are hierarchical, with the
+// segments separated by dots. A pattern may contain '*' segments, matching any
+// single segment, and a trailing '#' segment, matching zero or more segments.
+//
+// To avoid flooding the overlay, wildcard subscriptions are grouped into scribe
+// trees by their anchor: the literal segments preceding the first wildcard. An
+// event published to a topic of depth n is additionally sent to those of the n+1
+// anchor trees which may contain matching patterns (the topic's prefixes) that
+// have live subscribers, and each subscriber filters the events against its own
+// patterns. The overlay nodes announce the anchors they join and withdraw the
+// ones they leave on a registry topic all of them are subscribed to, refreshing
+// the live ones only rarely to repair announcements lost during churn.
+
+package iris
+
+import (
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/filter"
+	"github.com/karalabe/iris/proto"
+)
+
+// Separator of the topic hierarchy levels and the wildcard segments.
+const (
+	topicSeparator = "."
+	wildcardSingle = "*"
+	wildcardMulti  = "#"
+)
+
+// Topic on which the overlay nodes announce their wildcard anchors.
+const anchorTopic = "a#-anchors"
+
+// Wildcard specific errors
+var ErrInvalidPattern = errors.New("invalid wildcard pattern")
+var ErrInvalidTopic = errors.New("wildcard in published topic")
+
+// Checks whether a topic contains wildcard segments.
+func isPattern(topic string) bool {
+	for _, seg := range strings.Split(topic, topicSeparator) {
+		if seg == wildcardSingle || seg == wildcardMulti {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether a wildcard pattern is well formed: the multi-level wildcard is
+// only allowed as the last segment.
+func validPattern(pattern string) bool {
+	segs := strings.Split(pattern, topicSeparator)
+	for i, seg := range segs {
+		if seg == wildcardMulti && i != len(segs)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the anchor of a wildcard pattern, i.e. the literal segments up to the
+// first wildcard.
+func patternAnchor(pattern string) string {
+	segs := strings.Split(pattern, topicSeparator)
+	for i, seg := range segs {
+		if seg == wildcardSingle || seg == wildcardMulti {
+			return strings.Join(segs[:i], topicSeparator)
+		}
+	}
+	return pattern
+}
+
+// Returns all the anchors a concrete topic may be matched by, from the empty
+// root anchor to the full topic itself.
+func topicAnchors(topic string) []string {
+	segs := strings.Split(topic, topicSeparator)
+	anchors := make([]string, len(segs)+1)
+	for i := 1; i <= len(segs); i++ {
+		anchors[i] = strings.Join(segs[:i], topicSeparator)
+	}
+	return anchors
+}
+
+// Checks whether a concrete topic matches a wildcard pattern.
+func matchPattern(pattern, topic string) bool {
+	pats := strings.Split(pattern, topicSeparator)
+	segs := strings.Split(topic, topicSeparator)
+
+	for i, pat := range pats {
+		switch {
+		case pat == wildcardMulti:
+			return true
+		case i >= len(segs):
+			return false
+		case pat != wildcardSingle && pat != segs[i]:
+			return false
+		}
+	}
+	return len(pats) == len(segs)
+}
+
+// Subscribes to a wildcard pattern, joining the anchor's topic trees if no other
+// pattern of the connection did so already.
+func (c *Connection) subscribeWildcard(pattern string, flt *filter.Filter, handler SubscriptionHandler) error {
+	if !validPattern(pattern) {
+		return ErrInvalidPattern
+	}
+	anchor := patternAnchor(pattern)
+
+	// Make sure there are no double subscriptions and not closing
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.wildLive[anchor][pattern]; ok {
+			c.subLock.Unlock()
+			return ErrSubscribed
+		}
+	}
+	patterns, ok := c.wildLive[anchor]
+	if !ok {
+		patterns = make(map[string]SubscriptionHandler)
+		c.wildLive[anchor] = patterns
+	}
+	patterns[pattern] = handler
+	if flt != nil {
+		c.wildFilt[pattern] = flt
+	}
+	c.subLock.Unlock()
+
+	// Join the anchor trees through the carrier if first pattern
+	if !ok {
+		for i, prefix := range wildcardPrefixes {
+			if err := c.iris.subscribe(c.id, prefix+anchor); err != nil {
+				c.rollbackWildcard(anchor, pattern, wildcardPrefixes[:i])
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Removes a wildcard pattern whose subscription failed, leaving the anchor trees
+// already joined if no other pattern of the connection needs them.
+func (c *Connection) rollbackWildcard(anchor, pattern string, joined []string) {
+	c.subLock.Lock()
+	delete(c.wildLive[anchor], pattern)
+	delete(c.wildFilt, pattern)
+	last := len(c.wildLive[anchor]) == 0
+	if last {
+		delete(c.wildLive, anchor)
+	}
+	c.subLock.Unlock()
+
+	if last {
+		for _, prefix := range joined {
+			if err := c.iris.unsubscribe(c.id, prefix+anchor); err != nil {
+				log.Printf("iris: failed to leave wildcard anchor tree: %v.", err)
+			}
+		}
+	}
+}
+
+// Unsubscribes from a wildcard pattern, leaving the anchor's topic trees if no
+// other pattern of the connection needs them.
+func (c *Connection) unsubscribeWildcard(pattern string) error {
+	anchor := patternAnchor(pattern)
+
+	// Remove subscription if present
+	c.subLock.Lock()
+	select {
+	case <-c.term:
+		c.subLock.Unlock()
+		return ErrTerminating
+	default:
+		if _, ok := c.wildLive[anchor][pattern]; !ok {
+			c.subLock.Unlock()
+			return ErrNotSubscribed
+		}
+	}
+	delete(c.wildLive[anchor], pattern)
+	delete(c.wildFilt, pattern)
+	last := len(c.wildLive[anchor]) == 0
+	if last {
+		delete(c.wildLive, anchor)
+	}
+	c.subLock.Unlock()
+
+	// Leave the anchor trees if last pattern
+	if last {
+		for _, prefix := range wildcardPrefixes {
+			if err := c.iris.unsubscribe(c.id, prefix+anchor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Publishes an event into the live wildcard anchor trees a concrete topic may be
+// matched by, chunk by chunk through publish. Each message gets its own copy of
+// the payload, since publishing encrypts in place. The copies are never returned
+// as dead letters, only the exact topic one is.
+func (c *Connection) publishWildcard(prefixIdx int, anchors []string, topic string, headers map[string]string, seq uint64, msg []byte, publish func(string, *proto.Message) error) error {
+	for _, anchor := range anchors {
+		cpy := make([]byte, len(msg))
+		copy(cpy, msg)
+		err := c.sendChunked(c.assemblePublish(topic, headers, seq, false, cpy), func(part *proto.Message) error {
+			return publish(wildcardPrefixes[prefixIdx]+anchor, part)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delivers an event arriving on a wildcard anchor tree to all the patterns of
+// the anchor matching the concrete topic (and the content filters the headers).
+func (c *Connection) handleWildcard(anchor string, topic string, headers map[string]string, origin Member, seq uint64, msg []byte) {
+	// Collect the matching handlers
+	c.subLock.RLock()
+	handlers := []SubscriptionHandler{}
+	for pattern, handler := range c.wildLive[anchor] {
+		if flt, ok := c.wildFilt[pattern]; ok && !flt.Match(headers) {
+			continue
+		}
+		if matchPattern(pattern, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.subLock.RUnlock()
+
+	// Deliver the event
+	for _, handler := range handlers {
+		deliverEvent(handler, origin, seq, msg)
+	}
+}
+
+// Returns the wildcard anchor of a carrier topic, if it is the first of the
+// anchor's trees (the one standing for the anchor in the registry).
+func topicAnchor(topic string) (string, bool) {
+	if !strings.HasPrefix(topic, wildcardPrefixes[0]) {
+		return "", false
+	}
+	return strings.TrimPrefix(topic, wildcardPrefixes[0]), true
+}
+
+// Filters the anchors a concrete topic may be matched by down to the ones which
+// were announced to have live subscribers by at least one node.
+func (o *Overlay) liveAnchors(topic string) []string {
+	o.anchLock.RLock()
+	defer o.anchLock.RUnlock()
+
+	now, live := time.Now(), []string{}
+	for _, anchor := range topicAnchors(topic) {
+		for _, expiry := range o.anchors[anchor] {
+			if now.Before(expiry) {
+				live = append(live, anchor)
+				break
+			}
+		}
+	}
+	return live
+}
+
+// Collects the wildcard anchors with local subscribers.
+func (o *Overlay) localAnchors() []string {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	anchors := []string{}
+	for topic, _ := range o.subLive {
+		if anchor, ok := topicAnchor(topic); ok {
+			anchors = append(anchors, anchor)
+		}
+	}
+	return anchors
+}
+
+// Announces the wildcard anchors with local subscribers and the ones withdrawn
+// to all the overlay nodes, or if query is set, requests all of them to announce
+// their own.
+func (o *Overlay) announceAnchors(anchors []string, gone []string, query bool) {
+	if err := o.scribe.Publish(anchorTopic, o.assembleAnchors(anchors, gone, query)); err != nil {
+		log.Printf("iris: failed to announce wildcard anchors: %v.", err)
+	}
+}
+
+// Periodically re-announces the local wildcard anchors to keep them alive in the
+// remote registries, and drops the expired remote ones, until terminated.
+func (o *Overlay) anchorBeater() {
+	beat := time.NewTicker(config.IrisAnchorBeat)
+	defer beat.Stop()
+
+	for {
+		select {
+		case <-o.anchQuit:
+			return
+		case <-beat.C:
+			if anchors := o.localAnchors(); len(anchors) > 0 {
+				o.announceAnchors(anchors, nil, false)
+			}
+			now := time.Now()
+
+			o.anchLock.Lock()
+			for anchor, nodes := range o.anchors {
+				for node, expiry := range nodes {
+					if !now.Before(expiry) {
+						delete(nodes, node)
+					}
+				}
+				if len(nodes) == 0 {
+					delete(o.anchors, anchor)
+				}
+			}
+			o.anchLock.Unlock()
+		}
+	}
+}
+
+// Registers the wildcard anchors announced by a node and removes the withdrawn
+// ones, answering with the local anchors if the announcement was a query.
+func (o *Overlay) handleAnchors(src *big.Int, anchors []string, gone []string, query bool) {
+	node, expiry := src.String(), time.Now().Add(config.IrisAnchorTimeout)
+
+	o.anchLock.Lock()
+	for _, anchor := range anchors {
+		nodes, ok := o.anchors[anchor]
+		if !ok {
+			nodes = make(map[string]time.Time)
+			o.anchors[anchor] = nodes
+		}
+		nodes[node] = expiry
+	}
+	for _, anchor := range gone {
+		if nodes, ok := o.anchors[anchor]; ok {
+			delete(nodes, node)
+			if len(nodes) == 0 {
+				delete(o.anchors, anchor)
+			}
+		}
+	}
+	o.anchLock.Unlock()
+
+	if query {
+		if anchors := o.localAnchors(); len(anchors) > 0 {
+			go o.announceAnchors(anchors, nil, false)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.deleted", false},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*.created", "orders.eu.x.created", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.eu", true},
+		{"orders.#", "orders.eu.created", true},
+		{"orders.#", "invoices.eu", false},
+		{"*.eu.#", "orders.eu.created", true},
+		{"*.eu.#", "orders.us.created", false},
+		{"#", "orders.eu.created", true},
+	}
+	for i, tt := range tests {
+		if match := matchPattern(tt.pattern, tt.topic); match != tt.match {
+			t.Errorf("test %d: match mismatch for %v on %v: have %v, want %v.", i, tt.pattern, tt.topic, match, tt.match)
+		}
+		if tt.match {
+			found := false
+			for _, anchor := range topicAnchors(tt.topic) {
+				if anchor == patternAnchor(tt.pattern) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("test %d: anchor %v not reached by %v.", i, patternAnchor(tt.pattern), tt.topic)
+			}
+		}
+	}
+	if validPattern("orders.#.created") {
+		t.Errorf("non-trailing multi-level wildcard accepted.")
+	}
+}
+
+// Tests that events are only fanned out into the announced, unexpired and not
+// withdrawn anchors.
+func TestWildcardAnchors(t *testing.T) {
+	o := &Overlay{anchors: make(map[string]map[string]time.Time)}
+	if anchors := o.liveAnchors("orders.eu.created"); len(anchors) != 0 {
+		t.Fatalf("anchors without announcements: have %v, want none.", anchors)
+	}
+	a, b := big.NewInt(1), big.NewInt(2)
+
+	o.handleAnchors(a, []string{"orders", "invoices"}, nil, false)
+	o.anchors["orders.eu"] = map[string]time.Time{a.String(): time.Now().Add(-time.Second)}
+
+	anchors := o.liveAnchors("orders.eu.created")
+	if len(anchors) != 1 || anchors[0] != "orders" {
+		t.Fatalf("live anchor mismatch: have %v, want [orders].", anchors)
+	}
+	o.handleAnchors(b, []string{"", "orders"}, nil, false)
+	if anchors := o.liveAnchors("orders.eu.created"); len(anchors) != 2 {
+		t.Fatalf("live anchor mismatch: have %v, want [ orders].", anchors)
+	}
+	// Withdrawn anchors should stay live only while others announce them
+	o.handleAnchors(a, nil, []string{"orders"}, false)
+	if anchors := o.liveAnchors("orders.eu.created"); len(anchors) != 2 {
+		t.Fatalf("live anchor mismatch: have %v, want [ orders].", anchors)
+	}
+	o.handleAnchors(b, nil, []string{"", "orders"}, false)
+	if anchors := o.liveAnchors("orders.eu.created"); len(anchors) != 0 {
+		t.Fatalf("withdrawn anchors live: have %v, want none.", anchors)
+	}
+	if _, ok := o.anchors["orders"]; ok {
+		t.Fatalf("withdrawn anchor left in the registry.")
+	}
+}
+
+// Individual wildcard tests.
+func TestWildcardSingleNode(t *testing.T) {
+	testWildcard(t, 1)
+}
+
+func TestWildcardMultiNode(t *testing.T) {
+	testWildcard(t, 5)
+}
+
+// Tests that events reach the exact and the matching wildcard subscribers, and
+// that the anchors are withdrawn when the last patterns are unsubscribed.
+func testWildcard(t *testing.T, nodes int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "wildcard-test"
+	cluster := fmt.Sprintf("wildcard-test-%d", nodes)
+	base := fmt.Sprintf("wildcard-test-%d", nodes)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Subscribe with each node to an exact topic and two patterns
+	patterns := []string{base + ".eu.created", base + ".*.created", base + ".#"}
+	expects := []int{1, 1, 3}
+
+	liveHands := make([][]*subscriber, nodes)
+	liveConns := make([]*Connection, nodes)
+	for i, node := range liveNodes {
+		conn, err := node.Connect(cluster, nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+		liveConns[i] = conn
+
+		liveHands[i] = make([]*subscriber, len(patterns))
+		for j, pattern := range patterns {
+			liveHands[i][j] = &subscriber{make(chan []byte, 16)}
+			if err := conn.Subscribe(pattern, liveHands[i][j]); err != nil {
+				t.Fatalf("failed to subscribe to %v: %v.", pattern, err)
+			}
+		}
+		if err := conn.Subscribe(base+".#.created", liveHands[i][0]); err != ErrInvalidPattern {
+			t.Fatalf("invalid pattern error mismatch: have %v, want %v.", err, ErrInvalidPattern)
+		}
+	}
+	// Make sure there is a little time to propagate state and reports
+	if nodes > 1 {
+		time.Sleep(time.Second)
+	}
+	// Publish a few events from the first node
+	conn, err := liveNodes[0].Connect(cluster, nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	for _, topic := range []string{base + ".eu.created", base + ".us.deleted", base} {
+		if err := conn.Publish(topic, []byte(topic)); err != nil {
+			t.Fatalf("failed to publish to %v: %v.", topic, err)
+		}
+	}
+	if err := conn.Publish(base+".*.created", nil); err != ErrInvalidTopic {
+		t.Fatalf("wildcard publish error mismatch: have %v, want %v.", err, ErrInvalidTopic)
+	}
+	// Verify the number of events received by each subscription
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < nodes; i++ {
+		for j, pattern := range patterns {
+			if n := len(liveHands[i][j].msgs); n != expects[j] {
+				t.Fatalf("node %d, %v: event count mismatch: have %v, want %v.", i, pattern, n, expects[j])
+			}
+		}
+	}
+	// Unsubscribe all the patterns and verify that the anchors are withdrawn
+	for i, conn := range liveConns {
+		for _, pattern := range patterns[1:] {
+			if err := conn.Unsubscribe(pattern); err != nil {
+				t.Fatalf("node %d: failed to unsubscribe from %v: %v.", i, pattern, err)
+			}
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	for i, node := range liveNodes {
+		if anchors := node.liveAnchors(base + ".eu.created"); len(anchors) != 0 {
+			t.Fatalf("node %d: withdrawn anchors live: have %v, want none.", i, anchors)
+		}
+	}
+}
@@ -21,36 +21,88 @@
 package link
 
 import (
-	"bytes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"encoding/gob"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 
+	"code.google.com/p/go.crypto/hkdf"
 	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/stream"
+	"github.com/karalabe/iris/proto/wire"
 )
 
+// Errors returned for frames failing the sequence or authenticity checks.
+var (
+	ErrReplay  = errors.New("replayed frame")
+	ErrReorder = errors.New("reordered frame")
+	ErrCorrupt = errors.New("corrupt frame")
+)
+
+// Size of the sequence number prefixing the MAC in the frame trailers.
+const seqSize = 8
+
 // Link termination message for graceful tear-down.
 type closePacket struct {
 }
 
-// Make sure the close packet is registered with gob.
+// Key renewal message, after which the sender switches to the keys derived
+// from the current ones and the attached nonce.
+type rekeyPacket struct {
+	Nonce []byte
+}
+
+// Make sure the link packets are registered with the wire codecs.
 func init() {
-	gob.Register(&closePacket{})
+	wire.Register(wire.LinkClose, func() wire.Codec { return new(closePacket) })
+	wire.Register(wire.LinkRekey, func() wire.Codec { return new(rekeyPacket) })
+}
+
+// Implements wire.Codec, the close packet has no fields.
+func (p *closePacket) EncodeWire(enc *wire.Encoder) {
+}
+
+// Implements wire.Codec, skipping any (future) fields of the close packet.
+func (p *closePacket) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		dec.Skip()
+	}
+	return dec.Err()
+}
+
+// Implements wire.Codec, appending the fields of the rekey packet.
+func (p *rekeyPacket) EncodeWire(enc *wire.Encoder) {
+	enc.Bytes(1, p.Nonce)
+}
+
+// Implements wire.Codec, restoring the fields of the rekey packet.
+func (p *rekeyPacket) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			p.Nonce = dec.Bytes()
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
 }
 
 // Accomplishes secure and authenticated full duplex communication. Note, only
 // the headers are encrypted and decrypted. It is the responsibility of the
 // caller to call proto.Message.Encrypt/Decrypt (link would bottleneck).
 type Link struct {
+	stats Stats // Traffic counters of the link (first for 64 bit atomic alignment)
+
 	socket *stream.Stream
 
 	inCipher  cipher.Stream
@@ -59,14 +111,24 @@ type Link struct {
 	inMacer  hash.Hash
 	outMacer hash.Hash
 
-	inBuffer  bytes.Buffer
-	outBuffer bytes.Buffer
+	inSecret  []byte // Rekey secret of the inbound channel to derive new keys from
+	outSecret []byte // Rekey secret of the outbound channel to derive new keys from
+
+	outCoder wire.Encoder
+
+	inHeadBuf  []byte
+	inTrailer  []byte
+	inMacSum   []byte
+	outTrailer []byte
+
+	inSeq  uint64 // Sequence number of the next expected inbound frame
+	outSeq uint64 // Sequence number of the next outbound frame
 
-	inCoder  *gob.Decoder
-	outCoder *gob.Encoder
+	compress bool // Whether the remote peer accepts compressed payloads
 
-	inHeadBuf []byte
-	inMacBuf  []byte
+	rekey    bool      // Whether the remote peer accepts key renewals
+	outBytes uint64    // Bytes sent since the last outbound key renewal
+	outKeyed time.Time // Time of the last outbound key renewal
 
 	Send     chan *proto.Message
 	Recv     chan *proto.Message
@@ -79,26 +141,61 @@ type Link struct {
 // channels (server keys first, client key second).
 func New(conn *stream.Stream, hkdf io.Reader, server bool) *Link {
 	l := &Link{
-		socket: conn,
+		socket:   conn,
+		outKeyed: time.Now(),
 	}
 	// Create the duplex channel
-	sc, sm := makeHalfDuplex(hkdf)
-	cc, cm := makeHalfDuplex(hkdf)
+	sc, sm, ss := makeHalfDuplex(hkdf)
+	cc, cm, cs := makeHalfDuplex(hkdf)
 	if server {
 		l.inCipher, l.outCipher, l.inMacer, l.outMacer = cc, sc, cm, sm
+		l.inSecret, l.outSecret = cs, ss
 	} else {
 		l.inCipher, l.outCipher, l.inMacer, l.outMacer = sc, cc, sm, cm
+		l.inSecret, l.outSecret = ss, cs
 	}
-	// Create the gob coders
-	l.inCoder = gob.NewDecoder(&l.inBuffer)
-	l.outCoder = gob.NewEncoder(&l.outBuffer)
-
+	l.outTrailer = make([]byte, seqSize, seqSize+l.outMacer.Size())
 	return l
 }
 
+// Traffic statistics of an encrypted link. Raw sizes are the payload lengths
+// before compression, wire sizes the lengths actually transferred.
+type Stats struct {
+	SentMsgs uint64 // Number of messages sent
+	SentRaw  uint64 // Payload bytes sent before compression
+	SentWire uint64 // Payload bytes sent over the wire
+	RecvMsgs uint64 // Number of messages received
+	RecvRaw  uint64 // Payload bytes received after decompression
+	RecvWire uint64 // Payload bytes received over the wire
+
+	Replayed  uint64 // Number of inbound frames discarded as replays
+	Reordered uint64 // Number of inbound frames arriving out of sequence
+	Corrupted uint64 // Number of inbound frames failing authentication
+
+	SentRekeys uint64 // Number of outbound key renewals
+	RecvRekeys uint64 // Number of inbound key renewals
+}
+
+// Returns the compression ratio of the outbound payloads (raw / wire).
+func (s Stats) SentRatio() float64 {
+	if s.SentWire == 0 {
+		return 1
+	}
+	return float64(s.SentRaw) / float64(s.SentWire)
+}
+
+// Returns the compression ratio of the inbound payloads (raw / wire).
+func (s Stats) RecvRatio() float64 {
+	if s.RecvWire == 0 {
+		return 1
+	}
+	return float64(s.RecvRaw) / float64(s.RecvWire)
+}
+
 // Assembles the crypto primitives needed for a one way communication channel:
-// the stream cipher for encryption and the mac for authentication.
-func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash) {
+// the stream cipher for encryption and the mac for authentication. A dedicated
+// secret is also extracted, from which the renewed keys are derived.
+func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash, []byte) {
 	// Extract the symmetric key and create the block cipher
 	key := make([]byte, config.SessionCipherBits/8)
 	n, err := io.ReadFull(hkdf, key)
@@ -125,7 +222,63 @@ func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash) {
 	}
 	mac := hmac.New(config.SessionHash, salt)
 
-	return stream, mac
+	// Extract the secret to derive the renewed keys from
+	secret := make([]byte, config.SessionHash().Size())
+	n, err = io.ReadFull(hkdf, secret)
+	if n != len(secret) || err != nil {
+		panic(fmt.Sprintf("Failed to extract session rekey secret: %v", err))
+	}
+	return stream, mac, secret
+}
+
+// Derives the renewed crypto primitives of a one way communication channel from
+// its current rekey secret and the nonce exchanged in the rekey packet.
+func rekeyHalfDuplex(secret, nonce []byte) (cipher.Stream, hash.Hash, []byte) {
+	hasher := func() hash.Hash { return config.HkdfHash.New() }
+	return makeHalfDuplex(hkdf.New(hasher, secret, nonce, config.HkdfInfo))
+}
+
+// Sets whether the remote side negotiated to accept compressed payloads. Must
+// be called before starting the transfers.
+func (l *Link) SetCompression(enabled bool) {
+	l.compress = enabled
+}
+
+// Returns whether compressed payloads are forwarded as is on the link.
+func (l *Link) Compression() bool {
+	return l.compress
+}
+
+// Sets whether both sides negotiated key renewals, after which the outbound
+// keys are rekeyed by traffic volume and, once started, periodically even if
+// idle. Must be called before starting the transfers. Inbound renewals are
+// always accepted.
+func (l *Link) SetRekeying(enabled bool) {
+	l.rekey = enabled
+}
+
+// Returns whether the outbound keys are periodically renewed on the link.
+func (l *Link) Rekeying() bool {
+	return l.rekey
+}
+
+// Retrieves a snapshot of the link's traffic statistics.
+func (l *Link) Stats() Stats {
+	return Stats{
+		SentMsgs: atomic.LoadUint64(&l.stats.SentMsgs),
+		SentRaw:  atomic.LoadUint64(&l.stats.SentRaw),
+		SentWire: atomic.LoadUint64(&l.stats.SentWire),
+		RecvMsgs: atomic.LoadUint64(&l.stats.RecvMsgs),
+		RecvRaw:  atomic.LoadUint64(&l.stats.RecvRaw),
+		RecvWire: atomic.LoadUint64(&l.stats.RecvWire),
+
+		Replayed:  atomic.LoadUint64(&l.stats.Replayed),
+		Reordered: atomic.LoadUint64(&l.stats.Reordered),
+		Corrupted: atomic.LoadUint64(&l.stats.Corrupted),
+
+		SentRekeys: atomic.LoadUint64(&l.stats.SentRekeys),
+		RecvRekeys: atomic.LoadUint64(&l.stats.RecvRekeys),
+	}
 }
 
 // Creates the buffer channels and starts the transfer processes.
@@ -174,6 +327,9 @@ func (l *Link) Close() error {
 // The actual message sending logic. Calculates the payload MAC, encrypts the
 // headers and sends it down to the stream. Direct send is public for handshake
 // simplifications. After that is done, the link should switch to channel mode.
+//
+// If the rekey thresholds were reached, the outbound keys are renewed before the
+// message is sent.
 func (l *Link) SendDirect(msg *proto.Message) error {
 	var err error
 
@@ -182,63 +338,193 @@ func (l *Link) SendDirect(msg *proto.Message) error {
 		log.Printf("link: unsecured data, send denied.")
 		return errors.New("unsecured data, send denied")
 	}
-	// Flatten and encrypt the headers
-	if err = l.outCoder.Encode(msg.Head); err != nil {
+	// Inflate compressed payloads if the remote side cannot handle them
+	if !l.compress && msg.Head.Size > 0 {
+		if msg, err = msg.Inflated(); err != nil {
+			return err
+		}
+	}
+	// Renew the outbound keys if enough data or time passed
+	if l.rekey {
+		if (config.SessionRekeyBytes > 0 && l.outBytes >= config.SessionRekeyBytes) ||
+			(config.SessionRekeyPeriod > 0 && time.Since(l.outKeyed) >= config.SessionRekeyPeriod) {
+			if err = l.rekeyOut(); err != nil {
+				return err
+			}
+		}
+	}
+	if err = l.send(msg); err != nil {
 		return err
 	}
-	l.outCipher.XORKeyStream(l.outBuffer.Bytes(), l.outBuffer.Bytes())
-	defer l.outBuffer.Reset()
+	// Update the traffic statistics
+	atomic.AddUint64(&l.stats.SentMsgs, 1)
+	atomic.AddUint64(&l.stats.SentRaw, uint64(payloadSize(msg)))
+	atomic.AddUint64(&l.stats.SentWire, uint64(len(msg.Data)))
+	return nil
+}
 
-	// Generate the MAC of the encrypted payload and headers
-	l.outMacer.Write(l.outBuffer.Bytes())
+// Encrypts the headers, MACs the whole message along with its sequence number
+// and sends it down the stream. Every frame is authenticated independently, so
+// the receiver can verify the sequence number before classifying it.
+func (l *Link) send(msg *proto.Message) error {
+	// Flatten and encrypt the headers
+	head := l.outCoder.Encode(&msg.Head)
+	l.outCipher.XORKeyStream(head, head)
+
+	// Generate the MAC of the sequence number, encrypted payload and headers
+	binary.BigEndian.PutUint64(l.outTrailer[:seqSize], l.outSeq)
+
+	l.outMacer.Reset()
+	l.outMacer.Write(l.outTrailer[:seqSize])
+	l.outMacer.Write(head)
 	l.outMacer.Write(msg.Data)
 
-	// Send the multi-part message (headers + payload + MAC)
-	if err = l.socket.Send(l.outBuffer.Bytes()); err != nil {
+	// Send the multi-part message (headers + payload + sequence number and MAC)
+	if err := l.socket.SendBytes(head); err != nil {
+		return err
+	}
+	if err := l.socket.SendBytes(msg.Data); err != nil {
+		return err
+	}
+	l.outTrailer = l.outMacer.Sum(l.outTrailer[:seqSize])
+	if err := l.socket.SendBytes(l.outTrailer); err != nil {
 		return err
 	}
-	if err = l.socket.Send(msg.Data); err != nil {
+	if err := l.socket.Flush(); err != nil {
 		return err
 	}
-	if err = l.socket.Send(l.outMacer.Sum(nil)); err != nil {
+	l.outSeq++
+	l.outBytes += uint64(len(head) + len(msg.Data))
+	return nil
+}
+
+// Renews the outbound keys: sends a fresh nonce to the remote side under the
+// current keys, and then switches to the ones derived from it.
+func (l *Link) rekeyOut() error {
+	nonce := make([]byte, config.SessionHash().Size())
+	if n, err := io.ReadFull(rand.Reader, nonce); n != len(nonce) || err != nil {
+		return fmt.Errorf("failed to generate rekey nonce: %v", err)
+	}
+	pkt := &proto.Message{
+		Head: proto.Header{
+			Meta: &rekeyPacket{Nonce: nonce},
+		},
+	}
+	if err := l.send(pkt); err != nil {
 		return err
 	}
-	return l.socket.Flush()
+	l.outCipher, l.outMacer, l.outSecret = rekeyHalfDuplex(l.outSecret, nonce)
+	l.outBytes, l.outKeyed = 0, time.Now()
+
+	atomic.AddUint64(&l.stats.SentRekeys, 1)
+	return nil
+}
+
+// Calculates the original size of a (possibly compressed) message payload.
+func payloadSize(msg *proto.Message) int {
+	if msg.Head.Size > 0 {
+		return msg.Head.Size
+	}
+	return len(msg.Data)
 }
 
 // The actual message receiving logic. Reads a message from the stream, verifies
 // its mac, decodes the headers and send it upwards. Direct receive is public for
 // handshake simplifications, after which the link should switch to channel mode.
+//
+// Key renewals of the remote side are handled transparently, these packets are
+// never returned. Replayed frames are discarded, whereas reordered and corrupt
+// ones are reported with ErrReorder and ErrCorrupt, the link being unusable
+// afterwards. The returned message is pooled, the receiver should release it
+// when done.
 func (l *Link) RecvDirect() (*proto.Message, error) {
-	var msg proto.Message
+	for {
+		msg, err := l.recv()
+		switch err {
+		case nil:
+			// Ok, process below
+		case ErrReplay:
+			atomic.AddUint64(&l.stats.Replayed, 1)
+			continue
+		case ErrReorder:
+			atomic.AddUint64(&l.stats.Reordered, 1)
+			return nil, err
+		case ErrCorrupt:
+			atomic.AddUint64(&l.stats.Corrupted, 1)
+			return nil, err
+		default:
+			return nil, err
+		}
+		// Switch to the renewed inbound keys if requested
+		if pkt, ok := msg.Head.Meta.(*rekeyPacket); ok {
+			l.inCipher, l.inMacer, l.inSecret = rekeyHalfDuplex(l.inSecret, pkt.Nonce)
+			msg.Release()
+
+			atomic.AddUint64(&l.stats.RecvRekeys, 1)
+			continue
+		}
+		// Update the traffic statistics
+		atomic.AddUint64(&l.stats.RecvMsgs, 1)
+		atomic.AddUint64(&l.stats.RecvRaw, uint64(payloadSize(msg)))
+		atomic.AddUint64(&l.stats.RecvWire, uint64(len(msg.Data)))
+
+		// Set the message security knowingly to true
+		msg.KnownSecure()
+		return msg, nil
+	}
+}
+
+// Reads a message from the stream, verifies its mac and sequence number, and
+// decodes the headers. Only authenticated frames are classified as replayed or
+// reordered, anything failing the mac is corrupt. Rejected frames leave the
+// cipher state untouched.
+func (l *Link) recv() (*proto.Message, error) {
 	var err error
 
 	// Retrieve a new package
 	if err = l.socket.Recv(&l.inHeadBuf); err != nil {
 		return nil, err
 	}
-	if err = l.socket.Recv(&msg.Data); err != nil {
+	buf, err := l.socket.RecvBuffer()
+	if err != nil {
 		return nil, err
 	}
-	if err = l.socket.Recv(&l.inMacBuf); err != nil {
+	msg := proto.Acquire(buf)
+	if err = l.socket.Recv(&l.inTrailer); err != nil {
+		msg.Release()
 		return nil, err
 	}
-	// Verify the message contents (payload + header)
+	// Verify the message contents (sequence number + header + payload)
+	if len(l.inTrailer) < seqSize {
+		msg.Release()
+		return nil, ErrCorrupt
+	}
+	l.inMacer.Reset()
+	l.inMacer.Write(l.inTrailer[:seqSize])
 	l.inMacer.Write(l.inHeadBuf)
 	l.inMacer.Write(msg.Data)
-	if !bytes.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
-		err = errors.New(fmt.Sprintf("mac mismatch: have %v, want %v.", l.inMacer.Sum(nil), l.inMacBuf))
-		return nil, err
+	if l.inMacSum = l.inMacer.Sum(l.inMacSum[:0]); !hmac.Equal(l.inTrailer[seqSize:], l.inMacSum) {
+		msg.Release()
+		return nil, ErrCorrupt
+	}
+	// Verify the now authenticated sequence number
+	switch seq := binary.BigEndian.Uint64(l.inTrailer[:seqSize]); {
+	case seq < l.inSeq:
+		msg.Release()
+		return nil, ErrReplay
+	case seq > l.inSeq:
+		msg.Release()
+		return nil, ErrReorder
 	}
+	l.inSeq++
+
 	// Extract the package contents
 	l.inCipher.XORKeyStream(l.inHeadBuf, l.inHeadBuf)
-	l.inBuffer.Write(l.inHeadBuf)
-	if err = l.inCoder.Decode(&msg.Head); err != nil {
+	if err = wire.Unmarshal(l.inHeadBuf, &msg.Head); err != nil {
+		msg.Release()
 		return nil, err
 	}
-	// Set the message security knowingly to true
-	msg.KnownSecure()
-	return &msg, nil
+	return msg, nil
 }
 
 // Sends messages from the upper layers into the encrypted link.
@@ -246,6 +532,14 @@ func (l *Link) sender() {
 	var errc chan error
 	var errv error
 
+	// Renew the outbound keys on time even if no messages are sent
+	var timer *time.Timer
+	var rekey <-chan time.Time
+	if l.rekey && config.SessionRekeyPeriod > 0 {
+		timer = time.NewTimer(config.SessionRekeyPeriod - time.Since(l.outKeyed))
+		defer timer.Stop()
+		rekey = timer.C
+	}
 	// Loop until an error occurs or quit is requested
 	for errv == nil && errc == nil {
 		select {
@@ -253,6 +547,12 @@ func (l *Link) sender() {
 			continue
 		case msg := <-l.Send:
 			errv = l.SendDirect(msg)
+			msg.Release()
+		case <-rekey:
+			if time.Since(l.outKeyed) >= config.SessionRekeyPeriod {
+				errv = l.rekeyOut()
+			}
+			timer.Reset(config.SessionRekeyPeriod - time.Since(l.outKeyed))
 		}
 	}
 	// If quit was requested, send all pending messages and close packet
@@ -262,6 +562,7 @@ func (l *Link) sender() {
 			select {
 			case msg := <-l.Send:
 				errv = l.SendDirect(msg)
+				msg.Release()
 			default:
 				done = true
 			}
@@ -296,6 +597,7 @@ func (l *Link) receiver() {
 		}
 		// Check if it's a remote close packet
 		if _, ok := msg.Head.Meta.(*closePacket); ok {
+			msg.Release()
 			break
 		}
 		// Transfer upwards, or terminate
@@ -309,6 +611,7 @@ func (l *Link) receiver() {
 				// Ok, upstream unblocked
 			case errc = <-l.recvQuit:
 				// Terminating
+				msg.Release()
 			}
 		}
 	}
@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -30,6 +31,7 @@ import (
 	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/stream"
 )
@@ -156,6 +158,354 @@ func TestDirectSendRecv(t *testing.T) {
 	}
 }
 
+// Tests that compressed payloads are only forwarded to peers accepting them and
+// that the link statistics reflect the compression ratios.
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	defer clientStrm.Close()
+	defer serverStrm.Close()
+
+	// Initialize the stream based encrypted links
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false)
+	serverLink := New(serverStrm, serverHKDF, true)
+
+	// Send a compressible message both with and without negotiated compression
+	data := bytes.Repeat([]byte("compressible payload "), 1024)
+	for _, compress := range []bool{true, false} {
+		clientLink.SetCompression(compress)
+
+		send := &proto.Message{Data: make([]byte, len(data))}
+		copy(send.Data, data)
+		send.Encrypt()
+
+		if err := clientLink.SendDirect(send); err != nil {
+			t.Fatalf("compress %v: failed to send message: %v.", compress, err)
+		}
+		recv, err := serverLink.RecvDirect()
+		if err != nil {
+			t.Fatalf("compress %v: failed to receive message: %v.", compress, err)
+		}
+		if compressed := recv.Head.Size > 0; compressed != compress {
+			t.Fatalf("compress %v: compression mismatch: have %v, want %v.", compress, compressed, compress)
+		}
+		if err := recv.Decrypt(); err != nil {
+			t.Fatalf("compress %v: failed to decrypt message: %v.", compress, err)
+		}
+		if !bytes.Equal(recv.Data, data) {
+			t.Fatalf("compress %v: data mismatch: have %v, want %v.", compress, recv.Data, data)
+		}
+	}
+	// Verify the statistics on both ends of the link
+	sent, recv := clientLink.Stats(), serverLink.Stats()
+	if sent.SentMsgs != 2 || sent.SentRaw != uint64(2*len(data)) || sent.SentWire >= sent.SentRaw {
+		t.Fatalf("sender stats mismatch: %+v.", sent)
+	}
+	if recv.RecvMsgs != sent.SentMsgs || recv.RecvRaw != sent.SentRaw || recv.RecvWire != sent.SentWire {
+		t.Fatalf("receiver stats mismatch: have %+v, want %+v.", recv, sent)
+	}
+	if ratio := sent.SentRatio(); ratio <= 1 || ratio >= 2 {
+		t.Fatalf("compression ratio mismatch: have %v, want (1, 2).", ratio)
+	}
+}
+
+// Tests that the link keys are renewed after the configured traffic volume and
+// time, without interrupting the message flow.
+func TestRekey(t *testing.T) {
+	// Override the rekey thresholds (not parallel, restore afterwards)
+	bytesLimit, periodLimit := config.SessionRekeyBytes, config.SessionRekeyPeriod
+	defer func() { config.SessionRekeyBytes, config.SessionRekeyPeriod = bytesLimit, periodLimit }()
+
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	defer clientStrm.Close()
+	defer serverStrm.Close()
+
+	// Initialize the stream based encrypted links
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false)
+	serverLink := New(serverStrm, serverHKDF, true)
+
+	clientLink.SetRekeying(true)
+	serverLink.SetRekeying(true)
+
+	// Transfer messages both ways, first rekeying by volume, then by time
+	transfer := func(from, to *Link) {
+		send := &proto.Message{
+			Head: proto.Header{
+				Meta: make([]byte, 32),
+			},
+			Data: make([]byte, 1024),
+		}
+		io.ReadFull(rand.Reader, send.Head.Meta.([]byte))
+		io.ReadFull(rand.Reader, send.Data)
+		send.Encrypt()
+
+		if err := from.SendDirect(send); err != nil {
+			t.Fatalf("failed to send message: %v.", err)
+		}
+		if recv, err := to.RecvDirect(); err != nil {
+			t.Fatalf("failed to receive message: %v.", err)
+		} else if !bytes.Equal(send.Head.Meta.([]byte), recv.Head.Meta.([]byte)) || !bytes.Equal(send.Data, recv.Data) {
+			t.Fatalf("send/receive mismatch: have %+v, want %+v.", recv, send)
+		}
+	}
+	config.SessionRekeyBytes, config.SessionRekeyPeriod = 4096, 0
+	for i := 0; i < 100; i++ {
+		transfer(clientLink, serverLink)
+		transfer(serverLink, clientLink)
+	}
+	config.SessionRekeyBytes, config.SessionRekeyPeriod = 0, time.Millisecond
+	for i := 0; i < 10; i++ {
+		time.Sleep(2 * time.Millisecond)
+		transfer(clientLink, serverLink)
+		transfer(serverLink, clientLink)
+	}
+	// Verify that keys were renewed the expected number of times on both sides
+	client, server := clientLink.Stats(), serverLink.Stats()
+	if client.SentRekeys < 30 || client.SentRekeys != server.RecvRekeys {
+		t.Fatalf("client rekey mismatch: sent %v, received %v.", client.SentRekeys, server.RecvRekeys)
+	}
+	if server.SentRekeys < 30 || server.SentRekeys != client.RecvRekeys {
+		t.Fatalf("server rekey mismatch: sent %v, received %v.", server.SentRekeys, client.RecvRekeys)
+	}
+	if client.SentMsgs != 110 || server.RecvMsgs != 110 {
+		t.Fatalf("message count mismatch: sent %v, received %v.", client.SentMsgs, server.RecvMsgs)
+	}
+	// Start the transfers and verify that idle links are rekeyed by time too
+	config.SessionRekeyPeriod = 10 * time.Millisecond
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	time.Sleep(100 * time.Millisecond)
+	if idle := clientLink.Stats().SentRekeys - client.SentRekeys; idle == 0 {
+		t.Fatalf("idle link not rekeyed.")
+	}
+	send := &proto.Message{
+		Head: proto.Header{
+			Meta: []byte("meta"),
+		},
+	}
+	clientLink.Send <- send
+	select {
+	case recv := <-serverLink.Recv:
+		if !bytes.Equal(recv.Head.Meta.([]byte), send.Head.Meta.([]byte)) {
+			t.Fatalf("send/receive mismatch: have %+v, want %+v.", recv, send)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("receive after idle rekeys timed out.")
+	}
+	if sent, recv := clientLink.Stats().SentRekeys, serverLink.Stats().RecvRekeys; sent != recv {
+		t.Fatalf("idle rekey mismatch: sent %v, received %v.", sent, recv)
+	}
+	// Ensure the links can be successfully torn down
+	go clientLink.Close()
+	if err := serverLink.Close(); err != nil {
+		t.Fatalf("failed to close server link: %v.", err)
+	}
+}
+
+// Tests that replayed frames are discarded, while reordered and corrupt ones
+// are reported with their distinct errors and counted, and that forged sequence
+// numbers are reported as corruption.
+func TestSequencing(t *testing.T) {
+	t.Parallel()
+
+	// Replay a frame and make sure the link recovers
+	client, server, relay, closer := newRelayedLinks(t)
+	defer closer()
+
+	first := relay.transfer(t, client)
+	relay.forward(t, first)
+	if _, err := server.RecvDirect(); err != nil {
+		t.Fatalf("failed to receive original message: %v.", err)
+	}
+	relay.forward(t, first)
+	relay.forward(t, relay.transfer(t, client))
+	if _, err := server.RecvDirect(); err != nil {
+		t.Fatalf("failed to receive message after replay: %v.", err)
+	}
+	if stats := server.Stats(); stats.RecvMsgs != 2 || stats.Replayed != 1 {
+		t.Fatalf("replay stats mismatch: %+v.", stats)
+	}
+	// Swap two frames and make sure the reordering is detected
+	client, server, relay, closer = newRelayedLinks(t)
+	defer closer()
+
+	first, second := relay.transfer(t, client), relay.transfer(t, client)
+	relay.forward(t, second)
+	relay.forward(t, first)
+	if _, err := server.RecvDirect(); err != ErrReorder {
+		t.Fatalf("reorder error mismatch: have %v, want %v.", err, ErrReorder)
+	}
+	if stats := server.Stats(); stats.Reordered != 1 {
+		t.Fatalf("reorder stats mismatch: %+v.", stats)
+	}
+	// Flip a payload bit and make sure the corruption is detected
+	client, server, relay, closer = newRelayedLinks(t)
+	defer closer()
+
+	first = relay.transfer(t, client)
+	first[1][0] ^= 0x01
+	relay.forward(t, first)
+	if _, err := server.RecvDirect(); err != ErrCorrupt {
+		t.Fatalf("corruption error mismatch: have %v, want %v.", err, ErrCorrupt)
+	}
+	if stats := server.Stats(); stats.Corrupted != 1 {
+		t.Fatalf("corruption stats mismatch: %+v.", stats)
+	}
+	// Forge the sequence number of a frame and make sure it's not taken for a replay
+	for _, seq := range []uint64{0, 5} {
+		client, server, relay, closer = newRelayedLinks(t)
+		defer closer()
+
+		first, second = relay.transfer(t, client), relay.transfer(t, client)
+		relay.forward(t, first)
+		if _, err := server.RecvDirect(); err != nil {
+			t.Fatalf("failed to receive original message: %v.", err)
+		}
+		binary.BigEndian.PutUint64(second[2][:seqSize], seq)
+		relay.forward(t, second)
+		if _, err := server.RecvDirect(); err != ErrCorrupt {
+			t.Fatalf("forged seq %d: error mismatch: have %v, want %v.", seq, err, ErrCorrupt)
+		}
+		if stats := server.Stats(); stats.Corrupted != 1 || stats.Replayed != 0 || stats.Reordered != 0 {
+			t.Fatalf("forged seq %d: stats mismatch: %+v.", seq, stats)
+		}
+	}
+}
+
+// Raw frame relay between two encrypted links, used to tamper with the traffic.
+type frameRelay struct {
+	in  *stream.Stream // Stream receiving the frames of the sending link
+	out *stream.Stream // Stream forwarding the frames to the receiving link
+}
+
+// Sends a random message through a link and captures its raw frames.
+func (r *frameRelay) transfer(t *testing.T, link *Link) [][]byte {
+	msg := &proto.Message{Data: make([]byte, 64)}
+	io.ReadFull(rand.Reader, msg.Data)
+	msg.Encrypt()
+
+	if err := link.SendDirect(msg); err != nil {
+		t.Fatalf("failed to send message: %v.", err)
+	}
+	frames := make([][]byte, 3)
+	for i := 0; i < len(frames); i++ {
+		if err := r.in.Recv(&frames[i]); err != nil {
+			t.Fatalf("failed to capture frame: %v.", err)
+		}
+	}
+	return frames
+}
+
+// Forwards a set of captured frames to the receiving link.
+func (r *frameRelay) forward(t *testing.T, frames [][]byte) {
+	for _, frame := range frames {
+		if err := r.out.SendBytes(frame); err != nil {
+			t.Fatalf("failed to forward frame: %v.", err)
+		}
+	}
+	if err := r.out.Flush(); err != nil {
+		t.Fatalf("failed to flush frames: %v.", err)
+	}
+}
+
+// Creates a client and server link, connected through a frame relay.
+func newRelayedLinks(t *testing.T) (*Link, *Link, *frameRelay, func()) {
+	clientStrm, relayIn, closeIn := newStreamPair(t)
+	relayOut, serverStrm, closeOut := newStreamPair(t)
+
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	client := New(clientStrm, clientHKDF, false)
+	server := New(serverStrm, serverHKDF, true)
+
+	closer := func() {
+		closeIn()
+		closeOut()
+	}
+	return client, server, &frameRelay{in: relayIn, out: relayOut}, closer
+}
+
+// Creates a connected pair of streams through a temporary listener.
+func newStreamPair(t *testing.T) (*stream.Stream, *stream.Stream, func()) {
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	client, err := stream.Dial(fmt.Sprintf("%s:%d", "localhost", addr.Port), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	server := <-listener.Sink
+
+	return client, server, func() {
+		client.Close()
+		server.Close()
+	}
+}
+
 // Tests the high level send and receive mechanisms.
 func TestSendRecv(t *testing.T) {
 	t.Parallel()
@@ -253,3 +603,66 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close server link: %v.", err)
 	}
 }
+
+// Benchmarks the direct transfer of messages, releasing the received ones into
+// the pool or leaving them to the garbage collector.
+func BenchmarkTransferPooled(b *testing.B) {
+	benchmarkTransfer(b, 1024, true)
+}
+
+func BenchmarkTransferCollected(b *testing.B) {
+	benchmarkTransfer(b, 1024, false)
+}
+
+func benchmarkTransfer(b *testing.B, block int, release bool) {
+	// Start a stream listener and establish a connection to it
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		b.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		b.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	clientStrm, err := stream.Dial(fmt.Sprintf("%s:%d", "localhost", addr.Port), time.Second)
+	if err != nil {
+		b.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	defer clientStrm.Close()
+	defer serverStrm.Close()
+
+	// Initialize the stream based encrypted links
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientLink := New(clientStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), false)
+	serverLink := New(serverStrm, hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info")), true)
+
+	// Generate a random message (no metadata, measure only the message path)
+	send := &proto.Message{
+		Data: make([]byte, block),
+	}
+	io.ReadFull(rand.Reader, send.Data)
+	send.Encrypt()
+
+	b.SetBytes(int64(block))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := clientLink.SendDirect(send); err != nil {
+			b.Fatalf("failed to send message: %v.", err)
+		}
+		recv, err := serverLink.RecvDirect()
+		if err != nil {
+			b.Fatalf("failed to receive message: %v.", err)
+		}
+		if release {
+			recv.Release()
+		}
+	}
+}
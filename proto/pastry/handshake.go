@@ -216,6 +216,7 @@ func (o *Overlay) shake(ses *session.Session) {
 			pkt = msg.Head.Meta.(*initPacket)
 			p.nodeId = pkt.Id
 			p.addrs = pkt.Addrs
+			msg.Release()
 
 			// Everything ok, accept connection
 			o.dedup(p)
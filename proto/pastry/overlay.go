@@ -44,7 +44,9 @@ const (
 	done
 )
 
-// Callback for events leaving the overlay network.
+// Callback for events leaving the overlay network. Delivered messages are owned
+// by the application, whilst forwarded ones only borrowed: pastry releases them
+// if the forward is denied, so the application must detach any message it keeps.
 type Callback interface {
 	Deliver(msg *proto.Message, key *big.Int)
 	Forward(msg *proto.Message, key *big.Int) bool
@@ -212,6 +214,20 @@ func (o *Overlay) Self() *big.Int {
 	return o.nodeId
 }
 
+// Returns the ids of the leaf set members, excluding the local node.
+func (o *Overlay) Leaves() []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	leaves := make([]*big.Int, 0, len(o.routes.leaves))
+	for _, leaf := range o.routes.leaves {
+		if leaf.Cmp(o.nodeId) != 0 {
+			leaves = append(leaves, leaf)
+		}
+	}
+	return leaves
+}
+
 // Sends a message to the closest node to the given destination.
 func (o *Overlay) Send(dest *big.Int, msg *proto.Message) {
 	// Package into overlay envelope
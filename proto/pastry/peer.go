@@ -111,7 +111,7 @@ func (p *peer) Close() error {
 	return res
 }
 
-// Sends a message to the remote peer.
+// Sends a message to the remote peer, passing on the ownership of the message.
 func (p *peer) send(msg *proto.Message) error {
 	// Select the outbound channel based on message contents
 	link := p.conn.DataLink
@@ -123,6 +123,7 @@ func (p *peer) send(msg *proto.Message) error {
 	case link.Send <- msg:
 		return nil
 	case <-time.After(config.PastrySendTimeout):
+		msg.Release()
 		return errors.New("timeout")
 	}
 }
@@ -26,6 +26,7 @@ import (
 	"math/big"
 
 	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/wire"
 )
 
 // Pastry operation code type.
@@ -56,9 +57,91 @@ type header struct {
 	State *state      // Routing table state exchange
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with gob and the wire codecs.
 func init() {
 	gob.Register(&header{})
+	wire.Register(wire.PastryHeader, func() wire.Codec { return new(header) })
+}
+
+// Implements wire.Codec, appending the non-zero header fields to the encoder.
+func (h *header) EncodeWire(enc *wire.Encoder) {
+	enc.Value(1, h.Meta)
+	enc.Uint(2, uint64(h.Op))
+	enc.Big(3, h.Dest)
+	enc.Struct(4, h.State)
+}
+
+// Implements wire.Codec, restoring the header fields from the decoder.
+func (h *header) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			h.Meta = dec.Value()
+		case 2:
+			h.Op = opcode(dec.Uint())
+		case 3:
+			h.Dest = dec.Big()
+		case 4:
+			h.State = new(state)
+			dec.Struct(h.State)
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+// Implements wire.Codec, encoding the address map as a list of peer entries.
+func (s *state) EncodeWire(enc *wire.Encoder) {
+	for peer, addrs := range s.Addrs {
+		enc.Struct(1, &stateEntry{Peer: peer, Addrs: addrs})
+	}
+	enc.Uint(2, s.Version)
+}
+
+// Implements wire.Codec, restoring the address map from the peer entries.
+func (s *state) DecodeWire(dec *wire.Decoder) error {
+	s.Addrs = make(map[string][]string)
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			entry := new(stateEntry)
+			dec.Struct(entry)
+			s.Addrs[entry.Peer] = entry.Addrs
+		case 2:
+			s.Version = dec.Uint()
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+// Single peer entry of a routing state exchange, used by the wire encoding.
+type stateEntry struct {
+	Peer  string
+	Addrs []string
+}
+
+// Implements wire.Codec, appending the peer id and its addresses.
+func (e *stateEntry) EncodeWire(enc *wire.Encoder) {
+	enc.Text(1, e.Peer)
+	enc.Strings(2, e.Addrs)
+}
+
+// Implements wire.Codec, restoring the peer id and its addresses.
+func (e *stateEntry) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			e.Peer = dec.Text()
+		case 2:
+			e.Addrs = dec.Strings()
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
 }
 
 // Simple wrapper around the peer send method, to handle errors by dropping.
@@ -95,6 +95,7 @@ func (o *Overlay) deliver(src *peer, msg *proto.Message) {
 	if head.Op != opNop {
 		o.process(src, head)
 		o.lock.RUnlock()
+		msg.Release()
 	} else {
 		// Remove all overlay infos from the message and send upwards
 		o.lock.RUnlock()
@@ -115,6 +116,8 @@ func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
 
 		if ok {
 			o.send(msg, p)
+		} else {
+			msg.Release()
 		}
 		return
 	}
@@ -133,8 +136,10 @@ func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
 			head.Meta = msg.Head.Meta
 			msg.Head.Meta = head
 			o.send(msg, p)
+			return
 		}
 	}
+	msg.Release()
 }
 
 // Processes overlay system messages: for joins it simply responds with the
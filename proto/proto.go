@@ -22,11 +22,19 @@
 package proto
 
 import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
 
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/pool"
+	"github.com/karalabe/iris/proto/wire"
 )
 
 // Baseline message headers.
@@ -34,29 +42,133 @@ type Header struct {
 	Meta interface{} // Metadata usable by upper network layers
 	Key  []byte      // AES key if the payload is encrypted (nil otherwise)
 	Iv   []byte      // Counter mode nonce if the payload is encrypted (nil otherwise)
+	Size int         // Original payload size if compressed before encryption (0 otherwise)
+}
+
+// Implements wire.Codec, appending the non-zero header fields to the encoder.
+func (h *Header) EncodeWire(enc *wire.Encoder) {
+	enc.Value(1, h.Meta)
+	enc.Bytes(2, h.Key)
+	enc.Bytes(3, h.Iv)
+	enc.Int(4, int64(h.Size))
+}
+
+// Implements wire.Codec, restoring the header fields from the decoder.
+func (h *Header) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			h.Meta = dec.Value()
+		case 2:
+			h.Key = dec.Bytes()
+		case 3:
+			h.Iv = dec.Bytes()
+		case 4:
+			h.Size = int(dec.Int())
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
 }
 
 // Iris message consisting of the payload and attached headers.
+//
+// Messages retrieved from the pool (e.g. by the network links) are reference
+// counted: whoever holds the last reference releases it, after which it cannot
+// be used any more. Links release the messages they send, so queueing a pooled
+// message on a link transfers one reference. Anything storing a pooled message
+// (or handing its payload to an application) should Detach it instead. Messages
+// not originating from the pool are unmanaged, releasing them is a no-op.
 type Message struct {
 	Head Header // Baseline headers
 	Data []byte // Payload in plain or ciphertext form
 
-	secure bool // Flag specifying whether the data segment was encrypted or not
+	secure bool         // Flag specifying whether the data segment was encrypted or not
+	refs   int32        // Reference count of a pooled message (0 if unmanaged)
+	buffer *pool.Buffer // Pooled backing buffer of the payload (nil if none)
+}
+
+// Pool of unused message containers.
+var messages = sync.Pool{
+	New: func() interface{} { return new(Message) },
 }
 
-// Encrypts a plaintext message with a temporary key and IV.
+// Retrieves a message container from the pool, taking over the ownership of the
+// payload buffer (nil if none). The caller holds the only reference.
+func Acquire(buf *pool.Buffer) *Message {
+	msg := messages.Get().(*Message)
+	msg.refs = 1
+	if buf != nil {
+		msg.buffer = buf
+		msg.Data = buf.Data
+	}
+	return msg
+}
+
+// Adds a reference to a pooled message, e.g. before queueing it on an extra link.
+func (m *Message) Retain() {
+	if atomic.LoadInt32(&m.refs) > 0 {
+		atomic.AddInt32(&m.refs, 1)
+	}
+}
+
+// Drops a reference of a pooled message, recycling it and its payload buffer if
+// it was the last one. Unmanaged messages are left untouched.
+func (m *Message) Release() {
+	if atomic.LoadInt32(&m.refs) == 0 {
+		return
+	}
+	if atomic.AddInt32(&m.refs, -1) == 0 {
+		if m.buffer != nil {
+			m.buffer.Release()
+		}
+		*m = Message{}
+		messages.Put(m)
+	}
+}
+
+// Removes a pooled message from the pool management, turning it into a normal
+// garbage collected one. Needed before storing it or passing its payload to an
+// application, where the lifetime is unknown.
+func (m *Message) Detach() {
+	atomic.StoreInt32(&m.refs, 0)
+	m.buffer = nil
+}
+
+// Error returned if a compressed payload does not inflate to its original size.
+var ErrCorruptPayload = errors.New("corrupt compressed payload")
+
+// Encrypts a plaintext message with a temporary key and IV. Payloads above the
+// compression threshold are deflated first, if it actually reduces their size.
 func (m *Message) Encrypt() error {
-	// Generate a new temporary key and the associated block cipher
-	key := make([]byte, config.PacketCipherBits/8)
-	if n, err := io.ReadFull(rand.Reader, key); n != len(key) || err != nil {
+	if err := m.compress(); err != nil {
+		return err
+	}
+	return m.encrypt()
+}
+
+// Encrypts the message payload as is with a temporary key and IV.
+func (m *Message) encrypt() error {
+	// Generate a new temporary key and the associated block cipher (the buffer is
+	// large enough to hold the IV of 128 bit block ciphers too)
+	keySize := config.PacketCipherBits / 8
+	nonces := make([]byte, keySize, keySize+aes.BlockSize)
+	if n, err := io.ReadFull(rand.Reader, nonces); n != len(nonces) || err != nil {
 		return err
 	}
+	key := nonces[:keySize:keySize]
 	block, err := config.PacketCipher(key)
 	if err != nil {
 		return err
 	}
 	// Generate a new random counter mode IV and the associated stream cipher
-	iv := make([]byte, block.BlockSize())
+	var iv []byte
+	if size := block.BlockSize(); keySize+size <= cap(nonces) {
+		iv = nonces[keySize : keySize+size]
+	} else {
+		iv = make([]byte, size)
+	}
 	if n, err := io.ReadFull(rand.Reader, iv); n != len(iv) || err != nil {
 		return err
 	}
@@ -80,10 +192,108 @@ func (m *Message) Decrypt() error {
 	}
 	stream := cipher.NewCTR(block, m.Head.Iv)
 
-	// Decrypt the message, clear out the crypto headers and return
+	// Decrypt the message, clear out the crypto headers and inflate if needed
 	stream.XORKeyStream(m.Data, m.Data)
 	m.Head.Key = nil
 	m.Head.Iv = nil
+
+	return m.decompress()
+}
+
+// Returns a version of an encrypted message with an uncompressed payload, to be
+// sent to peers not supporting compression. The original message is left as is
+// since it might be shared between multiple links.
+func (m *Message) Inflated() (*Message, error) {
+	if m.Head.Size == 0 {
+		return m, nil
+	}
+	plain := &Message{
+		Head: m.Head,
+		Data: make([]byte, len(m.Data)),
+	}
+	copy(plain.Data, m.Data)
+	if err := plain.Decrypt(); err != nil {
+		return nil, err
+	}
+	// Re-encrypt with a fresh key, never reusing the counter stream
+	if err := plain.encrypt(); err != nil {
+		return nil, err
+	}
+	return plain, nil
+}
+
+// Compressor along with its level, to detect configuration changes.
+type deflater struct {
+	*flate.Writer
+	level int
+}
+
+// Pools of compressors and decompressors, both having large internal states.
+var (
+	deflaters sync.Pool
+	inflaters sync.Pool
+)
+
+// Deflates the message payload if above the configured threshold, keeping the
+// result only if smaller than the original.
+func (m *Message) compress() error {
+	if config.PacketCompressThreshold <= 0 || len(m.Data) < config.PacketCompressThreshold {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	buf.Grow(len(m.Data) / 2)
+
+	// Fetch a compressor of the configured level, creating one if none is available
+	zip, ok := deflaters.Get().(*deflater)
+	if !ok || zip.level != config.PacketCompressLevel {
+		writer, err := flate.NewWriter(buf, config.PacketCompressLevel)
+		if err != nil {
+			return err
+		}
+		zip = &deflater{Writer: writer, level: config.PacketCompressLevel}
+	} else {
+		zip.Reset(buf)
+	}
+	defer deflaters.Put(zip)
+
+	if _, err := zip.Write(m.Data); err != nil {
+		return err
+	}
+	if err := zip.Close(); err != nil {
+		return err
+	}
+	if buf.Len() < len(m.Data) {
+		m.Head.Size = len(m.Data)
+		m.Data = buf.Bytes()
+	}
+	return nil
+}
+
+// Inflates a compressed message payload, verifying its original size.
+func (m *Message) decompress() error {
+	if m.Head.Size == 0 {
+		return nil
+	}
+	data := make([]byte, m.Head.Size)
+
+	// Fetch a decompressor, creating one if none is available
+	src := bytes.NewReader(m.Data)
+	zip, ok := inflaters.Get().(io.ReadCloser)
+	if !ok {
+		zip = flate.NewReader(src)
+	} else if err := zip.(flate.Resetter).Reset(src, nil); err != nil {
+		return err
+	}
+	defer inflaters.Put(zip)
+
+	if _, err := io.ReadFull(zip, data); err != nil {
+		return ErrCorruptPayload
+	}
+	if n, _ := zip.Read(make([]byte, 1)); n != 0 {
+		return ErrCorruptPayload
+	}
+	m.Data = data
+	m.Head.Size = 0
 	return nil
 }
 
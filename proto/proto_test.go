@@ -24,6 +24,9 @@ import (
 	"crypto/rand"
 	"io"
 	"testing"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/pool"
 )
 
 func TestCrypto(t *testing.T) {
@@ -65,6 +68,108 @@ func TestCrypto(t *testing.T) {
 	}
 }
 
+func TestCompression(t *testing.T) {
+	// Generate a well compressible payload above the threshold
+	data := bytes.Repeat([]byte(`{"name": "iris", "kind": "messaging"}`), 256)
+
+	msg := &Message{Data: make([]byte, len(data))}
+	copy(msg.Data, data)
+	if err := msg.Encrypt(); err != nil {
+		t.Fatalf("failed to encrypt message: %v.", err)
+	}
+	if msg.Head.Size != len(data) || len(msg.Data) >= len(data) {
+		t.Fatalf("payload not compressed: size = %v, length = %v, original = %v.", msg.Head.Size, len(msg.Data), len(data))
+	}
+	// Inflate a copy for non-compressing peers and ensure the original is intact
+	cipher := make([]byte, len(msg.Data))
+	copy(cipher, msg.Data)
+
+	plain, err := msg.Inflated()
+	if err != nil {
+		t.Fatalf("failed to inflate message: %v.", err)
+	}
+	if !bytes.Equal(msg.Data, cipher) || msg.Head.Size != len(data) {
+		t.Fatalf("inflation modified the original message.")
+	}
+	if plain.Head.Size != 0 || len(plain.Data) != len(data) || !plain.Secure() {
+		t.Fatalf("inflated message invalid: size = %v, length = %v, secure = %v.", plain.Head.Size, len(plain.Data), plain.Secure())
+	}
+	// Decrypt both versions and verify the contents
+	for i, m := range []*Message{msg, plain} {
+		if err := m.Decrypt(); err != nil {
+			t.Fatalf("message %d: failed to decrypt: %v.", i, err)
+		}
+		if !bytes.Equal(m.Data, data) || m.Head.Size != 0 {
+			t.Fatalf("message %d: data mismatch: have %v, want %v.", i, m.Data, data)
+		}
+	}
+	// Ensure small messages are left uncompressed
+	msg = &Message{Data: make([]byte, config.PacketCompressThreshold-1)}
+	if err := msg.Encrypt(); err != nil {
+		t.Fatalf("failed to encrypt message: %v.", err)
+	}
+	if msg.Head.Size != 0 || len(msg.Data) != config.PacketCompressThreshold-1 {
+		t.Fatalf("small payload compressed: size = %v, length = %v.", msg.Head.Size, len(msg.Data))
+	}
+	// Ensure corrupt payloads are detected
+	msg = &Message{Data: make([]byte, len(data))}
+	copy(msg.Data, data)
+	msg.Encrypt()
+	msg.Head.Size++
+	if err := msg.Decrypt(); err != ErrCorruptPayload {
+		t.Fatalf("corrupt payload error mismatch: have %v, want %v.", err, ErrCorruptPayload)
+	}
+}
+
+func TestPooling(t *testing.T) {
+	// Acquire a pooled message and verify the reference counting
+	buf := pool.NewBuffer(128)
+	msg := Acquire(buf)
+	if len(msg.Data) != 128 || msg.buffer != buf || msg.refs != 1 {
+		t.Fatalf("pooled message invalid: length = %v, refs = %v.", len(msg.Data), msg.refs)
+	}
+	msg.Retain()
+	msg.Release()
+	if msg.refs != 1 || msg.Data == nil {
+		t.Fatalf("message recycled while referenced: refs = %v.", msg.refs)
+	}
+	msg.Release()
+	if msg.refs != 0 || msg.Data != nil || msg.buffer != nil {
+		t.Fatalf("released message not reset: %+v.", msg)
+	}
+	// Detached and unmanaged messages must survive releases
+	msg = Acquire(pool.NewBuffer(128))
+	msg.Detach()
+	msg.Release()
+	if len(msg.Data) != 128 {
+		t.Fatalf("detached message recycled.")
+	}
+	msg = &Message{Data: make([]byte, 128)}
+	msg.Retain()
+	msg.Release()
+	if msg.refs != 0 || len(msg.Data) != 128 {
+		t.Fatalf("unmanaged message modified: refs = %v, length = %v.", msg.refs, len(msg.Data))
+	}
+}
+
+// Sink to prevent the compiler from optimizing away the benchmarked allocations.
+var sink *Message
+
+func BenchmarkMessageAlloc(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = &Message{Data: make([]byte, 1024)}
+	}
+}
+
+func BenchmarkMessagePooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = Acquire(pool.NewBuffer(1024))
+		sink.Release()
+	}
+}
+
 func BenchmarkEncrypt1Byte(b *testing.B) {
 	benchmarkEncrypt(b, 1)
 }
@@ -0,0 +1,85 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Contains the return of undeliverable messages to their senders: virgin events
+// reaching the root of a topic without subscribers or retention, and balanced
+// messages finding no member to deliver to. Only messages whose upper layer
+// headers request it are returned, since most best effort traffic is dropped
+// silently by design.
+
+package scribe
+
+import (
+	"errors"
+	"log"
+
+	"github.com/karalabe/iris/proto"
+)
+
+// Reasons reported for returned messages.
+var ErrNoSubscribers = errors.New("no subscribers")
+var ErrNoCapacity = errors.New("no capacity")
+
+// Optional interface of the upper layer headers, requesting a message to be
+// returned to its sender if it cannot be delivered.
+type Bouncer interface {
+	Bounce() bool
+}
+
+// Wire code of the reason a message was returned.
+type bounce uint8
+
+const (
+	bounceNoSubscribers bounce = iota + 1
+	bounceNoCapacity
+)
+
+// Returns an undeliverable message to its origin, if requested by the upper
+// layer. Reliable events are never returned, their delivery status reports the
+// failure already.
+func (o *Overlay) bounceMessage(head *header, reason bounce, msg *proto.Message) {
+	if head.Seq != 0 {
+		return
+	}
+	if bouncer, ok := head.Meta.(Bouncer); !ok || !bouncer.Bounce() {
+		return
+	}
+	msg.Head.Meta = head.Meta
+	msg.KnownSecure()
+	o.sendBounce(head.Sender, reason, msg)
+}
+
+// Decrypts a returned message and passes it upstream along with the reason of
+// the failed delivery.
+func (o *Overlay) handleBounce(msg *proto.Message) error {
+	head := msg.Head.Meta.(*header)
+	msg.Head.Meta = head.Meta
+	if err := msg.Decrypt(); err != nil {
+		return err
+	}
+	switch head.Bounce {
+	case bounceNoSubscribers:
+		o.app.HandleBounce(ErrNoSubscribers, msg)
+	case bounceNoCapacity:
+		o.app.HandleBounce(ErrNoCapacity, msg)
+	default:
+		log.Printf("scribe: unknown bounce reason: %v.", head.Bounce)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the leader elections: the node closest to the election id
+// (the key owner) keeps the candidates of the election in campaign order, the
+// first of them being the leader. Candidates refresh their campaigns at each
+// heartbeat and are confirmed the current leader in reply. Candidates failing to
+// refresh are dropped, electing the next one in line.
+//
+// The owner replicates the election to the leaf set after every change and at
+// each heartbeat, so that the next closest node keeps the same leader when taking
+// over. Leaders not hearing from the owner for too long step down on their own.
+
+package scribe
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Candidate of an election, identified by its node and an upper layer id.
+type candidate struct {
+	Node   *big.Int  // Overlay node of the candidate
+	Member uint64    // Upper layer id of the candidate within the node
+	Seen   time.Time // Time of the last campaign refresh
+}
+
+// State of an election, replicated to the leaf set of the owner.
+type ballot struct {
+	Name       string       // Name of the election
+	Term       uint64       // Number of leader changes so far
+	Candidates []*candidate // Candidates in campaign order, the first leading
+}
+
+// Campaign of a local candidate.
+type campaign struct {
+	leader bool      // Whether the candidate is the current leader
+	term   uint64    // Term of the last confirmed leader
+	seen   time.Time // Time of the last confirmation from the owner
+}
+
+// Leader election state of the local node.
+type elections struct {
+	owned     map[string]*ballot              // Elections owned by the local node
+	replicas  map[string]*ballot              // Elections replicated from neighbors
+	campaigns map[string]map[uint64]*campaign // Local campaigns by election and candidate
+
+	lock sync.Mutex
+}
+
+// Creates an empty leader election state.
+func newElections() *elections {
+	return &elections{
+		owned:     make(map[string]*ballot),
+		replicas:  make(map[string]*ballot),
+		campaigns: make(map[string]map[uint64]*campaign),
+	}
+}
+
+// Leadership change of a local candidate, reported after releasing the lock.
+type leadership struct {
+	election string // Name of the election
+	member   uint64 // Upper layer id of the candidate
+	leader   bool   // Whether the candidate became or ceased to be the leader
+	term     uint64 // Term of the leadership
+}
+
+// Leader confirmation of an election, sent after releasing the lock.
+type confirmation struct {
+	dest   *big.Int   // Candidate node to notify
+	name   string     // Name of the election
+	term   uint64     // Term of the current leader
+	leader *candidate // Current leader (nil if none)
+}
+
+// Enters a local candidate into the named election. The campaign is refreshed by
+// the heartbeat until resigned. Leadership changes are reported upstream.
+func (o *Overlay) Campaign(election string, member uint64) {
+	o.ele.lock.Lock()
+	members, ok := o.ele.campaigns[election]
+	if !ok {
+		members = make(map[uint64]*campaign)
+		o.ele.campaigns[election] = members
+	}
+	members[member] = &campaign{seen: time.Now()}
+	o.ele.lock.Unlock()
+
+	o.sendCampaign(pastry.Resolve(election), election, member, false)
+}
+
+// Withdraws a local candidate from the named election, stepping down if it was
+// the leader (no upstream report is made).
+func (o *Overlay) Resign(election string, member uint64) {
+	o.ele.lock.Lock()
+	delete(o.ele.campaigns[election], member)
+	if len(o.ele.campaigns[election]) == 0 {
+		delete(o.ele.campaigns, election)
+	}
+	o.ele.lock.Unlock()
+
+	o.sendCampaign(pastry.Resolve(election), election, member, true)
+}
+
+// Retrieves an owned election, promoting the local replica or creating a new one
+// if not owned yet. Promoted candidates are given a fresh grace period. The lock
+// is assumed held.
+func (o *Overlay) ownElection(electionId *big.Int, name string) *ballot {
+	sid := electionId.String()
+	if b, ok := o.ele.owned[sid]; ok {
+		return b
+	}
+	b, ok := o.ele.replicas[sid]
+	if ok {
+		delete(o.ele.replicas, sid)
+		for _, c := range b.Candidates {
+			c.Seen = time.Now()
+		}
+	} else {
+		b = &ballot{Name: name}
+	}
+	o.ele.owned[sid] = b
+	return b
+}
+
+// Handles a campaign registration, refresh or resignation arriving at the owner.
+// Leader changes are confirmed to all candidates, plain refreshes only to the
+// refreshing one.
+func (o *Overlay) handleCampaign(src *big.Int, electionId *big.Int, name string, member uint64, resign bool) {
+	o.ele.lock.Lock()
+	b := o.ownElection(electionId, name)
+
+	// Update the candidate list, tracking leader changes
+	leader := leaderOf(b)
+	idx := -1
+	for i, c := range b.Candidates {
+		if c.Node.Cmp(src) == 0 && c.Member == member {
+			idx = i
+			break
+		}
+	}
+	switch {
+	case resign && idx >= 0:
+		b.Candidates = append(b.Candidates[:idx], b.Candidates[idx+1:]...)
+	case !resign && idx >= 0:
+		b.Candidates[idx].Seen = time.Now()
+	case !resign:
+		b.Candidates = append(b.Candidates, &candidate{Node: src, Member: member, Seen: time.Now()})
+	}
+	var confirms []*confirmation
+	if leaderOf(b) != leader {
+		b.Term++
+		confirms = confirmLeader(b)
+	} else if !resign {
+		confirms = []*confirmation{&confirmation{dest: src, name: b.Name, term: b.Term, leader: leaderOf(b)}}
+	}
+	snap := snapshotBallot(b)
+	o.ele.lock.Unlock()
+
+	o.sendConfirms(confirms)
+	o.replicateElection(electionId, snap)
+}
+
+// Handles a leader confirmation arriving at a candidate node, reporting upstream
+// the local candidates which became or ceased to be the leader.
+func (o *Overlay) handleElected(election string, term uint64, leader *big.Int, chosen uint64) {
+	var changes []*leadership
+
+	o.ele.lock.Lock()
+	for member, c := range o.ele.campaigns[election] {
+		elected := leader != nil && leader.Cmp(o.pastry.Self()) == 0 && chosen == member
+		if elected != c.leader || (elected && term != c.term) {
+			changes = append(changes, &leadership{election, member, elected, term})
+		}
+		c.leader, c.term, c.seen = elected, term, time.Now()
+	}
+	o.ele.lock.Unlock()
+
+	for _, change := range changes {
+		o.app.HandleLeadership(change.election, change.member, change.leader, change.term)
+	}
+}
+
+// Handles the replicated state of a neighbor's election. If the local node
+// believes itself the owner too, the node closer to the election id wins.
+func (o *Overlay) handleBallot(src *big.Int, electionId *big.Int, state *ballot) {
+	o.ele.lock.Lock()
+	defer o.ele.lock.Unlock()
+
+	sid := electionId.String()
+	if _, ok := o.ele.owned[sid]; ok {
+		if pastry.Distance(o.pastry.Self(), electionId).Cmp(pastry.Distance(src, electionId)) <= 0 {
+			return
+		}
+		delete(o.ele.owned, sid)
+	}
+	o.ele.replicas[sid] = state
+}
+
+// Assembles the leader confirmations of an election for all its candidate nodes.
+// The lock is assumed held.
+func confirmLeader(b *ballot) []*confirmation {
+	leader := leaderOf(b)
+
+	seen := make(map[string]struct{})
+	confirms := []*confirmation{}
+	for _, c := range b.Candidates {
+		if _, ok := seen[c.Node.String()]; !ok {
+			seen[c.Node.String()] = struct{}{}
+			confirms = append(confirms, &confirmation{dest: c.Node, name: b.Name, term: b.Term, leader: leader})
+		}
+	}
+	return confirms
+}
+
+// Sends out the leader confirmations of an election round.
+func (o *Overlay) sendConfirms(confirms []*confirmation) {
+	for _, c := range confirms {
+		if c.leader == nil {
+			o.sendElected(c.dest, c.name, c.term, nil, 0)
+		} else {
+			o.sendElected(c.dest, c.name, c.term, c.leader.Node, c.leader.Member)
+		}
+	}
+}
+
+// Maintains the elections at each heartbeat. Owned elections drop the candidates
+// which did not refresh (electing the next in line), and are replicated or handed
+// off if their id moved closer to a neighbor. Local campaigns are refreshed, and
+// leaders not confirmed by the owner for too long step down.
+func (o *Overlay) maintainElections() {
+	type replica struct {
+		id   *big.Int
+		snap *ballot
+	}
+	type refresh struct {
+		election string
+		member   uint64
+	}
+	var confirms []*confirmation
+	var snaps []*replica
+	var refreshes []*refresh
+	var changes []*leadership
+
+	o.ele.lock.Lock()
+	now := time.Now()
+	timeout := time.Duration(config.ScribeKillCount) * config.ScribeBeatPeriod
+	for sid, b := range o.ele.owned {
+		id, _ := new(big.Int).SetString(sid, 10)
+
+		// Expire the silent candidates, re-electing if the leader went missing
+		leader := leaderOf(b)
+		live := b.Candidates[:0]
+		for _, c := range b.Candidates {
+			if now.Sub(c.Seen) <= timeout {
+				live = append(live, c)
+			}
+		}
+		b.Candidates = live
+		if leaderOf(b) != leader {
+			b.Term++
+			confirms = append(confirms, confirmLeader(b)...)
+		}
+		// Step down if no longer the owner, drop if abandoned
+		switch {
+		case !o.ownsKey(id):
+			delete(o.ele.owned, sid)
+			o.ele.replicas[sid] = b
+		case len(b.Candidates) == 0:
+			delete(o.ele.owned, sid)
+		}
+		snaps = append(snaps, &replica{id, snapshotBallot(b)})
+	}
+	for election, members := range o.ele.campaigns {
+		for member, c := range members {
+			if c.leader && now.Sub(c.seen) > timeout {
+				c.leader = false
+				changes = append(changes, &leadership{election, member, false, c.term})
+			}
+			refreshes = append(refreshes, &refresh{election, member})
+		}
+	}
+	o.ele.lock.Unlock()
+
+	o.sendConfirms(confirms)
+	for _, rep := range snaps {
+		o.replicateElection(rep.id, rep.snap)
+	}
+	for _, change := range changes {
+		o.app.HandleLeadership(change.election, change.member, false, change.term)
+	}
+	for _, ref := range refreshes {
+		o.sendCampaign(pastry.Resolve(ref.election), ref.election, ref.member, false)
+	}
+}
+
+// Sends the state of an election to all the members of the local leaf set.
+func (o *Overlay) replicateElection(electionId *big.Int, state *ballot) {
+	for _, leaf := range o.pastry.Leaves() {
+		o.sendBallot(leaf, electionId, state)
+	}
+}
+
+// Returns the current leader of an election, or nil if there are no candidates.
+func leaderOf(b *ballot) *candidate {
+	if len(b.Candidates) == 0 {
+		return nil
+	}
+	return b.Candidates[0]
+}
+
+// Creates a copy of the election state, safe to use outside the lock.
+func snapshotBallot(b *ballot) *ballot {
+	snap := &ballot{
+		Name:       b.Name,
+		Term:       b.Term,
+		Candidates: make([]*candidate, len(b.Candidates)),
+	}
+	for i, c := range b.Candidates {
+		cpy := *c
+		snap.Candidates[i] = &cpy
+	}
+	return snap
+}
@@ -0,0 +1,123 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package scribe
+
+import (
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Election candidate, tracking the leadership of its local members.
+type voter struct {
+	*collector
+
+	leaders map[uint64]bool // Members currently leading
+	lock    sync.Mutex
+}
+
+func (v *voter) HandleLeadership(election string, member uint64, leader bool, term uint64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if leader {
+		v.leaders[member] = true
+	} else {
+		delete(v.leaders, member)
+	}
+}
+
+// Counts the members leading across all the voters.
+func countLeaders(voters []*voter) int {
+	count := 0
+	for _, v := range voters {
+		v.lock.Lock()
+		count += len(v.leaders)
+		v.lock.Unlock()
+	}
+	return count
+}
+
+// Tests whether elections keep exactly one leader, replacing resigned ones.
+func TestElection(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	live := make([]*Overlay, 0, nodes)
+	voters := make([]*voter, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		v := &voter{collector: &collector{}, leaders: make(map[uint64]bool)}
+		node := New(overId, key, v)
+
+		live = append(live, node)
+		voters = append(voters, v)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		time.Sleep(time.Second)
+	}
+	// Campaign with two members on every node
+	for i, node := range live {
+		node.Campaign(topicId, uint64(2*i))
+		node.Campaign(topicId, uint64(2*i+1))
+	}
+	time.Sleep(time.Second)
+	if n := countLeaders(voters); n != 1 {
+		t.Fatalf("leader count mismatch: have %v, want 1.", n)
+	}
+	// Resign the leaders one by one, verifying that a new one takes over
+	for i := 0; i < 2*nodes-1; i++ {
+		// Resign outside the lock, local deliveries may recurse
+		for j, v := range voters {
+			v.lock.Lock()
+			members := []uint64{}
+			for member := range v.leaders {
+				members = append(members, member)
+				delete(v.leaders, member)
+			}
+			v.lock.Unlock()
+
+			for _, member := range members {
+				live[j].Resign(topicId, member)
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+		if n := countLeaders(voters); n != 1 {
+			t.Fatalf("resign %d: leader count mismatch: have %v, want 1.", i, n)
+		}
+	}
+}
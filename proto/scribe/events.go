@@ -47,7 +47,10 @@
 //
 //  - Balance:
 //    It is essentially the same as publish, with the only difference that the
-//    message is send forward on only one edge of the multi-cast tree.
+//    message is send forward on only one edge of the multi-cast tree. Keyed
+//    balances are the exception: they always climb up to the topic root and
+//    descend along the edges picked by consistently hashing the key, so that
+//    the same key reaches the same member regardless of the entry point.
 //
 //  - Report:
 //    These are used to distribute load reports between members of a multi-cast
@@ -57,6 +60,39 @@
 //    As the name suggests, direct messages have a precise destination. Only the
 //    true recipient must handle it. Delivery to a non-precise destination means
 //    either the destination terminated, or pastry's mis-delivered (churn?).
+//
+//  - Ack, status and nack:
+//    Control messages of the reliable publish mode (see reliable.go), flowing
+//    between neighboring nodes of a topic tree (or the publisher and the entry
+//    point of the tree). Like reports, they always use precise addressing.
+//
+//  - Retain, recall and probe:
+//    Requests of the topic retention mechanism (see retention.go), routed to the
+//    topic root like subscriptions. The replies (retained events and claims) use
+//    precise addressing.
+//
+//  - Enqueue, consume and settle:
+//    Requests of the work queues (see queue.go), routed to the queue owner (the
+//    node closest to the queue id). Job deliveries and state replicas use precise
+//    addressing.
+//
+//  - Schedule:
+//    Scheduled events (see schedule.go) are routed to the owner of a random
+//    message key, which mirrors them to its closest leaf using precise addressing
+//    and publishes them when due.
+//
+//  - Campaign:
+//    Leader election campaigns (see election.go) are routed to the owner of the
+//    election id, which confirms the leader and replicates the election to its
+//    leaf set using precise addressing.
+//
+//  - Acquire and release:
+//    Lease requests of the distributed locks (see lock.go), routed to the owner
+//    of the lock id. Grants and the lock mirrors use precise addressing.
+//
+//  - Bounce:
+//    Virgin events and balances that cannot be delivered (see bounce.go) may be
+//    returned to their origin node, using precise addressing.
 
 package scribe
 
@@ -66,6 +102,8 @@ import (
 	"log"
 	"math/big"
 
+	"github.com/karalabe/iris/balancer"
+	"github.com/karalabe/iris/filter"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/pastry"
 	"github.com/karalabe/iris/proto/scribe/topic"
@@ -74,6 +112,16 @@ import (
 // Implements the pastry.Callback.Deliver method.
 func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 	head := msg.Head.Meta.(*header)
+
+	// Payload carrying messages may outlive the delivery, so detach them from the
+	// pool, whilst control messages are recycled. Direct ones are passed upstream.
+	switch head.Op {
+	case opDirect:
+	case opPublish, opBalance, opEnqueue, opJob, opSchedule, opMirror, opBounce, opRetained:
+		msg.Detach()
+	default:
+		defer msg.Release()
+	}
 	switch head.Op {
 	case opSubscribe:
 		// Topic roots will get self-subscribe messages, discard them
@@ -101,6 +149,17 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); !hand || err != nil {
 			// Simple race condition between unsubscribe and publish, left in for debug
 			log.Printf("scribe: %v failed to handle delivered publish (churn?): %v %v.", o.pastry.Self(), hand, err)
+
+			// Virgin events reaching the root of a non-existent topic have no subscribers,
+			// but may still need to be retained
+			if !hand && head.Prev == nil {
+				o.retainEvent(head, msg)
+				if head.Seq != 0 {
+					o.sendStatus(head.Sender, true, head.Topic, head.Sender, head.Seq, &Status{})
+				} else if !o.retains(head.Topic) {
+					o.bounceMessage(head, bounceNoSubscribers, msg)
+				}
+			}
 		}
 	case opBalance:
 		// Non-virgin balances must be delivered precisely
@@ -111,6 +170,14 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		if hand, err := o.handleBalance(msg, head.Topic, head.Prev); !hand || err != nil {
 			// Simple race condition between unsubscribe and balance, left in for debug
 			log.Printf("scribe: failed to handle delivered balance: %v %v.", hand, err)
+
+			// Return the message if the topic is unknown or has no capacity left
+			switch {
+			case !hand && head.Prev == nil:
+				o.bounceMessage(head, bounceNoSubscribers, msg)
+			case hand && err != nil:
+				o.bounceMessage(head, bounceNoCapacity, msg)
+			}
 		}
 	case opReport:
 		// Load reports are always addresses precisely, drop any other
@@ -125,11 +192,113 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		// Direct messages are always precise
 		if o.pastry.Self().Cmp(key) != 0 {
 			log.Printf("scribe: direct message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			msg.Release()
 			return
 		}
 		if err := o.handleDirect(msg); err != nil {
 			log.Printf("scribe: failed to handle direct message: %v.", err)
 		}
+	case opAck, opStatus, opNack:
+		// Reliable delivery control messages are always precise
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: reliable control message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		switch head.Op {
+		case opAck:
+			o.handleAck(head.Sender, head)
+		case opStatus:
+			o.handleStatus(head.Sender, head)
+		case opNack:
+			o.handleNack(head.Sender, head)
+		}
+	case opRetain:
+		o.handleRetain(head.Topic, head.Retention)
+	case opRecall:
+		o.handleRecall(head.Sender, head.Topic, head.ReqId)
+	case opProbe:
+		// Probes delivered to another node mean the topic root changed
+		if head.Sender.Cmp(o.pastry.Self()) != 0 {
+			o.sendClaim(head.Sender, head.Topic)
+		}
+	case opRetained, opClaim:
+		// Recall replies and handovers are always precise
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: retention message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if head.Op == opRetained {
+			o.handleRetained(head, msg)
+		} else {
+			o.handleClaim(head.Sender, head.Topic)
+		}
+	case opEnqueue:
+		o.handleEnqueue(head.Topic, msg)
+	case opConsume:
+		o.handleConsume(head.Sender, head.Topic, head.Queue)
+	case opSettle:
+		o.handleSettle(head.Sender, head.Topic, head.Queue, head.JobId, head.Done)
+	case opJob, opReplica:
+		// Job deliveries and replicas are always precise
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: work queue message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if head.Op == opReplica {
+			o.handleReplica(head.Sender, head.Topic, head.Replica)
+		} else if err := o.handleJob(msg); err != nil {
+			log.Printf("scribe: failed to handle work queue job: %v.", err)
+		}
+	case opSchedule:
+		o.handleSchedule(key, msg)
+	case opMirror, opUnmirror:
+		// Scheduled event replicas are always precise
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: scheduled event replica delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if head.Op == opMirror {
+			o.handleMirror(head.Delay, msg)
+		} else {
+			o.handleUnmirror(head.Delay)
+		}
+	case opCampaign:
+		o.handleCampaign(head.Sender, head.Topic, head.Election, head.Member, head.Resign)
+	case opElected, opBallot:
+		// Leader confirmations and replicas are always precise
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: leader election message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if head.Op == opElected {
+			o.handleElected(head.Election, head.Term, head.Leader, head.Member)
+		} else {
+			o.handleBallot(head.Sender, head.Topic, head.Ballot)
+		}
+	case opAcquire:
+		o.handleAcquire(head.Sender, head.Topic, head.Lock, head.Member, head.ReqId, head.TTL, head.Until)
+	case opRelease:
+		o.handleRelease(head.Sender, head.Topic, head.Lock, head.Member, head.Token, head.Renew)
+	case opGrant, opMutex:
+		// Lease grants and lock mirrors are always precise
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: lock message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if head.Op == opGrant {
+			o.handleGrant(head.Topic, head.Lock, head.Member, head.ReqId, head.Token)
+		} else {
+			o.handleMutex(head.Sender, head.Topic, head.Mutex)
+		}
+	case opBounce:
+		// Returned messages are always precise
+		if o.pastry.Self().Cmp(key) != 0 {
+			log.Printf("scribe: returned message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+			return
+		}
+		if err := o.handleBounce(msg); err != nil {
+			log.Printf("scribe: failed to handle returned message: %v.", err)
+		}
 	default:
 		log.Printf("unknown opcode received: %v, %v", head.Op, head)
 	}
@@ -160,6 +329,7 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 	}
 	// Catch virgin publish messages and only blindly forward if cannot handle
 	if head.Op == opPublish && head.Prev == nil {
+		msg.Detach()
 		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding publish: %v %v.", hand, err)
 		} else {
@@ -168,6 +338,7 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 	}
 	// Catch virgin balance messages and only blindly forward if cannot handle
 	if head.Op == opBalance && head.Prev == nil {
+		msg.Detach()
 		if hand, err := o.handleBalance(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding balance: %v %v.", hand, err)
 		} else {
@@ -201,8 +372,9 @@ func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int) error {
 			return err
 		}
 		rep := &report{
-			Tops: []*big.Int{topicId},
-			Caps: []int{1},
+			Tops:    []*big.Int{topicId},
+			Loads:   []balancer.Load{{Cap: 1}},
+			Filters: []filter.Summary{filter.All()},
 		}
 		o.sendReport(nodeId, rep)
 	}
@@ -225,6 +397,7 @@ func (o *Overlay) handleUnsubscribe(nodeId, topicId *big.Int) error {
 		return err
 	}
 	if nodeId.Cmp(o.pastry.Self()) != 0 {
+		delete(o.hosts, heartId(topicId, nodeId).String())
 		if err := o.unmonitor(topicId, nodeId); err != nil {
 			return err
 		}
@@ -239,6 +412,7 @@ func (o *Overlay) handleUnsubscribe(nodeId, topicId *big.Int) error {
 			go o.sendUnsubscribe(parent, top.Self())
 		}
 		delete(o.topics, sid)
+		o.forgetReliable(topicId)
 	}
 	return nil
 }
@@ -260,24 +434,43 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 	if prevHop != nil && !top.Neighbor(prevHop) {
 		return true, fmt.Errorf("non-neighbor direct publish: %v", prevHop)
 	}
-	// Extract the message headers
+	// Extract the message headers, acknowledging and deduplicating reliable events
 	head := msg.Head.Meta.(*header)
+	if head.Seq != 0 && !o.acceptReliable(head, msg, prevHop) {
+		return true, nil
+	}
+	o.retainEvent(head, msg)
 
 	// Get the batch of nodes to broadcast to
-	nodes, local := top.Broadcast(prevHop), false
+	nodes, local := top.BroadcastMatching(prevHop, head.Headers), false
 	owner := o.pastry.Self()
+
+	remotes := make([]*big.Int, 0, len(nodes))
 	for _, id := range nodes {
 		if id.Cmp(owner) != 0 {
-			// Create a copy since overlay will modify headers
-			cpy := new(proto.Message)
-			*cpy = *msg
-			cpy.Head.Meta = head.copy()
-
-			o.fwdPublish(id, cpy)
+			remotes = append(remotes, id)
 		} else {
 			local = true
 		}
 	}
+	// Track reliable events until the downstream hops report back, notifying the
+	// filtered out subtrees of the skipped events
+	var skips map[string][]uint64
+	if head.Seq != 0 {
+		skips = o.skipReliable(head, top.Broadcast(prevHop), remotes)
+		o.trackReliable(head, msg, prevHop, remotes, skips, local)
+	}
+	for _, id := range remotes {
+		// Create a copy since overlay will modify headers
+		cpy := new(proto.Message)
+		*cpy = *msg
+		cpy.Head.Meta = head.copy()
+		if head.Seq != 0 {
+			cpy.Head.Meta.(*header).Skip = skips[id.String()]
+		}
+
+		o.fwdPublish(id, cpy)
+	}
 	// If local subscription is present, decrypt and deliver
 	if local {
 		// Assemble a fresh copy for decryption
@@ -311,8 +504,16 @@ func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *b
 		// No error, but not handled either
 		return false, nil
 	}
-	// Fetch the recipient and either forward or deliver
-	node, err := top.Balance(prevHop)
+	// Fetch the recipient (keyed or load based) and either forward or deliver
+	head := msg.Head.Meta.(*header)
+
+	var node *big.Int
+	var err error
+	if head.Key != nil {
+		node, err = top.BalanceKey(head.Key, prevHop)
+	} else {
+		node, err = top.BalanceBy(head.Strat, append([]*big.Int{prevHop}, head.Avoid...)...)
+	}
 	if err != nil {
 		return true, err
 	}
@@ -322,7 +523,6 @@ func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *b
 		return true, nil
 	}
 	// Remove all carrier headers and decrypt
-	head := msg.Head.Meta.(*header)
 	msg.Head.Meta = head.Meta
 	if err := msg.Decrypt(); err != nil {
 		return true, err
@@ -338,9 +538,10 @@ func (o *Overlay) handleDirect(msg *proto.Message) error {
 	head := msg.Head.Meta.(*header)
 	msg.Head.Meta = head.Meta
 	if err := msg.Decrypt(); err != nil {
+		msg.Release()
 		return err
 	}
-	// Deliver the message upstream
+	// Deliver the message upstream (passing on the ownership)
 	o.app.HandleDirect(head.Sender, msg)
 	return nil
 }
@@ -361,7 +562,7 @@ func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 			continue
 		}
 		// Insert the report into the topic and assign parent if needed
-		if err := top.ProcessReport(src, rep.Caps[i]); err != nil {
+		if err := top.ProcessReport(src, rep.Loads[i], rep.Filters[i]); err != nil {
 			// Report arrived from untracked node, assign as parent?
 			if top.Parent() != nil {
 				// Nope, we already have a parent, bin it
@@ -382,7 +583,7 @@ func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 			top.Reown(src)
 
 			// Insert the topic report now
-			if err := top.ProcessReport(src, rep.Caps[i]); err != nil {
+			if err := top.ProcessReport(src, rep.Loads[i], rep.Filters[i]); err != nil {
 				errs = append(errs, fmt.Errorf("failed to process parent report: %v.", err))
 				continue
 			}
@@ -392,6 +593,17 @@ func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 				errs = append(errs, fmt.Errorf("failed to ping node: %v.", err))
 				continue
 			}
+			// Track whether the child hosts members (older reports carry no names)
+			if parent := top.Parent(); parent == nil || parent.Cmp(src) != 0 {
+				hid := heartId(id, src).String()
+				o.lock.Lock()
+				if i < len(rep.Names) && rep.Names[i] != "" {
+					o.hosts[hid] = rep.Names[i]
+				} else {
+					delete(o.hosts, hid)
+				}
+				o.lock.Unlock()
+			}
 		}
 	}
 	// Return any errors
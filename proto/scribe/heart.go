@@ -26,56 +26,101 @@ import (
 	"log"
 	"math/big"
 
+	"github.com/karalabe/iris/balancer"
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/filter"
+	"github.com/karalabe/iris/proto/scribe/topic"
 )
 
 // Load report between two carrier nodes.
 type report struct {
-	Tops []*big.Int // Topics shared between two carrier nodes
-	Caps []int      // Capacity reports related to the topics above
+	Tops    []*big.Int       // Topics shared between two carrier nodes
+	Loads   []balancer.Load  // Load reports related to the topics above
+	Filters []filter.Summary // Filter summaries of the subtrees behind the reporter
+	Names   []string         // Names of the topics above hosted by the reporter ("" if none)
+}
+
+// Generates the heartbeat id of a node within a topic.
+func heartId(topic *big.Int, node *big.Int) *big.Int {
+	return new(big.Int).Add(new(big.Int).Lsh(topic, uint(config.PastrySpace)), node)
 }
 
 // Adds the node within the topic to the list of monitored entities.
 func (o *Overlay) monitor(topic *big.Int, node *big.Int) error {
-	id := new(big.Int).Add(new(big.Int).Lsh(topic, uint(config.PastrySpace)), node)
-	return o.heart.Monitor(id)
+	return o.heart.Monitor(heartId(topic, node))
 }
 
 // Remove the node of a specific topic from the list of monitored entities.
 func (o *Overlay) unmonitor(topic *big.Int, node *big.Int) error {
-	id := new(big.Int).Add(new(big.Int).Lsh(topic, uint(config.PastrySpace)), node)
-	return o.heart.Unmonitor(id)
+	return o.heart.Unmonitor(heartId(topic, node))
 }
 
 // Updates the last ping time of a node within a topic.
 func (o *Overlay) ping(topic *big.Int, node *big.Int) error {
-	id := new(big.Int).Add(new(big.Int).Lsh(topic, uint(config.PastrySpace)), node)
-	return o.heart.Ping(id)
+	return o.heart.Ping(heartId(topic, node))
 }
 
 // Implements the heart.Callback.Beat method. At each heartbeat, the load stats
-// of all the topics are gathered, mapped to destination nodes and sent out. In
-// addition, each root topic sends a subscription message to discover newly
-// added roots.
+// and filter summaries of all the topics are gathered, mapped to destination
+// nodes and sent out, and the local loads and filters are refreshed from the
+// application. In addition, each root topic sends a subscription message to
+// discover newly added roots.
 func (o *Overlay) Beat() {
 	o.lock.RLock()
-	defer o.lock.RUnlock()
 
-	// Collect and assemble load reports
+	// Collect and assemble load reports, gathering the topics to cycle too
 	reports := make(map[string]*report)
-	for _, top := range o.topics {
-		ids, caps := top.GenerateReports()
+	cycles := make([]*topic.Topic, 0, len(o.topics))
+	names := make(map[*topic.Topic]string)
+	roots := []*big.Int{}
+	for sid, top := range o.topics {
+		ids, loads, filters := top.GenerateReports()
+		parent := top.Parent()
 		for i, id := range ids {
 			sid := id.String()
 			rep, ok := reports[id.String()]
 			if !ok {
-				rep = &report{[]*big.Int{}, []int{}}
+				rep = &report{[]*big.Int{}, []balancer.Load{}, []filter.Summary{}, []string{}}
 				reports[sid] = rep
 			}
 			rep.Tops = append(rep.Tops, top.Self())
-			rep.Caps = append(rep.Caps, caps[i])
+			rep.Loads = append(rep.Loads, loads[i])
+
+			// Tell the parent if local members are hosted, so it can report our death
+			name := ""
+			if parent != nil && parent.Cmp(id) == 0 {
+				name = o.names[top.Self().String()]
+			}
+			rep.Names = append(rep.Names, name)
+
+			// Retaining roots need all events, whatever the subscriber filters
+			if o.retains(top.Self()) {
+				rep.Filters = append(rep.Filters, filter.All())
+			} else {
+				rep.Filters = append(rep.Filters, filters[i])
+			}
+		}
+		// Note the locally subscribed topics to refresh
+		if name, ok := o.names[sid]; ok {
+			names[top] = name
+		}
+		cycles = append(cycles, top)
+
+		if top.Parent() == nil {
+			roots = append(roots, top.Self())
 		}
-		top.Cycle()
+	}
+	o.lock.RUnlock()
+
+	// Update the local load stats and filters outside the overlay lock, since the
+	// application may call back into the overlay while gathering them
+	for _, top := range cycles {
+		var local *balancer.Load
+		if name, ok := names[top]; ok {
+			local = o.app.Load(name)
+			top.Filter(o.app.Filter(name))
+		}
+		top.Cycle(local)
 	}
 	// Distribute the load reports to the remote carriers
 	for sid, rep := range reports {
@@ -85,16 +130,21 @@ func (o *Overlay) Beat() {
 			panic("failed to extract node id.")
 		}
 	}
-	// Subscribe all root topics
-	for _, top := range o.topics {
-		if top.Parent() == nil {
-			go o.sendSubscribe(top.Self())
-		}
+	// Subscribe all root topics, probe the retained ones for root changes and
+	// maintain the work queues, scheduled events, leader elections and locks
+	for _, id := range roots {
+		go o.sendSubscribe(id)
 	}
+	go o.probeRetained()
+	go o.maintainQueues()
+	go o.maintainSchedule()
+	go o.maintainElections()
+	go o.maintainLocks()
 }
 
 // Implements the heat.Callback.Dead method, monitoring the death events of
-// topic member nodes.
+// topic member nodes. The application is notified only by the former parent of
+// a dead child that reported hosting members, so each death is reported once.
 func (o *Overlay) Dead(id *big.Int) {
 	// Split the id into topic and node parts
 	topic := new(big.Int).Rsh(id, uint(config.PastrySpace))
@@ -102,9 +152,11 @@ func (o *Overlay) Dead(id *big.Int) {
 
 	log.Printf("scribe: %v topic member death report: %v.", o.pastry.Self(), node)
 
-	o.lock.RLock()
+	o.lock.Lock()
 	top, ok := o.topics[topic.String()]
-	o.lock.RUnlock()
+	name, hosted := o.hosts[id.String()]
+	delete(o.hosts, id.String())
+	o.lock.Unlock()
 	if !ok {
 		log.Printf("scribe: topic %v already dead.", topic)
 		return
@@ -122,5 +174,9 @@ func (o *Overlay) Dead(id *big.Int) {
 		if err := o.handleUnsubscribe(node, topic); err != nil {
 			log.Printf("scribe: failed to unsubscribe dead node: %v.", err)
 		}
+		// Notify the application if the dead child hosted members
+		if hosted {
+			o.app.HandleDeath(name, node)
+		}
 	}
 }
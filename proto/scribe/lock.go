@@ -0,0 +1,420 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the distributed locks: the node closest to the lock id (the
+// key owner) keeps the lease holder of the lock and the queue of waiting lockers,
+// handing out strictly increasing fencing tokens with every granted lease. Leases
+// end when released, when their time-to-live passes, or when the holder node stops
+// renewing them at its heartbeats (i.e. it died).
+//
+// The owner mirrors each lock to its leaf closest to the lock id after every
+// change and at each heartbeat. Ownership is re-checked at every heartbeat: owners
+// seeing a closer node step down, mirrors becoming the closest promote theirs.
+// Lockers resend their pending acquisitions at each heartbeat, so requests lost in
+// the churn are retried.
+
+package scribe
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Lock specific errors
+var ErrLockTimeout = errors.New("lock acquisition timed out")
+
+// Holder or waiter of a lock.
+type locker struct {
+	Node   *big.Int      // Overlay node of the locker
+	Member uint64        // Upper layer id of the locker within the node
+	ReqId  uint64        // Id of the acquisition request
+	TTL    time.Duration // Duration of the requested lease
+	Until  time.Time     // Lease expiry (holder) or acquisition deadline (waiter)
+	Seen   time.Time     // Time of the last lease renewal (holder)
+}
+
+// State of a lock, mirrored to the closest leaf of the owner.
+type mutex struct {
+	Name    string    // Name of the lock
+	Token   uint64    // Last fencing token handed out
+	Holder  *locker   // Current lease holder (nil if free)
+	Waiters []*locker // Pending acquisitions in arrival order
+}
+
+// Pending lock acquisition of the local node.
+type acquisition struct {
+	name   string        // Name of the lock to acquire
+	member uint64        // Upper layer id of the locker
+	ttl    time.Duration // Duration of the requested lease
+	until  time.Time     // Deadline of the acquisition
+	token  chan uint64   // Channel receiving the fencing token
+}
+
+// Lease held by a local locker.
+type lease struct {
+	token uint64    // Fencing token of the lease
+	until time.Time // Expiry of the lease
+}
+
+// Distributed lock state of the local node.
+type locks struct {
+	owned    map[string]*mutex            // Locks owned by the local node
+	replicas map[string]*mutex            // Locks mirrored from neighbors
+	pending  map[uint64]*acquisition      // Local acquisitions waiting for a grant
+	held     map[string]map[uint64]*lease // Leases held locally by lock and locker
+	reqIdx   uint64                       // Id to assign to the next acquisition
+
+	lock sync.Mutex
+}
+
+// Creates an empty distributed lock state.
+func newLocks() *locks {
+	return &locks{
+		owned:    make(map[string]*mutex),
+		replicas: make(map[string]*mutex),
+		pending:  make(map[uint64]*acquisition),
+		held:     make(map[string]map[uint64]*lease),
+	}
+}
+
+// Lease grant of a lock, sent after releasing the lock.
+type grant struct {
+	id     *big.Int // Id of the lock
+	name   string   // Name of the lock
+	holder *locker  // Locker receiving the lease
+	token  uint64   // Fencing token of the lease
+}
+
+// Acquires a lease on the named lock for a local locker, blocking until granted
+// or the timeout expires. The lease lasts for ttl, unless released earlier or the
+// local node dies. The returned fencing token is larger than any handed out for
+// the lock before.
+func (o *Overlay) Lock(name string, member uint64, ttl time.Duration, timeout time.Duration) (uint64, error) {
+	o.lck.lock.Lock()
+	reqId := o.lck.reqIdx
+	o.lck.reqIdx++
+
+	acq := &acquisition{
+		name:   name,
+		member: member,
+		ttl:    ttl,
+		until:  time.Now().Add(timeout),
+		token:  make(chan uint64, 1),
+	}
+	o.lck.pending[reqId] = acq
+	o.lck.lock.Unlock()
+
+	// Request the lease and wait for the grant
+	o.sendAcquire(pastry.Resolve(name), name, member, reqId, ttl, acq.until)
+	select {
+	case token := <-acq.token:
+		return token, nil
+	case <-time.After(timeout):
+		o.lck.lock.Lock()
+		delete(o.lck.pending, reqId)
+		o.lck.lock.Unlock()
+
+		// A grant might have arrived meanwhile
+		select {
+		case token := <-acq.token:
+			return token, nil
+		default:
+			return 0, ErrLockTimeout
+		}
+	}
+}
+
+// Releases the lease of a local locker on the named lock.
+func (o *Overlay) Unlock(name string, member uint64, token uint64) {
+	o.lck.lock.Lock()
+	if l, ok := o.lck.held[name][member]; ok && l.token == token {
+		delete(o.lck.held[name], member)
+		if len(o.lck.held[name]) == 0 {
+			delete(o.lck.held, name)
+		}
+	}
+	o.lck.lock.Unlock()
+
+	o.sendRelease(pastry.Resolve(name), name, member, token)
+}
+
+// Retrieves an owned lock, promoting the local mirror or creating a new one if
+// not owned yet. A promoted holder is given a fresh renewal grace period. The lock
+// is assumed held.
+func (o *Overlay) ownMutex(lockId *big.Int, name string) *mutex {
+	sid := lockId.String()
+	if m, ok := o.lck.owned[sid]; ok {
+		return m
+	}
+	m, ok := o.lck.replicas[sid]
+	if ok {
+		delete(o.lck.replicas, sid)
+		if m.Holder != nil {
+			m.Holder.Seen = time.Now()
+		}
+	} else {
+		m = &mutex{Name: name}
+	}
+	o.lck.owned[sid] = m
+	return m
+}
+
+// Handles a lease acquisition (or its retry) arriving at the lock owner, granting
+// the lease if the lock is free, or queuing the locker otherwise.
+func (o *Overlay) handleAcquire(src *big.Int, lockId *big.Int, name string, member uint64, reqId uint64, ttl time.Duration, until time.Time) {
+	o.lck.lock.Lock()
+	m := o.ownMutex(lockId, name)
+
+	var grants []*grant
+	switch {
+	case m.Holder != nil && m.Holder.Node.Cmp(src) == 0 && m.Holder.ReqId == reqId:
+		// Retried acquisition of a granted lease, grant again
+		grants = append(grants, &grant{lockId, name, m.Holder, m.Token})
+	case queuedLocker(m, src, reqId):
+		// Retried acquisition of a waiting locker, keep waiting
+	default:
+		m.Waiters = append(m.Waiters, &locker{Node: src, Member: member, ReqId: reqId, TTL: ttl, Until: until})
+		grants = o.grantLease(lockId, m)
+	}
+	snap := snapshotMutex(m)
+	o.lck.lock.Unlock()
+
+	o.mirrorMutex(lockId, snap)
+	o.sendGrants(grants)
+}
+
+// Handles a lease renewal or release arriving at the lock owner. Messages not
+// matching the current lease (expired or taken over) are discarded.
+func (o *Overlay) handleRelease(src *big.Int, lockId *big.Int, name string, member uint64, token uint64, renew bool) {
+	o.lck.lock.Lock()
+	m := o.ownMutex(lockId, name)
+
+	var grants []*grant
+	if h := m.Holder; h != nil && h.Node.Cmp(src) == 0 && h.Member == member && m.Token == token {
+		if renew {
+			h.Seen = time.Now()
+		} else {
+			m.Holder = nil
+			grants = o.grantLease(lockId, m)
+		}
+	}
+	snap := snapshotMutex(m)
+	o.lck.lock.Unlock()
+
+	if !renew {
+		o.mirrorMutex(lockId, snap)
+	}
+	o.sendGrants(grants)
+}
+
+// Handles a lease granted by the lock owner, passing the token to the waiting
+// acquisition. Duplicate grants (retried acquisitions) are ignored, while grants
+// nobody waits for any more are released right away.
+func (o *Overlay) handleGrant(lockId *big.Int, name string, member uint64, reqId uint64, token uint64) {
+	o.lck.lock.Lock()
+	if l, ok := o.lck.held[name][member]; ok && l.token == token {
+		o.lck.lock.Unlock()
+		return
+	}
+	acq, ok := o.lck.pending[reqId]
+	if ok {
+		delete(o.lck.pending, reqId)
+
+		leases, ok := o.lck.held[name]
+		if !ok {
+			leases = make(map[uint64]*lease)
+			o.lck.held[name] = leases
+		}
+		leases[member] = &lease{token: token, until: time.Now().Add(acq.ttl)}
+	}
+	o.lck.lock.Unlock()
+
+	if ok {
+		acq.token <- token
+	} else {
+		o.sendRelease(lockId, name, member, token)
+	}
+}
+
+// Handles the mirrored state of a neighbor's lock. If the local node believes
+// itself the owner too, the node closer to the lock id wins.
+func (o *Overlay) handleMutex(src *big.Int, lockId *big.Int, state *mutex) {
+	o.lck.lock.Lock()
+	defer o.lck.lock.Unlock()
+
+	sid := lockId.String()
+	if _, ok := o.lck.owned[sid]; ok {
+		if pastry.Distance(o.pastry.Self(), lockId).Cmp(pastry.Distance(src, lockId)) <= 0 {
+			return
+		}
+		delete(o.lck.owned, sid)
+	}
+	o.lck.replicas[sid] = state
+}
+
+// Grants the lease of a free lock to the first waiter whose acquisition did not
+// time out yet, handing out the next fencing token. The lock is assumed held.
+func (o *Overlay) grantLease(lockId *big.Int, m *mutex) []*grant {
+	if m.Holder != nil {
+		return nil
+	}
+	now := time.Now()
+	for len(m.Waiters) > 0 {
+		w := m.Waiters[0]
+		m.Waiters = m.Waiters[1:]
+		if now.After(w.Until) {
+			continue
+		}
+		m.Token++
+		w.Until, w.Seen = now.Add(w.TTL), now
+		m.Holder = w
+		return []*grant{&grant{lockId, m.Name, w, m.Token}}
+	}
+	return nil
+}
+
+// Sends out the lease grants of a locking round.
+func (o *Overlay) sendGrants(grants []*grant) {
+	for _, g := range grants {
+		o.sendGrant(g.holder.Node, g.id, g.name, g.holder.Member, g.holder.ReqId, g.token)
+	}
+}
+
+// Mirrors the state of a lock to the leaf closest to the lock id.
+func (o *Overlay) mirrorMutex(lockId *big.Int, state *mutex) {
+	if leaf := o.closestLeaf(lockId); leaf != nil {
+		o.sendMutex(leaf, lockId, state)
+	}
+}
+
+// Maintains the locks at each heartbeat. Owned locks release the leases which
+// expired or were not renewed (granting the next waiters), drop the timed out
+// waiters, and are mirrored or handed off if their id moved closer to a neighbor.
+// Locally held leases are renewed and pending acquisitions retried.
+func (o *Overlay) maintainLocks() {
+	type mirror struct {
+		id   *big.Int
+		snap *mutex
+	}
+	type renewal struct {
+		name   string
+		member uint64
+		token  uint64
+	}
+	type retry struct {
+		reqId uint64
+		acq   *acquisition
+	}
+	var grants []*grant
+	var mirrors []*mirror
+	var renewals []*renewal
+	var retries []*retry
+
+	o.lck.lock.Lock()
+	now := time.Now()
+	timeout := time.Duration(config.ScribeKillCount) * config.ScribeBeatPeriod
+	for sid, m := range o.lck.owned {
+		id, _ := new(big.Int).SetString(sid, 10)
+
+		// Expire the lease if over or not renewed, and the timed out waiters
+		if h := m.Holder; h != nil && (now.After(h.Until) || now.Sub(h.Seen) > timeout) {
+			m.Holder = nil
+		}
+		waiters := m.Waiters[:0]
+		for _, w := range m.Waiters {
+			if !now.After(w.Until) {
+				waiters = append(waiters, w)
+			}
+		}
+		m.Waiters = waiters
+		grants = append(grants, o.grantLease(id, m)...)
+
+		// Step down if no longer the owner
+		if !o.ownsKey(id) {
+			delete(o.lck.owned, sid)
+			o.lck.replicas[sid] = m
+		}
+		mirrors = append(mirrors, &mirror{id, snapshotMutex(m)})
+	}
+	for sid, m := range o.lck.replicas {
+		if id, _ := new(big.Int).SetString(sid, 10); o.ownsKey(id) {
+			o.ownMutex(id, m.Name)
+		}
+	}
+	for name, leases := range o.lck.held {
+		for member, l := range leases {
+			if now.After(l.until) {
+				delete(leases, member)
+				continue
+			}
+			renewals = append(renewals, &renewal{name, member, l.token})
+		}
+		if len(leases) == 0 {
+			delete(o.lck.held, name)
+		}
+	}
+	for reqId, acq := range o.lck.pending {
+		retries = append(retries, &retry{reqId, acq})
+	}
+	o.lck.lock.Unlock()
+
+	for _, mir := range mirrors {
+		o.mirrorMutex(mir.id, mir.snap)
+	}
+	o.sendGrants(grants)
+	for _, ren := range renewals {
+		o.sendRenew(pastry.Resolve(ren.name), ren.name, ren.member, ren.token)
+	}
+	for _, ret := range retries {
+		o.sendAcquire(pastry.Resolve(ret.acq.name), ret.acq.name, ret.acq.member, ret.reqId, ret.acq.ttl, ret.acq.until)
+	}
+}
+
+// Checks whether a locker is already waiting for a lock.
+func queuedLocker(m *mutex, node *big.Int, reqId uint64) bool {
+	for _, w := range m.Waiters {
+		if w.Node.Cmp(node) == 0 && w.ReqId == reqId {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates a copy of the lock state, safe to use outside the lock.
+func snapshotMutex(m *mutex) *mutex {
+	snap := &mutex{
+		Name:    m.Name,
+		Token:   m.Token,
+		Waiters: make([]*locker, len(m.Waiters)),
+	}
+	if m.Holder != nil {
+		holder := *m.Holder
+		snap.Holder = &holder
+	}
+	for i, w := range m.Waiters {
+		cpy := *w
+		snap.Waiters[i] = &cpy
+	}
+	return snap
+}
@@ -0,0 +1,113 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+)
+
+// Tests whether lock leases and fencing tokens survive the death of the owner.
+func TestLockFailover(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	live := make([]*Overlay, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, &collector{})
+		live = append(live, node)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		time.Sleep(time.Second)
+	}
+	// Lock a few times to find the owner and advance the token
+	var token uint64
+	for i := 0; i < 3; i++ {
+		next, err := live[0].Lock(topicId, 1, time.Minute, time.Second)
+		if err != nil {
+			t.Fatalf("lock %d: failed to acquire: %v.", i, err)
+		}
+		if next <= token {
+			t.Fatalf("lock %d: token not increasing: have %v, want > %v.", i, next, token)
+		}
+		token = next
+		if i < 2 {
+			live[0].Unlock(topicId, 1, token)
+		}
+	}
+	owner := -1
+	for i, node := range live {
+		node.lck.lock.Lock()
+		if len(node.lck.owned) > 0 {
+			owner = i
+		}
+		node.lck.lock.Unlock()
+	}
+	if owner == -1 {
+		t.Fatalf("no lock owner found.")
+	}
+	// Kill the owner (or another node if the locker owns it)
+	victim := owner
+	if victim == 0 {
+		victim = 1
+	}
+	for i, node := range live {
+		if i == victim {
+			node.Shutdown()
+		} else {
+			defer node.Shutdown()
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Verify that the lease survived and the tokens keep increasing
+	locker := (victim + 1) % nodes
+	if locker == 0 {
+		locker = 2
+	}
+	if _, err := live[locker].Lock(topicId, 2, time.Minute, 500*time.Millisecond); err != ErrLockTimeout {
+		t.Fatalf("held lock acquisition error mismatch: have %v, want %v.", err, ErrLockTimeout)
+	}
+	live[0].Unlock(topicId, 1, token)
+	next, err := live[locker].Lock(topicId, 2, time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("failed to acquire released lock: %v.", err)
+	}
+	if next <= token {
+		t.Fatalf("token not increasing after failover: have %v, want > %v.", next, token)
+	}
+}
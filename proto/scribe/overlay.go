@@ -28,7 +28,9 @@ import (
 	"math/big"
 	"sync"
 
+	"github.com/karalabe/iris/balancer"
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/filter"
 	"github.com/karalabe/iris/heart"
 	"github.com/karalabe/iris/proto"
 	"github.com/karalabe/iris/proto/pastry"
@@ -42,7 +44,33 @@ var ErrSubscribed = errors.New("already subscribed")
 type Callback interface {
 	HandlePublish(sender *big.Int, topic string, msg *proto.Message)
 	HandleBalance(sender *big.Int, topic string, msg *proto.Message)
+
+	// Handles a direct message, which may be pooled: the callee owns it and has
+	// to either release or detach it.
 	HandleDirect(sender *big.Int, msg *proto.Message)
+
+	// Notifies of the death of a child node that hosted members of a topic. Only
+	// the former parent of the dead node is notified, even if not subscribed.
+	HandleDeath(topic string, node *big.Int)
+
+	// Reports the load of the local subscribers of a topic, or nil if the topic
+	// is not load balanced (the local capacity is then estimated from the CPU).
+	Load(topic string) *balancer.Load
+
+	// Reports the filter summary of the local subscribers of a topic.
+	Filter(topic string) filter.Summary
+
+	// Handles a job of a locally consumed work queue, which needs to be acked or
+	// nacked via the overlay.
+	HandleJob(queue string, id uint64, attempt int, msg *proto.Message)
+
+	// Handles a locally originated message returned by the overlay as it could
+	// not be delivered (only if its headers implement Bouncer).
+	HandleBounce(reason error, msg *proto.Message)
+
+	// Notifies a local candidate of winning or losing the leadership of an
+	// election.
+	HandleLeadership(election string, member uint64, leader bool, term uint64)
 }
 
 // The overlay implementation, receiving the overlay events and processing
@@ -55,6 +83,13 @@ type Overlay struct {
 
 	topics map[string]*topic.Topic // Topics active in the local node
 	names  map[string]string       // Mapping from topic id to its textual name
+	hosts  map[string]string       // Topic names hosted by the children, keyed by heart id
+	rel    *reliable               // Reliable publish state
+	ret    *retention              // Retained topic state
+	que    *queues                 // Work queue state
+	sch    *schedule               // Scheduled event state
+	ele    *elections              // Leader election state
+	lck    *locks                  // Distributed lock state
 
 	lock sync.RWMutex
 }
@@ -66,6 +101,13 @@ func New(overId string, key *rsa.PrivateKey, app Callback) *Overlay {
 		app:    app,
 		topics: make(map[string]*topic.Topic),
 		names:  make(map[string]string),
+		hosts:  make(map[string]string),
+		rel:    newReliable(),
+		ret:    newRetention(),
+		que:    newQueues(),
+		sch:    newSchedule(),
+		ele:    newElections(),
+		lck:    newLocks(),
 	}
 	o.pastry = pastry.New(overId, key, o)
 	o.heart = heart.New(config.ScribeBeatPeriod, config.ScribeKillCount, o)
@@ -103,6 +145,11 @@ func (o *Overlay) Shutdown() error {
 	return o.pastry.Shutdown()
 }
 
+// Returns the overlay id of the local node.
+func (o *Overlay) Self() *big.Int {
+	return o.pastry.Self()
+}
+
 // Subscribes to the specified scribe topic.
 func (o *Overlay) Subscribe(topic string) error {
 	// Resolve the topic id
@@ -139,22 +186,59 @@ func (o *Overlay) Unsubscribe(topic string) error {
 
 // Publishes a message into topic to be broadcast to everyone.
 func (o *Overlay) Publish(topic string, msg *proto.Message) error {
+	return o.PublishHeaders(topic, nil, msg)
+}
+
+// Publishes a message with content headers into topic, to be broadcast to every
+// subscriber whose filter matches the headers. Subtrees of the topic containing
+// no matching filters are not visited.
+func (o *Overlay) PublishHeaders(topic string, headers map[string]string, msg *proto.Message) error {
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
-	o.sendPublish(pastry.Resolve(topic), msg)
+	o.sendPublish(pastry.Resolve(topic), headers, msg)
 	return nil
 }
 
 // Balances a message to one of the subscribed nodes.
 func (o *Overlay) Balance(topic string, msg *proto.Message) error {
+	return o.BalanceBy(topic, balancer.Weighted, nil, msg)
+}
+
+// Balances a message to one of the subscribed nodes, using the given balancing
+// strategy at each hop of the topic tree. The message will not be delivered to
+// any of the nodes in avoid, as long as the topic tree allows choosing others.
+func (o *Overlay) BalanceBy(topic string, strat balancer.Strategy, avoid []*big.Int, msg *proto.Message) error {
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
-	o.sendBalance(pastry.Resolve(topic), msg)
+	o.sendBalance(pastry.Resolve(topic), strat, avoid, msg)
 	return nil
 }
 
+// Balances a message to one of the subscribed nodes, consistently choosing the
+// same one for the same key while the topic membership is stable.
+func (o *Overlay) BalanceKey(topic string, key []byte, msg *proto.Message) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendBalanceKey(pastry.Resolve(topic), key, msg)
+	return nil
+}
+
+// Returns the aggregated load of a topic as seen from the local node. Note, the
+// remote parts are only updated with each heartbeat, so the numbers are merely
+// approximate.
+func (o *Overlay) Load(topic string) (balancer.Load, error) {
+	o.lock.RLock()
+	top, ok := o.topics[pastry.Resolve(topic).String()]
+	o.lock.RUnlock()
+	if !ok {
+		return balancer.Load{}, errors.New("non-existent topic")
+	}
+	return top.Load(), nil
+}
+
 // Sends a direct message to a known node.
 func (o *Overlay) Direct(dest *big.Int, msg *proto.Message) error {
 	if err := msg.Encrypt(); err != nil {
@@ -163,3 +247,25 @@ func (o *Overlay) Direct(dest *big.Int, msg *proto.Message) error {
 	o.sendDirect(dest, msg)
 	return nil
 }
+
+// Checks whether the local node is the closest to a key among its leaf set.
+func (o *Overlay) ownsKey(key *big.Int) bool {
+	self := pastry.Distance(o.pastry.Self(), key)
+	for _, leaf := range o.pastry.Leaves() {
+		if pastry.Distance(leaf, key).Cmp(self) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the leaf set member closest to a key, or nil if the leaf set is empty.
+func (o *Overlay) closestLeaf(key *big.Int) *big.Int {
+	var best, dist *big.Int
+	for _, leaf := range o.pastry.Leaves() {
+		if d := pastry.Distance(leaf, key); best == nil || d.Cmp(dist) < 0 {
+			best, dist = leaf, d
+		}
+	}
+	return best
+}
@@ -26,8 +26,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/karalabe/iris/balancer"
 	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/filter"
 	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
 )
 
 type collector struct {
@@ -58,6 +61,26 @@ func (c *collector) HandleDirect(sender *big.Int, msg *proto.Message) {
 	c.direct = append(c.direct, msg)
 }
 
+func (c *collector) HandleDeath(topic string, node *big.Int) {
+}
+
+func (c *collector) Load(topic string) *balancer.Load {
+	return nil
+}
+
+func (c *collector) Filter(topic string) filter.Summary {
+	return filter.All()
+}
+
+func (c *collector) HandleJob(queue string, id uint64, attempt int, msg *proto.Message) {
+}
+
+func (c *collector) HandleBounce(reason error, msg *proto.Message) {
+}
+
+func (c *collector) HandleLeadership(election string, member uint64, leader bool, term uint64) {
+}
+
 // Tests whether topic publishing work as expected.
 func TestPublish(t *testing.T) {
 	// Override the overlay configuration
@@ -356,3 +379,111 @@ func TestDirect(t *testing.T) {
 		time.Sleep(time.Second)
 	}
 }
+
+// Collector recording the death notifications.
+type mourner struct {
+	*collector
+	deaths []*big.Int
+}
+
+func (m *mourner) HandleDeath(topic string, node *big.Int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.deaths = append(m.deaths, node)
+}
+
+// Tests that node deaths are reported once, and only for member hosting nodes.
+func TestDeathReport(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 6
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes, every second hosting
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	live := make([]*Overlay, 0, nodes)
+	colls := make([]*mourner, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		coll := &mourner{collector: &collector{}}
+		node := New(overId, key, coll)
+		live = append(live, node)
+		colls = append(colls, coll)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		time.Sleep(time.Second)
+	}
+	for i := 0; i < nodes; i += 2 {
+		if err := live[i].Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Find a non-root hosting node and a non-root carrier (other than the hosting
+	// node's parent, which needs to report the death) to kill
+	sid := pastry.Resolve(topicId).String()
+	victim, carrier := -1, -1
+	var parent *big.Int
+	for i, node := range live {
+		node.lock.RLock()
+		if top, ok := node.topics[sid]; ok && top.Parent() != nil {
+			if _, hosts := node.names[sid]; hosts && victim == -1 {
+				victim, parent = i, top.Parent()
+			}
+		}
+		node.lock.RUnlock()
+	}
+	if victim == -1 {
+		t.Fatalf("failed to find non-root hosting node.")
+	}
+	for i, node := range live {
+		node.lock.RLock()
+		if top, ok := node.topics[sid]; ok && top.Parent() != nil && node.Self().Cmp(parent) != 0 {
+			if _, hosts := node.names[sid]; !hosts && carrier == -1 {
+				carrier = i
+			}
+		}
+		node.lock.RUnlock()
+	}
+	for i, node := range live {
+		if i != victim && i != carrier {
+			defer node.Shutdown()
+		}
+	}
+	// Kill the nodes abruptly, without unsubscribing from the topic
+	for _, i := range []int{victim, carrier} {
+		if i != -1 {
+			live[i].heart.Terminate()
+			live[i].pastry.Shutdown()
+		}
+	}
+	time.Sleep(time.Duration(config.ScribeKillCount+4) * config.ScribeBeatPeriod)
+
+	// Verify that a single death notification arrived, for the hosting node
+	deaths := []*big.Int{}
+	for i, coll := range colls {
+		if i != victim && i != carrier {
+			coll.lock.Lock()
+			deaths = append(deaths, coll.deaths...)
+			coll.lock.Unlock()
+		}
+	}
+	if len(deaths) != 1 {
+		t.Fatalf("death notification count mismatch: have %v, want %v.", len(deaths), 1)
+	}
+	if deaths[0].Cmp(live[victim].Self()) != 0 {
+		t.Fatalf("dead node mismatch: have %v, want %v.", deaths[0], live[victim].Self())
+	}
+}
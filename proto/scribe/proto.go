@@ -24,8 +24,12 @@ package scribe
 import (
 	"encoding/gob"
 	"math/big"
+	"time"
 
+	"github.com/karalabe/iris/balancer"
+	"github.com/karalabe/iris/filter"
 	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/wire"
 )
 
 // Scribe operation code type.
@@ -39,6 +43,30 @@ const (
 	opBalance                   // Topic balance
 	opReport                    // Load report
 	opDirect                    // Direct send
+	opAck                       // Reliable event arrival acknowledgement
+	opStatus                    // Reliable event subtree delivery status
+	opNack                      // Reliable event repair request
+	opRetain                    // Topic retention policy update
+	opRecall                    // Retained event request
+	opRetained                  // Retained events (recall reply or handover)
+	opProbe                     // Retained topic root probe
+	opClaim                     // Retained topic root claim
+	opEnqueue                   // Work queue job insertion
+	opConsume                   // Work queue consumer registration
+	opJob                       // Work queue job delivery
+	opSettle                    // Work queue job ack or nack
+	opReplica                   // Work queue state replication
+	opSchedule                  // Scheduled event storage
+	opMirror                    // Scheduled event replication
+	opUnmirror                  // Scheduled event replica removal
+	opBounce                    // Undeliverable message returned to its sender
+	opCampaign                  // Leader election campaign (or resignation)
+	opElected                   // Leader election confirmation
+	opBallot                    // Leader election state replication
+	opAcquire                   // Lock lease acquisition
+	opRelease                   // Lock lease release (or renewal)
+	opGrant                     // Lock lease grant
+	opMutex                     // Lock state mirroring
 )
 
 // Extra headers for the scribe.
@@ -49,9 +77,60 @@ type header struct {
 	Sender *big.Int    // Origin overlay node
 
 	// Operation dependent fields
-	Topic  *big.Int // Topic id used during unsubscribing, broadcasting and balancing
-	Prev   *big.Int // Previous hop inside topic to prevent optimize routes
-	Report *report  // CPU load/capacity report
+	Topic   *big.Int          // Topic id used during unsubscribing, broadcasting and balancing
+	Prev    *big.Int          // Previous hop inside topic to prevent optimize routes
+	Key     []byte            // Affinity key for consistent balancing (nil otherwise)
+	Strat   balancer.Strategy // Strategy to use when balancing
+	Avoid   []*big.Int        // Nodes to avoid when balancing, if possible
+	Headers map[string]string // Event headers to evaluate subtree filters against
+	Report  *report           // Load report (capacity, queue depth, latency, filters)
+
+	// Reliable publish fields
+	Seq    uint64   // Sequence number of a reliable event (0 if best effort)
+	Origin *big.Int // Publisher of the event an ack, status or nack refers to (or of a scheduled event)
+	Virgin bool     // Whether an ack, status or nack is meant for the publisher itself
+	Status *Status  // Aggregated delivery status of a subtree
+	Nack   []uint64 // Sequence numbers of the events missing from a stream
+	Skip   []uint64 // Sequence numbers of the stream's events filtered out above the hop
+
+	// Retention fields
+	ReqId     uint64     // Id of the recall request (or lock acquisition)
+	Retention *Retention // Retention policy of a topic (nil if not retained)
+	Retained  int        // Number of events in the recall reply or handover (each sent separately)
+	Handover  bool       // Whether the retained events are handed over to a new root
+	RetainKey string     // Retention key value of the carried event
+	Stamp     time.Time  // Arrival time of the carried event at the topic root
+
+	// Work queue fields
+	Queue   string // Name of the work queue
+	Dead    string // Name of the dead-letter queue of a job ("" if none)
+	JobId   uint64 // Id of the job being delivered or settled
+	Attempt int    // Delivery attempt of the job
+	Done    bool   // Whether the job was processed successfully
+	Replica *queue // Replicated state of a work queue
+
+	// Scheduled publish fields
+	Due   time.Time // Time to publish the scheduled event at
+	Delay *big.Int  // Message key of a mirrored scheduled event
+
+	// Returned message fields
+	Bounce bounce // Reason why the message could not be delivered
+
+	// Leader election fields
+	Election string   // Name of the election
+	Member   uint64   // Upper layer id of the campaigning candidate (or of the leader)
+	Resign   bool     // Whether the candidate withdraws from the election
+	Term     uint64   // Term of the current leader
+	Leader   *big.Int // Node of the current leader (nil if none)
+	Ballot   *ballot  // Replicated state of an election
+
+	// Distributed lock fields
+	Lock  string        // Name of the lock
+	TTL   time.Duration // Duration of the requested lease
+	Until time.Time     // Deadline of the lock acquisition
+	Token uint64        // Fencing token of a lease
+	Renew bool          // Whether the lease is renewed instead of released
+	Mutex *mutex        // Mirrored state of a lock
 }
 
 // Creates a copy of the header needed by the broadcast.
@@ -61,9 +140,316 @@ func (h *header) copy() *header {
 	return cpy
 }
 
-// Make sure the header struct is registered with gob.
+// Make sure the header struct is registered with gob and the wire codecs.
 func init() {
 	gob.Register(&header{})
+	wire.Register(wire.ScribeHeader, func() wire.Codec { return new(header) })
+}
+
+// Implements wire.Codec, appending the non-zero header fields to the encoder.
+// The replicated states (queues, ballots and mutexes) are only exchanged within
+// the leaf sets on changes, rarely enough to be left to the gob fallback.
+func (h *header) EncodeWire(enc *wire.Encoder) {
+	enc.Value(1, h.Meta)
+	enc.Uint(2, uint64(h.Op))
+	enc.Big(3, h.Sender)
+
+	enc.Big(4, h.Topic)
+	enc.Big(5, h.Prev)
+	enc.Bytes(6, h.Key)
+	enc.Uint(7, uint64(h.Strat))
+	for _, avoid := range h.Avoid {
+		enc.Big(8, avoid)
+	}
+	enc.StringMap(9, h.Headers)
+	enc.Struct(10, h.Report)
+
+	enc.Uint(11, h.Seq)
+	enc.Big(12, h.Origin)
+	enc.Bool(13, h.Virgin)
+	enc.Struct(14, h.Status)
+	enc.Uints(15, h.Nack)
+
+	enc.Uint(16, h.ReqId)
+	enc.Struct(17, h.Retention)
+	enc.Int(18, int64(h.Retained))
+	enc.Bool(19, h.Handover)
+
+	enc.Text(20, h.Queue)
+	enc.Text(21, h.Dead)
+	enc.Uint(22, h.JobId)
+	enc.Int(23, int64(h.Attempt))
+	enc.Bool(24, h.Done)
+	enc.Gob(25, h.Replica)
+
+	enc.Time(26, h.Due)
+	enc.Big(27, h.Delay)
+
+	enc.Uint(28, uint64(h.Bounce))
+
+	enc.Text(29, h.Election)
+	enc.Uint(30, h.Member)
+	enc.Bool(31, h.Resign)
+	enc.Uint(32, h.Term)
+	enc.Big(33, h.Leader)
+	enc.Gob(34, h.Ballot)
+
+	enc.Text(35, h.Lock)
+	enc.Duration(36, h.TTL)
+	enc.Time(37, h.Until)
+	enc.Uint(38, h.Token)
+	enc.Bool(39, h.Renew)
+	enc.Gob(40, h.Mutex)
+
+	enc.Text(41, h.RetainKey)
+	enc.Time(42, h.Stamp)
+	enc.Uints(43, h.Skip)
+}
+
+// Implements wire.Codec, restoring the header fields from the decoder.
+func (h *header) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			h.Meta = dec.Value()
+		case 2:
+			h.Op = opcode(dec.Uint())
+		case 3:
+			h.Sender = dec.Big()
+		case 4:
+			h.Topic = dec.Big()
+		case 5:
+			h.Prev = dec.Big()
+		case 6:
+			h.Key = dec.Bytes()
+		case 7:
+			h.Strat = balancer.Strategy(dec.Uint())
+		case 8:
+			h.Avoid = append(h.Avoid, dec.Big())
+		case 9:
+			h.Headers = dec.StringMap()
+		case 10:
+			h.Report = new(report)
+			dec.Struct(h.Report)
+		case 11:
+			h.Seq = dec.Uint()
+		case 12:
+			h.Origin = dec.Big()
+		case 13:
+			h.Virgin = dec.Bool()
+		case 14:
+			h.Status = new(Status)
+			dec.Struct(h.Status)
+		case 15:
+			h.Nack = dec.Uints()
+		case 16:
+			h.ReqId = dec.Uint()
+		case 17:
+			h.Retention = new(Retention)
+			dec.Struct(h.Retention)
+		case 18:
+			h.Retained = int(dec.Int())
+		case 19:
+			h.Handover = dec.Bool()
+		case 20:
+			h.Queue = dec.Text()
+		case 21:
+			h.Dead = dec.Text()
+		case 22:
+			h.JobId = dec.Uint()
+		case 23:
+			h.Attempt = int(dec.Int())
+		case 24:
+			h.Done = dec.Bool()
+		case 25:
+			dec.Gob(&h.Replica)
+		case 26:
+			h.Due = dec.Time()
+		case 27:
+			h.Delay = dec.Big()
+		case 28:
+			h.Bounce = bounce(dec.Uint())
+		case 29:
+			h.Election = dec.Text()
+		case 30:
+			h.Member = dec.Uint()
+		case 31:
+			h.Resign = dec.Bool()
+		case 32:
+			h.Term = dec.Uint()
+		case 33:
+			h.Leader = dec.Big()
+		case 34:
+			dec.Gob(&h.Ballot)
+		case 35:
+			h.Lock = dec.Text()
+		case 36:
+			h.TTL = dec.Duration()
+		case 37:
+			h.Until = dec.Time()
+		case 38:
+			h.Token = dec.Uint()
+		case 39:
+			h.Renew = dec.Bool()
+		case 40:
+			dec.Gob(&h.Mutex)
+		case 41:
+			h.RetainKey = dec.Text()
+		case 42:
+			h.Stamp = dec.Time()
+		case 43:
+			h.Skip = dec.Uints()
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+// Implements wire.Codec, appending the per topic entries of the load report as
+// repeated fields, in topic order.
+func (r *report) EncodeWire(enc *wire.Encoder) {
+	for _, top := range r.Tops {
+		enc.Big(1, top)
+	}
+	for i := range r.Loads {
+		enc.Struct(2, (*wireLoad)(&r.Loads[i]))
+	}
+	for i := range r.Filters {
+		enc.Struct(3, (*wireSummary)(&r.Filters[i]))
+	}
+	enc.Strings(4, r.Names)
+}
+
+// Implements wire.Codec, restoring the load report entries from the decoder.
+// Reports with mismatching entry counts are rejected as corrupt.
+func (r *report) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			r.Tops = append(r.Tops, dec.Big())
+		case 2:
+			var load balancer.Load
+			dec.Struct((*wireLoad)(&load))
+			r.Loads = append(r.Loads, load)
+		case 3:
+			var sum filter.Summary
+			dec.Struct((*wireSummary)(&sum))
+			r.Filters = append(r.Filters, sum)
+		case 4:
+			r.Names = dec.Strings()
+		default:
+			dec.Skip()
+		}
+	}
+	if len(r.Loads) != len(r.Tops) || len(r.Filters) != len(r.Tops) || len(r.Names) > len(r.Tops) {
+		dec.Fail(wire.ErrCorrupt)
+	}
+	return dec.Err()
+}
+
+// Wire codec of a balancer load report entry.
+type wireLoad balancer.Load
+
+// Implements wire.Codec, appending the non-zero load fields to the encoder.
+func (l *wireLoad) EncodeWire(enc *wire.Encoder) {
+	enc.Int(1, int64(l.Cap))
+	enc.Int(2, int64(l.Pend))
+	enc.Duration(3, l.Lat)
+	enc.Int(4, int64(l.Members))
+}
+
+// Implements wire.Codec, restoring the load fields from the decoder.
+func (l *wireLoad) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			l.Cap = int(dec.Int())
+		case 2:
+			l.Pend = int(dec.Int())
+		case 3:
+			l.Lat = dec.Duration()
+		case 4:
+			l.Members = int(dec.Int())
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+// Wire codec of a subtree filter summary.
+type wireSummary filter.Summary
+
+// Implements wire.Codec, appending the summary with the filters in their textual
+// form to the encoder.
+func (s *wireSummary) EncodeWire(enc *wire.Encoder) {
+	enc.Bool(1, s.All)
+	for _, f := range s.Filters {
+		enc.Text(2, f.String())
+	}
+}
+
+// Implements wire.Codec, restoring the summary by reparsing the filters.
+func (s *wireSummary) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			s.All = dec.Bool()
+		case 2:
+			f, err := filter.Parse(dec.Text())
+			if err != nil {
+				dec.Fail(err)
+				break
+			}
+			s.Filters = append(s.Filters, f)
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+// Implements wire.Codec, appending the non-zero status fields to the encoder.
+func (s *Status) EncodeWire(enc *wire.Encoder) {
+	enc.Int(1, int64(s.Delivered))
+	enc.Int(2, int64(s.Failed))
+}
+
+// Implements wire.Codec, restoring the status fields from the decoder.
+func (s *Status) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			s.Delivered = int(dec.Int())
+		case 2:
+			s.Failed = int(dec.Int())
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+// Implements wire.Codec, appending the non-zero policy fields to the encoder.
+func (r *Retention) EncodeWire(enc *wire.Encoder) {
+	enc.Int(1, int64(r.Events))
+	enc.Text(2, r.Key)
+}
+
+// Implements wire.Codec, restoring the policy fields from the decoder.
+func (r *Retention) DecodeWire(dec *wire.Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			r.Events = int(dec.Int())
+		case 2:
+			r.Key = dec.Text()
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
 }
 
 // Envelopes a scribe header into the generic packet container and sends it to
@@ -113,10 +499,185 @@ func (o *Overlay) sendUnsubscribe(parentId *big.Int, topicId *big.Int) {
 	o.sendPacket(parentId, &header{Op: opUnsubscribe, Topic: topicId})
 }
 
-// Assembles a topic publish message, consisting of the publish opcode, and the
-// destination topic (to allow catching publishes in flight).
-func (o *Overlay) sendPublish(topicId *big.Int, msg *proto.Message) {
-	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId}, msg)
+// Assembles a topic publish message, consisting of the publish opcode, the
+// destination topic (to allow catching publishes in flight) and the optional
+// event headers (to allow pruning non-matching subtrees).
+func (o *Overlay) sendPublish(topicId *big.Int, headers map[string]string, msg *proto.Message) {
+	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId, Headers: headers}, msg)
+}
+
+// Assembles a reliable event arrival acknowledgement, consisting of the ack
+// opcode and the event identifiers (topic, publisher and sequence number).
+func (o *Overlay) sendAck(dest *big.Int, virgin bool, topicId *big.Int, origin *big.Int, seq uint64) {
+	o.sendPacket(dest, &header{Op: opAck, Topic: topicId, Origin: origin, Seq: seq, Virgin: virgin})
+}
+
+// Assembles a reliable event delivery status report, consisting of the status
+// opcode, the event identifiers and the aggregated status of the subtree.
+func (o *Overlay) sendStatus(dest *big.Int, virgin bool, topicId *big.Int, origin *big.Int, seq uint64, status *Status) {
+	o.sendPacket(dest, &header{Op: opStatus, Topic: topicId, Origin: origin, Seq: seq, Virgin: virgin, Status: status})
+}
+
+// Assembles a reliable event repair request, consisting of the nack opcode, the
+// stream identifiers (topic and publisher) and the missing sequence numbers.
+func (o *Overlay) sendNack(dest *big.Int, virgin bool, topicId *big.Int, origin *big.Int, missing []uint64) {
+	o.sendPacket(dest, &header{Op: opNack, Topic: topicId, Origin: origin, Nack: missing, Virgin: virgin})
+}
+
+// Assembles a retention policy update, consisting of the retain opcode, the
+// topic and the new policy. The message is routed to the topic root.
+func (o *Overlay) sendRetain(topicId *big.Int, policy *Retention) {
+	o.sendPacket(topicId, &header{Op: opRetain, Topic: topicId, Retention: policy})
+}
+
+// Assembles a retained event request, consisting of the recall opcode, the topic
+// and the local request id. The message is routed to the topic root.
+func (o *Overlay) sendRecall(topicId *big.Int, id uint64) {
+	o.sendPacket(topicId, &header{Op: opRecall, Topic: topicId, ReqId: id})
+}
+
+// Assembles a recall reply, consisting of the retained opcode, the topic, the
+// request id, the retention policy and the retained events.
+func (o *Overlay) sendRetained(dest *big.Int, topicId *big.Int, id uint64, policy *Retention, events []*retained) {
+	o.sendRetainedEvents(dest, &header{Op: opRetained, Topic: topicId, ReqId: id, Retention: policy}, events)
+}
+
+// Assembles a retained topic handover, consisting of the retained opcode with
+// the handover flag set, the topic, the retention policy and the events.
+func (o *Overlay) sendHandover(dest *big.Int, topicId *big.Int, policy *Retention, events []*retained) {
+	o.sendRetainedEvents(dest, &header{Op: opRetained, Topic: topicId, Retention: policy, Handover: true}, events)
+}
+
+// Sends retained events one per message, each extending the common header with
+// the event count and the event's own fields, so that the payloads travel on the
+// data links. Without events, the bare header is sent.
+func (o *Overlay) sendRetainedEvents(dest *big.Int, head *header, events []*retained) {
+	if len(events) == 0 {
+		o.sendPacket(dest, head)
+		return
+	}
+	for _, event := range events {
+		part := head.copy()
+		part.Retained, part.RetainKey, part.Origin, part.Stamp = len(events), event.key, event.origin, event.stamp
+
+		msg := new(proto.Message)
+		*msg = *event.msg
+		o.sendDataPacket(dest, part, msg)
+	}
+}
+
+// Assembles a retained topic root probe, consisting of the probe opcode and the
+// topic. The message is routed to the (possibly new) topic root.
+func (o *Overlay) sendProbe(topicId *big.Int) {
+	o.sendPacket(topicId, &header{Op: opProbe, Topic: topicId})
+}
+
+// Assembles a retained topic root claim, consisting of the claim opcode and the
+// topic, sent to the previous root.
+func (o *Overlay) sendClaim(dest *big.Int, topicId *big.Int) {
+	o.sendPacket(dest, &header{Op: opClaim, Topic: topicId})
+}
+
+// Assembles a job insertion, consisting of the enqueue opcode, the queue and its
+// dead-letter queue, and the job payload. The message is routed to the owner.
+func (o *Overlay) sendEnqueue(queueId *big.Int, queue string, dead string, msg *proto.Message) {
+	o.sendDataPacket(queueId, &header{Op: opEnqueue, Topic: queueId, Queue: queue, Dead: dead}, msg)
+}
+
+// Assembles a consumer registration, consisting of the consume opcode and the
+// queue. The message is routed to the queue owner.
+func (o *Overlay) sendConsume(queueId *big.Int, queue string) {
+	o.sendPacket(queueId, &header{Op: opConsume, Topic: queueId, Queue: queue})
+}
+
+// Assembles a job settlement, consisting of the settle opcode, the queue, the
+// job id and the success flag. The message is routed to the queue owner.
+func (o *Overlay) sendSettle(queueId *big.Int, queue string, id uint64, done bool) {
+	o.sendPacket(queueId, &header{Op: opSettle, Topic: queueId, Queue: queue, JobId: id, Done: done})
+}
+
+// Assembles a queue state replication, consisting of the replica opcode, the
+// queue id and the state itself, sent to a leaf set member.
+func (o *Overlay) sendReplica(dest *big.Int, queueId *big.Int, state *queue) {
+	o.sendPacket(dest, &header{Op: opReplica, Topic: queueId, Replica: state})
+}
+
+// Assembles a campaign refresh or resignation, consisting of the campaign opcode,
+// the election and the candidate id. The message is routed to the election owner.
+func (o *Overlay) sendCampaign(electionId *big.Int, election string, member uint64, resign bool) {
+	o.sendPacket(electionId, &header{Op: opCampaign, Topic: electionId, Election: election, Member: member, Resign: resign})
+}
+
+// Assembles a leader confirmation, consisting of the elected opcode, the election,
+// the term and the current leader, sent to a candidate node.
+func (o *Overlay) sendElected(dest *big.Int, election string, term uint64, leader *big.Int, member uint64) {
+	o.sendPacket(dest, &header{Op: opElected, Election: election, Term: term, Leader: leader, Member: member})
+}
+
+// Assembles an election state replication, consisting of the ballot opcode, the
+// election id and the state itself, sent to a leaf set member.
+func (o *Overlay) sendBallot(dest *big.Int, electionId *big.Int, state *ballot) {
+	o.sendPacket(dest, &header{Op: opBallot, Topic: electionId, Ballot: state})
+}
+
+// Assembles a lock acquisition, consisting of the acquire opcode, the lock, the
+// locker and request ids, the lease duration and the acquisition deadline. The
+// message is routed to the lock owner.
+func (o *Overlay) sendAcquire(lockId *big.Int, lock string, member uint64, reqId uint64, ttl time.Duration, until time.Time) {
+	o.sendPacket(lockId, &header{Op: opAcquire, Topic: lockId, Lock: lock, Member: member, ReqId: reqId, TTL: ttl, Until: until})
+}
+
+// Assembles a lease release, consisting of the release opcode, the lock, the
+// locker and the fencing token of the lease. The message is routed to the lock
+// owner.
+func (o *Overlay) sendRelease(lockId *big.Int, lock string, member uint64, token uint64) {
+	o.sendPacket(lockId, &header{Op: opRelease, Topic: lockId, Lock: lock, Member: member, Token: token})
+}
+
+// Assembles a lease renewal, consisting of the release opcode with the renewal
+// flag set, the lock, the locker and the fencing token of the lease. The message
+// is routed to the lock owner.
+func (o *Overlay) sendRenew(lockId *big.Int, lock string, member uint64, token uint64) {
+	o.sendPacket(lockId, &header{Op: opRelease, Topic: lockId, Lock: lock, Member: member, Token: token, Renew: true})
+}
+
+// Assembles a lease grant, consisting of the grant opcode, the lock, the locker
+// and request ids and the fencing token, sent to the locker node.
+func (o *Overlay) sendGrant(dest *big.Int, lockId *big.Int, lock string, member uint64, reqId uint64, token uint64) {
+	o.sendPacket(dest, &header{Op: opGrant, Topic: lockId, Lock: lock, Member: member, ReqId: reqId, Token: token})
+}
+
+// Assembles a lock state mirror, consisting of the mutex opcode, the lock id and
+// the state itself, sent to the closest leaf.
+func (o *Overlay) sendMutex(dest *big.Int, lockId *big.Int, state *mutex) {
+	o.sendPacket(dest, &header{Op: opMutex, Topic: lockId, Mutex: state})
+}
+
+// Assembles a scheduled event, consisting of the schedule opcode, the topic and
+// headers of the event, its publisher and due time. The message is routed to the
+// owner of the message key.
+func (o *Overlay) sendSchedule(id *big.Int, topicId *big.Int, headers map[string]string, origin *big.Int, due time.Time, msg *proto.Message) {
+	o.sendDataPacket(id, &header{Op: opSchedule, Topic: topicId, Headers: headers, Origin: origin, Due: due}, msg)
+}
+
+// Assembles a scheduled event replica, consisting of the mirror opcode, the
+// message key and the scheduled event fields, sent to a leaf of the owner.
+func (o *Overlay) sendMirror(dest *big.Int, id *big.Int, topicId *big.Int, headers map[string]string, origin *big.Int, due time.Time, msg *proto.Message) {
+	o.sendDataPacket(dest, &header{Op: opMirror, Topic: topicId, Headers: headers, Origin: origin, Due: due, Delay: id}, msg)
+}
+
+// Assembles a scheduled event replica removal, consisting of the unmirror opcode
+// and the message key.
+func (o *Overlay) sendUnmirror(dest *big.Int, id *big.Int) {
+	o.sendPacket(dest, &header{Op: opUnmirror, Delay: id})
+}
+
+// Assembles the publish message of a due scheduled event. Contrary to the other
+// packets, the sender is the original publisher, not the local node.
+func (o *Overlay) sendDelayed(topicId *big.Int, headers map[string]string, origin *big.Int, msg *proto.Message) {
+	head := &header{Op: opPublish, Sender: origin, Topic: topicId, Headers: headers, Meta: msg.Head.Meta}
+	msg.Head.Meta = head
+	o.pastry.Send(topicId, msg)
 }
 
 // Reroutes a publish message to a new destination to traverse the topic tree
@@ -126,10 +687,17 @@ func (o *Overlay) fwdPublish(dest *big.Int, msg *proto.Message) {
 }
 
 // Assembles a topic balance message, consisting of the balance opcode, the
-// originating application (to allow replies) and the destination topic (to
-// allow catching balances midway).
-func (o *Overlay) sendBalance(topicId *big.Int, msg *proto.Message) {
-	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId}, msg)
+// originating application (to allow replies), the destination topic (to allow
+// catching balances midway), the balancing strategy to use and the nodes to
+// avoid (if any).
+func (o *Overlay) sendBalance(topicId *big.Int, strat balancer.Strategy, avoid []*big.Int, msg *proto.Message) {
+	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId, Strat: strat, Avoid: avoid}, msg)
+}
+
+// Assembles a keyed topic balance message, consisting of the balance opcode,
+// the destination topic and the affinity key used to select the recipient.
+func (o *Overlay) sendBalanceKey(topicId *big.Int, key []byte, msg *proto.Message) {
+	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId, Key: key}, msg)
 }
 
 // Reroutes a balanced message to a new destination to traverse the topic tree
@@ -147,3 +715,9 @@ func (o *Overlay) sendReport(nodeId *big.Int, rep *report) {
 func (o *Overlay) sendDirect(dest *big.Int, msg *proto.Message) {
 	o.sendDataPacket(dest, &header{Op: opDirect}, msg)
 }
+
+// Returns an undeliverable message to its origin, along with the reason of the
+// failed delivery.
+func (o *Overlay) sendBounce(dest *big.Int, reason bounce, msg *proto.Message) {
+	o.sendDataPacket(dest, &header{Op: opBounce, Bounce: reason}, msg)
+}
@@ -0,0 +1,133 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package scribe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/balancer"
+	"github.com/karalabe/iris/filter"
+	"github.com/karalabe/iris/proto/wire"
+)
+
+// Assembles a load report header, as sent to every tree neighbor on each beat.
+func makeReportHeader(topics int) *header {
+	even, _ := filter.Parse(`kind == "even"`)
+	rep := &report{}
+	for i := 0; i < topics; i++ {
+		rep.Tops = append(rep.Tops, new(big.Int).Lsh(big.NewInt(int64(i+1)), 100))
+		rep.Loads = append(rep.Loads, balancer.Load{Cap: 1000 + i, Pend: i, Lat: time.Duration(i) * time.Millisecond, Members: i % 3})
+		rep.Filters = append(rep.Filters, filter.Summary{Filters: []*filter.Filter{even}})
+		rep.Names = append(rep.Names, "")
+	}
+	rep.Filters[0], rep.Names[0] = filter.All(), "topic"
+	return &header{Op: opReport, Sender: big.NewInt(314), Report: rep}
+}
+
+// Tests that the explicitly encoded composite fields survive a round trip.
+func TestWireRoundtrip(t *testing.T) {
+	tests := []*header{
+		{Op: opReport, Report: &report{}},
+		makeReportHeader(1),
+		makeReportHeader(8),
+		{Op: opStatus, Status: &Status{}},
+		{Op: opStatus, Topic: big.NewInt(1), Origin: big.NewInt(2), Seq: 3, Virgin: true, Status: &Status{Delivered: 4, Failed: 1}},
+		{Op: opRetain, Retention: &Retention{Events: 16, Key: "sensor"}},
+		{Op: opPublish, Seq: 10, Skip: []uint64{7, 9}},
+	}
+	for i, tt := range tests {
+		res := new(header)
+		if err := wire.Unmarshal(wire.Marshal(tt), res); err != nil {
+			t.Fatalf("test %d: failed to decode header: %v.", i, err)
+		}
+		if !reflect.DeepEqual(tt, res) {
+			t.Fatalf("test %d: header mismatch: have %+v, want %+v.", i, res, tt)
+		}
+	}
+	// Reports with mismatching entry counts must be rejected
+	bad := makeReportHeader(2)
+	bad.Report.Loads = bad.Report.Loads[:1]
+	if err := wire.Unmarshal(wire.Marshal(bad), new(header)); err != wire.ErrCorrupt {
+		t.Fatalf("corrupt report error mismatch: have %v, want %v.", err, wire.ErrCorrupt)
+	}
+}
+
+// Fuzzes the scribe header decoder, ensuring it never panics and that anything
+// it accepts survives subsequent round trips. The first re-encoding normalizes
+// the input (e.g. padded big integers), so only the later ones are compared.
+func FuzzDecode(f *testing.F) {
+	f.Add(wire.Marshal(makeReportHeader(1)))
+	f.Add(wire.Marshal(makeReportHeader(4)))
+	f.Add(wire.Marshal(&header{Op: opStatus, Status: &Status{Delivered: 1}, Retention: &Retention{Key: "k"}}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		res := new(header)
+		if err := wire.Unmarshal(data, res); err != nil {
+			return
+		}
+		again := new(header)
+		if err := wire.Unmarshal(wire.Marshal(res), again); err != nil {
+			t.Fatalf("failed to decode re-encoded header: %v.", err)
+		}
+		final := new(header)
+		if err := wire.Unmarshal(wire.Marshal(again), final); err != nil {
+			t.Fatalf("failed to decode twice re-encoded header: %v.", err)
+		}
+		if !reflect.DeepEqual(again, final) {
+			t.Fatalf("re-encoded header mismatch: have %+v, want %+v.", final, again)
+		}
+	})
+}
+
+// Benchmarks the encoding and decoding of load reports, comparing the explicit
+// codecs with the stateless gob fallback they replace.
+func BenchmarkReportWire(b *testing.B) {
+	head := makeReportHeader(8)
+	enc := new(wire.Encoder)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := wire.Unmarshal(enc.Encode(head), new(header)); err != nil {
+			b.Fatalf("failed to decode header: %v.", err)
+		}
+	}
+}
+
+func BenchmarkReportGob(b *testing.B) {
+	rep := makeReportHeader(8).Report
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(rep); err != nil {
+			b.Fatalf("failed to encode report: %v.", err)
+		}
+		if err := gob.NewDecoder(buf).Decode(new(report)); err != nil {
+			b.Fatalf("failed to decode report: %v.", err)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the work queues: the node closest to the queue id (the key
+// owner) keeps the jobs of the queue and dispatches them to the consuming nodes,
+// which must settle (ack or nack) them within a visibility timeout. Jobs which
+// are nacked or not settled in time are redelivered, preferably to a different
+// consumer, and after too many failed attempts moved into a dead-letter queue.
+//
+// The owner replicates the state of its queues to the leaf set after every change
+// and at each heartbeat. When the owner dies, the queue messages are delivered to
+// the next closest node, which promotes its replica and takes over. An owner that
+// sees a closer node in its leaf set replicates a last time and steps down.
+
+package scribe
+
+import (
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Job of a work queue.
+type job struct {
+	Id       uint64       // Id of the job within the queue
+	Head     proto.Header // Upper layer and crypto headers of the job
+	Data     []byte       // Encrypted payload of the job
+	Dead     string       // Dead-letter queue of the job ("" if none)
+	Attempts int          // Number of delivery attempts so far
+	Worker   *big.Int     // Consumer node holding the job (nil if pending)
+	Last     *big.Int     // Consumer node of the previous attempt
+	Lease    time.Time    // Deadline for settling the job
+}
+
+// State of a work queue, replicated to the leaf set of the owner.
+type queue struct {
+	Name string // Name of the queue
+	Jobs []*job // Jobs in enqueue order
+	Next uint64 // Id to assign to the next job
+}
+
+// Consumer node of an owned queue.
+type consumer struct {
+	node *big.Int  // Id of the consumer node
+	seen time.Time // Time of the last consume refresh
+}
+
+// Work queue state of the local node.
+type queues struct {
+	owned    map[string]*queue               // Queues owned by the local node
+	replicas map[string]*queue               // Queues replicated from neighbors
+	workers  map[string]map[string]*consumer // Consumer nodes of the owned queues
+	consumed map[string]struct{}             // Queues consumed by the local node
+
+	lock sync.Mutex
+}
+
+// Creates an empty work queue state.
+func newQueues() *queues {
+	return &queues{
+		owned:    make(map[string]*queue),
+		replicas: make(map[string]*queue),
+		workers:  make(map[string]map[string]*consumer),
+		consumed: make(map[string]struct{}),
+	}
+}
+
+// Job delivery or dead-letter move, executed after releasing the queue lock.
+type dispatch struct {
+	dest *big.Int // Node to send the job to
+	head *header  // Scribe header of the job message
+	job  *job     // Job to deliver
+}
+
+// Enqueues a job into the named work queue, to be delivered to one of the queue
+// consumers. After config.ScribeQueueAttempts failed deliveries, the job is moved
+// into the dead queue (dropped if empty).
+func (o *Overlay) Enqueue(queue string, dead string, msg *proto.Message) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendEnqueue(pastry.Resolve(queue), queue, dead, msg)
+	return nil
+}
+
+// Starts consuming the jobs of the named work queue. The registration is kept
+// alive by the heartbeat.
+func (o *Overlay) Consume(queue string) {
+	o.que.lock.Lock()
+	o.que.consumed[queue] = struct{}{}
+	o.que.lock.Unlock()
+
+	o.sendConsume(pastry.Resolve(queue), queue)
+}
+
+// Stops consuming the jobs of the named work queue. Jobs arriving afterwards are
+// nacked automatically.
+func (o *Overlay) Unconsume(queue string) {
+	o.que.lock.Lock()
+	delete(o.que.consumed, queue)
+	o.que.lock.Unlock()
+}
+
+// Acknowledges the successful processing of a job, removing it from the queue.
+func (o *Overlay) Ack(queue string, id uint64) {
+	o.sendSettle(pastry.Resolve(queue), queue, id, true)
+}
+
+// Reports the failed processing of a job, making it available for redelivery.
+func (o *Overlay) Nack(queue string, id uint64) {
+	o.sendSettle(pastry.Resolve(queue), queue, id, false)
+}
+
+// Retrieves an owned queue, promoting the local replica or creating a new one if
+// not owned yet. The lock is assumed held.
+func (o *Overlay) ownQueue(queueId *big.Int, name string) *queue {
+	sid := queueId.String()
+	if q, ok := o.que.owned[sid]; ok {
+		return q
+	}
+	q, ok := o.que.replicas[sid]
+	if ok {
+		delete(o.que.replicas, sid)
+	} else {
+		q = &queue{Name: name, Next: 1}
+	}
+	o.que.owned[sid] = q
+	o.que.workers[sid] = make(map[string]*consumer)
+	return q
+}
+
+// Handles a job arriving at the queue owner.
+func (o *Overlay) handleEnqueue(queueId *big.Int, msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+
+	o.que.lock.Lock()
+	q := o.ownQueue(queueId, head.Queue)
+	j := &job{
+		Id:   q.Next,
+		Head: msg.Head,
+		Data: make([]byte, len(msg.Data)),
+		Dead: head.Dead,
+	}
+	j.Head.Meta = head.Meta
+	copy(j.Data, msg.Data)
+
+	q.Jobs = append(q.Jobs, j)
+	q.Next++
+
+	sends := o.dispatchJobs(queueId, q)
+	snap := snapshotQueue(q)
+	o.que.lock.Unlock()
+
+	o.sendJobs(sends)
+	o.replicateQueue(queueId, snap)
+}
+
+// Handles a consume registration (or refresh) arriving at the queue owner.
+func (o *Overlay) handleConsume(src *big.Int, queueId *big.Int, name string) {
+	o.que.lock.Lock()
+	q := o.ownQueue(queueId, name)
+	workers := o.que.workers[queueId.String()]
+	if w, ok := workers[src.String()]; ok {
+		w.seen = time.Now()
+	} else {
+		workers[src.String()] = &consumer{node: src, seen: time.Now()}
+	}
+	sends := o.dispatchJobs(queueId, q)
+	snap := snapshotQueue(q)
+	o.que.lock.Unlock()
+
+	o.sendJobs(sends)
+	if len(sends) > 0 {
+		o.replicateQueue(queueId, snap)
+	}
+}
+
+// Handles the settlement of a job arriving at the queue owner: acked jobs are
+// removed, nacked ones released for redelivery (or moved to the dead-letters).
+func (o *Overlay) handleSettle(src *big.Int, queueId *big.Int, name string, id uint64, done bool) {
+	o.que.lock.Lock()
+	q := o.ownQueue(queueId, name)
+
+	var sends []*dispatch
+	for _, j := range q.Jobs {
+		if j.Id != id || j.Worker == nil || j.Worker.Cmp(src) != 0 {
+			continue
+		}
+		if done {
+			removeJob(q, j)
+		} else if dead := o.releaseJob(q, j); dead != nil {
+			sends = append(sends, dead)
+		}
+		break
+	}
+	sends = append(sends, o.dispatchJobs(queueId, q)...)
+	snap := snapshotQueue(q)
+	o.que.lock.Unlock()
+
+	o.sendJobs(sends)
+	o.replicateQueue(queueId, snap)
+}
+
+// Handles a job delivered to a consumer node, passing it upstream if the queue
+// is still consumed locally, or nacking it otherwise.
+func (o *Overlay) handleJob(msg *proto.Message) error {
+	head := msg.Head.Meta.(*header)
+
+	o.que.lock.Lock()
+	_, ok := o.que.consumed[head.Queue]
+	o.que.lock.Unlock()
+
+	if !ok {
+		o.sendSettle(head.Topic, head.Queue, head.JobId, false)
+		return nil
+	}
+	// Remove all scribe headers, decrypt and deliver
+	msg.Head.Meta = head.Meta
+	if err := msg.Decrypt(); err != nil {
+		return err
+	}
+	o.app.HandleJob(head.Queue, head.JobId, head.Attempt, msg)
+	return nil
+}
+
+// Handles the replicated state of a neighbor's queue. If the local node believes
+// itself the owner too, the node closer to the queue id wins.
+func (o *Overlay) handleReplica(src *big.Int, queueId *big.Int, state *queue) {
+	o.que.lock.Lock()
+	defer o.que.lock.Unlock()
+
+	sid := queueId.String()
+	if _, ok := o.que.owned[sid]; ok {
+		if pastry.Distance(o.pastry.Self(), queueId).Cmp(pastry.Distance(src, queueId)) <= 0 {
+			return
+		}
+		delete(o.que.owned, sid)
+		delete(o.que.workers, sid)
+	}
+	o.que.replicas[sid] = state
+}
+
+// Releases a job held by a consumer for redelivery. If the job ran out of its
+// delivery attempts, it is removed and its dead-letter move returned. The lock
+// is assumed held.
+func (o *Overlay) releaseJob(q *queue, j *job) *dispatch {
+	j.Worker = nil
+	if j.Attempts < config.ScribeQueueAttempts {
+		return nil
+	}
+	removeJob(q, j)
+	if j.Dead == "" {
+		log.Printf("scribe: dropping job %d of queue %s after %d attempts.", j.Id, q.Name, j.Attempts)
+		return nil
+	}
+	dead := pastry.Resolve(j.Dead)
+	return &dispatch{
+		dest: dead,
+		head: &header{Op: opEnqueue, Topic: dead, Queue: j.Dead},
+		job:  j,
+	}
+}
+
+// Assigns the pending jobs of a queue to the consumers with free capacity, in
+// enqueue order, avoiding the consumer of the previous attempt if possible. The
+// lock is assumed held.
+func (o *Overlay) dispatchJobs(queueId *big.Int, q *queue) []*dispatch {
+	workers := o.que.workers[queueId.String()]
+	if len(workers) == 0 {
+		return nil
+	}
+	// Count the jobs held by each consumer
+	held := make(map[string]int)
+	for _, j := range q.Jobs {
+		if j.Worker != nil {
+			held[j.Worker.String()]++
+		}
+	}
+	// Assign pending jobs to the least loaded consumers
+	var sends []*dispatch
+	for _, j := range q.Jobs {
+		if j.Worker != nil {
+			continue
+		}
+		var best *consumer
+		for id, w := range workers {
+			if held[id] >= config.ScribeQueuePrefetch {
+				continue
+			}
+			if best == nil {
+				best = w
+				continue
+			}
+			// Prefer a different consumer than the last, then the less loaded
+			bestLast := j.Last != nil && j.Last.Cmp(best.node) == 0
+			thisLast := j.Last != nil && j.Last.Cmp(w.node) == 0
+			if (bestLast && !thisLast) || (bestLast == thisLast && held[id] < held[best.node.String()]) {
+				best = w
+			}
+		}
+		if best == nil {
+			break
+		}
+		held[best.node.String()]++
+
+		j.Worker, j.Last = best.node, best.node
+		j.Lease = time.Now().Add(config.ScribeQueueVisibility)
+		j.Attempts++
+
+		sends = append(sends, &dispatch{
+			dest: best.node,
+			head: &header{Op: opJob, Topic: queueId, Queue: q.Name, JobId: j.Id, Attempt: j.Attempts},
+			job:  j,
+		})
+	}
+	return sends
+}
+
+// Sends out the jobs assigned by a dispatch round.
+func (o *Overlay) sendJobs(sends []*dispatch) {
+	for _, send := range sends {
+		msg := &proto.Message{
+			Head: send.job.Head,
+			Data: make([]byte, len(send.job.Data)),
+		}
+		copy(msg.Data, send.job.Data)
+		msg.KnownSecure()
+
+		o.sendDataPacket(send.dest, send.head, msg)
+	}
+}
+
+// Maintains the owned queues at each heartbeat: drops the consumers which did not
+// refresh, releases the expired jobs, redispatches and replicates. Queues whose
+// id moved closer to a neighbor are replicated a last time and handed off. The
+// locally consumed queues are refreshed at their owners.
+func (o *Overlay) maintainQueues() {
+	type replica struct {
+		id   *big.Int
+		snap *queue
+	}
+	var sends []*dispatch
+	var snaps []*replica
+
+	o.que.lock.Lock()
+	now := time.Now()
+	for sid, q := range o.que.owned {
+		id, _ := new(big.Int).SetString(sid, 10)
+
+		// Expire the silent consumers and the overdue jobs
+		for wid, w := range o.que.workers[sid] {
+			if now.Sub(w.seen) > time.Duration(config.ScribeKillCount)*config.ScribeBeatPeriod {
+				delete(o.que.workers[sid], wid)
+			}
+		}
+		for _, j := range append([]*job{}, q.Jobs...) {
+			if j.Worker != nil && now.After(j.Lease) {
+				if dead := o.releaseJob(q, j); dead != nil {
+					sends = append(sends, dead)
+				}
+			}
+		}
+		// Step down if no longer the owner, otherwise redispatch
+		if !o.ownsKey(id) {
+			delete(o.que.owned, sid)
+			delete(o.que.workers, sid)
+			o.que.replicas[sid] = q
+		} else {
+			sends = append(sends, o.dispatchJobs(id, q)...)
+		}
+		snaps = append(snaps, &replica{id, snapshotQueue(q)})
+	}
+	consumed := make([]string, 0, len(o.que.consumed))
+	for name := range o.que.consumed {
+		consumed = append(consumed, name)
+	}
+	o.que.lock.Unlock()
+
+	o.sendJobs(sends)
+	for _, rep := range snaps {
+		o.replicateQueue(rep.id, rep.snap)
+	}
+	for _, name := range consumed {
+		o.sendConsume(pastry.Resolve(name), name)
+	}
+}
+
+// Sends the state of a queue to all the members of the local leaf set.
+func (o *Overlay) replicateQueue(queueId *big.Int, state *queue) {
+	for _, leaf := range o.pastry.Leaves() {
+		o.sendReplica(leaf, queueId, state)
+	}
+}
+
+// Removes a job from a queue. The lock is assumed held.
+func removeJob(q *queue, j *job) {
+	for i, old := range q.Jobs {
+		if old == j {
+			q.Jobs = append(q.Jobs[:i], q.Jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Creates a copy of the queue state, safe to use outside the lock.
+func snapshotQueue(q *queue) *queue {
+	snap := &queue{
+		Name: q.Name,
+		Jobs: make([]*job, len(q.Jobs)),
+		Next: q.Next,
+	}
+	for i, j := range q.Jobs {
+		cpy := *j
+		snap.Jobs[i] = &cpy
+	}
+	return snap
+}
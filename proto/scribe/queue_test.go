@@ -0,0 +1,254 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package scribe
+
+import (
+	"crypto/x509"
+
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Work queue consumer, settling the jobs according to a preset behavior.
+type worker struct {
+	*collector
+
+	node   *Overlay        // Overlay to settle the jobs through
+	settle int             // Behavior: 0 = ack, 1 = nack, 2 = ignore
+	jobs   map[byte]int    // Number of deliveries per job payload
+	dead   map[byte]uint64 // Dead-letter jobs received
+	lock   sync.Mutex
+}
+
+func (w *worker) HandleJob(queue string, id uint64, attempt int, msg *proto.Message) {
+	// Settle outside the lock, local deliveries may recurse
+	w.lock.Lock()
+	settle := w.settle
+	if queue == topicId+"-dead" {
+		w.dead[msg.Data[0]] = id
+		settle = 0
+	} else {
+		w.jobs[msg.Data[0]]++
+	}
+	w.lock.Unlock()
+
+	switch settle {
+	case 0:
+		w.node.Ack(queue, id)
+	case 1:
+		w.node.Nack(queue, id)
+	}
+}
+
+// Tests whether work queues deliver, redeliver and dead-letter jobs correctly.
+func TestQueue(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+	jobs := 50
+
+	oldVisibility, oldAttempts := config.ScribeQueueVisibility, config.ScribeQueueAttempts
+	config.ScribeQueueVisibility, config.ScribeQueueAttempts = 500*time.Millisecond, 3
+	defer func() { config.ScribeQueueVisibility, config.ScribeQueueAttempts = oldVisibility, oldAttempts }()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	live := make([]*Overlay, 0, nodes)
+	workers := make([]*worker, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		w := &worker{
+			collector: &collector{},
+			settle:    i % 3,
+			jobs:      make(map[byte]int),
+			dead:      make(map[byte]uint64),
+		}
+		node := New(overId, key, w)
+		w.node = node
+
+		live = append(live, node)
+		workers = append(workers, w)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		time.Sleep(time.Second)
+	}
+	// Consume the dead-letter queue on the first node, and the job queue on the
+	// acking and ignoring ones
+	live[0].Consume(topicId + "-dead")
+	for i, w := range workers {
+		if w.settle != 1 {
+			live[i].Consume(topicId)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Enqueue a batch of jobs and verify that all get acked (after redeliveries)
+	for i := 0; i < jobs; i++ {
+		msg := &proto.Message{Data: []byte{byte(i)}}
+		if err := live[i%nodes].Enqueue(topicId, topicId+"-dead", msg); err != nil {
+			t.Fatalf("job %d: failed to enqueue: %v.", i, err)
+		}
+	}
+	time.Sleep(3 * time.Second)
+
+	acked := make(map[byte]bool)
+	for _, w := range workers {
+		w.lock.Lock()
+		if w.settle == 0 {
+			for job, _ := range w.jobs {
+				acked[job] = true
+			}
+		}
+		w.lock.Unlock()
+	}
+	if len(acked) != jobs {
+		t.Fatalf("acked job count mismatch: have %v, want %v.", len(acked), jobs)
+	}
+	// Consume the job queue on the nacking nodes only, and verify dead-lettering
+	for i, w := range workers {
+		if w.settle == 1 {
+			live[i].Consume(topicId)
+		} else {
+			live[i].Unconsume(topicId)
+		}
+	}
+	time.Sleep(time.Second)
+
+	msg := &proto.Message{Data: []byte{0xff}}
+	if err := live[0].Enqueue(topicId, topicId+"-dead", msg); err != nil {
+		t.Fatalf("failed to enqueue poisoned job: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	workers[0].lock.Lock()
+	if _, ok := workers[0].dead[0xff]; !ok {
+		t.Fatalf("poisoned job not dead-lettered.")
+	}
+	workers[0].lock.Unlock()
+
+	attempts := 0
+	for _, w := range workers {
+		w.lock.Lock()
+		attempts += w.jobs[0xff]
+		w.lock.Unlock()
+	}
+	if attempts != config.ScribeQueueAttempts {
+		t.Fatalf("poisoned job attempt mismatch: have %v, want %v.", attempts, config.ScribeQueueAttempts)
+	}
+}
+
+// Tests whether work queue state survives the death of the queue owner.
+func TestQueueFailover(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+	jobs := 20
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	live := make([]*Overlay, 0, nodes)
+	workers := make([]*worker, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		w := &worker{
+			collector: &collector{},
+			jobs:      make(map[byte]int),
+			dead:      make(map[byte]uint64),
+		}
+		node := New(overId, key, w)
+		w.node = node
+
+		live = append(live, node)
+		workers = append(workers, w)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		time.Sleep(time.Second)
+	}
+	// Enqueue a batch of jobs without consumers and find the queue owner
+	for i := 0; i < jobs; i++ {
+		msg := &proto.Message{Data: []byte{byte(i)}}
+		if err := live[i%nodes].Enqueue(topicId, "", msg); err != nil {
+			t.Fatalf("job %d: failed to enqueue: %v.", i, err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	owner := -1
+	for i, node := range live {
+		node.que.lock.Lock()
+		if _, ok := node.que.owned[pastry.Resolve(topicId).String()]; ok {
+			owner = i
+		}
+		node.que.lock.Unlock()
+	}
+	if owner == -1 {
+		t.Fatalf("failed to find queue owner.")
+	}
+	// Kill the owner, consume on the survivors and verify that all jobs arrive
+	live[owner].Shutdown()
+	time.Sleep(2 * time.Second)
+
+	for i, node := range live {
+		if i != owner {
+			defer node.Shutdown()
+			node.Consume(topicId)
+		}
+	}
+	time.Sleep(2 * time.Second)
+
+	acked := make(map[byte]bool)
+	for _, w := range workers {
+		w.lock.Lock()
+		for job, _ := range w.jobs {
+			acked[job] = true
+		}
+		w.lock.Unlock()
+	}
+	if len(acked) != jobs {
+		t.Fatalf("acked job count mismatch: have %v, want %v.", len(acked), jobs)
+	}
+}
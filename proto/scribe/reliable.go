@@ -0,0 +1,507 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the reliable publish mode of scribe.
+//
+// Reliable events carry a per publisher (node) and per topic sequence number.
+// Every hop of the topic tree immediately acknowledges the arrival of an event
+// to the hop it received it from, which retransmits unacknowledged events up to
+// a limit. Once all the downstream neighbors of a hop either reported their own
+// delivery status or were deemed failed, the aggregated status is passed back
+// upstream, finally reaching the publisher.
+//
+// Each node also tracks the sequence numbers seen from each publisher, dropping
+// duplicates and requesting the retransmission of missing events (NACK) from the
+// previous hop, which serves them from a bounded per topic history. Events pruned
+// from a subtree by the filters are not gaps: the hop that pruned them lists the
+// skipped sequence numbers in the next event it forwards down that subtree.
+
+package scribe
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Reliable publish specific errors
+var ErrUndelivered = errors.New("publish not acknowledged")
+
+// Delivery status of a reliably published event.
+type Status struct {
+	Delivered int // Number of subscribed nodes the event was delivered to
+	Failed    int // Number of topic tree links which failed to acknowledge
+}
+
+// Reliable delivery state of the local node.
+type reliable struct {
+	seqs    map[string]uint64       // Last sequence number used per local topic
+	pubs    map[string]*publication // Events published locally, awaiting status
+	fwds    map[string]*forward     // Events forwarded, awaiting downstream status
+	streams map[string]*stream      // Sequence trackers per topic and publisher
+	skips   map[string][]uint64     // Filtered out events per topic, publisher and downstream hop
+	history map[string]*history     // Recent events per topic for repairs
+	repairs int                     // Number of events requested for repair
+
+	lock sync.Mutex
+}
+
+// Creates an empty reliable delivery state.
+func newReliable() *reliable {
+	return &reliable{
+		seqs:    make(map[string]uint64),
+		pubs:    make(map[string]*publication),
+		fwds:    make(map[string]*forward),
+		streams: make(map[string]*stream),
+		skips:   make(map[string][]uint64),
+		history: make(map[string]*history),
+	}
+}
+
+// A locally published event, retransmitted until the tree acknowledges it.
+type publication struct {
+	topic   *big.Int          // Topic the event was published to
+	headers map[string]string // Content headers of the event
+	msg     *proto.Message    // Encrypted event to retransmit
+	acked   bool              // Whether the entry node acknowledged the event
+	tries   int               // Number of transmissions so far
+	status  chan *Status      // Channel to deliver the final status on
+}
+
+// An event forwarded within the topic tree, awaiting the downstream reports.
+type forward struct {
+	upstream *big.Int        // Hop to report the subtree status to
+	virgin   bool            // Whether the upstream is the publisher itself
+	msg      *proto.Message  // Encrypted event to retransmit
+	pending  map[string]*hop // Downstream hops not yet reported
+	status   Status          // Aggregated status of the reported subtrees
+}
+
+// Delivery state of a single downstream hop.
+type hop struct {
+	id    *big.Int  // Id of the downstream node
+	acked time.Time // Time of the acknowledgement (zero if not yet)
+	tries int       // Number of transmissions so far
+	skip  []uint64  // Filtered out events to report along with the transmissions
+}
+
+// Sequence tracker of a single publisher within a topic.
+type stream struct {
+	next  uint64              // Next sequence number expected
+	ahead map[uint64]struct{} // Sequence numbers received beyond next
+}
+
+// Bounded history of recently seen events within a topic.
+type history struct {
+	msgs  map[string]*proto.Message // Events indexed by publisher and sequence
+	order []string                  // Insertion order for eviction
+}
+
+// Generates the index of an event within a topic.
+func eventId(topic *big.Int, origin *big.Int, seq uint64) string {
+	return fmt.Sprintf("%v/%v/%d", topic, origin, seq)
+}
+
+// Creates a shallow copy of an event with its own scribe header.
+func copyEvent(msg *proto.Message) *proto.Message {
+	cpy := new(proto.Message)
+	*cpy = *msg
+	cpy.Head.Meta = msg.Head.Meta.(*header).copy()
+	return cpy
+}
+
+// Publishes a message with content headers into topic reliably, blocking until
+// the delivery status is reported back by the topic tree, or the timeout expires.
+func (o *Overlay) PublishReliable(topic string, headers map[string]string, msg *proto.Message, timeout time.Duration) (*Status, error) {
+	if err := msg.Encrypt(); err != nil {
+		return nil, err
+	}
+	id := pastry.Resolve(topic)
+	sid := id.String()
+
+	// Assign the next sequence number and envelope the event
+	o.rel.lock.Lock()
+	seq, ok := o.rel.seqs[sid]
+	if !ok {
+		// Fresh or forgotten counter, start above any number used before
+		seq = uint64(time.Now().UnixNano())
+	}
+	seq++
+	o.rel.seqs[sid] = seq
+
+	msg.Head.Meta = &header{
+		Meta:    msg.Head.Meta,
+		Op:      opPublish,
+		Sender:  o.pastry.Self(),
+		Topic:   id,
+		Headers: headers,
+		Seq:     seq,
+	}
+	pub := &publication{
+		topic:   id,
+		headers: headers,
+		msg:     msg,
+		status:  make(chan *Status, 1),
+	}
+	event := eventId(id, o.pastry.Self(), seq)
+	o.rel.pubs[event] = pub
+	o.rel.remember(id, event, msg)
+	o.rel.lock.Unlock()
+
+	// Send the event and wait for the status
+	o.retransmitPublication(event)
+	select {
+	case status := <-pub.status:
+		if status == nil {
+			return nil, ErrUndelivered
+		}
+		return status, nil
+	case <-time.After(timeout):
+		o.rel.lock.Lock()
+		delete(o.rel.pubs, event)
+		o.rel.lock.Unlock()
+		return nil, ErrUndelivered
+	}
+}
+
+// Sends (or resends) a locally published event towards the topic root until
+// acknowledged or the retransmission limit is reached.
+func (o *Overlay) retransmitPublication(event string) {
+	o.rel.lock.Lock()
+	defer o.rel.lock.Unlock()
+
+	pub, ok := o.rel.pubs[event]
+	if !ok || pub.acked {
+		return
+	}
+	if pub.tries > config.ScribeRetransLimit {
+		delete(o.rel.pubs, event)
+		pub.status <- nil
+		return
+	}
+	pub.tries++
+
+	cpy := copyEvent(pub.msg)
+	go o.pastry.Send(pub.topic, cpy)
+	time.AfterFunc(config.ScribeRetransTimeout, func() { o.retransmitPublication(event) })
+}
+
+// Acknowledges the arrival of a reliable event and checks whether it's a new
+// one (true) or a duplicate (false). Gaps in the publisher's sequence trigger a
+// repair request towards the upstream hop.
+func (o *Overlay) acceptReliable(head *header, msg *proto.Message, prevHop *big.Int) bool {
+	upstream, virgin := prevHop, prevHop == nil
+	if virgin {
+		upstream = head.Sender
+	}
+	go o.sendAck(upstream, virgin, head.Topic, head.Sender, head.Seq)
+
+	o.rel.lock.Lock()
+	defer o.rel.lock.Unlock()
+
+	// Fetch the sequence tracker of the publisher
+	key := fmt.Sprintf("%v/%v", head.Topic, head.Sender)
+	str, ok := o.rel.streams[key]
+	if !ok {
+		str = &stream{next: head.Seq, ahead: make(map[uint64]struct{})}
+		o.rel.streams[key] = str
+	}
+	event := eventId(head.Topic, head.Sender, head.Seq)
+
+	// Events filtered out upstream will never arrive, consider them seen
+	for _, seq := range head.Skip {
+		if seq >= str.next {
+			str.ahead[seq] = struct{}{}
+		}
+	}
+	// Drop duplicates, reporting an empty status if not a retransmission
+	if _, dup := str.ahead[head.Seq]; dup || head.Seq < str.next {
+		if fwd, ok := o.rel.fwds[event]; !ok || fwd.upstream.Cmp(upstream) != 0 {
+			go o.sendStatus(upstream, virgin, head.Topic, head.Sender, head.Seq, &Status{})
+		}
+		return false
+	}
+	// Restart the tracker if the publisher reset its counter (unrepairable anyway)
+	if head.Seq-str.next > uint64(config.ScribeReliableBuffer) {
+		str.next, str.ahead = head.Seq, make(map[uint64]struct{})
+	}
+	// Request the repair of any gaps and advance the tracker
+	if head.Seq > str.next {
+		missing := []uint64{}
+		for seq := str.next; seq < head.Seq; seq++ {
+			if _, ok := str.ahead[seq]; !ok {
+				missing = append(missing, seq)
+			}
+		}
+		if len(missing) > 0 {
+			o.rel.repairs += len(missing)
+			go o.sendNack(upstream, virgin, head.Topic, head.Sender, missing)
+		}
+	}
+	str.ahead[head.Seq] = struct{}{}
+	for _, ok := str.ahead[str.next]; ok; _, ok = str.ahead[str.next] {
+		delete(str.ahead, str.next)
+		str.next++
+	}
+	// Give up on unrepairable gaps if too far behind
+	if len(str.ahead) > config.ScribeReliableBuffer {
+		min := head.Seq
+		for seq, _ := range str.ahead {
+			if seq < min {
+				min = seq
+			}
+		}
+		str.next = min
+		for _, ok := str.ahead[str.next]; ok; _, ok = str.ahead[str.next] {
+			delete(str.ahead, str.next)
+			str.next++
+		}
+	}
+	o.rel.remember(head.Topic, event, msg)
+	return true
+}
+
+// Stores an event into the topic's repair history, evicting the oldest ones.
+func (r *reliable) remember(topic *big.Int, event string, msg *proto.Message) {
+	sid := topic.String()
+	hist, ok := r.history[sid]
+	if !ok {
+		hist = &history{msgs: make(map[string]*proto.Message)}
+		r.history[sid] = hist
+	}
+	hist.msgs[event] = copyEvent(msg)
+	hist.order = append(hist.order, event)
+	for len(hist.order) > config.ScribeReliableBuffer {
+		delete(hist.msgs, hist.order[0])
+		hist.order = hist.order[1:]
+	}
+}
+
+// Records a reliable event as skipped for the downstream hops it is filtered out
+// from, and collects the pending skips of the hops it is forwarded to. The skips
+// arriving from upstream concern the whole subtree, so they are passed on to all
+// downstream hops.
+func (o *Overlay) skipReliable(head *header, hops []*big.Int, matches []*big.Int) map[string][]uint64 {
+	forward := make(map[string]bool)
+	for _, id := range matches {
+		forward[id.String()] = true
+	}
+	o.rel.lock.Lock()
+	defer o.rel.lock.Unlock()
+
+	skips := make(map[string][]uint64)
+	for _, id := range hops {
+		if id.Cmp(o.pastry.Self()) == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%v/%v/%v", head.Topic, head.Sender, id)
+		pend := append(o.rel.skips[key], head.Skip...)
+		if forward[id.String()] {
+			if len(pend) > 0 {
+				skips[id.String()] = pend
+			}
+			delete(o.rel.skips, key)
+			continue
+		}
+		// Filtered out, keep a bounded list (older ones are unrepairable anyway)
+		pend = append(pend, head.Seq)
+		if n := len(pend) - config.ScribeReliableBuffer; n > 0 {
+			pend = pend[n:]
+		}
+		o.rel.skips[key] = pend
+	}
+	return skips
+}
+
+// Starts tracking a reliable event about to be forwarded to the downstream
+// nodes, reporting the status upstream when all of them are done.
+func (o *Overlay) trackReliable(head *header, msg *proto.Message, prevHop *big.Int, nodes []*big.Int, skips map[string][]uint64, local bool) {
+	fwd := &forward{
+		upstream: prevHop,
+		virgin:   prevHop == nil,
+		msg:      copyEvent(msg),
+		pending:  make(map[string]*hop),
+	}
+	if fwd.virgin {
+		fwd.upstream = head.Sender
+	}
+	if local {
+		fwd.status.Delivered++
+	}
+	for _, id := range nodes {
+		fwd.pending[id.String()] = &hop{id: id, tries: 1, skip: skips[id.String()]}
+	}
+	event := eventId(head.Topic, head.Sender, head.Seq)
+
+	o.rel.lock.Lock()
+	defer o.rel.lock.Unlock()
+
+	if len(fwd.pending) == 0 {
+		o.finishForward(event, fwd)
+		return
+	}
+	o.rel.fwds[event] = fwd
+	time.AfterFunc(config.ScribeRetransTimeout, func() { o.retransmitForward(event) })
+}
+
+// Retransmits a forwarded event to the downstream hops that didn't acknowledge
+// it yet, fails the unresponsive ones and reports upstream if all are done.
+func (o *Overlay) retransmitForward(event string) {
+	o.rel.lock.Lock()
+	defer o.rel.lock.Unlock()
+
+	fwd, ok := o.rel.fwds[event]
+	if !ok {
+		return
+	}
+	for id, hop := range fwd.pending {
+		if hop.acked.IsZero() {
+			// Not yet acknowledged, retransmit or give up
+			if hop.tries > config.ScribeRetransLimit {
+				delete(fwd.pending, id)
+				fwd.status.Failed++
+				continue
+			}
+			hop.tries++
+
+			cpy := copyEvent(fwd.msg)
+			cpy.Head.Meta.(*header).Skip = hop.skip
+			go o.fwdPublish(hop.id, cpy)
+		} else if time.Since(hop.acked) > config.ScribeStatusTimeout {
+			// Acknowledged, but the subtree status never arrived
+			delete(fwd.pending, id)
+			fwd.status.Failed++
+		}
+	}
+	if len(fwd.pending) == 0 {
+		o.finishForward(event, fwd)
+		return
+	}
+	time.AfterFunc(config.ScribeRetransTimeout, func() { o.retransmitForward(event) })
+}
+
+// Reports the aggregated status of a completed forward upstream. The reliable
+// lock is assumed to be held.
+func (o *Overlay) finishForward(event string, fwd *forward) {
+	delete(o.rel.fwds, event)
+
+	head := fwd.msg.Head.Meta.(*header)
+	status := fwd.status
+	go o.sendStatus(fwd.upstream, fwd.virgin, head.Topic, head.Sender, head.Seq, &status)
+}
+
+// Handles the arrival acknowledgement of a reliable event from a downstream hop.
+func (o *Overlay) handleAck(src *big.Int, head *header) {
+	event := eventId(head.Topic, head.Origin, head.Seq)
+
+	o.rel.lock.Lock()
+	defer o.rel.lock.Unlock()
+
+	if head.Virgin {
+		if pub, ok := o.rel.pubs[event]; ok {
+			pub.acked = true
+		}
+		return
+	}
+	if fwd, ok := o.rel.fwds[event]; ok {
+		if hop, ok := fwd.pending[src.String()]; ok && hop.acked.IsZero() {
+			hop.acked = time.Now()
+		}
+	}
+}
+
+// Handles the delivery status report of a downstream subtree.
+func (o *Overlay) handleStatus(src *big.Int, head *header) {
+	event := eventId(head.Topic, head.Origin, head.Seq)
+
+	o.rel.lock.Lock()
+	defer o.rel.lock.Unlock()
+
+	if head.Virgin {
+		if pub, ok := o.rel.pubs[event]; ok {
+			delete(o.rel.pubs, event)
+			pub.status <- head.Status
+		}
+		return
+	}
+	if fwd, ok := o.rel.fwds[event]; ok {
+		if _, ok := fwd.pending[src.String()]; ok {
+			delete(fwd.pending, src.String())
+			fwd.status.Delivered += head.Status.Delivered
+			fwd.status.Failed += head.Status.Failed
+
+			if len(fwd.pending) == 0 {
+				o.finishForward(event, fwd)
+			}
+		}
+	}
+}
+
+// Handles a repair request, resending the missing events still in the history.
+// Requests from the first hop are served with fresh publishes routed to the
+// topic, since the entry node does not accept events from outside the tree.
+func (o *Overlay) handleNack(src *big.Int, head *header) {
+	o.rel.lock.Lock()
+	msgs := []*proto.Message{}
+	if hist, ok := o.rel.history[head.Topic.String()]; ok {
+		for _, seq := range head.Nack {
+			if msg, ok := hist.msgs[eventId(head.Topic, head.Origin, seq)]; ok {
+				msgs = append(msgs, copyEvent(msg))
+			}
+		}
+	}
+	o.rel.lock.Unlock()
+
+	for _, msg := range msgs {
+		if head.Virgin {
+			msg.Head.Meta.(*header).Prev = nil
+			o.pastry.Send(head.Topic, msg)
+		} else {
+			o.fwdPublish(src, msg)
+		}
+	}
+}
+
+// Drops all the reliable delivery state associated with a removed topic.
+func (o *Overlay) forgetReliable(topic *big.Int) {
+	prefix := topic.String() + "/"
+
+	o.rel.lock.Lock()
+	defer o.rel.lock.Unlock()
+
+	delete(o.rel.seqs, topic.String())
+	delete(o.rel.history, topic.String())
+	for key, _ := range o.rel.streams {
+		if strings.HasPrefix(key, prefix) {
+			delete(o.rel.streams, key)
+		}
+	}
+	for key, _ := range o.rel.skips {
+		if strings.HasPrefix(key, prefix) {
+			delete(o.rel.skips, key)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/filter"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Tests whether reliable publishing delivers and reports the status correctly.
+func TestPublishReliable(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+	pubs := 20
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes, subscribing every second
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make([]*Overlay, 0, nodes)
+	subs := 0
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		live = append(live, node)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		time.Sleep(time.Second)
+
+		if i%2 == 0 {
+			if err := node.Subscribe(topicId); err != nil {
+				t.Fatalf("failed to subscribe to topic: %v.", err)
+			}
+			subs++
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Publish reliably from every node and verify the delivery statuses
+	for i, node := range live {
+		for j := 0; j < pubs; j++ {
+			msg := &proto.Message{
+				Data: []byte{byte(i), byte(j)},
+			}
+			status, err := node.PublishReliable(topicId, nil, msg, 5*time.Second)
+			if err != nil {
+				t.Fatalf("node %d, event %d: failed to publish reliably: %v.", i, j, err)
+			}
+			if status.Delivered != subs || status.Failed != 0 {
+				t.Fatalf("node %d, event %d: status mismatch: have %+v, want %+v.", i, j, *status, Status{Delivered: subs})
+			}
+		}
+	}
+	coll.lock.Lock()
+	if n := len(coll.publish); n != nodes*pubs*subs {
+		t.Fatalf("arrive event mismatch: have %v, want %v.", n, nodes*pubs*subs)
+	}
+	coll.lock.Unlock()
+
+	// Abandon the topic, verify the counters are pruned and republishing works
+	for i := 0; i < nodes; i += 2 {
+		if err := live[i].Unsubscribe(topicId); err != nil {
+			t.Fatalf("failed to unsubscribe from topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+	for i := 0; i < nodes; i += 2 {
+		live[i].rel.lock.Lock()
+		n := len(live[i].rel.seqs)
+		live[i].rel.lock.Unlock()
+		if n != 0 {
+			t.Fatalf("node %d: sequence counters not pruned: have %v, want %v.", i, n, 0)
+		}
+	}
+	for i := 0; i < nodes; i += 2 {
+		if err := live[i].Subscribe(topicId); err != nil {
+			t.Fatalf("failed to resubscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+	for i, node := range live {
+		msg := &proto.Message{
+			Data: []byte{byte(i)},
+		}
+		status, err := node.PublishReliable(topicId, nil, msg, 5*time.Second)
+		if err != nil {
+			t.Fatalf("node %d: failed to republish reliably: %v.", i, err)
+		}
+		if status.Delivered != subs || status.Failed != 0 {
+			t.Fatalf("node %d: republish status mismatch: have %+v, want %+v.", i, *status, Status{Delivered: subs})
+		}
+	}
+	// Publish into a topic without subscribers and verify an empty status
+	msg := &proto.Message{
+		Data: []byte{0},
+	}
+	status, err := live[0].PublishReliable(topicId+"-empty", nil, msg, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to publish reliably into empty topic: %v.", err)
+	}
+	if status.Delivered != 0 || status.Failed != 0 {
+		t.Fatalf("empty topic status mismatch: have %+v, want %+v.", *status, Status{})
+	}
+}
+
+// Tests that events missing on the first hop are repaired by the publisher, even
+// if it is not part of the topic tree.
+func TestReliableVirginRepair(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 6
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes, subscribing only the first
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{}
+	live := make([]*Overlay, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		live = append(live, node)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		time.Sleep(time.Second)
+	}
+	if err := live[0].Subscribe(topicId); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	// Find a publisher outside of the topic tree
+	sid := pastry.Resolve(topicId).String()
+	var pub *Overlay
+	for _, node := range live {
+		node.lock.RLock()
+		_, ok := node.topics[sid]
+		node.lock.RUnlock()
+		if !ok {
+			pub = node
+			break
+		}
+	}
+	if pub == nil {
+		t.Fatalf("failed to find node outside of the topic tree.")
+	}
+	// Publish an event, make the tree forget it and request a first hop repair
+	if _, err := pub.PublishReliable(topicId, nil, &proto.Message{Data: []byte{0x01}}, 5*time.Second); err != nil {
+		t.Fatalf("failed to publish reliably: %v.", err)
+	}
+	for _, node := range live {
+		node.rel.lock.Lock()
+		node.rel.streams = make(map[string]*stream)
+		node.rel.lock.Unlock()
+	}
+	pub.rel.lock.Lock()
+	seq := pub.rel.seqs[sid]
+	pub.rel.lock.Unlock()
+
+	pub.handleNack(live[0].Self(), &header{Topic: pastry.Resolve(topicId), Origin: pub.Self(), Nack: []uint64{seq}, Virgin: true})
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.publish); n != 2 {
+		t.Fatalf("delivery count mismatch: have %v, want %v.", n, 2)
+	}
+}
+
+// Collector accepting only the events with an even kind header.
+type picky struct {
+	*collector
+	even filter.Summary
+}
+
+func (p *picky) Filter(topic string) filter.Summary {
+	return p.even
+}
+
+// Tests that events pruned by the subscription filters are not mistaken for
+// gaps in the filtered out subtrees, and thus never repaired.
+func TestReliableFiltered(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 6
+	pubs := 20
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the filtering scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	even, _ := filter.Parse(`kind == "even"`)
+	coll := &picky{
+		collector: &collector{},
+		even:      filter.Summary{Filters: []*filter.Filter{even}},
+	}
+	live := make([]*Overlay, 0, nodes)
+	subs := 0
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		live = append(live, node)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		time.Sleep(time.Second)
+
+		if i%2 == 0 {
+			if err := node.Subscribe(topicId); err != nil {
+				t.Fatalf("failed to subscribe to topic: %v.", err)
+			}
+			subs++
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Publish alternating matching and non-matching events from every node
+	for i, node := range live {
+		for j := 0; j < pubs; j++ {
+			headers, want := map[string]string{"kind": "even"}, subs
+			if j%2 == 1 {
+				headers, want = map[string]string{"kind": "odd"}, 0
+			}
+			status, err := node.PublishReliable(topicId, headers, &proto.Message{Data: []byte{byte(i), byte(j)}}, 5*time.Second)
+			if err != nil {
+				t.Fatalf("node %d, event %d: failed to publish reliably: %v.", i, j, err)
+			}
+			if status.Delivered != want || status.Failed != 0 {
+				t.Fatalf("node %d, event %d: status mismatch: have %+v, want %+v.", i, j, *status, Status{Delivered: want})
+			}
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Verify the deliveries and that no filtered out event was requested for repair
+	coll.lock.Lock()
+	if n := len(coll.publish); n != nodes*pubs/2*subs {
+		t.Fatalf("arrive event mismatch: have %v, want %v.", n, nodes*pubs/2*subs)
+	}
+	coll.lock.Unlock()
+
+	for i, node := range live {
+		node.rel.lock.Lock()
+		repairs := node.rel.repairs
+		node.rel.lock.Unlock()
+		if repairs != 0 {
+			t.Fatalf("node %d: filtered events requested for repair: have %v, want %v.", i, repairs, 0)
+		}
+	}
+}
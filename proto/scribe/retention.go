@@ -0,0 +1,329 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the topic retention mechanism: the root node of a retained
+// topic keeps the most recent events (or the latest event per key) and hands
+// them to new subscribers on request.
+//
+// Since topic roots may change as nodes join the overlay, the root of each
+// retained topic probes the topic id at every heartbeat. If the probe is
+// delivered to another node, that node claims the root role and the old one
+// hands over the retained events.
+
+package scribe
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Retention specific errors
+var ErrRecallTimeout = errors.New("retained event recall timed out")
+
+// Retention policy of a topic, enforced by the topic root.
+type Retention struct {
+	Events int    // Number of most recent events to keep (0 if unbounded by count)
+	Key    string // Event header to keep only the latest event of per value ("" if none)
+}
+
+// Event retained by a topic root.
+type RetainedEvent struct {
+	Msg    *proto.Message // Decrypted event with the upper layer headers
+	Origin *big.Int       // Node which published the event
+	Stamp  time.Time      // Arrival time of the event at the root
+}
+
+// Event stored by a topic root, sent one per message on recalls and handovers.
+type retained struct {
+	msg    *proto.Message // Encrypted event with the upper layer headers
+	key    string         // Value of the retention key header
+	origin *big.Int       // Node which published the event
+	stamp  time.Time      // Arrival time of the event at the root
+}
+
+// Retained events of a recall reply or handover, collected as they arrive.
+type recollection struct {
+	events []*retained  // Events arrived so far
+	done   chan *header // Channel receiving the last header once all events arrived
+}
+
+// Retained events of a single topic.
+type store struct {
+	policy Retention   // Retention policy of the topic
+	events []*retained // Retained events in arrival order
+}
+
+// Retention state of the local node.
+type retention struct {
+	stores map[string]*store        // Topics retained by the local node
+	recall map[uint64]*recollection // Pending recall requests
+	idx    uint64                   // Id of the next recall request
+
+	lock sync.Mutex
+}
+
+// Creates an empty retention state.
+func newRetention() *retention {
+	return &retention{
+		stores: make(map[string]*store),
+		recall: make(map[uint64]*recollection),
+	}
+}
+
+// Inserts an event into the store, evicting according to the retention policy.
+func (s *store) insert(event *retained) {
+	// Key based retention replaces the previous value, keyless events are dropped
+	if s.policy.Key != "" {
+		if event.key == "" {
+			return
+		}
+		for i, old := range s.events {
+			if old.key == event.key {
+				s.events = append(s.events[:i], s.events[i+1:]...)
+				break
+			}
+		}
+	}
+	// Insert in arrival order (handovers may merge older events)
+	idx := sort.Search(len(s.events), func(i int) bool { return s.events[i].stamp.After(event.stamp) })
+	s.events = append(s.events, nil)
+	copy(s.events[idx+1:], s.events[idx:])
+	s.events[idx] = event
+
+	// Evict the oldest events beyond the limits
+	limit := config.ScribeRetainLimit
+	if s.policy.Events > 0 && s.policy.Events < limit {
+		limit = s.policy.Events
+	}
+	if len(s.events) > limit {
+		s.events = s.events[len(s.events)-limit:]
+	}
+}
+
+// Sets the retention policy of a topic at its root. A zero policy disables the
+// retention and drops all retained events.
+func (o *Overlay) Retain(topic string, policy Retention) {
+	o.sendRetain(pastry.Resolve(topic), &policy)
+}
+
+// Fetches the retention policy and the retained events of topic from its root.
+// If the topic is not retained, a nil policy is returned.
+func (o *Overlay) Recall(topic string, timeout time.Duration) (*Retention, []*RetainedEvent, error) {
+	// Register a new recall request
+	o.ret.lock.Lock()
+	id := o.ret.idx
+	o.ret.idx++
+	reply := &recollection{done: make(chan *header, 1)}
+	o.ret.recall[id] = reply
+	o.ret.lock.Unlock()
+
+	defer func() {
+		o.ret.lock.Lock()
+		delete(o.ret.recall, id)
+		o.ret.lock.Unlock()
+	}()
+	// Send the request to the topic root and wait for the reply
+	o.sendRecall(pastry.Resolve(topic), id)
+
+	var head *header
+	select {
+	case head = <-reply.done:
+	case <-time.After(timeout):
+		return nil, nil, ErrRecallTimeout
+	}
+	if head.Retention == nil {
+		return nil, nil, nil
+	}
+	// Decrypt the retained events (arrival order may differ between links)
+	o.ret.lock.Lock()
+	arrived := reply.events
+	o.ret.lock.Unlock()
+
+	sort.Sort(byArrival(arrived))
+	events := make([]*RetainedEvent, 0, len(arrived))
+	for _, event := range arrived {
+		msg := &proto.Message{
+			Head: event.msg.Head,
+			Data: make([]byte, len(event.msg.Data)),
+		}
+		copy(msg.Data, event.msg.Data)
+		if err := msg.Decrypt(); err != nil {
+			return nil, nil, err
+		}
+		events = append(events, &RetainedEvent{Msg: msg, Origin: event.origin, Stamp: event.stamp})
+	}
+	return head.Retention, events, nil
+}
+
+// Checks whether the local node retains a topic.
+func (o *Overlay) retains(topicId *big.Int) bool {
+	o.ret.lock.Lock()
+	defer o.ret.lock.Unlock()
+
+	_, ok := o.ret.stores[topicId.String()]
+	return ok
+}
+
+// Stores an event if the local node retains its topic.
+func (o *Overlay) retainEvent(head *header, msg *proto.Message) {
+	o.ret.lock.Lock()
+	defer o.ret.lock.Unlock()
+
+	st, ok := o.ret.stores[head.Topic.String()]
+	if !ok {
+		return
+	}
+	// Keep a copy of the event, as the original is decrypted upon local delivery
+	cpy := new(proto.Message)
+	*cpy = *msg
+	cpy.Head.Meta = head.Meta
+	cpy.Data = make([]byte, len(msg.Data))
+	copy(cpy.Data, msg.Data)
+
+	event := &retained{
+		msg:    cpy,
+		origin: head.Sender,
+		stamp:  time.Now(),
+	}
+	if st.policy.Key != "" {
+		event.key = head.Headers[st.policy.Key]
+	}
+	st.insert(event)
+}
+
+// Probes the ids of all the retained topics to detect root changes.
+func (o *Overlay) probeRetained() {
+	o.ret.lock.Lock()
+	ids := make([]*big.Int, 0, len(o.ret.stores))
+	for sid := range o.ret.stores {
+		if id, ok := new(big.Int).SetString(sid, 10); ok {
+			ids = append(ids, id)
+		}
+	}
+	o.ret.lock.Unlock()
+
+	for _, id := range ids {
+		o.sendProbe(id)
+	}
+}
+
+// Handles a retention policy update arriving at the topic root.
+func (o *Overlay) handleRetain(topicId *big.Int, policy *Retention) {
+	o.ret.lock.Lock()
+	defer o.ret.lock.Unlock()
+
+	sid := topicId.String()
+	if policy.Events == 0 && policy.Key == "" {
+		delete(o.ret.stores, sid)
+		return
+	}
+	// Create the store if needed, or re-enforce the new policy on the old events
+	st, ok := o.ret.stores[sid]
+	if !ok {
+		o.ret.stores[sid] = &store{policy: *policy}
+		return
+	}
+	events := st.events
+	st.policy, st.events = *policy, nil
+	for _, event := range events {
+		st.insert(event)
+	}
+}
+
+// Handles a recall request arriving at the topic root, replying with the policy
+// and the retained events (nil policy if the topic is not retained).
+func (o *Overlay) handleRecall(src *big.Int, topicId *big.Int, id uint64) {
+	o.ret.lock.Lock()
+	var policy *Retention
+	var events []*retained
+	if st, ok := o.ret.stores[topicId.String()]; ok {
+		policy = new(Retention)
+		*policy = st.policy
+		events = append([]*retained{}, st.events...)
+	}
+	o.ret.lock.Unlock()
+
+	o.sendRetained(src, topicId, id, policy, events)
+}
+
+// Handles the arrival of a retained event (or of an empty store): either part of
+// a recall reply or of the handover of a topic store from a previous root.
+func (o *Overlay) handleRetained(head *header, msg *proto.Message) {
+	var event *retained
+	if head.Retained > 0 {
+		msg.Head.Meta = head.Meta
+		event = &retained{msg: msg, key: head.RetainKey, origin: head.Origin, stamp: head.Stamp}
+	}
+	o.ret.lock.Lock()
+	defer o.ret.lock.Unlock()
+
+	// Recall replies are collected until complete, then passed to the waiting request
+	if !head.Handover {
+		if reply, ok := o.ret.recall[head.ReqId]; ok {
+			if event != nil {
+				reply.events = append(reply.events, event)
+			}
+			if len(reply.events) >= head.Retained {
+				select {
+				case reply.done <- head:
+				default:
+				}
+			}
+		}
+		return
+	}
+	// Handovers are merged into the local store
+	sid := head.Topic.String()
+	st, ok := o.ret.stores[sid]
+	if !ok {
+		st = &store{policy: *head.Retention}
+		o.ret.stores[sid] = st
+	}
+	if event != nil {
+		st.insert(event)
+	}
+}
+
+// Handles a root claim of a retained topic, handing over the retained events to
+// the new root.
+func (o *Overlay) handleClaim(src *big.Int, topicId *big.Int) {
+	o.ret.lock.Lock()
+	sid := topicId.String()
+	st, ok := o.ret.stores[sid]
+	delete(o.ret.stores, sid)
+	o.ret.lock.Unlock()
+
+	if ok {
+		o.sendHandover(src, topicId, &st.policy, st.events)
+	}
+}
+
+// Retained events sortable by their arrival time at the topic root.
+type byArrival []*retained
+
+func (s byArrival) Len() int           { return len(s) }
+func (s byArrival) Less(i, j int) bool { return s[i].stamp.Before(s[j].stamp) }
+func (s byArrival) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
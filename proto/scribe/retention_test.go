@@ -0,0 +1,151 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package scribe
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Tests whether the topic roots retain the events according to the policies.
+func TestRetention(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+	pubs := 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < 2*nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make([]*Overlay, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		live = append(live, node)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		time.Sleep(time.Second)
+	}
+	// Verify that non-retained topics report no policy
+	if policy, _, err := live[0].Recall(topicId, time.Second); err != nil || policy != nil {
+		t.Fatalf("non-retained recall mismatch: have %v/%v, want %v/%v.", policy, err, nil, nil)
+	}
+	// Set up a count and a key based retention, and publish a few events to each
+	counted, keyed := topicId+"-counted", topicId+"-keyed"
+	live[0].Retain(counted, Retention{Events: 3})
+	live[1].Retain(keyed, Retention{Key: "key"})
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < pubs; i++ {
+		node := live[i%nodes]
+		if err := node.Publish(counted, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("event %d: failed to publish counted event: %v.", i, err)
+		}
+		headers := map[string]string{"key": fmt.Sprintf("%d", i%2)}
+		if err := node.PublishHeaders(keyed, headers, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("event %d: failed to publish keyed event: %v.", i, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Recall the retained events from every node and verify them
+	for i, node := range live {
+		policy, events, err := node.Recall(counted, time.Second)
+		if err != nil || policy == nil || policy.Events != 3 {
+			t.Fatalf("node %d: counted recall failed: %v/%v.", i, policy, err)
+		}
+		if len(events) != 3 {
+			t.Fatalf("node %d: counted event count mismatch: have %v, want %v.", i, len(events), 3)
+		}
+		for j, event := range events {
+			if want := []byte{byte(pubs - 3 + j)}; !bytes.Equal(event.Msg.Data, want) {
+				t.Fatalf("node %d: counted event %d mismatch: have %v, want %v.", i, j, event.Msg.Data, want)
+			}
+		}
+		policy, events, err = node.Recall(keyed, time.Second)
+		if err != nil || policy == nil || policy.Key != "key" {
+			t.Fatalf("node %d: keyed recall failed: %v/%v.", i, policy, err)
+		}
+		if len(events) != 2 {
+			t.Fatalf("node %d: keyed event count mismatch: have %v, want %v.", i, len(events), 2)
+		}
+		for j, event := range events {
+			if want := []byte{byte(pubs - 2 + j)}; !bytes.Equal(event.Msg.Data, want) {
+				t.Fatalf("node %d: keyed event %d mismatch: have %v, want %v.", i, j, event.Msg.Data, want)
+			}
+		}
+	}
+	// Boot a few more nodes, possibly moving the topic roots, and verify that the
+	// retained events are handed over
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		live = append(live, node)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	for i, node := range live {
+		policy, events, err := node.Recall(counted, time.Second)
+		if err != nil || policy == nil || policy.Events != 3 {
+			t.Fatalf("node %d: counted recall after churn failed: %v/%v.", i, policy, err)
+		}
+		if len(events) != 3 {
+			t.Fatalf("node %d: counted event count mismatch after churn: have %v, want %v.", i, len(events), 3)
+		}
+		for j, event := range events {
+			if want := []byte{byte(pubs - 3 + j)}; !bytes.Equal(event.Msg.Data, want) {
+				t.Fatalf("node %d: counted event %d mismatch after churn: have %v, want %v.", i, j, event.Msg.Data, want)
+			}
+		}
+	}
+	// Disable the retention and verify that the events are dropped
+	live[2].Retain(counted, Retention{})
+	time.Sleep(100 * time.Millisecond)
+
+	if policy, _, err := live[3].Recall(counted, time.Second); err != nil || policy != nil {
+		t.Fatalf("disabled recall mismatch: have %v/%v, want %v/%v.", policy, err, nil, nil)
+	}
+}
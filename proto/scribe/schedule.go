@@ -0,0 +1,208 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// This file contains the scheduled (delayed) publishing: a scheduled event is
+// routed to the node owning a random message key, which holds it until due and
+// then publishes it through the usual topic path. The owner mirrors each pending
+// event to its leaf closest to the message key, which takes over should the owner
+// die. Ownership is re-checked at every heartbeat: owners seeing a closer node
+// reroute their events, replicas becoming the closest promote theirs.
+
+package scribe
+
+import (
+	"crypto/rand"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+	"github.com/karalabe/iris/proto/pastry"
+)
+
+// Scheduled event waiting for its due time.
+type delayed struct {
+	id      *big.Int          // Message key the event is stored under
+	topic   *big.Int          // Topic to publish the event into
+	headers map[string]string // Content headers of the event
+	origin  *big.Int          // Node which scheduled the event
+	msg     *proto.Message    // Encrypted event with the upper layer headers
+	due     time.Time         // Time to publish the event at
+	timer   *time.Timer       // Publish timer (nil for replicas)
+}
+
+// Scheduled event state of the local node.
+type schedule struct {
+	owned    map[string]*delayed // Events owned by the local node
+	replicas map[string]*delayed // Events mirrored from neighbors
+
+	lock sync.Mutex
+}
+
+// Creates an empty schedule.
+func newSchedule() *schedule {
+	return &schedule{
+		owned:    make(map[string]*delayed),
+		replicas: make(map[string]*delayed),
+	}
+}
+
+// Publishes a message with content headers into topic at a future time. The
+// event is held by the overlay until due, then delivered like a normal publish.
+func (o *Overlay) PublishAt(topic string, headers map[string]string, msg *proto.Message, due time.Time) error {
+	// Generate a random message key to spread the events
+	key := make([]byte, config.PastrySpace/8)
+	if n, err := io.ReadFull(rand.Reader, key); n < len(key) || err != nil {
+		return err
+	}
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendSchedule(new(big.Int).SetBytes(key), pastry.Resolve(topic), headers, o.pastry.Self(), due, msg)
+	return nil
+}
+
+// Creates a sendable copy of a scheduled event's message.
+func (d *delayed) copyMsg() *proto.Message {
+	cpy := &proto.Message{
+		Head: d.msg.Head,
+		Data: make([]byte, len(d.msg.Data)),
+	}
+	copy(cpy.Data, d.msg.Data)
+	cpy.KnownSecure()
+	return cpy
+}
+
+// Extracts a scheduled event from a scribe message.
+func newDelayed(id *big.Int, msg *proto.Message) *delayed {
+	head := msg.Head.Meta.(*header)
+
+	d := &delayed{
+		id:      id,
+		topic:   head.Topic,
+		headers: head.Headers,
+		origin:  head.Origin,
+		msg: &proto.Message{
+			Head: msg.Head,
+			Data: msg.Data,
+		},
+		due: head.Due,
+	}
+	d.msg.Head.Meta = head.Meta
+	return d
+}
+
+// Handles a scheduled event arriving at the owner of its message key, storing
+// and mirroring it.
+func (o *Overlay) handleSchedule(id *big.Int, msg *proto.Message) {
+	d := newDelayed(id, msg)
+
+	// Mirror first, so that a due event is not mirrored after publishing
+	o.mirrorDelayed(d)
+
+	o.sch.lock.Lock()
+	defer o.sch.lock.Unlock()
+
+	if old, ok := o.sch.owned[id.String()]; ok {
+		old.timer.Stop()
+	}
+	o.sch.owned[id.String()] = d
+	delete(o.sch.replicas, id.String())
+	d.timer = time.AfterFunc(d.due.Sub(time.Now()), func() { o.fireDelayed(d) })
+}
+
+// Handles a scheduled event mirrored by its owner.
+func (o *Overlay) handleMirror(id *big.Int, msg *proto.Message) {
+	o.sch.lock.Lock()
+	defer o.sch.lock.Unlock()
+
+	if _, ok := o.sch.owned[id.String()]; !ok {
+		o.sch.replicas[id.String()] = newDelayed(id, msg)
+	}
+}
+
+// Handles the removal of a mirrored event, published by its owner.
+func (o *Overlay) handleUnmirror(id *big.Int) {
+	o.sch.lock.Lock()
+	defer o.sch.lock.Unlock()
+
+	delete(o.sch.replicas, id.String())
+}
+
+// Publishes a due event and removes it from the schedule and the mirror.
+func (o *Overlay) fireDelayed(d *delayed) {
+	o.sch.lock.Lock()
+	if o.sch.owned[d.id.String()] != d {
+		o.sch.lock.Unlock()
+		return
+	}
+	delete(o.sch.owned, d.id.String())
+	o.sch.lock.Unlock()
+
+	o.sendDelayed(d.topic, d.headers, d.origin, d.copyMsg())
+	if leaf := o.closestLeaf(d.id); leaf != nil {
+		o.sendUnmirror(leaf, d.id)
+	}
+}
+
+// Mirrors a scheduled event to the leaf closest to its message key.
+func (o *Overlay) mirrorDelayed(d *delayed) {
+	if leaf := o.closestLeaf(d.id); leaf != nil {
+		o.sendMirror(leaf, d.id, d.topic, d.headers, d.origin, d.due, d.copyMsg())
+	}
+}
+
+// Maintains the schedule at each heartbeat: owned events whose key moved closer
+// to a neighbor are rerouted, the rest re-mirrored (the closest leaf might have
+// changed). Mirrored events whose key became locally owned are promoted.
+func (o *Overlay) maintainSchedule() {
+	var reroute, mirror []*delayed
+
+	o.sch.lock.Lock()
+	for sid, d := range o.sch.owned {
+		if o.ownsKey(d.id) {
+			mirror = append(mirror, d)
+			continue
+		}
+		d.timer.Stop()
+		delete(o.sch.owned, sid)
+		reroute = append(reroute, d)
+	}
+	for sid, d := range o.sch.replicas {
+		if !o.ownsKey(d.id) {
+			continue
+		}
+		delete(o.sch.replicas, sid)
+		o.sch.owned[sid] = d
+
+		dd := d // Closure
+		d.timer = time.AfterFunc(d.due.Sub(time.Now()), func() { o.fireDelayed(dd) })
+		mirror = append(mirror, d)
+	}
+	o.sch.lock.Unlock()
+
+	for _, d := range reroute {
+		o.sendSchedule(d.id, d.topic, d.headers, d.origin, d.due, d.copyMsg())
+	}
+	for _, d := range mirror {
+		o.mirrorDelayed(d)
+	}
+}
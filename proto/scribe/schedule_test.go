@@ -0,0 +1,111 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/karalabe/iris/config"
+	"github.com/karalabe/iris/proto"
+)
+
+// Tests whether scheduled events are published when due, even if their owner
+// dies in the meanwhile.
+func TestPublishAt(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	live := make([]*Overlay, 0, nodes)
+	colls := make([]*collector, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		coll := &collector{publish: []*proto.Message{}}
+		node := New(overId, key, coll)
+
+		live = append(live, node)
+		colls = append(colls, coll)
+
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		time.Sleep(time.Second)
+
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Schedule a batch of events from the first node
+	events := 10
+	due := time.Now().Add(2 * time.Second)
+	for i := 0; i < events; i++ {
+		if err := live[0].PublishAt(topicId, nil, &proto.Message{Data: []byte{byte(i)}}, due); err != nil {
+			t.Fatalf("event %d: failed to schedule: %v.", i, err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// Kill the node owning the most events (apart from the scheduler)
+	victim, most := -1, 0
+	for i := 1; i < nodes; i++ {
+		live[i].sch.lock.Lock()
+		if n := len(live[i].sch.owned); n > most {
+			victim, most = i, n
+		}
+		live[i].sch.lock.Unlock()
+	}
+	for i, node := range live {
+		if i == victim {
+			node.Shutdown()
+		} else {
+			defer node.Shutdown()
+		}
+	}
+	// Verify that nothing arrived before due, and everything after
+	for i, coll := range colls {
+		coll.lock.Lock()
+		if n := len(coll.publish); i != victim && n != 0 {
+			t.Fatalf("node %d: events arrived before due: %v.", i, n)
+		}
+		coll.lock.Unlock()
+	}
+	time.Sleep(due.Sub(time.Now()) + 2*time.Second)
+	for i, coll := range colls {
+		coll.lock.Lock()
+		if n := len(coll.publish); i != victim && n != events {
+			t.Fatalf("node %d: event count mismatch: have %v, want %v.", i, n, events)
+		}
+		coll.lock.Unlock()
+	}
+}
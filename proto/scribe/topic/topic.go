@@ -29,7 +29,9 @@ import (
 	"sync/atomic"
 
 	"github.com/karalabe/iris/balancer"
+	"github.com/karalabe/iris/config"
 	"github.com/karalabe/iris/ext/sortext"
+	"github.com/karalabe/iris/filter"
 	"github.com/karalabe/iris/system"
 )
 
@@ -48,6 +50,9 @@ type Topic struct {
 	load *balancer.Balancer // Balancer to load-distribute messages
 	msgs int32              // Number of messages balanced to locals (atomic, take care)
 
+	filters map[string]filter.Summary // Filter summaries reported by the neighbors
+	local   *filter.Summary           // Filter summary of the local subscribers (nil if unknown)
+
 	lock sync.RWMutex
 }
 
@@ -60,6 +65,7 @@ func New(id, owner *big.Int) *Topic {
 		nodes:   []*big.Int{},
 		members: make(map[string]struct{}),
 		load:    balancer.New(),
+		filters: make(map[string]filter.Summary),
 	}
 }
 
@@ -87,6 +93,7 @@ func (t *Topic) Reown(parent *big.Int) {
 	if t.parent != nil {
 		t.load.Unregister(t.parent)
 		delete(t.members, t.parent.String())
+		delete(t.filters, t.parent.String())
 	}
 	// Initialize and save the new parent if any
 	if parent != nil {
@@ -146,6 +153,7 @@ func (t *Topic) Unsubscribe(id *big.Int) error {
 	t.nodes = t.nodes[:last]
 	sortext.BigInts(t.nodes)
 	delete(t.members, id.String())
+	delete(t.filters, id.String())
 
 	// log.Printf("%v:%v: remed, state: %v.", t.owner, t.id, t.nodes)
 
@@ -191,15 +199,71 @@ func (t *Topic) Broadcast(ex *big.Int) []*big.Int {
 	return nodes
 }
 
+// Returns the list of nodes that a broadcast message with the given headers
+// should be sent to, skipping those whose subtree filters cannot match. Nodes
+// without a filter report yet are always included. An optional ex node can be
+// specified to exclude it from the list.
+func (t *Topic) BroadcastMatching(ex *big.Int, headers map[string]string) []*big.Int {
+	nodes := t.Broadcast(ex)
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	matches := nodes[:0]
+	for _, id := range nodes {
+		if id.Cmp(t.owner) == 0 {
+			if t.local != nil && !t.local.Match(headers) {
+				continue
+			}
+		} else if sum, ok := t.filters[id.String()]; ok && !sum.Match(headers) {
+			continue
+		}
+		matches = append(matches, id)
+	}
+	return matches
+}
+
 // Returns a node id to which the balancer deemed the next message should be
 // sent. An optional ex node can be specified to prevent balancing there (if
 // others exist).
 func (t *Topic) Balance(ex *big.Int) (*big.Int, error) {
+	return t.BalanceBy(balancer.Weighted, ex)
+}
+
+// Returns a node id to which the next message should be sent, as picked by the
+// requested balancing strategy. Optional ex nodes can be specified to prevent
+// balancing there (in order of priority, if others exist).
+func (t *Topic) BalanceBy(strat balancer.Strategy, ex ...*big.Int) (*big.Int, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
 	// Pick a balance target
-	id, err := t.load.Balance(ex)
+	id, err := t.load.BalanceBy(strat, ex...)
+	if err != nil {
+		return nil, err
+	}
+	// If the target is the local node, increment the task counter
+	if id.Cmp(t.owner) == 0 {
+		atomic.AddInt32(&t.msgs, 1)
+	}
+	return id, nil
+}
+
+// Returns a node id to which a keyed message should be sent. Keys are always
+// resolved top-down: non-root nodes pass the message towards the topic root,
+// whilst the root (and every node reached from its parent) consistently hashes
+// the key onto one of its children, so that the same key always arrives at the
+// same leaf while the tree is stable.
+func (t *Topic) BalanceKey(key []byte, prev *big.Int) (*big.Int, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	// If not yet descending, forward towards the root
+	if t.parent != nil && (prev == nil || prev.Cmp(t.parent) != 0) {
+		return t.parent, nil
+	}
+	// Pick a child based on the key
+	id, err := t.load.BalanceKey(key, t.parent)
 	if err != nil {
 		return nil, err
 	}
@@ -210,8 +274,9 @@ func (t *Topic) Balance(ex *big.Int) (*big.Int, error) {
 	return id, nil
 }
 
-// Returns the list of nodes to report to, and the report for each.
-func (t *Topic) GenerateReports() ([]*big.Int, []int) {
+// Returns the list of nodes to report to, and the load report and the filter
+// summary (of the rest of the tree) for each.
+func (t *Topic) GenerateReports() ([]*big.Int, []balancer.Load, []filter.Summary) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
@@ -228,34 +293,97 @@ func (t *Topic) GenerateReports() ([]*big.Int, []int) {
 	if t.parent != nil {
 		ids = append(ids, t.parent)
 	}
-	// Calculate the capacities that should be reported to each
-	caps := make([]int, len(ids))
+	// Calculate the loads that should be reported to each
+	loads := make([]balancer.Load, len(ids))
 	for i, id := range ids {
-		caps[i] = t.load.Capacity(id)
+		loads[i] = t.load.Load(id)
 	}
-	// Return the capacity with the nodes to report to
-	return ids, caps
+	// Summarize the filters of everything but the destination
+	filters := make([]filter.Summary, len(ids))
+	for i, id := range ids {
+		filters[i] = t.summarize(id)
+	}
+	// Return the loads with the nodes to report to
+	return ids, loads, filters
 }
 
-// Sets the load capacity for a source node in the balancer.
-func (t *Topic) ProcessReport(id *big.Int, cap int) error {
-	return t.load.Update(id, cap)
+// Merges the filter summaries of all neighbors (and local subscribers) except
+// the given node. Unknown summaries are considered as accepting everything.
+func (t *Topic) summarize(ex *big.Int) filter.Summary {
+	// Gather the neighbors to summarize
+	ids := make([]*big.Int, 0, len(t.nodes)+1)
+	for _, id := range t.nodes {
+		if id.Cmp(ex) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	if t.parent != nil && t.parent.Cmp(ex) != 0 {
+		ids = append(ids, t.parent)
+	}
+	// Merge their summaries, bailing out if any is unknown
+	sum := filter.Summary{}
+	for _, id := range ids {
+		var rep *filter.Summary
+		if id.Cmp(t.owner) == 0 {
+			rep = t.local
+		} else if known, ok := t.filters[id.String()]; ok {
+			rep = &known
+		}
+		if rep == nil {
+			return filter.All()
+		}
+		if sum = sum.Merge(*rep, config.ScribeFilterLimit); sum.All {
+			return sum
+		}
+	}
+	return sum
+}
+
+// Returns the aggregated load stats of the whole topic tree.
+func (t *Topic) Load() balancer.Load {
+	return t.load.Load(nil)
+}
+
+// Sets the load stats for a source node in the balancer and stores the filter
+// summary of the subtree behind it.
+func (t *Topic) ProcessReport(id *big.Int, load balancer.Load, sum filter.Summary) error {
+	if err := t.load.UpdateLoad(id, load); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	t.filters[id.String()] = sum
+	t.lock.Unlock()
+
+	return nil
+}
+
+// Sets the filter summary of the local subscribers.
+func (t *Topic) Filter(local filter.Summary) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.local = &local
 }
 
 // If local subscriptions are alive in the topic, updates the balancer according
-// to the messages processed since the last beat.
-func (t *Topic) Cycle() {
+// to the local load report, or if none is available, the messages processed
+// since the last beat relative to the CPU usage.
+func (t *Topic) Cycle(local *balancer.Load) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
 	// Notify the balancer of the local capacity
 	idx := sortext.SearchBigInts(t.nodes, t.owner)
 	if idx < len(t.nodes) && t.owner.Cmp(t.nodes[idx]) == 0 {
-		// Sanity check not to send some weird value
-		cap := math.Max(0, float64(atomic.LoadInt32(&t.msgs))/float64(system.CpuUsage()))
-		cap = math.Min(math.MaxInt32, cap)
-
-		t.load.Update(t.owner, int(cap))
+		if local != nil {
+			t.load.UpdateLoad(t.owner, *local)
+		} else {
+			// Sanity check not to send some weird value
+			cap := math.Max(0, float64(atomic.LoadInt32(&t.msgs))/float64(system.CpuUsage()))
+			cap = math.Min(math.MaxInt32, cap)
+
+			t.load.Update(t.owner, int(cap))
+		}
 	}
 	// Reset counters for next beat
 	atomic.StoreInt32(&t.msgs, 0)
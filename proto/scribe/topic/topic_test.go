@@ -23,7 +23,9 @@ import (
 	"math/big"
 	"testing"
 
+	"github.com/karalabe/iris/balancer"
 	"github.com/karalabe/iris/ext/sortext"
+	"github.com/karalabe/iris/filter"
 )
 
 func TestTopic(t *testing.T) {
@@ -109,25 +111,78 @@ func TestTopic(t *testing.T) {
 		t.Fatalf("failed to subscribe with local node: %v.", err)
 	}
 	// Check load report generation
-	ns, caps := top.GenerateReports()
-	if len(ns) != len(nodes) || len(caps) != len(nodes) {
-		t.Fatalf("report target size mismatch: have %v/%v nodes/caps, want %v.", len(ns), len(caps), len(nodes))
+	ns, loads, _ := top.GenerateReports()
+	if len(ns) != len(nodes) || len(loads) != len(nodes) {
+		t.Fatalf("report target size mismatch: have %v/%v nodes/loads, want %v.", len(ns), len(loads), len(nodes))
 	}
-	for i, cap := range caps {
-		if cap != len(nodes) {
-			t.Fatalf("capacity %d mismatch: have %v, want %v", i, cap, len(nodes))
+	for i, load := range loads {
+		if load.Cap != len(nodes) {
+			t.Fatalf("capacity %d mismatch: have %v, want %v", i, load.Cap, len(nodes))
 		}
 	}
 	// Check load processing
 	total := 1 // Local apps
 	for i, id := range nodes {
-		top.ProcessReport(id, 10*(i+1))
+		top.ProcessReport(id, balancer.Load{Cap: 10 * (i + 1)}, filter.All())
 		total += 10 * (i + 1)
 	}
-	ns, caps = top.GenerateReports()
-	for i, cap := range caps {
-		if cap != total-10*(i+1) {
-			t.Fatalf("capacity %d mismatch: have %v, want %v", i, cap, total-10*(i+1))
+	ns, loads, _ = top.GenerateReports()
+	for i, load := range loads {
+		if load.Cap != total-10*(i+1) {
+			t.Fatalf("capacity %d mismatch: have %v, want %v", i, load.Cap, total-10*(i+1))
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	// Create a topic with a local subscription and a few children
+	topicId := big.NewInt(1)
+	ownerId := big.NewInt(2)
+	nodes := []*big.Int{big.NewInt(3), big.NewInt(4), big.NewInt(5)}
+
+	top := New(topicId, ownerId)
+	for _, id := range nodes {
+		if err := top.Subscribe(id); err != nil {
+			t.Fatalf("failed to subscribe node %v: %v.", id, err)
+		}
+	}
+	if err := top.Subscribe(ownerId); err != nil {
+		t.Fatalf("failed to subscribe with local node: %v.", err)
+	}
+	// Without filter reports, everything should be broadcast to
+	eu := map[string]string{"region": "eu"}
+	if n := len(top.BroadcastMatching(nil, eu)); n != len(nodes)+1 {
+		t.Fatalf("unfiltered broadcast size mismatch: have %v, want %v.", n, len(nodes)+1)
+	}
+	// Report distinct filters from all the neighbors
+	for i, expr := range []string{`region == "eu"`, `region == "us"`, `region == "asia"`} {
+		f, err := filter.Parse(expr)
+		if err != nil {
+			t.Fatalf("failed to parse filter %v: %v.", expr, err)
+		}
+		top.ProcessReport(nodes[i], balancer.Load{Cap: 1}, filter.Summary{Filters: []*filter.Filter{f}})
+	}
+	local, _ := filter.Parse(`region == "us"`)
+	top.Filter(filter.Summary{Filters: []*filter.Filter{local}})
+
+	// Verify that only the matching subtrees are broadcast to
+	ids := top.BroadcastMatching(nil, eu)
+	if len(ids) != 1 || ids[0].Cmp(nodes[0]) != 0 {
+		t.Fatalf("filtered broadcast mismatch: have %v, want %v.", ids, nodes[:1])
+	}
+	if ids := top.BroadcastMatching(nodes[1], map[string]string{"region": "us"}); len(ids) != 1 || ids[0].Cmp(ownerId) != 0 {
+		t.Fatalf("filtered broadcast mismatch: have %v, want %v.", ids, []*big.Int{ownerId})
+	}
+	// Verify that the reports summarize the rest of the tree
+	ns, _, sums := top.GenerateReports()
+	counts := map[string]int{nodes[0].String(): 2, nodes[1].String(): 3, nodes[2].String(): 2}
+	for i, id := range ns {
+		sum := sums[i]
+		if sum.All || len(sum.Filters) != counts[id.String()] {
+			t.Fatalf("summary for %v mismatch: have %v/%d, want %v/%d.", id, sum.All, len(sum.Filters), false, counts[id.String()])
+		}
+		if id.Cmp(nodes[0]) == 0 && sum.Match(eu) {
+			t.Fatalf("summary for %v contains its own filter.", id)
 		}
 	}
 }
@@ -64,8 +64,12 @@ type authResponse struct {
 }
 
 // Data channel linking request message. Used both to init, reply and verify.
+// During verification the peers also advertise their payload compression and
+// whether they accept link key renewals.
 type linkRequest struct {
-	Id int64
+	Id       int64
+	Compress bool
+	Rekey    bool
 }
 
 // Make sure the link request packet is registered with gob.
@@ -344,7 +348,7 @@ func (l *Listener) serverLink(sess *Session) error {
 	// Send over the temporary session id to the client for data link setup
 	msg := &proto.Message{
 		Head: proto.Header{
-			Meta: &linkRequest{id},
+			Meta: &linkRequest{Id: id},
 		},
 	}
 	if err = sess.CtrlLink.SendDirect(msg); err != nil {
@@ -360,7 +364,7 @@ func (l *Listener) serverLink(sess *Session) error {
 	// Send the data link authentication
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: &linkRequest{id},
+			Meta: &linkRequest{Id: id, Compress: config.SessionCompress, Rekey: config.SessionRekey},
 		},
 	}
 	// Retrieve the remote data link authentication
@@ -373,6 +377,8 @@ func (l *Listener) serverLink(sess *Session) error {
 		return errors.New("corrupt auth message")
 	} else if res.Id != id {
 		return errors.New("mismatched auth message")
+	} else {
+		sess.negotiate(res)
 	}
 	return nil
 }
@@ -392,7 +398,7 @@ func clientLink(sess *Session) error {
 	}
 	// Send the temporary id back on the data stream
 	req := &initRequest{
-		Link: &linkRequest{msg.Head.Meta.(*linkRequest).Id},
+		Link: &linkRequest{Id: msg.Head.Meta.(*linkRequest).Id},
 	}
 	if err = strm.Send(req); err != nil {
 		strm.Close()
@@ -408,7 +414,7 @@ func clientLink(sess *Session) error {
 	// Send the data link authentication
 	auth := &proto.Message{
 		Head: proto.Header{
-			Meta: req.Link,
+			Meta: &linkRequest{Id: req.Link.Id, Compress: config.SessionCompress, Rekey: config.SessionRekey},
 		},
 	}
 	// Retrieve the remote data link authentication
@@ -421,6 +427,8 @@ func clientLink(sess *Session) error {
 		return errors.New("corrupt authentication message")
 	} else if res.Id != req.Link.Id {
 		return errors.New("mismatched authentication message")
+	} else {
+		sess.negotiate(res)
 	}
 	return nil
 }
@@ -58,6 +58,18 @@ func (s *Session) init(conn *stream.Stream, server bool) {
 	s.DataLink = link.New(conn, s.kdf, server)
 }
 
+// Enables payload compression and key renewal on both links, if negotiated by
+// both sides.
+func (s *Session) negotiate(remote *linkRequest) {
+	compress := config.SessionCompress && remote.Compress
+	s.CtrlLink.SetCompression(compress)
+	s.DataLink.SetCompression(compress)
+
+	rekey := config.SessionRekey && remote.Rekey
+	s.CtrlLink.SetRekeying(rekey)
+	s.DataLink.SetRekeying(rekey)
+}
+
 // Starts the session data transfers on the control and data channels.
 func (s *Session) Start(cap int) {
 	s.CtrlLink.Start(cap)
@@ -51,6 +51,15 @@ func TestForward(t *testing.T) {
 	}
 	server := <-sock.Sink
 
+	// Make sure payload compression and rekeying was negotiated on all links
+	for _, sess := range []*Session{client, server} {
+		if !sess.CtrlLink.Compression() || !sess.DataLink.Compression() {
+			t.Fatalf("compression not negotiated: ctrl %v, data %v.", sess.CtrlLink.Compression(), sess.DataLink.Compression())
+		}
+		if !sess.CtrlLink.Rekeying() || !sess.DataLink.Rekeying() {
+			t.Fatalf("rekeying not negotiated: ctrl %v, data %v.", sess.CtrlLink.Rekeying(), sess.DataLink.Rekeying())
+		}
+	}
 	// Initiate the message transfers
 	client.Start(2)
 	server.Start(2)
@@ -17,7 +17,10 @@
 //
 // Author: peterke@gmail.com (Peter Szilagyi)
 
-// Package stream wraps a TCP/IP network connection with the Go gob en/decoder.
+// Package stream wraps a TCP/IP network connection with a length prefixed frame
+// codec. Byte slices are framed as is, protocol headers with an explicit wire
+// codec are binary encoded, and any other values fall back to a stateless gob
+// encoding (meant only for rarely sent handshake data).
 //
 // Note, in case of a serialization error (encoding or decoding failure), it is
 // assumed that there is either a protocol mismatch between the parties, or an
@@ -27,15 +30,28 @@ package stream
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"time"
+
+	"github.com/karalabe/iris/pool"
+	"github.com/karalabe/iris/proto/wire"
 )
 
 // Constants for the protocol TCP/IP layer
 const acceptBlockTimeout = 250 * time.Millisecond
 
+// Maximum size of a single frame, protecting against corrupt length prefixes.
+const maxFrameSize = 1 << 30
+
+// Error returned if a frame exceeds the allowed maximum size.
+var ErrFrameSize = errors.New("frame size limit exceeded")
+
 // Stream listener to accept inbound connections.
 type Listener struct {
 	Sink chan *Stream // Channel receiving the accepted connections
@@ -44,12 +60,13 @@ type Listener struct {
 	quit   chan chan error  // Termination synchronization channel
 }
 
-// TCP/IP based stream with a gob encoder on top.
+// TCP/IP based stream with a frame codec on top.
 type Stream struct {
 	socket  *net.TCPConn      // Network connection to the remote endpoint
 	buffers *bufio.ReadWriter // Buffered access to the network socket
-	encoder *gob.Encoder      // Gob encoder for data serialization
-	decoder *gob.Decoder      // Gob decoder for data deserialization
+	encoder wire.Encoder      // Binary encoder for header serialization
+	inFrame []byte            // Buffer of the last inbound encoded frame
+	outSize []byte            // Buffer of the outbound frame length prefix
 }
 
 // Opens a TCP server socket and returns a stream listener, ready to accept. If
@@ -83,7 +100,7 @@ func (l *Listener) Close() error {
 	return <-errc
 }
 
-// Accepts incoming connection requests, converts them info a TCP/IP gob stream
+// Accepts incoming connection requests, converts them info a TCP/IP stream
 // and send them back on the sink channel.
 func (l *Listener) accepter(timeout time.Duration) {
 	var errc chan error
@@ -124,7 +141,7 @@ func (l *Listener) accepter(timeout time.Duration) {
 	errc <- errv
 }
 
-// Creates a new, gob backed network stream based on a live TCP/IP connection.
+// Creates a new, frame based network stream based on a live TCP/IP connection.
 func newStream(sock *net.TCPConn) *Stream {
 	reader := bufio.NewReader(sock)
 	writer := bufio.NewWriter(sock)
@@ -132,8 +149,7 @@ func newStream(sock *net.TCPConn) *Stream {
 	return &Stream{
 		socket:  sock,
 		buffers: bufio.NewReadWriter(reader, writer),
-		encoder: gob.NewEncoder(writer),
-		decoder: gob.NewDecoder(reader),
+		outSize: make([]byte, binary.MaxVarintLen64),
 	}
 }
 
@@ -154,13 +170,45 @@ func (s *Stream) Sock() *net.TCPConn {
 // Serializes an object and sends it over the wire. In case of an error, the
 // connection is torn down.
 func (s *Stream) Send(data interface{}) error {
-	if err := s.encoder.Encode(data); err != nil {
+	var frame []byte
+	switch v := data.(type) {
+	case []byte:
+		frame = v
+	case *[]byte:
+		frame = *v
+	case wire.Codec:
+		frame = s.encoder.Encode(v)
+	default:
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(data); err != nil {
+			s.socket.Close()
+			return err
+		}
+		frame = buf.Bytes()
+	}
+	return s.SendBytes(frame)
+}
+
+// Sends a byte slice frame over the wire, without the type switching overhead of
+// Send. In case of an error, the connection is torn down.
+func (s *Stream) SendBytes(frame []byte) error {
+	if err := s.write(frame); err != nil {
 		s.socket.Close()
 		return err
 	}
 	return nil
 }
 
+// Writes a length prefixed frame into the outbound buffer.
+func (s *Stream) write(frame []byte) error {
+	n := binary.PutUvarint(s.outSize, uint64(len(frame)))
+	if _, err := s.buffers.Write(s.outSize[:n]); err != nil {
+		return err
+	}
+	_, err := s.buffers.Write(frame)
+	return err
+}
+
 // Flushes the outbound socket. In case of an error, the  network stream is torn
 // down.
 func (s *Stream) Flush() error {
@@ -171,16 +219,77 @@ func (s *Stream) Flush() error {
 	return nil
 }
 
-// Receives a gob of the given type and returns it. If an  error occurs, the
-// network stream is torn down.
+// Receives an object of the given type and returns it. Byte slices are filled
+// in place, reusing their capacity if possible. If an error occurs, the network
+// stream is torn down.
 func (s *Stream) Recv(data interface{}) error {
-	if err := s.decoder.Decode(data); err != nil {
+	var err error
+	switch v := data.(type) {
+	case *[]byte:
+		*v, err = s.read(*v)
+	case wire.Codec:
+		if s.inFrame, err = s.read(s.inFrame); err == nil {
+			err = wire.Unmarshal(s.inFrame, v)
+		}
+	default:
+		if s.inFrame, err = s.read(s.inFrame); err == nil {
+			err = gob.NewDecoder(bytes.NewReader(s.inFrame)).Decode(data)
+		}
+	}
+	if err != nil {
 		s.socket.Close()
 		return err
 	}
 	return nil
 }
 
+// Receives a byte slice frame into a buffer retrieved from the pool (nil if the
+// frame is empty). If an error occurs, the network stream is torn down.
+func (s *Stream) RecvBuffer() (*pool.Buffer, error) {
+	size, err := s.size()
+	if err == nil && size > 0 {
+		buf := pool.NewBuffer(int(size))
+		if _, err = io.ReadFull(s.buffers, buf.Data); err == nil {
+			return buf, nil
+		}
+		buf.Release()
+	}
+	if err != nil {
+		s.socket.Close()
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Reads the length prefix of the next inbound frame.
+func (s *Stream) size() (uint64, error) {
+	size, err := binary.ReadUvarint(s.buffers)
+	if err != nil {
+		return 0, err
+	}
+	if size > maxFrameSize {
+		return 0, ErrFrameSize
+	}
+	return size, nil
+}
+
+// Reads a length prefixed frame from the inbound buffer, into the given slice if
+// it has enough capacity, or a newly allocated one otherwise.
+func (s *Stream) read(buf []byte) ([]byte, error) {
+	size, err := s.size()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(s.buffers, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 // Closes the underlying network connection of a stream.
 func (s *Stream) Close() error {
 	return s.socket.Close()
@@ -0,0 +1,577 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2014 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+// Package wire implements the compact, versioned binary encoding of the protocol
+// headers, replacing the reflection driven and stateful gob coders on the hot
+// paths.
+//
+// An encoded header is a sequence of tagged fields, each tag consisting of the
+// field number and its wire kind (varint or length prefixed blob). Zero valued
+// fields are omitted and unknown ones skipped, so headers may gain new fields
+// without breaking older peers, as long as field numbers are never reused.
+//
+// Nested upper layer headers (interface values) are prefixed by the type id of
+// their registered codec. Types without an explicit codec fall back to a fresh
+// (stateless) gob encoding, which is meant only for rarely sent control data.
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"math/big"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Version of the wire format, prefixed to every top level encoding.
+const Version = 1
+
+// Type ids of the registered codecs. Ids must never be changed or reused.
+const (
+	typeGob      uint64 = iota // Gob encoded value of an unregistered type
+	PastryHeader               // Headers of the pastry overlay
+	ScribeHeader               // Headers of the scribe topic layer
+	IrisHeader                 // Headers of the iris messaging layer
+	LinkClose                  // Termination packet of an encrypted link
+	LinkRekey                  // Key renewal packet of an encrypted link
+)
+
+// Wire kinds of the encoded fields.
+const (
+	kindVarint = 0 // Unsigned varint (signed values zig-zag encoded)
+	kindBlob   = 1 // Length prefixed byte blob
+)
+
+var (
+	ErrVersion = errors.New("wire: unsupported version")
+	ErrCorrupt = errors.New("wire: corrupt data")
+	ErrType    = errors.New("wire: unknown type")
+)
+
+// Explicit binary codec of a protocol header.
+type Codec interface {
+	// Appends the non-zero fields of the header to the encoder.
+	EncodeWire(enc *Encoder)
+
+	// Restores the header fields from the decoder, skipping unknown ones.
+	DecodeWire(dec *Decoder) error
+}
+
+// Registry of the explicit codecs, mapping between type ids and types.
+var (
+	codecs   = make(map[uint64]func() Codec)
+	typeIds  = make(map[reflect.Type]uint64)
+	regsLock sync.RWMutex
+)
+
+// Registers a codec type with a given type id, used to encode interface values
+// (upper layer headers) of the type. The constructor must return a pointer.
+func Register(id uint64, fresh func() Codec) {
+	regsLock.Lock()
+	defer regsLock.Unlock()
+
+	if id == typeGob {
+		panic("wire: reserved type id")
+	}
+	if _, ok := codecs[id]; ok {
+		panic("wire: duplicate type id")
+	}
+	codecs[id] = fresh
+	typeIds[reflect.TypeOf(fresh())] = id
+}
+
+// Looks up the type id of a value, returning the gob fallback if unregistered.
+func typeOf(v interface{}) (uint64, Codec) {
+	regsLock.RLock()
+	defer regsLock.RUnlock()
+
+	if id, ok := typeIds[reflect.TypeOf(v)]; ok {
+		return id, v.(Codec)
+	}
+	return typeGob, nil
+}
+
+// Creates a new, empty value of a registered type id.
+func fresh(id uint64) Codec {
+	regsLock.RLock()
+	defer regsLock.RUnlock()
+
+	if maker, ok := codecs[id]; ok {
+		return maker()
+	}
+	return nil
+}
+
+// Encodes a header into a newly allocated buffer.
+func Marshal(v Codec) []byte {
+	enc := new(Encoder)
+	return enc.Encode(v)
+}
+
+// Decodes a header from a top level encoding. Any byte slices are copied out of
+// the source buffer, so it can be reused afterwards.
+func Unmarshal(data []byte, v Codec) error {
+	if len(data) == 0 {
+		return ErrCorrupt
+	}
+	if data[0] != Version {
+		return ErrVersion
+	}
+	dec := &Decoder{buf: data[1:]}
+	if err := v.DecodeWire(dec); err != nil {
+		return err
+	}
+	return dec.Err()
+}
+
+// Binary header encoder, reusable between subsequent encodings.
+type Encoder struct {
+	buf []byte
+}
+
+// Encodes a header into the internal buffer, prefixed by the format version. The
+// returned slice is valid only until the next call to Encode.
+func (e *Encoder) Encode(v Codec) []byte {
+	e.buf = append(e.buf[:0], Version)
+	v.EncodeWire(e)
+	return e.buf
+}
+
+// Appends a raw unsigned varint.
+func (e *Encoder) varint(v uint64) {
+	for v >= 0x80 {
+		e.buf = append(e.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	e.buf = append(e.buf, byte(v))
+}
+
+// Appends a field tag.
+func (e *Encoder) key(field int, kind int) {
+	e.varint(uint64(field)<<1 | uint64(kind))
+}
+
+// Appends a length prefixed blob field.
+func (e *Encoder) blob(field int, v []byte) {
+	e.key(field, kindBlob)
+	e.varint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// Appends a length prefixed blob field, the contents of which are generated by
+// the filler. The length is inserted in front of the contents after the fact.
+func (e *Encoder) nest(field int, filler func()) {
+	e.key(field, kindBlob)
+	start := len(e.buf)
+	filler()
+
+	// Insert the varint length of the contents before them
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(e.buf)-start))
+
+	e.buf = append(e.buf, size[:n]...)
+	copy(e.buf[start+n:], e.buf[start:len(e.buf)-n])
+	copy(e.buf[start:], size[:n])
+}
+
+// Appends an unsigned integer field, unless zero.
+func (e *Encoder) Uint(field int, v uint64) {
+	if v != 0 {
+		e.key(field, kindVarint)
+		e.varint(v)
+	}
+}
+
+// Appends a signed integer field, unless zero.
+func (e *Encoder) Int(field int, v int64) {
+	e.Uint(field, uint64(v<<1)^uint64(v>>63))
+}
+
+// Appends a boolean field, unless false.
+func (e *Encoder) Bool(field int, v bool) {
+	if v {
+		e.Uint(field, 1)
+	}
+}
+
+// Appends a byte slice field, unless empty.
+func (e *Encoder) Bytes(field int, v []byte) {
+	if len(v) > 0 {
+		e.blob(field, v)
+	}
+}
+
+// Appends a string field, unless empty.
+func (e *Encoder) Text(field int, v string) {
+	if len(v) > 0 {
+		e.key(field, kindBlob)
+		e.varint(uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Appends a big integer field, unless nil. The sign is stored in the first byte.
+func (e *Encoder) Big(field int, v *big.Int) {
+	if v != nil {
+		e.nest(field, func() {
+			e.buf = append(e.buf, byte(v.Sign()+1))
+			e.buf = append(e.buf, v.Bytes()...)
+		})
+	}
+}
+
+// Appends a timestamp field with nanosecond precision, unless zero.
+func (e *Encoder) Time(field int, v time.Time) {
+	if !v.IsZero() {
+		e.Int(field, v.UnixNano())
+	}
+}
+
+// Appends a duration field, unless zero.
+func (e *Encoder) Duration(field int, v time.Duration) {
+	e.Int(field, int64(v))
+}
+
+// Appends a list of unsigned integers, unless empty.
+func (e *Encoder) Uints(field int, v []uint64) {
+	if len(v) > 0 {
+		e.nest(field, func() {
+			for _, x := range v {
+				e.varint(x)
+			}
+		})
+	}
+}
+
+// Appends a list of strings, unless empty.
+func (e *Encoder) Strings(field int, v []string) {
+	if len(v) > 0 {
+		e.nest(field, func() {
+			for _, s := range v {
+				e.varint(uint64(len(s)))
+				e.buf = append(e.buf, s...)
+			}
+		})
+	}
+}
+
+// Appends a string to string map, unless empty.
+func (e *Encoder) StringMap(field int, v map[string]string) {
+	if len(v) > 0 {
+		e.nest(field, func() {
+			for key, val := range v {
+				e.varint(uint64(len(key)))
+				e.buf = append(e.buf, key...)
+				e.varint(uint64(len(val)))
+				e.buf = append(e.buf, val...)
+			}
+		})
+	}
+}
+
+// Appends a nested struct with an explicit codec, unless nil.
+func (e *Encoder) Struct(field int, v Codec) {
+	if v != nil && !reflect.ValueOf(v).IsNil() {
+		e.nest(field, func() { v.EncodeWire(e) })
+	}
+}
+
+// Appends an interface value (upper layer header), unless nil. Values of types
+// without a registered codec are gob encoded, requiring gob registration.
+func (e *Encoder) Value(field int, v interface{}) {
+	if v == nil {
+		return
+	}
+	id, codec := typeOf(v)
+	e.nest(field, func() {
+		e.varint(id)
+		if codec != nil {
+			codec.EncodeWire(e)
+		} else {
+			e.gob(&v)
+		}
+	})
+}
+
+// Appends a gob encoded field, unless nil. Meant for rarely sent, complex types
+// where an explicit codec would not pay off.
+func (e *Encoder) Gob(field int, v interface{}) {
+	if v == nil {
+		return
+	}
+	if val := reflect.ValueOf(v); val.Kind() == reflect.Ptr && val.IsNil() {
+		return
+	}
+	e.nest(field, func() { e.gob(v) })
+}
+
+// Appends the stateless gob encoding of a value. Encoding failures mean a type
+// is unregistered or unsupported, which is a programming error.
+func (e *Encoder) gob(v interface{}) {
+	buf := bytes.NewBuffer(e.buf)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		panic("wire: gob fallback failed: " + err.Error())
+	}
+	e.buf = buf.Bytes()
+}
+
+// Binary header decoder iterating over the encoded fields. Errors are sticky:
+// after the first failure all reads return zero values and Next reports false.
+type Decoder struct {
+	buf   []byte
+	field int
+	kind  int
+	err   error
+}
+
+// Advances to the next encoded field, reporting whether one is available.
+func (d *Decoder) Next() bool {
+	if d.err != nil || len(d.buf) == 0 {
+		return false
+	}
+	tag := d.varint()
+	d.field, d.kind = int(tag>>1), int(tag&1)
+	return d.err == nil
+}
+
+// Returns the number of the current field.
+func (d *Decoder) Field() int {
+	return d.field
+}
+
+// Returns the first error encountered during decoding.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Fails the decoding with the given error, unless already failed.
+func (d *Decoder) Fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Reads a raw unsigned varint.
+func (d *Decoder) varint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.Fail(ErrCorrupt)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// Reads a length prefixed byte sequence, aliasing the source buffer.
+func (d *Decoder) chunk() []byte {
+	size := d.varint()
+	if d.err != nil {
+		return nil
+	}
+	if size > uint64(len(d.buf)) {
+		d.Fail(ErrCorrupt)
+		return nil
+	}
+	data := d.buf[:size]
+	d.buf = d.buf[size:]
+	return data
+}
+
+// Reads the contents of the current blob field, aliasing the source buffer.
+func (d *Decoder) blob() []byte {
+	if d.kind != kindBlob {
+		d.Fail(ErrCorrupt)
+		return nil
+	}
+	return d.chunk()
+}
+
+// Runs a nested decoding over the contents of the current blob field.
+func (d *Decoder) nest(reader func(sub *Decoder)) {
+	data := d.blob()
+	if d.err != nil {
+		return
+	}
+	sub := &Decoder{buf: data}
+	reader(sub)
+	d.Fail(sub.err)
+}
+
+// Skips the current (unknown) field.
+func (d *Decoder) Skip() {
+	if d.kind == kindBlob {
+		d.blob()
+	} else {
+		d.varint()
+	}
+}
+
+// Reads the current field as an unsigned integer.
+func (d *Decoder) Uint() uint64 {
+	if d.kind != kindVarint {
+		d.Fail(ErrCorrupt)
+		return 0
+	}
+	return d.varint()
+}
+
+// Reads the current field as a signed integer.
+func (d *Decoder) Int() int64 {
+	v := d.Uint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// Reads the current field as a boolean.
+func (d *Decoder) Bool() bool {
+	return d.Uint() != 0
+}
+
+// Reads the current field as a byte slice, copied out of the source buffer.
+func (d *Decoder) Bytes() []byte {
+	data := d.blob()
+	if d.err != nil {
+		return nil
+	}
+	return append([]byte(nil), data...)
+}
+
+// Reads the current field as a string.
+func (d *Decoder) Text() string {
+	return string(d.blob())
+}
+
+// Reads the current field as a big integer.
+func (d *Decoder) Big() *big.Int {
+	data := d.blob()
+	if d.err != nil {
+		return nil
+	}
+	if len(data) == 0 || data[0] > 2 {
+		d.Fail(ErrCorrupt)
+		return nil
+	}
+	v := new(big.Int).SetBytes(data[1:])
+	switch data[0] {
+	case 0:
+		v.Neg(v)
+	case 1:
+		if v.Sign() != 0 {
+			d.Fail(ErrCorrupt)
+			return nil
+		}
+	}
+	return v
+}
+
+// Reads the current field as a timestamp. The epoch is mapped to the zero time,
+// since the encoder cannot distinguish between the two either.
+func (d *Decoder) Time() time.Time {
+	if nanos := d.Int(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// Reads the current field as a duration.
+func (d *Decoder) Duration() time.Duration {
+	return time.Duration(d.Int())
+}
+
+// Reads the current field as a list of unsigned integers.
+func (d *Decoder) Uints() []uint64 {
+	var list []uint64
+	d.nest(func(sub *Decoder) {
+		for len(sub.buf) > 0 && sub.err == nil {
+			list = append(list, sub.varint())
+		}
+	})
+	return list
+}
+
+// Reads the current field as a list of strings.
+func (d *Decoder) Strings() []string {
+	var list []string
+	d.nest(func(sub *Decoder) {
+		for len(sub.buf) > 0 && sub.err == nil {
+			list = append(list, string(sub.chunk()))
+		}
+	})
+	return list
+}
+
+// Reads the current field as a string to string map.
+func (d *Decoder) StringMap() map[string]string {
+	var dict map[string]string
+	d.nest(func(sub *Decoder) {
+		for len(sub.buf) > 0 && sub.err == nil {
+			if dict == nil {
+				dict = make(map[string]string)
+			}
+			key := string(sub.chunk())
+			dict[key] = string(sub.chunk())
+		}
+	})
+	return dict
+}
+
+// Reads the current field into a nested struct with an explicit codec.
+func (d *Decoder) Struct(v Codec) {
+	d.nest(func(sub *Decoder) {
+		sub.Fail(v.DecodeWire(sub))
+	})
+}
+
+// Reads the current field as an interface value (upper layer header).
+func (d *Decoder) Value() interface{} {
+	var v interface{}
+	d.nest(func(sub *Decoder) {
+		id := sub.varint()
+		if sub.err != nil {
+			return
+		}
+		if id == typeGob {
+			sub.gob(&v)
+			return
+		}
+		codec := fresh(id)
+		if codec == nil {
+			sub.Fail(ErrType)
+			return
+		}
+		sub.Fail(codec.DecodeWire(sub))
+		v = codec
+	})
+	return v
+}
+
+// Reads the current field as a gob encoded value into the given pointer.
+func (d *Decoder) Gob(v interface{}) {
+	d.nest(func(sub *Decoder) { sub.gob(v) })
+}
+
+// Decodes the remainder of the buffer with a stateless gob decoder.
+func (d *Decoder) gob(v interface{}) {
+	if err := gob.NewDecoder(bytes.NewReader(d.buf)).Decode(v); err != nil {
+		d.Fail(err)
+	}
+	d.buf = nil
+}
@@ -0,0 +1,382 @@
+// Iris - Decentralized Messaging Framework
+// Copyright 2013 Peter Szilagyi. All rights reserved.
+//
+// Iris is dual licensed: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// The framework is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU General Public License for
+// more details.
+//
+// Alternatively, the Iris framework may be used in accordance with the terms
+// and conditions contained in a signed written agreement between you and the
+// author(s).
+//
+// Author: peterke@gmail.com (Peter Szilagyi)
+
+package wire
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Outer test header, mimicking the lower layer headers of the protocol stack.
+type testOuter struct {
+	Meta  interface{}
+	Op    uint64
+	Dest  *big.Int
+	Key   []byte
+	Shift int64
+	Flag  bool
+	Due   time.Time
+	Wait  time.Duration
+	Topic string
+	Seqs  []uint64
+	Addrs []string
+	Heads map[string]string
+	Inner *testInner
+	Blob  *testBlob
+	Items []*testInner
+}
+
+// Inner test header, mimicking the upper layer headers of the protocol stack.
+type testInner struct {
+	Src  uint64
+	Name string
+}
+
+// Test struct without an explicit codec, sent through the gob fallback.
+type testBlob struct {
+	Load  float64
+	Names []string
+}
+
+// Test header with an extra field, mimicking a newer protocol version.
+type testNewer struct {
+	Src   uint64
+	Name  string
+	Extra []byte
+}
+
+func init() {
+	Register(1000, func() Codec { return new(testOuter) })
+	Register(1001, func() Codec { return new(testInner) })
+	gob.Register(&testBlob{})
+}
+
+func (h *testOuter) EncodeWire(enc *Encoder) {
+	enc.Value(1, h.Meta)
+	enc.Uint(2, h.Op)
+	enc.Big(3, h.Dest)
+	enc.Bytes(4, h.Key)
+	enc.Int(5, h.Shift)
+	enc.Bool(6, h.Flag)
+	enc.Time(7, h.Due)
+	enc.Duration(8, h.Wait)
+	enc.Text(9, h.Topic)
+	enc.Uints(10, h.Seqs)
+	enc.Strings(11, h.Addrs)
+	enc.StringMap(12, h.Heads)
+	enc.Struct(13, h.Inner)
+	enc.Gob(14, h.Blob)
+	for _, item := range h.Items {
+		enc.Struct(15, item)
+	}
+}
+
+func (h *testOuter) DecodeWire(dec *Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			h.Meta = dec.Value()
+		case 2:
+			h.Op = dec.Uint()
+		case 3:
+			h.Dest = dec.Big()
+		case 4:
+			h.Key = dec.Bytes()
+		case 5:
+			h.Shift = dec.Int()
+		case 6:
+			h.Flag = dec.Bool()
+		case 7:
+			h.Due = dec.Time()
+		case 8:
+			h.Wait = dec.Duration()
+		case 9:
+			h.Topic = dec.Text()
+		case 10:
+			h.Seqs = dec.Uints()
+		case 11:
+			h.Addrs = dec.Strings()
+		case 12:
+			h.Heads = dec.StringMap()
+		case 13:
+			h.Inner = new(testInner)
+			dec.Struct(h.Inner)
+		case 14:
+			dec.Gob(&h.Blob)
+		case 15:
+			item := new(testInner)
+			dec.Struct(item)
+			h.Items = append(h.Items, item)
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+func (h *testInner) EncodeWire(enc *Encoder) {
+	enc.Uint(1, h.Src)
+	enc.Text(2, h.Name)
+}
+
+func (h *testInner) DecodeWire(dec *Decoder) error {
+	for dec.Next() {
+		switch dec.Field() {
+		case 1:
+			h.Src = dec.Uint()
+		case 2:
+			h.Name = dec.Text()
+		default:
+			dec.Skip()
+		}
+	}
+	return dec.Err()
+}
+
+func (h *testNewer) EncodeWire(enc *Encoder) {
+	enc.Uint(1, h.Src)
+	enc.Text(2, h.Name)
+	enc.Bytes(3, h.Extra)
+}
+
+func (h *testNewer) DecodeWire(dec *Decoder) error {
+	return nil
+}
+
+// Assembles a test header with all the fields set.
+func makeTestHeader() *testOuter {
+	return &testOuter{
+		Meta:  &testInner{Src: 314, Name: "inner"},
+		Op:    7,
+		Dest:  new(big.Int).Lsh(big.NewInt(1), 127),
+		Key:   []byte{0x00, 0x01, 0x02},
+		Shift: -1000000,
+		Flag:  true,
+		Due:   time.Unix(1400000000, 123456789),
+		Wait:  -3 * time.Second,
+		Topic: "some/topic",
+		Seqs:  []uint64{1, 1 << 40, 3},
+		Addrs: []string{"127.0.0.1:1", "", "[::1]:2"},
+		Heads: map[string]string{"a": "b", "": "c"},
+		Inner: &testInner{Src: 1, Name: "nested"},
+		Blob:  &testBlob{Load: 0.5, Names: []string{"x", "y"}},
+		Items: []*testInner{{Src: 2}, {}, {Name: "last"}},
+	}
+}
+
+// Checks whether two test headers are equal, comparing timestamps and big ints
+// by value instead of internal representation.
+func equalHeaders(a, b *testOuter) bool {
+	if !a.Due.Equal(b.Due) {
+		return false
+	}
+	if (a.Dest == nil) != (b.Dest == nil) || (a.Dest != nil && a.Dest.Cmp(b.Dest) != 0) {
+		return false
+	}
+	ac, bc := *a, *b
+	ac.Due, bc.Due = time.Time{}, time.Time{}
+	ac.Dest, bc.Dest = nil, nil
+
+	// Nested headers need the same relaxed comparison
+	am, aok := a.Meta.(*testOuter)
+	bm, bok := b.Meta.(*testOuter)
+	if aok != bok || (aok && !equalHeaders(am, bm)) {
+		return false
+	}
+	if aok {
+		ac.Meta, bc.Meta = nil, nil
+	}
+	return reflect.DeepEqual(&ac, &bc)
+}
+
+// Tests that all field kinds survive an encode/decode round trip.
+func TestRoundtrip(t *testing.T) {
+	tests := []*testOuter{
+		{},
+		{Dest: new(big.Int)},
+		{Dest: big.NewInt(-42), Shift: 1},
+		{Meta: &testBlob{Load: 1}},
+		{Meta: []byte{0x99, 0x98}},
+		makeTestHeader(),
+		{Meta: makeTestHeader()},
+	}
+	for i, tt := range tests {
+		data := Marshal(tt)
+		if data[0] != Version {
+			t.Fatalf("test %d: version mismatch: have %v, want %v.", i, data[0], Version)
+		}
+		res := new(testOuter)
+		if err := Unmarshal(data, res); err != nil {
+			t.Fatalf("test %d: failed to decode header: %v.", i, err)
+		}
+		if !equalHeaders(tt, res) {
+			t.Fatalf("test %d: header mismatch: have %+v, want %+v.", i, res, tt)
+		}
+	}
+}
+
+// Tests that unknown fields of newer peers are skipped.
+func TestUnknownFields(t *testing.T) {
+	data := Marshal(&testNewer{Src: 1, Name: "newer", Extra: []byte{1, 2, 3}})
+
+	res := new(testInner)
+	if err := Unmarshal(data, res); err != nil {
+		t.Fatalf("failed to decode newer header: %v.", err)
+	}
+	if res.Src != 1 || res.Name != "newer" {
+		t.Fatalf("header mismatch: have %+v, want {1 newer}.", res)
+	}
+}
+
+// Tests that corrupt encodings are reported instead of being misinterpreted.
+func TestCorruption(t *testing.T) {
+	data := Marshal(makeTestHeader())
+
+	// Version mismatches
+	if err := Unmarshal(nil, new(testOuter)); err != ErrCorrupt {
+		t.Fatalf("empty input error mismatch: have %v, want %v.", err, ErrCorrupt)
+	}
+	bad := append([]byte{Version + 1}, data[1:]...)
+	if err := Unmarshal(bad, new(testOuter)); err != ErrVersion {
+		t.Fatalf("version error mismatch: have %v, want %v.", err, ErrVersion)
+	}
+	// Truncated inputs (must never decode into the full header)
+	for i := 2; i < len(data); i++ {
+		res := new(testOuter)
+		if err := Unmarshal(data[:i], res); err == nil && equalHeaders(res, makeTestHeader()) {
+			t.Fatalf("truncation at %d: decoded full header.", i)
+		}
+	}
+	// Unknown nested types
+	enc := new(Encoder)
+	enc.buf = append(enc.buf, Version)
+	enc.nest(1, func() { enc.varint(999999) })
+	if err := Unmarshal(enc.buf, new(testOuter)); err != ErrType {
+		t.Fatalf("unknown type error mismatch: have %v, want %v.", err, ErrType)
+	}
+}
+
+// Fuzzes the decoder, ensuring it never panics and that anything it accepts
+// survives a subsequent round trip.
+func FuzzDecode(f *testing.F) {
+	f.Add(Marshal(&testOuter{}))
+	f.Add(Marshal(makeTestHeader()))
+	f.Add(Marshal(&testOuter{Meta: makeTestHeader()}))
+	f.Add([]byte{Version, 0x03, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		res := new(testOuter)
+		if err := Unmarshal(data, res); err != nil {
+			return
+		}
+		again := new(testOuter)
+		if err := Unmarshal(Marshal(res), again); err != nil {
+			t.Fatalf("failed to decode re-encoded header: %v.", err)
+		}
+		if !equalHeaders(res, again) {
+			t.Fatalf("re-encoded header mismatch: have %+v, want %+v.", again, res)
+		}
+	})
+}
+
+// Gob counterpart of the test header, as the interface field needs registration.
+func init() {
+	gob.Register(&testOuter{})
+	gob.Register(&testInner{})
+}
+
+// Assembles a header stack resembling a routed topic event.
+func makeBenchHeader() *testOuter {
+	return &testOuter{
+		Meta: &testOuter{
+			Meta:  &testInner{Src: 1234567, Name: "client"},
+			Op:    2,
+			Dest:  new(big.Int).Lsh(big.NewInt(3), 120),
+			Topic: "events/sensors",
+			Heads: map[string]string{"kind": "temperature"},
+		},
+		Op:   1,
+		Dest: new(big.Int).Lsh(big.NewInt(5), 120),
+		Key:  bytes.Repeat([]byte{0x42}, 16),
+	}
+}
+
+func BenchmarkEncodeWire(b *testing.B) {
+	head := makeBenchHeader()
+	enc := new(Encoder)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc.Encode(head)
+	}
+}
+
+func BenchmarkEncodeGob(b *testing.B) {
+	head := makeBenchHeader()
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(head); err != nil {
+			b.Fatalf("failed to encode header: %v.", err)
+		}
+		buf.Reset()
+	}
+}
+
+func BenchmarkDecodeWire(b *testing.B) {
+	data := Marshal(makeBenchHeader())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Unmarshal(data, new(testOuter)); err != nil {
+			b.Fatalf("failed to decode header: %v.", err)
+		}
+	}
+}
+
+func BenchmarkDecodeGob(b *testing.B) {
+	// Stream the same header repeatedly, as a link would
+	head := makeBenchHeader()
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	dec := gob.NewDecoder(buf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := enc.Encode(head); err != nil {
+			b.Fatalf("failed to encode header: %v.", err)
+		}
+		b.StartTimer()
+		if err := dec.Decode(new(testOuter)); err != nil {
+			b.Fatalf("failed to decode header: %v.", err)
+		}
+	}
+}